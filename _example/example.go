@@ -17,6 +17,7 @@ var password = flag.String("password", "", "password")
 var status = flag.String("status", "xa", "status")
 var statusMessage = flag.String("status-msg", "I for one welcome our new codebot overlords.", "status message")
 var notls = flag.Bool("notls", false, "No TLS")
+var directtls = flag.Bool("directtls", false, "TLS before the stream opens, no STARTTLS")
 var debug = flag.Bool("debug", false, "debug output")
 var session = flag.Bool("session", false, "use server session")
 
@@ -52,6 +53,7 @@ func main() {
 		User:          *username,
 		Password:      *password,
 		NoTLS:         *notls,
+		DirectTLS:     *directtls,
 		Debug:         *debug,
 		Session:       *session,
 		Status:        *status,
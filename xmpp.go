@@ -5,16 +5,14 @@
 // TODO(rsc):
 //	More precise error handling.
 //	Presence functionality.
-// TODO(mattn):
-//  Add proxy authentication.
 
 // Package xmpp implements a simple Google Talk client
 // using the XMPP protocol described in RFC 3920 and RFC 3921.
 package xmpp
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/tls"
@@ -26,10 +24,10 @@ import (
 	"io"
 	"math/big"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -42,10 +40,14 @@ const (
 	nsSession = "urn:ietf:params:xml:ns:xmpp-session"
 )
 
-// Default TLS configuration options
+// Default TLS configuration options, used by clients without Options.TLSConfig.
+//
+// Deprecated: DefaultConfig is shared by all clients; set Options.TLSConfig instead.
 var DefaultConfig = &tls.Config{}
 
-// DebugWriter is the writer used to write debugging output to.
+// DebugWriter is the writer used to write debugging output to, if Options.Debug is set.
+//
+// Deprecated: DebugWriter is shared by all clients; set Options.DebugReader instead.
 var DebugWriter io.Writer = os.Stderr
 
 // Cookie is a unique XMPP session identifier
@@ -61,83 +63,160 @@ func getCookie() Cookie {
 
 // Client holds XMPP connection opitons
 type Client struct {
-	conn   net.Conn // connection to server
-	jid    string   // Jabber ID for our connection
-	domain string
-	p      *xml.Decoder
+	conn      net.Conn     // connection to server, a transport unless it carries a plain XML stream
+	idMutex   sync.RWMutex // guards jid and domain, which a reconnect replaces
+	jid       string       // Jabber ID for our connection
+	domain    string
+	p         *xml.Decoder
+	sm        smState    // XEP-0198 stream management state
+	sendMutex sync.Mutex // serializes writes to conn
+	iqMutex   sync.Mutex
+	iqPending map[string]chan *clientIQ // IQ requests waiting for a response, by id
+	mucMutex  sync.Mutex
+	mucJoins  map[string]chan *clientPresence   // rooms waiting for our self-presence, by room JID
+	mucRooms  map[string]map[string]MUCOccupant // occupants of the rooms we joined, by room JID and nick
+	queue     sendQueue
+	events    events
+
+	streamOpen  bool         // whether we opened the stream
+	negotiation *negotiation // aborts the stream negotiation, see NewClientContext
+
+	mamMutex   sync.Mutex
+	mamQueries map[string]*mamCollector // running archive queries, by query id
+
+	ibbMutex   sync.Mutex
+	ibbStreams map[string]*ibbReader // in-band bytestreams being received, by sender and sid
+
+	presenceMutex   sync.Mutex
+	presencePending map[string]chan *clientPresence // presence waiting for an error, by id
+
+	blockMutex   sync.Mutex
+	blocked      []string           // JIDs on our block list
+	blockFetched bool               // whether blocked was fetched from the server
+	blockFetch   chan struct{}      // closed once the fetch of blocked in progress, if any, is done
+	blockPushes  []clientBlockItems // pushes received while fetching
+
+	errorLangs []string // preferred languages of error texts
+	capsNode   string   // XEP-0115 caps node, see Options.CapsNode
+
+	discoMutex sync.Mutex
+	features   []string // features registered with AddFeature
+
+	debugOut       io.Writer      // copy of what is written, see Options.DebugWriter
+	logger         Logger         // see Options.Logger
+	serverFeatures StreamFeatures // see StreamFeatures
+
+	recvTimeout  time.Duration // see SetRecvTimeout; guarded by sendMutex
+	recvDeadline bool          // whether Recv set a read deadline on conn
+
+	reconnectOpts *Options // options to reconnect with, see Options.AutoReconnect; guarded by sendMutex
+	closeMutex    sync.Mutex
+	closed        chan struct{} // closed by Close
+
+	autoReply      AutoReplyPolicy // see Options.AutoReply
+	autoReplyAllow []string
+	software       struct{ name, version, os string } // see Options.ClientName
+	lastActive     time.Time                          // when we last sent a message or presence; guarded by sendMutex
+	originIDs      bool                               // see Options.OriginID
+	dedup          *dedup                             // see Options.DedupMessages
+	dialer         Dialer                             // see Options.Dialer
+	rosterMutex    sync.Mutex
+	contacts       map[string]bool // bare JIDs on our roster, as far as we know
+	rosterVer      string          // see RosterVersion; guarded by rosterMutex
 }
 
+// JID returns the full JID the server bound the stream to, like "user@example.com/bot".
 func (c *Client) JID() string {
+	c.idMutex.RLock()
+	defer c.idMutex.RUnlock()
 	return c.jid
 }
 
-func containsIgnoreCase(s, substr string) bool {
-	s, substr = strings.ToUpper(s), strings.ToUpper(substr)
-	return strings.Contains(s, substr)
+// serverDomain returns the domain of the server we are connected to.
+func (c *Client) serverDomain() string {
+	c.idMutex.RLock()
+	defer c.idMutex.RUnlock()
+	return c.domain
 }
 
-func connect(host, user, passwd string, timeout time.Duration) (net.Conn, error) {
-	addr := host
+// Resource returns the resource the server bound, which may differ from Options.Resource,
+// e.g. "bot-ab12" for a requested "bot".
+func (c *Client) Resource() string {
+	jid := c.JID()
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[i+1:]
+	}
+	return ""
+}
 
-	if strings.TrimSpace(host) == "" {
-		a := strings.SplitN(user, "@", 2)
-		if len(a) == 2 {
-			addr = a[1]
-		}
+// sendf formats according to a format specifier and writes the result to the server.
+// It holds c.sendMutex during the write, so stanzas sent from different goroutines
+// are never interleaved on the wire.
+func (c *Client) sendf(format string, a ...interface{}) (n int, err error) {
+	s := fmt.Sprintf(format, a...)
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	requestAck := c.sm.sent(s)
+	if isActivity(s) {
+		c.lastActive = time.Now()
 	}
-	a := strings.SplitN(host, ":", 2)
-	if len(a) == 1 {
-		addr += ":5222"
+	if n, err = c.write(s); err == nil && requestAck {
+		err = c.requestAck()
 	}
+	return n, err
+}
 
-	proxy := os.Getenv("HTTP_PROXY")
-	if proxy == "" {
-		proxy = os.Getenv("http_proxy")
-	}
-	// test for no proxy, takes a comma separated list with substrings to match
-	if proxy != "" {
-		noproxy := os.Getenv("NO_PROXY")
-		if noproxy == "" {
-			noproxy = os.Getenv("no_proxy")
-		}
-		if noproxy != "" {
-			nplist := strings.Split(noproxy, ",")
-			for _, s := range nplist {
-				if containsIgnoreCase(addr, s) {
-					proxy = ""
-					break
-				}
-			}
-		}
+// Logger receives the diagnostics of a client, see Options.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// logf passes a diagnostic to Options.Logger, if set.
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
 	}
-	if proxy != "" {
-		url, err := url.Parse(proxy)
-		if err == nil {
-			addr = url.Host
-		}
+}
+
+// write writes s to the connection, copying it to Options.DebugWriter;
+// c.sendMutex must be held.
+func (c *Client) write(s string) (int, error) {
+	if c.debugOut != nil {
+		io.WriteString(c.debugOut, s)
 	}
+	return writeString(c.conn, s)
+}
 
-	c, err := net.DialTimeout("tcp", addr, timeout)
-	if err != nil {
-		return nil, err
+// writeString writes s to w. A short write without an error fails with io.ErrShortWrite,
+// lest the rest of the stanza be lost silently.
+func writeString(w io.Writer, s string) (int, error) {
+	n, err := io.WriteString(w, s)
+	if err == nil && n < len(s) {
+		err = io.ErrShortWrite
 	}
+	return n, err
+}
 
-	if proxy != "" {
-		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\n", host)
-		fmt.Fprintf(c, "Host: %s\r\n", host)
-		fmt.Fprintf(c, "\r\n")
-		br := bufio.NewReader(c)
-		req, _ := http.NewRequest("CONNECT", host, nil)
-		resp, err := http.ReadResponse(br, req)
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != 200 {
-			f := strings.SplitN(resp.Status, " ", 2)
-			return nil, errors.New(f[1])
+func containsIgnoreCase(s, substr string) bool {
+	s, substr = strings.ToUpper(s), strings.ToUpper(substr)
+	return strings.Contains(s, substr)
+}
+
+func connect(ctx context.Context, host, user string, o *Options) (net.Conn, error) {
+	addr := host
+
+	if strings.TrimSpace(host) == "" {
+		if _, domain, ok := splitUser(user); ok {
+			addr = domain
 		}
 	}
-	return c, nil
+	a := strings.SplitN(host, ":", 2)
+	if len(a) == 1 && o.DirectTLS {
+		addr += ":5223"
+	} else if len(a) == 1 {
+		addr += ":5222"
+	}
+	return o.dial(ctx, addr)
 }
 
 // Options are used to specify additional options for new clients, such as a Resource.
@@ -148,6 +227,10 @@ type Options struct {
 	Host string
 
 	// User specifies what user to authenticate to the remote server.
+	// The client authenticates with the first of SCRAM-SHA-256, SCRAM-SHA-1, PLAIN, EXTERNAL,
+	// ANONYMOUS, OAUTHBEARER, X-OAUTH2 and DIGEST-MD5 that the server offers and the options
+	// hold credentials for: EXTERNAL takes a client certificate in TLSConfig, and ANONYMOUS
+	// no User, Password or OAuthToken at all.
 	User string
 
 	// Password supplies the password to use for authentication with the remote server.
@@ -157,40 +240,89 @@ type Options struct {
 	// DialTimeout of zero means no timeout.
 	DialTimeout time.Duration
 
+	// Dialer, if set, dials the connection to the server, e.g. through a SOCKS5 proxy.
+	// Otherwise the client dials directly, or through an HTTPConnectDialer for the proxy
+	// named by the HTTP_PROXY environment variable. SOCKS5 bytestreams are dialed with
+	// Dialer as well, if set, and directly otherwise.
+	Dialer Dialer
+
+	// NegotiationTimeout is the time limit for each step of the stream negotiation,
+	// such as reading the stream features, the authentication result or the bind result.
+	// A NegotiationTimeout of zero means no timeout.
+	NegotiationTimeout time.Duration
+
 	// Resource specifies an XMPP client resource, like "bot", instead of accepting one
 	// from the server.  Use "" to let the server generate one for your client.
 	Resource string
 
 	// OAuthScope provides go-xmpp the required scope for OAuth2 authentication.
+	// It is not sent to the server; the token alone selects OAuth.
 	OAuthScope string
 
 	// OAuthToken provides go-xmpp with the required OAuth2 token used to authenticate
+	// instead of Password, with OAUTHBEARER, RFC 7628, if the server offers it, and
+	// else with X-OAUTH2. Leave Password empty, or the password is preferred.
 	OAuthToken string
 
-	// OAuthXmlNs provides go-xmpp with the required namespaced used for OAuth2 authentication.  This is
-	// provided to the server as the xmlns:auth attribute of the OAuth2 authentication request.
+	// OAuthXmlNs provides go-xmpp with the required namespaced used for X-OAUTH2 authentication.  This is
+	// provided to the server as the xmlns:auth attribute of the OAuth2 authentication request,
+	// e.g. "http://www.google.com/talk/protocol/auth".
 	OAuthXmlNs string
 
 	// TLS Config
 	TLSConfig *tls.Config
 
+	// PinnedCertSHA256, if set, lists the SHA-256 fingerprints, in hex, of the certificates
+	// or the public keys (SubjectPublicKeyInfo) the server may present. The connection is
+	// aborted after the TLS handshake if the server's certificate matches none of them.
+	// Pins are checked in addition to the usual verification; to rely on the pins alone,
+	// e.g. for a self-signed certificate, set InsecureSkipVerify in TLSConfig.
+	PinnedCertSHA256 []string
+
 	// InsecureAllowUnencryptedAuth permits authentication over a TCP connection that has not been promoted to
 	// TLS by STARTTLS; this could leak authentication information over the network, or permit man in the middle
 	// attacks.
 	InsecureAllowUnencryptedAuth bool
 
-	// NoTLS directs go-xmpp to not use TLS initially to contact the server; instead, a plain old unencrypted
+	// AllowUnencryptedAnonymous permits ANONYMOUS authentication, which sends no
+	// credentials, over a connection that is not encrypted by direct TLS or STARTTLS.
+	// By default the client refuses to authenticate over such a connection with any
+	// mechanism, so a downgrade never goes unnoticed; InsecureAllowUnencryptedAuth
+	// lifts the refusal for all mechanisms.
+	AllowUnencryptedAnonymous bool
+
+	// NoTLS directs go-xmpp to not use TLS to contact the server; instead, a plain old unencrypted
 	// TCP connection should be used. (Can be combined with StartTLS to support STARTTLS-based servers.)
+	// Without StartTLS, connecting to a server that requires STARTTLS fails.
 	NoTLS bool
 
-	// StartTLS directs go-xmpp to STARTTLS if the server supports it; go-xmpp will automatically STARTTLS
-	// if the server requires it regardless of this option.
+	// StartTLS directs go-xmpp to STARTTLS if the server supports it even if NoTLS is set.
+	// Unless NoTLS or DirectTLS is set, go-xmpp opens the stream in plain text and STARTTLS
+	// whenever the server supports it, RFC 6120 5.
 	StartTLS bool
 
+	// DirectTLS directs go-xmpp to secure the connection by TLS before opening the stream, without
+	// STARTTLS, xep-0368. The port defaults to 5223 then, and the server is looked up with the
+	// xmpps-client SRV record. A Host with port 5223 implies DirectTLS, unless NoTLS is set.
+	DirectTLS bool
+
 	// Debug output
 	Debug bool
 
-	// Use server sessions
+	// DebugReader, if set, receives a copy of the XML read from the server, and DebugWriter
+	// one of the XML written to it. Debug without DebugReader copies what is read to the
+	// package's DebugWriter.
+	DebugReader io.Writer
+	DebugWriter io.Writer
+
+	// Logger, if set, receives the diagnostics of the client, like failed attempts to
+	// reconnect and stanzas it drops; a *log.Logger will do. The client does not write
+	// anywhere on its own, except for the XML copied to DebugWriter with Debug.
+	Logger Logger
+
+	// Session establishes a session after binding, RFC 3921 3, if the server advertises
+	// sessions as optional. A server requiring them always gets one, and one that does
+	// not advertise them never does.
 	Session bool
 
 	// Presence Status
@@ -198,15 +330,145 @@ type Options struct {
 
 	// Status message
 	StatusMessage string
+
+	// Priority is the priority of the resource in the initial presence, from -128 to 127,
+	// RFC 6121 4.7.2.3. The server routes messages to the bare JID to the resource with
+	// the highest priority; one with a negative priority gets none.
+	Priority int
+
+	// StreamManagement enables XEP-0198 stream management if the server advertises it.
+	// If the server marks stream management as required, it must be set or the connection fails.
+	// The stanzas the server did not acknowledge are sent again when resuming the session,
+	// see ImportSMState.
+	StreamManagement bool
+
+	// StreamManagementAckEvery is the number of stanzas after which the client asks the
+	// server for an ack, 5 if zero. If negative, acks are only requested by RequestAck.
+	StreamManagementAckEvery int
+
+	// smResume is the stream management session to resume, see ImportSMState.
+	smResume *smSnapshot
+
+	// SendQueueSize is the number of stanzas QueueSend buffers before it blocks.
+	// Defaults to 64.
+	SendQueueSize int
+
+	// EventBufferSize is the number of stanzas the channel returned by Client.Events
+	// buffers before the reader waits. Defaults to 64.
+	EventBufferSize int
+
+	// ErrorLanguages lists the preferred languages of the texts of a StanzaError,
+	// most preferred first, e.g. []string{"de", "en"}. If the server sends the text in
+	// none of them, the text without a language or any other text is used.
+	ErrorLanguages []string
+
+	// OriginID makes Send add an origin-id, xep-0359 3.2, with the id of the message,
+	// so that the message can be matched with its archived copy, see Chat.StanzaID.
+	OriginID bool
+
+	// DedupMessages makes Recv drop the messages it returned before, e.g. as carbons, and
+	// both Recv and QueryMAM leave out the messages the other one returned, as when an
+	// archive query catching up overlaps with live messages. Messages are recognized by
+	// their stanza ids and origin-ids, xep-0359; the ids of about the last 1000 are remembered.
+	DedupMessages bool
+
+	// CapsNode is the node identifying the software in its entity capabilities, xep-0115,
+	// e.g. "https://github.com/mattn/go-xmpp". If set, available presence advertises the
+	// capabilities and Recv answers disco#info queries to us and to the caps node with
+	// the features registered with Client.AddFeature, so that the reply hashes to the
+	// advertised ver.
+	CapsNode string
+
+	// AutoReply says whose software version, entity time and ping queries, xep-0092,
+	// xep-0202 and xep-0199, Recv answers; everyone's by default. Queries from our own
+	// account and our server are always answered.
+	AutoReply AutoReplyPolicy
+
+	// AutoReplyAllow lists the bare JIDs and the domains whose queries are answered
+	// whatever AutoReply says.
+	AutoReplyAllow []string
+
+	// ClientName and ClientVersion are the name, "go-xmpp" unless set, and the version
+	// of the software Recv answers version queries with. ClientOS, the operating system,
+	// is left out of the answer unless set.
+	ClientName    string
+	ClientVersion string
+	ClientOS      string
+
+	// AutoReconnect makes Recv connect to the server again, with delays following
+	// ReconnectBackoff, when the connection is lost, instead of returning the error. It
+	// authenticates, binds a resource, or resumes the stream management session if it can,
+	// sends the initial presence and returns a Reconnected. Only clients made with NewClient
+	// and NewClientContext reconnect. Close stops the attempts. The stream errors conflict,
+	// when another connection took over our resource, not-authorized and policy-violation
+	// are returned rather than reconnecting.
+	AutoReconnect    bool
+	ReconnectBackoff Backoff
+
+	// OnReconnect, if set, is called in a new goroutine each time Recv reconnected, e.g.
+	// to join the rooms of r again; it may wait for Recv, which runs on meanwhile.
+	OnReconnect func(c *Client, r Reconnected)
+
+	// SendErrorHandler, if set, is called with every stanza queued by QueueSend that failed to be sent.
+	SendErrorHandler func(stanza interface{}, err error)
 }
 
 // NewClient establishes a new Client connection based on a set of Options.
 func (o Options) NewClient() (*Client, error) {
+	return o.NewClientContext(context.Background())
+}
+
+// NewClientContext establishes a new Client connection like NewClient, but gives up
+// once ctx is done, returning ctx.Err(): the SRV lookup, the dial, the TLS handshake and
+// each step of the stream negotiation are bounded by the deadline of ctx and aborted if
+// it is canceled. ctx has no effect on the client once NewClientContext returned.
+func (o Options) NewClientContext(ctx context.Context) (*Client, error) {
+	client, err := o.newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if o.AutoReconnect {
+		client.reconnectOpts = &o
+	}
+
+	o.sendInitialPresence(client)
+	return client, nil
+}
+
+// sendInitialPresence tells the server we're connected and can now receive and send
+// messages. A resumed session keeps the presence it had.
+func (o Options) sendInitialPresence(client *Client) {
+	if client.sm.resumed {
+		return
+	}
+	var priority string
+	if o.Priority != 0 {
+		priority = "<priority>" + strconv.Itoa(o.Priority) + "</priority>"
+	}
+	client.sendf("<presence xml:lang='en'><show>%s</show><status>%s</status>%s%s</presence>", xmlEscape(o.Status), xmlEscape(o.StatusMessage), priority, client.capsElement())
+}
+
+// TestCredentials connects to the server, authenticates and binds a resource like NewClient,
+// but closes the connection again right away, without having sent any presence.
+// It returns nil if the server accepted the credentials, or an *AuthError if it rejected them.
+func (o Options) TestCredentials() error {
+	client, err := o.newClient(context.Background())
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+// newClient connects to the server and negotiates the stream.
+func (o Options) newClient(ctx context.Context) (*Client, error) {
 	host := o.Host
 	if strings.TrimSpace(host) == "" {
-		a := strings.SplitN(o.User, "@", 2)
-		if len(a) == 2 {
-			if _, addrs, err := net.LookupSRV("xmpp-client", "tcp", a[1]); err == nil {
+		if _, domain, ok := splitUser(o.User); ok {
+			service := "xmpp-client"
+			if o.DirectTLS {
+				service = "xmpps-client"
+			}
+			if _, addrs, err := net.DefaultResolver.LookupSRV(ctx, service, "tcp", domain); err == nil {
 				if len(addrs) > 0 {
 					// default to first record
 					host = fmt.Sprintf("%s:%d", addrs[0].Target, addrs[0].Port)
@@ -218,24 +480,58 @@ func (o Options) NewClient() (*Client, error) {
 						}
 					}
 				} else {
-					host = a[1]
+					host = domain
 				}
 			} else {
-				host = a[1]
+				host = domain
 			}
 		}
 	}
-	c, err := connect(host, o.User, o.Password, o.DialTimeout)
+	c, err := connect(ctx, host, o.User, &o)
+	if err != nil {
+		return nil, err
+	}
+	return o.newClientFromConn(ctx, c, host)
+}
+
+// NewClientFromConn negotiates the stream like NewClient, but on conn, an already
+// established connection to the server, e.g. one made through a SOCKS proxy or a custom
+// dialer. With opts.DirectTLS, the connection is secured by TLS first, verifying the
+// server name of opts.TLSConfig, or else the domain of opts.Host or opts.User.
+// Otherwise the stream is secured by STARTTLS, unless opts.NoTLS is set.
+func NewClientFromConn(conn net.Conn, opts Options) (*Client, error) {
+	host := opts.Host
+	if strings.TrimSpace(host) == "" {
+		if _, domain, ok := splitUser(opts.User); ok {
+			host = domain
+		}
+	}
+	client, err := opts.newClientFromConn(context.Background(), conn, host)
 	if err != nil {
 		return nil, err
 	}
+	opts.sendInitialPresence(client)
+	return client, nil
+}
 
+// newClientFromConn negotiates the stream on the connection c to host, aborting it
+// once ctx is done.
+func (o Options) newClientFromConn(ctx context.Context, c net.Conn, host string) (*Client, error) {
+	direct := o.directTLS(host)
 	if strings.LastIndex(host, ":") > 0 {
 		host = host[:strings.LastIndex(host, ":")]
 	}
 
 	client := new(Client)
-	if o.NoTLS {
+	client.negotiation = watchContext(ctx, c)
+	// fail returns the error of ctx instead of err if the negotiation was aborted.
+	fail := func(err error) (*Client, error) {
+		if cerr := client.negotiation.stop(); cerr != nil {
+			err = cerr
+		}
+		return nil, err
+	}
+	if !direct {
 		client.conn = c
 	} else {
 		var tlsconn *tls.Conn
@@ -247,29 +543,49 @@ func (o Options) NewClient() (*Client, error) {
 			newconfig.ServerName = host
 			tlsconn = tls.Client(c, newconfig)
 		}
-		if err = tlsconn.Handshake(); err != nil {
-			return nil, err
+		if err := tlsconn.Handshake(); err != nil {
+			c.Close()
+			return fail(err)
 		}
 		insecureSkipVerify := DefaultConfig.InsecureSkipVerify
 		if o.TLSConfig != nil {
 			insecureSkipVerify = o.TLSConfig.InsecureSkipVerify
 		}
 		if !insecureSkipVerify {
-			if err = tlsconn.VerifyHostname(host); err != nil {
-				return nil, err
+			if err := tlsconn.VerifyHostname(host); err != nil {
+				c.Close()
+				return fail(err)
 			}
 		}
+		if err := o.verifyPins(tlsconn); err != nil {
+			c.Close()
+			return fail(err)
+		}
 		client.conn = tlsconn
 	}
 
 	if err := client.init(&o); err != nil {
+		client.Close()
+		return fail(err)
+	}
+	if err := client.negotiation.stop(); err != nil {
 		client.Close()
 		return nil, err
 	}
+	client.negotiation = nil
 
 	return client, nil
 }
 
+// directTLS reports whether the connection to host, as "hostname" or "hostname:port",
+// is secured by TLS before the stream opens.
+func (o Options) directTLS(host string) bool {
+	if o.NoTLS {
+		return false
+	}
+	return o.DirectTLS || strings.HasSuffix(host, ":5223")
+}
+
 // NewClient creates a new connection to a host given as "hostname" or "hostname:port".
 // If host is not specified, the  DNS SRV should be used to find the host from the domainpart of the JID.
 // Default the port to 5222.
@@ -297,10 +613,34 @@ func NewClientNoTLS(host, user, passwd string, debug bool) (*Client, error) {
 	return opts.NewClient()
 }
 
-// Close closes the XMPP connection
+// Close closes the stream and the XMPP connection, after sending the stanzas still
+// queued by QueueSend.
 func (c *Client) Close() error {
-	if c.conn != (*tls.Conn)(nil) {
-		return c.conn.Close()
+	c.closeMutex.Lock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	conn := c.conn
+	c.closeMutex.Unlock()
+
+	// A stalled write would block the writes below, and hold c.sendMutex meanwhile.
+	if conn != nil {
+		conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	}
+	c.closeQueue()
+	c.sendMutex.Lock()
+	conn, open := c.conn, c.streamOpen
+	c.sendMutex.Unlock()
+	if open {
+		c.sendf("%s", c.transport().closeStream())
+	}
+	if conn != (*tls.Conn)(nil) {
+		return conn.Close()
 	}
 	return nil
 }
@@ -334,17 +674,68 @@ func cnonce() string {
 	return fmt.Sprintf("%016x", cn)
 }
 
+// AuthError is returned when the server rejects our authentication.
+type AuthError struct {
+	// Condition is the SASL failure condition, e.g. "not-authorized".
+	Condition string
+	Text      string
+}
+
+func (e *AuthError) Error() string {
+	errorMessage := e.Text
+	if errorMessage == "" {
+		// Condition is the type of sub-element in failure,
+		// which gives a description of what failed if there was no text element
+		errorMessage = e.Condition
+	}
+	return "auth failure: " + errorMessage
+}
+
+// ids of the IQs sent during the negotiation.
+const (
+	bindID    = IDPrefix + "bind1"
+	sessionID = IDPrefix + "session1"
+)
+
 func (c *Client) init(o *Options) error {
+	if err := checkPriority(o.Priority); err != nil {
+		return err
+	}
+	if o.NegotiationTimeout > 0 || c.negotiation != nil {
+		defer func() {
+			c.conn.SetReadDeadline(time.Time{})
+		}()
+	}
+	c.queue.size = o.SendQueueSize
+	c.queue.onError = o.SendErrorHandler
+	c.events.size = o.EventBufferSize
+	c.errorLangs = o.ErrorLanguages
+	c.originIDs = o.OriginID
+	if o.DedupMessages && c.dedup == nil {
+		c.dedup = newDedup(dedupWindow)
+	}
+	c.capsNode = o.CapsNode
+	c.debugOut = o.DebugWriter
+	c.dialer = o.Dialer
+	c.logger = o.Logger
+	c.autoReply = o.AutoReply
+	c.autoReplyAllow = o.AutoReplyAllow
+	c.software.name, c.software.version, c.software.os = o.ClientName, o.ClientVersion, o.ClientOS
+	if c.software.name == "" {
+		c.software.name = defaultIdentity.Name
+	}
 
 	var domain string
 	var user string
-	a := strings.SplitN(o.User, "@", 2)
 	if len(o.User) > 0 {
-		if len(a) != 2 {
+		var ok bool
+		if user, domain, ok = splitUser(o.User); !ok {
 			return errors.New("xmpp: invalid username (want user@domain): " + o.User)
 		}
-		user = a[0]
-		domain = a[1]
+		// e.g. "user name" is the account user\20name, xep-0106
+		if strings.IndexFunc(user, invalidLocalRune) >= 0 {
+			user = EscapeLocalpart(user)
+		}
 	} // Otherwise, we'll be attempting ANONYMOUS
 
 	// Declare intent to be a jabber client and gather stream features.
@@ -358,115 +749,101 @@ func (c *Client) init(o *Options) error {
 		return err
 	}
 
-	if o.User == "" && o.Password == "" {
-		foundAnonymous := false
-		for _, m := range f.Mechanisms.Mechanism {
-			if m == "ANONYMOUS" {
-				fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='ANONYMOUS' />\n", nsSASL)
-				foundAnonymous = true
-				break
-			}
+	mechanism, err := chooseMechanism(f.Mechanisms.Mechanism, o, c.IsEncrypted())
+	if err != nil {
+		return err
+	}
+	// Even digest forms of authentication are unsafe if we do not know that the host
+	// we are talking to is the actual server, and not a man in the middle playing
+	// proxy.
+	if (mechanism != "ANONYMOUS" || !o.AllowUnencryptedAnonymous) && !c.IsEncrypted() && !o.InsecureAllowUnencryptedAuth {
+		return errors.New("refusing to authenticate over unencrypted TCP connection")
+	}
+	var rspauth, serverSignature string
+	switch mechanism {
+	case "SCRAM-SHA-256", "SCRAM-SHA-1":
+		if serverSignature, err = c.authSCRAM(mechanism, user, o); err != nil {
+			return err
 		}
-		if !foundAnonymous {
-			return fmt.Errorf("ANONYMOUS authentication is not an option and username and password were not specified")
+	case "PLAIN":
+		// Plain authentication: send base64-encoded \x00 user \x00 password.
+		raw := "\x00" + user + "\x00" + o.Password
+		enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
+		base64.StdEncoding.Encode(enc, []byte(raw))
+		c.sendf("<auth xmlns='%s' mechanism='PLAIN'>%s</auth>\n", nsSASL, enc)
+	case "DIGEST-MD5":
+		if rspauth, err = c.authDigestMD5(user, domain, o); err != nil {
+			return err
 		}
-	} else {
-		// Even digest forms of authentication are unsafe if we do not know that the host
-		// we are talking to is the actual server, and not a man in the middle playing
-		// proxy.
-		if !c.IsEncrypted() && !o.InsecureAllowUnencryptedAuth {
-			return errors.New("refusing to authenticate over unencrypted TCP connection")
+	case "EXTERNAL":
+		// An empty response: the authorization identity is the one of the certificate, RFC 6120 6.3.8.
+		c.sendf("<auth xmlns='%s' mechanism='EXTERNAL'>=</auth>\n", nsSASL)
+	case "ANONYMOUS":
+		c.sendf("<auth xmlns='%s' mechanism='ANONYMOUS' />\n", nsSASL)
+	default:
+		c.sendOAuth(mechanism, user, domain, o)
+	}
+	// Next message should be either success or failure.
+	var status string
+	for authenticated := false; !authenticated; {
+		c.setStepDeadline(o)
+		name, val, err := next(c.p)
+		if err != nil {
+			return stepError("authentication result", err, err)
 		}
-
-		mechanism := ""
-		for _, m := range f.Mechanisms.Mechanism {
-			if m == "X-OAUTH2" && o.OAuthToken != "" && o.OAuthScope != "" {
-				mechanism = m
-				// Oauth authentication: send base64-encoded \x00 user \x00 token.
-				raw := "\x00" + user + "\x00" + o.OAuthToken
-				enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
-				base64.StdEncoding.Encode(enc, []byte(raw))
-				fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='X-OAUTH2' auth:service='oauth2' "+
-					"xmlns:auth='%s'>%s</auth>\n", nsSASL, o.OAuthXmlNs, enc)
-				break
-			}
-			if m == "PLAIN" {
-				mechanism = m
-				// Plain authentication: send base64-encoded \x00 user \x00 password.
-				raw := "\x00" + user + "\x00" + o.Password
-				enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
-				base64.StdEncoding.Encode(enc, []byte(raw))
-				fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='PLAIN'>%s</auth>\n", nsSASL, enc)
-				break
-			}
-			if m == "DIGEST-MD5" {
-				mechanism = m
-				// Digest-MD5 authentication
-				fmt.Fprintf(c.conn, "<auth xmlns='%s' mechanism='DIGEST-MD5'/>\n", nsSASL)
-				var ch saslChallenge
-				if err = c.p.DecodeElement(&ch, nil); err != nil {
-					return errors.New("unmarshal <challenge>: " + err.Error())
+		switch v := val.(type) {
+		case *saslSuccess:
+			// The server may send rspauth as additional data instead of a challenge, RFC 6120 6.3.10.
+			if rspauth != "" {
+				if strings.TrimSpace(v.Data) == "" {
+					return errors.New("xmpp: DIGEST-MD5 server did not send rspauth")
 				}
-				b, err := base64.StdEncoding.DecodeString(string(ch))
-				if err != nil {
+				if err := checkDigestRspAuth(v.Data, rspauth); err != nil {
 					return err
 				}
-				tokens := map[string]string{}
-				for _, token := range strings.Split(string(b), ",") {
-					kv := strings.SplitN(strings.TrimSpace(token), "=", 2)
-					if len(kv) == 2 {
-						if kv[1][0] == '"' && kv[1][len(kv[1])-1] == '"' {
-							kv[1] = kv[1][1 : len(kv[1])-1]
-						}
-						tokens[kv[0]] = kv[1]
-					}
+			}
+			if serverSignature != "" {
+				if err := checkSCRAMServerFinal(v.Data, serverSignature); err != nil {
+					return err
 				}
-				realm, _ := tokens["realm"]
-				nonce, _ := tokens["nonce"]
-				qop, _ := tokens["qop"]
-				charset, _ := tokens["charset"]
-				cnonceStr := cnonce()
-				digestURI := "xmpp/" + domain
-				nonceCount := fmt.Sprintf("%08x", 1)
-				digest := saslDigestResponse(user, realm, o.Password, nonce, cnonceStr, "AUTHENTICATE", digestURI, nonceCount)
-				message := "username=\"" + user + "\", realm=\"" + realm + "\", nonce=\"" + nonce + "\", cnonce=\"" + cnonceStr +
-					"\", nc=" + nonceCount + ", qop=" + qop + ", digest-uri=\"" + digestURI + "\", response=" + digest + ", charset=" + charset
-
-				fmt.Fprintf(c.conn, "<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte(message)))
-
-				var rspauth saslRspAuth
-				if err = c.p.DecodeElement(&rspauth, nil); err != nil {
-					return errors.New("unmarshal <challenge>: " + err.Error())
+			}
+			authenticated = true
+		case *saslChallenge:
+			if rspauth != "" {
+				// The server proves it knows the password, too, RFC 2831 2.1.3.
+				if err := checkDigestRspAuth(string(*v), rspauth); err != nil {
+					return err
 				}
-				b, err = base64.StdEncoding.DecodeString(string(rspauth))
-				if err != nil {
+				rspauth = ""
+				c.sendf("<response xmlns='%s'/>\n", nsSASL)
+				continue
+			}
+			if serverSignature != "" {
+				// Some servers send the server-final-message in a challenge.
+				if err := checkSCRAMServerFinal(string(*v), serverSignature); err != nil {
 					return err
 				}
-				fmt.Fprintf(c.conn, "<response xmlns='%s'/>\n", nsSASL)
-				break
+				serverSignature = ""
+				c.sendf("<response xmlns='%s'/>\n", nsSASL)
+				continue
 			}
+			if mechanism != "OAUTHBEARER" || status != "" {
+				return errors.New("xmpp: unexpected SASL challenge")
+			}
+			// The server rejected the token, RFC 7628 3.2.3; a dummy response
+			// gets us the <failure/>.
+			if status = oauthBearerStatus(string(*v)); status == "" {
+				status = "invalid_token"
+			}
+			c.sendf("<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte("\x01")))
+		case *saslFailure:
+			if v.Text == "" && status != "" {
+				v.Text = status
+			}
+			return &AuthError{Condition: v.Any.Local, Text: v.Text}
+		default:
+			return errors.New("expected <success> or <failure>, got <" + name.Local + "> in " + name.Space)
 		}
-		if mechanism == "" {
-			return fmt.Errorf("PLAIN authentication is not an option: %v", f.Mechanisms.Mechanism)
-		}
-	}
-	// Next message should be either success or failure.
-	name, val, err := next(c.p)
-	if err != nil {
-		return err
-	}
-	switch v := val.(type) {
-	case *saslSuccess:
-	case *saslFailure:
-		errorMessage := v.Text
-		if errorMessage == "" {
-			// v.Any is type of sub-element in failure,
-			// which gives a description of what failed if there was no text element
-			errorMessage = v.Any.Local
-		}
-		return errors.New("auth failure: " + errorMessage)
-	default:
-		return errors.New("expected <success> or <failure>, got <" + name.Local + "> in " + name.Space)
 	}
 
 	// Now that we're authenticated, we're supposed to start the stream over again.
@@ -474,58 +851,121 @@ func (c *Client) init(o *Options) error {
 	if f, err = c.startStream(o, domain); err != nil {
 		return err
 	}
+	c.idMutex.Lock()
+	c.domain = domain
+	c.idMutex.Unlock()
+
+	// A resumed stream management session is still bound to its resource.
+	if resumed, err := c.resumeStreamManagement(f, o); err != nil || resumed {
+		return err
+	}
 
-	// Generate a unique cookie
-	cookie := getCookie()
+	// The features of the restarted stream tell how to go on: bind a resource, then
+	// establish a session and enable stream management if offered. Compression is not
+	// supported and left alone.
+	if f.Bind.XMLName.Local == "" {
+		return fmt.Errorf("xmpp: server offers no resource binding after authentication, only %v", f.names())
+	}
 
 	// Send IQ message asking to bind to the local user name.
 	if o.Resource == "" {
-		fmt.Fprintf(c.conn, "<iq type='set' id='%x'><bind xmlns='%s'></bind></iq>\n", cookie, nsBind)
+		c.sendf("<iq type='set' id='%s'><bind xmlns='%s'></bind></iq>\n", bindID, nsBind)
 	} else {
-		fmt.Fprintf(c.conn, "<iq type='set' id='%x'><bind xmlns='%s'><resource>%s</resource></bind></iq>\n", cookie, nsBind, o.Resource)
+		c.sendf("<iq type='set' id='%s'><bind xmlns='%s'><resource>%s</resource></bind></iq>\n", bindID, nsBind, xmlEscape(o.Resource))
 	}
 	var iq clientIQ
-	if err = c.p.DecodeElement(&iq, nil); err != nil {
-		return errors.New("unmarshal <iq>: " + err.Error())
+	for iq.ID != bindID {
+		// Skip responses to anything else, and any other stanza.
+		c.setStepDeadline(o)
+		_, val, err := next(c.p)
+		if err != nil {
+			return stepError("bind result", err, err)
+		}
+		if v, ok := val.(*clientIQ); ok {
+			iq = *v
+		}
+	}
+	if iq.Type == IQTypeError {
+		// e.g. conflict if the server does not allow another session with the resource
+		if o.Resource != "" {
+			return fmt.Errorf("xmpp: binding resource %q: %w", o.Resource, c.stanzaError(&iq.Error))
+		}
+		return c.stanzaError(&iq.Error)
 	}
-	if &iq.Bind == nil {
+	if iq.Bind.Jid == "" {
 		return errors.New("<iq> result missing <bind>")
 	}
+	// The server may assign a resource other than the requested one.
+	c.idMutex.Lock()
 	c.jid = iq.Bind.Jid // our local id
-	c.domain = domain
+	c.idMutex.Unlock()
 
-	if o.Session {
-		//if server support session, open it
-		fmt.Fprintf(c.conn, "<iq to='%s' type='set' id='%x'><session xmlns='%s'/></iq>", xmlEscape(domain), cookie, nsSession)
+	if f.Session != nil && (f.Session.Optional == nil || o.Session) {
+		if err = c.establishSession(o, domain); err != nil {
+			return err
+		}
 	}
 
-	// We're connected and can now receive and send messages.
-	fmt.Fprintf(c.conn, "<presence xml:lang='en'><show>%s</show><status>%s</status></presence>", o.Status, o.StatusMessage)
+	return c.enableStreamManagement(f, o)
+}
 
+// establishSession establishes a session, RFC 3921 3, and waits for the result.
+func (c *Client) establishSession(o *Options, domain string) error {
+	c.sendf("<iq to='%s' type='set' id='%s'><session xmlns='%s'/></iq>\n", xmlEscape(domain), sessionID, nsSession)
+	var iq clientIQ
+	for iq.ID != sessionID {
+		// Skip responses to anything else, and any other stanza.
+		c.setStepDeadline(o)
+		_, val, err := next(c.p)
+		if err != nil {
+			return stepError("session result", err, err)
+		}
+		if v, ok := val.(*clientIQ); ok {
+			iq = *v
+		}
+	}
+	if iq.Type == IQTypeError {
+		return fmt.Errorf("xmpp: establishing session: %w", c.stanzaError(&iq.Error))
+	}
 	return nil
 }
 
-// startTlsIfRequired examines the server's stream features and, if STARTTLS is required or supported, performs the TLS handshake.
+// startTlsIfRequired examines the server's stream features and, if STARTTLS is required or supported, performs the TLS handshake,
+// RFC 6120 5.4. Unless o.NoTLS is set, a server without STARTTLS is an error, as the connection would stay unencrypted.
 // f will be updated if the handshake completes, as the new stream's features are typically different from the original.
 func (c *Client) startTLSIfRequired(f *streamFeatures, o *Options, domain string) (*streamFeatures, error) {
 	// whether we start tls is a matter of opinion: the server's and the user's.
+	_, framed := c.conn.(transport)
 	switch {
+	case framed:
+		// STARTTLS is for plain XML streams; other transports are secured on their own.
+		return f, nil
+	case c.IsEncrypted():
+		// the connection was secured by direct TLS.
+		return f, nil
+	case f.StartTLS == nil && !o.NoTLS:
+		return f, errors.New("xmpp: server does not support STARTTLS, but the connection must be encrypted; " +
+			"set DirectTLS if the server expects TLS from the outset, or NoTLS to connect unencrypted")
 	case f.StartTLS == nil:
 		// the server does not support STARTTLS
 		return f, nil
+	case !o.NoTLS:
+		// the user wants encryption and did not get it from direct TLS.
 	case !o.StartTLS && f.StartTLS.Required == nil:
 		return f, nil
-	case f.StartTLS.Required != nil:
-		// the server requires STARTTLS.
 	case !o.StartTLS:
+		return f, errors.New("xmpp: server requires STARTTLS, but NoTLS is set without StartTLS; " +
+			"set StartTLS to upgrade the connection")
+	default:
 		// the user wants STARTTLS and the server supports it.
 	}
 	var err error
 
-	fmt.Fprintf(c.conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>\n")
+	c.sendf("<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>\n")
 	var k tlsProceed
+	c.setStepDeadline(o)
 	if err = c.p.DecodeElement(&k, nil); err != nil {
-		return f, errors.New("unmarshal <proceed>: " + err.Error())
+		return f, stepError("STARTTLS proceed", errors.New("unmarshal <proceed>: "+err.Error()), err)
 	}
 
 	tc := o.TLSConfig
@@ -539,6 +979,9 @@ func (c *Client) startTLSIfRequired(f *streamFeatures, o *Options, domain string
 	if err = t.Handshake(); err != nil {
 		return f, errors.New("starttls handshake: " + err.Error())
 	}
+	if err = o.verifyPins(t); err != nil {
+		return f, err
+	}
 	c.conn = t
 
 	// restart our declaration of XMPP stream intentions.
@@ -550,62 +993,185 @@ func (c *Client) startTLSIfRequired(f *streamFeatures, o *Options, domain string
 }
 
 // startStream will start a new XML decoder for the connection, signal the start of a stream to the server and verify that the server has
-// also started the stream; if o.Debug is true, startStream will tee decoded XML data to stderr.  The features advertised by the server
+// also started the stream; if o.DebugReader or o.Debug is set, startStream will tee decoded XML data to it or to DebugWriter.  The features advertised by the server
 // will be returned.
 func (c *Client) startStream(o *Options, domain string) (*streamFeatures, error) {
-	if o.Debug {
+	if o.DebugReader != nil {
+		c.p = xml.NewDecoder(tee{c.conn, o.DebugReader})
+	} else if o.Debug {
 		c.p = xml.NewDecoder(tee{c.conn, DebugWriter})
 	} else {
 		c.p = xml.NewDecoder(c.conn)
 	}
 
-	_, err := fmt.Fprintf(c.conn, "<?xml version='1.0'?>\n"+
-		"<stream:stream to='%s' xmlns='%s'\n"+
-		" xmlns:stream='%s' version='1.0'>\n",
-		xmlEscape(domain), nsClient, nsStream)
-	if err != nil {
+	t := c.transport()
+	if _, err := c.sendf("%s", t.openStream(domain)); err != nil {
 		return nil, err
 	}
+	c.streamOpen = true
 
 	// We expect the server to start a <stream>.
+	c.setStepDeadline(o)
 	se, err := nextStart(c.p)
 	if err != nil {
-		return nil, err
+		return nil, stepError("stream header", err, err)
 	}
-	if se.Name.Space != nsStream || se.Name.Local != "stream" {
+	if !t.isStreamOpen(se) {
 		return nil, fmt.Errorf("expected <stream> but got <%v> in %v", se.Name.Local, se.Name.Space)
 	}
 
 	// Now we're in the stream and can use Unmarshal.
 	// Next message should be <features> to tell us authentication options.
 	// See section 4.6 in RFC 3920.
+	// The server may refuse the stream with a stream error instead.
 	f := new(streamFeatures)
-	if err = c.p.DecodeElement(f, nil); err != nil {
-		return f, errors.New("unmarshal <features>: " + err.Error())
+	if se, err = nextStart(c.p); err != nil {
+		return f, stepError("stream features", errors.New("unmarshal <features>: "+err.Error()), err)
 	}
+	if se.Name.Space == nsStream && se.Name.Local == "error" {
+		var e streamError
+		if err = c.p.DecodeElement(&e, &se); err != nil {
+			return f, err
+		}
+		return f, parseStreamError(e.InnerXML)
+	}
+	if err = c.p.DecodeElement(f, &se); err != nil {
+		return f, stepError("stream features", errors.New("unmarshal <features>: "+err.Error()), err)
+	}
+	c.serverFeatures.add(f)
 	return f, nil
 }
 
+// setStepDeadline limits the time the next negotiation step may take to o.NegotiationTimeout.
+// The context given to NewClientContext aborts the step on its own.
+func (c *Client) setStepDeadline(o *Options) {
+	c.negotiation.setReadDeadline(c.conn, o.NegotiationTimeout)
+}
+
+// stepError returns err, unless cause, the read error that made the negotiation step fail,
+// is a timeout; then it returns an error telling which step timed out.
+func stepError(step string, err, cause error) error {
+	if ne, ok := cause.(net.Error); ok && ne.Timeout() {
+		return fmt.Errorf("xmpp: timed out waiting for %s: %w", step, cause)
+	}
+	return err
+}
+
 // IsEncrypted will return true if the client is connected using a TLS transport, either because it used.
 // TLS to connect from the outset, or because it successfully used STARTTLS to promote a TCP connection to TLS.
 func (c *Client) IsEncrypted() bool {
-	_, ok := c.conn.(*tls.Conn)
-	return ok
+	return c.transport().encrypted()
 }
 
 // Chat is an incoming or outgoing XMPP chat message.
 type Chat struct {
 	Remote    string
 	Type      string
+	ID        string // Send generates one if empty
 	Text      string
 	Subject   string
 	Thread    string
-	Ooburl    string
+	Ooburl    string // URL of a file attached with xep-0066, e.g. from UploadFile
 	Oobdesc   string
 	Roster    Roster
 	Other     []string
 	OtherElem []XMLElement
+	// Delayed is set if the delivery of the message was delayed, xep-0203, like that of
+	// offline messages the server sends after login and of room history; Stamp is then
+	// the time the message was originally sent, and DelayedBy the entity that stored it,
+	// like our server or the room, if it says.
+	Delayed   bool
 	Stamp     time.Time
+	DelayedBy string
+	// Forwarded is set if the message forwards another message.
+	Forwarded *Forwarded
+	// Bodies and Subjects hold the localized variants of the body and subject.
+	// Recv sets them only if the message carries texts with an explicit language,
+	// and keeps the one in the default language of the message in Text and Subject.
+	// Send sends them after Text and Subject.
+	Bodies   []LangText
+	Subjects []LangText
+	// ChatState is the chat state notification of the message, like ChatStateComposing.
+	// Send leaves out the body of a message with a chat state but without text.
+	ChatState string
+	// Markable asks the recipient for chat markers, Marker is a chat marker for
+	// an earlier message.
+	Markable bool
+	Marker   *ChatMarker
+	// Carbon is CarbonSent or CarbonReceived for a copy of a message another of our
+	// resources sent or received. Remote of a sent copy is the recipient.
+	Carbon string
+	// Error is the error of a message of type error, RFC 6120 8.3.
+	Error *StanzaError
+	// OriginID is the id the sender gave the message, xep-0359 3.2, which survives
+	// archiving. Send sends it, or ID if Options.OriginID is set.
+	OriginID string
+	// StanzaIDs are the ids our server or the room gave the message, xep-0359 3.1,
+	// see StanzaID. Ids claimed by other entities are left out.
+	StanzaIDs []StanzaID
+	// ReplaceID is the id of the earlier message this one corrects, xep-0308. It is up
+	// to the receiver to check that the earlier message came from the same sender.
+	ReplaceID string
+	// Nickname is the nickname the sender gave itself, xep-0172, like in a first message
+	// to someone who does not know it yet, unlike Nick, its nickname in a room. Send
+	// sends it, if set.
+	Nickname string
+	// OccupantID is the id the room gave the occupant who sent a groupchat message,
+	// xep-0421, which, unlike the nick, stays the same when the occupant changes its
+	// nick or joins again. Trust it only if MUCSupportsOccupantID. Send sends it, if set.
+	OccupantID string
+}
+
+// HasPayload reports whether the message carries anything besides its addressing,
+// like a body, a subject or an extension element such as a receipt. Messages without
+// a body are common for notifications, so check this rather than Text.
+func (c Chat) HasPayload() bool {
+	return c.Text != "" || c.Subject != "" || len(c.Bodies) > 0 || len(c.Subjects) > 0 ||
+		c.Thread != "" || c.Ooburl != "" || c.ReplaceID != "" || c.ChatState != "" || c.Markable || c.Marker != nil || c.Forwarded != nil ||
+		len(c.OtherElem) > 0 || c.Error != nil
+}
+
+// IsGroupChat reports whether the message was sent to a room, xep-0045, rather than
+// to us alone. Private messages from occupants are of type chat.
+func (c Chat) IsGroupChat() bool {
+	return c.Type == "groupchat"
+}
+
+// RoomJID returns the room a groupchat message came from, or "" for other messages.
+func (c Chat) RoomJID() string {
+	if !c.IsGroupChat() {
+		return ""
+	}
+	return c.BareJID()
+}
+
+// Nick returns the nickname of the occupant who sent a groupchat message, or "" for
+// other messages and for those of the room itself, like its subject.
+func (c Chat) Nick() string {
+	if !c.IsGroupChat() {
+		return ""
+	}
+	return c.Resource()
+}
+
+// BareJID returns the sender of the message without its resource, e.g. "juliet@example.com".
+func (c Chat) BareJID() string {
+	return strings.SplitN(c.Remote, "/", 2)[0]
+}
+
+// Resource returns the resource of the sender of the message, or "" if there is none.
+// The resource of a message from a room is the nickname of the occupant.
+func (c Chat) Resource() string {
+	if i := strings.Index(c.Remote, "/"); i >= 0 {
+		return c.Remote[i+1:]
+	}
+	return ""
+}
+
+// LangText is a text in a language, RFC 6120 8.1.5.
+type LangText struct {
+	Lang string // empty for the default language of the stanza
+	Text string
 }
 
 type Roster []Contact
@@ -620,9 +1186,41 @@ type Contact struct {
 type Presence struct {
 	From   string
 	To     string
-	Type   string
-	Show   string
+	ID     string
+	Type   string // empty for available, or error, probe, subscribe, subscribed, unavailable, unsubscribe, unsubscribed
+	Show   string // away, chat, dnd, xa, or empty for online
 	Status string
+	// Priority is the priority of the resource, from -128 to 127, RFC 6121 4.7.2.3.
+	// A priority received out of range is taken as 0.
+	Priority int
+
+	// MUC is set for presence from a room occupant.
+	MUC *MUCUser
+
+	// MUCDestroy is set if the presence announces that a room was destroyed.
+	MUCDestroy *MUCDestroy
+
+	// Nickname is the nickname the sender gave itself, xep-0172, usually along with a
+	// subscription request. SendPresence sends it, if set.
+	Nickname string
+
+	// OccupantID is the id the room gave the occupant, like Chat.OccupantID.
+	OccupantID string
+}
+
+// IsAvailable reports whether the presence announces that the sender is online, RFC 6121 4.2.
+func (p Presence) IsAvailable() bool {
+	return p.Type == ""
+}
+
+// IsUnavailable reports whether the presence announces that the sender went offline, RFC 6121 4.5.
+func (p Presence) IsUnavailable() bool {
+	return p.Type == "unavailable"
+}
+
+// IsSubscriptionRequest reports whether the sender asks to subscribe to our presence, RFC 6121 3.1.
+func (p Presence) IsSubscriptionRequest() bool {
+	return p.Type == "subscribe"
 }
 
 type IQ struct {
@@ -630,23 +1228,68 @@ type IQ struct {
 	From  string
 	To    string
 	Type  string
-	Query []byte
+	Query []byte // the child element, as received
+
+	// Payload is the child element decoded into the type registered for it with
+	// RegisterIQNamespace, or nil.
+	Payload interface{}
+}
+
+// RawStanza is an element at the root of the stream that the client does not know,
+// e.g. of an extension it does not implement. Recv returns it rather than fail.
+type RawStanza struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	InnerXML string
 }
 
 // Recv waits to receive the next XMPP stanza.
 // Return type is either a presence notification or a chat message.
 func (c *Client) Recv() (stanza interface{}, err error) {
 	for {
+		timeout := c.armRecvTimeout()
 		_, val, err := next(c.p)
 		if err != nil {
+			if timeout > 0 && isTimeout(err) {
+				err = fmt.Errorf("xmpp: nothing received for %v: %w", timeout, err)
+			}
+			c.abortIQs()
+			c.abortMUCJoins()
+			c.abortPresences()
+			c.abortIBB()
+			c.abortAcks()
+			r, err := c.reconnect(err)
+			if err == nil {
+				return *r, nil
+			}
 			return Chat{}, err
 		}
+		if ok, err := c.handleSM(val); ok || err != nil {
+			if err != nil {
+				return Chat{}, err
+			}
+			continue
+		}
 		switch v := val.(type) {
+		case *RawStanza:
+			return *v, nil
 		case *clientMessage:
+			if c.deliverMAM(v) {
+				continue
+			}
+			if v.CarbonSent != nil || v.CarbonReceived != nil {
+				if chat, ok := c.carbon(v); ok {
+					return chat, nil
+				}
+				continue
+			}
 			if v.Event.XMLNS == XMPPNS_PUBSUB_EVENT {
 				// Handle Pubsub notifications
 				switch v.Event.Items.Node {
 				case XMPPNS_AVATAR_PEP_METADATA:
+					if len(v.Event.Items.Items) == 0 {
+						return pubsubClientToReturn(v.Event), nil
+					}
 					return handleAvatarMetadata(v.Event.Items.Items[0].Body,
 						v.From)
 				// I am not sure whether this can even happen.
@@ -656,46 +1299,108 @@ func (c *Client) Recv() (stanza interface{}, err error) {
 				return handleAvatarData(v.Event.Items.Items[0].Body,
 					v.From,
 					v.Event.Items.Items[0].ID)*/
+				case nsMood:
+					return moodEvent(v.Event, v.From), nil
+				case nsActivity:
+					return activityEvent(v.Event, v.From), nil
 				default:
 					return pubsubClientToReturn(v.Event), nil
 				}
 			}
 
-			stamp, _ := time.Parse(
-				"2006-01-02T15:04:05Z",
-				v.Delay.Stamp,
-			)
-			chat := Chat{
-				Remote:    v.From,
-				Type:      v.Type,
-				Text:      v.Body,
-				Subject:   v.Subject,
-				Thread:    v.Thread,
-				Other:     v.OtherStrings(),
-				OtherElem: v.Other,
-				Stamp:     stamp,
+			if c.duplicate(v) {
+				continue
+			}
+			if r, ok := v.retraction(); ok && v.Type != "error" {
+				return r, nil
+			}
+			chat := v.chat()
+			if v.Error != nil {
+				chat.Error = newStanzaError(v.Error, c.errorLangs)
 			}
 			return chat, nil
 		case *clientQuery:
 			var r Roster
+			var jids []string
 			for _, item := range v.Item {
 				r = append(r, Contact{item.Jid, item.Name, item.Group})
+				jids = append(jids, item.Jid)
 			}
+			c.setContacts(jids)
 			return Chat{Type: "roster", Roster: r}, nil
 		case *clientPresence:
-			return Presence{v.From, v.To, v.Type, v.Show, v.Status}, nil
+			if c.deliverPresenceError(v) {
+				continue
+			}
+			c.trackOccupant(v)
+			c.deliverMUCPresence(v)
+			priority, _ := strconv.Atoi(strings.TrimSpace(v.Priority))
+			if checkPriority(priority) != nil {
+				priority = 0
+			}
+			return Presence{
+				From:       v.From,
+				To:         v.To,
+				ID:         v.ID,
+				Type:       v.Type,
+				Show:       v.Show,
+				Status:     v.Status,
+				Priority:   priority,
+				MUC:        v.MUCUser.user(),
+				MUCDestroy: v.MUCUser.destroy(),
+				Nickname:   strings.TrimSpace(v.Nick),
+				OccupantID: v.OccupantID.id(),
+			}, nil
 		case *clientIQ:
-			switch {
-			case v.Query.XMLName.Space == "urn:xmpp:ping":
-				// TODO check more strictly
-				err := c.SendResultPing(v.ID, v.From)
+			if c.deliverIQ(v) || c.handleBlockPush(v) {
+				continue
+			}
+			if push, ok := c.rosterPush(v); ok {
+				return push, nil
+			}
+			if j, ok := c.jingle(v); ok {
+				return j, nil
+			}
+			if r, ok, err := c.handleS5B(v); ok {
+				if err != nil {
+					return Chat{}, err
+				}
+				if r != nil {
+					return *r, nil
+				}
+				continue
+			}
+			if open, ok, err := c.handleIBB(v); ok {
+				if err != nil {
+					return Chat{}, err
+				}
+				if open != nil {
+					return *open, nil
+				}
+				continue
+			}
+			if ok, err := c.handlePing(v); ok {
 				if err != nil {
 					return Chat{}, err
 				}
-				fallthrough
+				continue
+			}
+			if ok, err := c.handleAutoReply(v); ok {
+				if err != nil {
+					return Chat{}, err
+				}
+				continue
+			}
+			if ok, err := c.handleDiscoInfo(v); ok {
+				if err != nil {
+					return Chat{}, err
+				}
+				continue
+			}
+			switch {
 			case v.Type == "error":
 				switch v.ID {
-				case "sub1":
+				case pubsubSubscribeID:
 					// Pubsub subscription failed
 					var errs []clientPubsubError
 					err := xml.Unmarshal([]byte(v.Error.InnerXML), &errs)
@@ -712,7 +1417,8 @@ func (c *Client) Recv() (stanza interface{}, err error) {
 						Errors: errsStr,
 					}, nil
 				}
-			case v.Type == "result" && v.ID == "unsub1":
+				c.logf("xmpp: dropping IQ error %q from %s: %v", v.ID, v.From, c.stanzaError(&v.Error))
+			case v.Type == "result" && v.ID == pubsubUnsubscribeID:
 				// Unsubscribing MAY contain a pubsub element. But it does
 				// not have to
 				return PubsubUnsubscription{
@@ -723,7 +1429,7 @@ func (c *Client) Recv() (stanza interface{}, err error) {
 				}, nil
 			case v.Query.XMLName.Local == "pubsub":
 				switch v.ID {
-				case "sub1":
+				case pubsubSubscribeID:
 					// Subscription or unsubscription was successful
 					var sub clientPubsubSubscription
 					err := xml.Unmarshal([]byte(v.Query.InnerXML), &sub)
@@ -737,7 +1443,7 @@ func (c *Client) Recv() (stanza interface{}, err error) {
 						Node:   sub.Node,
 						Errors: nil,
 					}, nil
-				case "unsub1":
+				case pubsubUnsubscribeID:
 					var sub clientPubsubSubscription
 					err := xml.Unmarshal([]byte(v.Query.InnerXML), &sub)
 					if err != nil {
@@ -750,7 +1456,7 @@ func (c *Client) Recv() (stanza interface{}, err error) {
 						Node:   sub.Node,
 						Errors: nil,
 					}, nil
-				case "items1", "items3":
+				case pubsubLastItemsID, pubsubItemID:
 					var p clientPubsubItems
 					err := xml.Unmarshal([]byte(v.Query.InnerXML), &p)
 					if err != nil {
@@ -796,75 +1502,175 @@ func (c *Client) Recv() (stanza interface{}, err error) {
 			case v.Query.XMLName.Local == "":
 				return IQ{ID: v.ID, From: v.From, To: v.To, Type: v.Type}, nil
 			default:
-				res, err := xml.Marshal(v.Query)
+				res, err := v.rawQuery()
+				if err != nil {
+					return Chat{}, err
+				}
+				payload, err := v.payload()
 				if err != nil {
 					return Chat{}, err
 				}
 
 				return IQ{ID: v.ID, From: v.From, To: v.To, Type: v.Type,
-					Query: res}, nil
+					Query: res, Payload: payload}, nil
 			}
 		}
 	}
 }
 
 // Send sends the message wrapped inside an XMPP message stanza body.
+// Like all methods that write to the server, it is safe for concurrent use by multiple goroutines.
 func (c *Client) Send(chat Chat) (n int, err error) {
-	var subtext, thdtext, oobtext string
+	var subtext, bodytext, thdtext, statetext string
 	if chat.Subject != `` {
 		subtext = `<subject>` + xmlEscape(chat.Subject) + `</subject>`
 	}
+	subtext += langElements("subject", chat.Subjects)
+	if chat.Text == `` && chat.Ooburl != `` && len(chat.Bodies) == 0 {
+		// clients without xep-0066 show the URL
+		bodytext = `<body>` + xmlEscape(chat.Ooburl) + `</body>`
+	} else if chat.Text != `` || len(chat.Bodies) == 0 && chat.ChatState == `` {
+		bodytext = `<body>` + xmlEscape(chat.Text) + `</body>`
+	}
+	bodytext += langElements("body", chat.Bodies)
 	if chat.Thread != `` {
 		thdtext = `<thread>` + xmlEscape(chat.Thread) + `</thread>`
 	}
-	if chat.Ooburl != `` {
-		oobtext = `<x xmlns="jabber:x:oob"><url>` + xmlEscape(chat.Ooburl) + `</url>`
-		if chat.Oobdesc != `` {
-			oobtext += `<desc>` + xmlEscape(chat.Oobdesc) + `</desc>`
-		}
-		oobtext += `</x>`
+	if isChatState(chat.ChatState) {
+		statetext = `<` + chat.ChatState + ` xmlns='` + nsChatStates + `'/>`
+	}
+	if chat.Markable {
+		statetext += `<markable xmlns='` + nsChatMarkers + `'/>`
+	}
+	if chat.ReplaceID != `` {
+		statetext += `<replace xmlns='` + nsCorrect + `' id='` + xmlEscape(chat.ReplaceID) + `'/>`
 	}
+	statetext += nickElement(chat.Nickname) + occupantIDElement(chat.OccupantID)
+	id := chat.ID
+	if id == `` {
+		id = NewID()
+	}
+
+	// The texts may contain %, so they are arguments rather than part of the format.
+	return c.sendf("<message to='%s' type='%s' id='%s' xml:lang='en'>%s%s%s%s%s%s</message>",
+		xmlEscape(chat.Remote), xmlEscape(chat.Type), xmlEscape(id), subtext, bodytext, oobElement(chat), thdtext, statetext,
+		c.originIDElement(chat, id))
+}
 
-	stanza := "<message to='%s' type='%s' id='%s' xml:lang='en'>" + subtext + "<body>%s</body>" + oobtext + thdtext + "</message>"
+// SendMessage sends body to a contact as a message of type chat and returns the id of
+// the message, which receipts and chat markers for it refer to.
+func (c *Client) SendMessage(to, body string) (id string, err error) {
+	id = NewID()
+	_, err = c.Send(Chat{Remote: to, Type: "chat", ID: id, Text: body})
+	return id, err
+}
+
+// SendGroupChat sends body to everyone in a room we joined, see JoinMUC, and returns
+// the id of the message. The room reflects the message back to us, usually with the same id.
+func (c *Client) SendGroupChat(room, body string) (id string, err error) {
+	id = NewID()
+	_, err = c.Send(Chat{Remote: room, Type: "groupchat", ID: id, Text: body})
+	return id, err
+}
 
-	return fmt.Fprintf(c.conn, stanza,
-		xmlEscape(chat.Remote), xmlEscape(chat.Type), cnonce(), xmlEscape(chat.Text))
+// NewID returns a random stanza id, like the ones Send gives messages without an ID.
+func NewID() string {
+	return cnonce()
 }
 
 // SendOOB sends OOB data wrapped inside an XMPP message stanza, without actual body.
+// Send sends the URL as the body as well, for clients that do not support xep-0066.
 func (c *Client) SendOOB(chat Chat) (n int, err error) {
-	var thdtext, oobtext string
+	var thdtext string
 	if chat.Thread != `` {
 		thdtext = `<thread>` + xmlEscape(chat.Thread) + `</thread>`
 	}
-	if chat.Ooburl != `` {
-		oobtext = `<x xmlns="jabber:x:oob"><url>` + xmlEscape(chat.Ooburl) + `</url>`
-		if chat.Oobdesc != `` {
-			oobtext += `<desc>` + xmlEscape(chat.Oobdesc) + `</desc>`
-		}
-		oobtext += `</x>`
+	return c.sendf("<message to='%s' type='%s' id='%s' xml:lang='en'>%s%s</message>",
+		xmlEscape(chat.Remote), xmlEscape(chat.Type), NewID(), oobElement(chat), thdtext)
+}
+
+// oobElement returns the xep-0066 element with the URL of chat, if any.
+func oobElement(chat Chat) string {
+	if chat.Ooburl == `` {
+		return ``
 	}
-	return fmt.Fprintf(c.conn, "<message to='%s' type='%s' id='%s' xml:lang='en'>"+oobtext+thdtext+"</message>",
-		xmlEscape(chat.Remote), xmlEscape(chat.Type), cnonce())
+	oobtext := `<x xmlns="jabber:x:oob"><url>` + xmlEscape(chat.Ooburl) + `</url>`
+	if chat.Oobdesc != `` {
+		oobtext += `<desc>` + xmlEscape(chat.Oobdesc) + `</desc>`
+	}
+	return oobtext + `</x>`
 }
 
 // SendOrg sends the original text without being wrapped in an XMPP message stanza.
 func (c *Client) SendOrg(org string) (n int, err error) {
-	return fmt.Fprint(c.conn, org)
+	return c.sendf("%s", org)
+}
+
+// SendRaw writes the XML fragment to the stream as is, e.g. a stanza of an extension the
+// client does not support. Like the stanzas the client builds, it is written whole, counted
+// for stream management and copied to Options.DebugWriter. It is not checked, though:
+// malformed XML will make the server close the stream.
+func (c *Client) SendRaw(raw string) error {
+	_, err := c.sendf("%s", raw)
+	return err
 }
 
+// checkPriority checks that a presence priority is in range, RFC 6121 4.7.2.3.
+func checkPriority(priority int) error {
+	if priority < -128 || priority > 127 {
+		return fmt.Errorf("xmpp: presence priority %d out of range -128..127", priority)
+	}
+	return nil
+}
+
+// SendPresence sends a presence stanza, RFC 6121 4.7. Empty From, To, ID and Type attributes
+// and empty Show and Status elements are left out, as is a Priority of zero. Available
+// presence carries our entity capabilities if Options.CapsNode is set.
+// A Priority out of range is an error.
 func (c *Client) SendPresence(presence Presence) (n int, err error) {
-	return fmt.Fprintf(c.conn, "<presence from='%s' to='%s'/>", xmlEscape(presence.From), xmlEscape(presence.To))
+	if err := checkPriority(presence.Priority); err != nil {
+		return 0, err
+	}
+	var attrs, children string
+	if presence.From != "" {
+		attrs += " from='" + xmlEscape(presence.From) + "'"
+	}
+	if presence.To != "" {
+		attrs += " to='" + xmlEscape(presence.To) + "'"
+	}
+	if presence.ID != "" {
+		attrs += " id='" + xmlEscape(presence.ID) + "'"
+	}
+	if presence.Type != "" {
+		attrs += " type='" + xmlEscape(presence.Type) + "'"
+	}
+	if presence.Show != "" {
+		children += "<show>" + xmlEscape(presence.Show) + "</show>"
+	}
+	if presence.Status != "" {
+		children += "<status>" + xmlEscape(presence.Status) + "</status>"
+	}
+	if presence.Priority != 0 {
+		children += "<priority>" + strconv.Itoa(presence.Priority) + "</priority>"
+	}
+	children += nickElement(presence.Nickname)
+	if presence.Type == "" {
+		children += c.capsElement()
+	}
+	if children == "" {
+		return c.sendf("<presence%s/>", attrs)
+	}
+	return c.sendf("<presence%s>%s</presence>", attrs, children)
 }
 
 // SendKeepAlive sends a "whitespace keepalive" as described in chapter 4.6.1 of RFC6120.
 func (c *Client) SendKeepAlive() (n int, err error) {
-	return fmt.Fprintf(c.conn, " ")
+	return c.sendf(" ")
 }
 
 // SendHtml sends the message as HTML as defined by XEP-0071
 func (c *Client) SendHtml(chat Chat) (n int, err error) {
-	return fmt.Fprintf(c.conn, "<message to='%s' type='%s' xml:lang='en'>"+
+	return c.sendf("<message to='%s' type='%s' xml:lang='en'>"+
 		"<body>%s</body>"+
 		"<html xmlns='http://jabber.org/protocol/xhtml-im'><body xmlns='http://www.w3.org/1999/xhtml'>%s</body></html></message>",
 		xmlEscape(chat.Remote), xmlEscape(chat.Type), xmlEscape(chat.Text), chat.Text)
@@ -872,23 +1678,29 @@ func (c *Client) SendHtml(chat Chat) (n int, err error) {
 
 // Roster asks for the chat roster.
 func (c *Client) Roster() error {
-	fmt.Fprintf(c.conn, "<iq from='%s' type='get' id='roster1'><query xmlns='jabber:iq:roster'/></iq>\n", xmlEscape(c.jid))
+	c.sendf("<iq from='%s' type='get' id='roster1'><query xmlns='jabber:iq:roster'/></iq>\n", xmlEscape(c.JID()))
 	return nil
 }
 
 // RFC 3920  C.1  Streams name space
 type streamFeatures struct {
-	XMLName    xml.Name `xml:"http://etherx.jabber.org/streams features"`
-	StartTLS   *tlsStartTLS
-	Mechanisms saslMechanisms
-	Bind       bindBind
-	Session    bool
+	XMLName     xml.Name `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS    *tlsStartTLS
+	Mechanisms  saslMechanisms
+	Bind        bindBind
+	Session     *sessionFeature
+	SM          *smFeature
+	Register    *struct{}           `xml:"http://jabber.org/features/iq-register register"`
+	Compression *compressionFeature `xml:"http://jabber.org/features/compress compression"`
+	RosterVer   *struct{}           `xml:"urn:xmpp:features:rosterver ver"`
+	Other       []struct {
+		XMLName xml.Name
+	} `xml:",any"`
 }
 
 type streamError struct {
-	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
-	Any     xml.Name
-	Text    string
+	XMLName  xml.Name `xml:"http://etherx.jabber.org/streams error"`
+	InnerXML []byte   `xml:",innerxml"`
 }
 
 // RFC 3920  C.3  TLS name space
@@ -918,8 +1730,6 @@ type saslAuth struct {
 
 type saslChallenge string
 
-type saslRspAuth string
-
 type saslResponse string
 
 type saslAbort struct {
@@ -928,6 +1738,7 @@ type saslAbort struct {
 
 type saslSuccess struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
+	Data    string   `xml:",chardata"`
 }
 
 type saslFailure struct {
@@ -950,19 +1761,168 @@ type clientMessage struct {
 	ID      string   `xml:"id,attr"`
 	To      string   `xml:"to,attr"`
 	Type    string   `xml:"type,attr"` // chat, error, groupchat, headline, or normal
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
 
-	// These should technically be []clientText, but string is much more convenient.
-	Subject string `xml:"subject"`
-	Body    string `xml:"body"`
-	Thread  string `xml:"thread"`
+	Subject []clientText `xml:"subject"`
+	Body    []clientText `xml:"body"`
+	Thread  string       `xml:"thread"`
 
 	// Pubsub
-	Event clientPubsubEvent `xml:"event"`
+	Event clientPubsubEvent `xml:"http://jabber.org/protocol/pubsub#event event"`
+
+	// XEP-0066
+	OOB *struct {
+		URL  string `xml:"url"`
+		Desc string `xml:"desc"`
+	} `xml:"jabber:x:oob x"`
+
+	// XEP-0297
+	Forwarded *clientForwarded `xml:"urn:xmpp:forward:0 forwarded"`
+
+	// XEP-0333
+	Markable     *struct{}         `xml:"urn:xmpp:chat-markers:0 markable"`
+	Received     *clientChatMarker `xml:"urn:xmpp:chat-markers:0 received"`
+	Displayed    *clientChatMarker `xml:"urn:xmpp:chat-markers:0 displayed"`
+	Acknowledged *clientChatMarker `xml:"urn:xmpp:chat-markers:0 acknowledged"`
+
+	// XEP-0313
+	MAMResult *clientMAMResult `xml:"urn:xmpp:mam:2 result"`
+
+	// XEP-0280
+	CarbonSent     *clientCarbon `xml:"urn:xmpp:carbons:2 sent"`
+	CarbonReceived *clientCarbon `xml:"urn:xmpp:carbons:2 received"`
+
+	Error *clientError `xml:"jabber:client error"`
+
+	// XEP-0308
+	Replace *struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:message-correct:0 replace"`
+
+	// XEP-0359
+	OriginID  *clientStanzaID  `xml:"urn:xmpp:sid:0 origin-id"`
+	StanzaIDs []clientStanzaID `xml:"urn:xmpp:sid:0 stanza-id"`
+
+	// XEP-0172
+	Nick string `xml:"http://jabber.org/protocol/nick nick"`
+
+	// XEP-0424
+	Retract  *clientRetract `xml:"urn:xmpp:message-retract:0 retract"`
+	Retract1 *clientRetract `xml:"urn:xmpp:message-retract:1 retract"`
+	ApplyTo  *clientApplyTo `xml:"urn:xmpp:fasten:0 apply-to"`
+
+	// XEP-0421
+	OccupantID *clientOccupantID `xml:"urn:xmpp:occupant-id:0 occupant-id"`
 
 	// Any hasn't matched element
 	Other []XMLElement `xml:",any"`
 
-	Delay Delay `xml:"delay"`
+	// XEP-0203, and XEP-0091 from older servers
+	Delay       *Delay `xml:"urn:xmpp:delay delay"`
+	LegacyDelay *Delay `xml:"jabber:x:delay x"`
+}
+
+// chat converts the message into the Chat returned by Recv.
+func (m *clientMessage) chat() Chat {
+	stamp, delayed, delayedBy := m.delay()
+	return Chat{
+		Remote:     m.From,
+		Type:       m.Type,
+		ID:         m.ID,
+		Text:       defaultText(m.Body, m.Lang),
+		Subject:    defaultText(m.Subject, m.Lang),
+		Thread:     m.Thread,
+		Ooburl:     m.oobURL(),
+		Oobdesc:    m.oobDesc(),
+		Other:      m.OtherStrings(),
+		OtherElem:  m.Other,
+		Stamp:      stamp,
+		Delayed:    delayed,
+		DelayedBy:  delayedBy,
+		Forwarded:  m.Forwarded.forwarded(),
+		Bodies:     langTexts(m.Body),
+		Subjects:   langTexts(m.Subject),
+		ChatState:  chatState(m.Other),
+		Markable:   m.Markable != nil,
+		Marker:     m.marker(),
+		Error:      m.stanzaError(),
+		OriginID:   m.originID(),
+		StanzaIDs:  m.stanzaIDs(),
+		ReplaceID:  m.replaceID(),
+		Nickname:   strings.TrimSpace(m.Nick),
+		OccupantID: m.OccupantID.id(),
+	}
+}
+
+func (m *clientMessage) replaceID() string {
+	if m.Replace == nil {
+		return ""
+	}
+	return m.Replace.ID
+}
+
+func (m *clientMessage) oobURL() string {
+	if m.OOB == nil {
+		return ""
+	}
+	return strings.TrimSpace(m.OOB.URL)
+}
+
+func (m *clientMessage) oobDesc() string {
+	if m.OOB == nil {
+		return ""
+	}
+	return m.OOB.Desc
+}
+
+// stanzaError returns the error of a message of type error, if any.
+func (m *clientMessage) stanzaError() *StanzaError {
+	if m.Error == nil {
+		return nil
+	}
+	return newStanzaError(m.Error, nil)
+}
+
+// defaultText returns the text in the default language lang of a stanza: the one
+// without a language or in lang, or else the first one.
+func defaultText(texts []clientText, lang string) string {
+	for _, t := range texts {
+		if t.Lang == "" || strings.EqualFold(t.Lang, lang) {
+			return t.Body
+		}
+	}
+	if len(texts) > 0 {
+		return texts[0].Body
+	}
+	return ""
+}
+
+// langTexts converts texts into LangTexts if any of them has an explicit language.
+func langTexts(texts []clientText) []LangText {
+	var a []LangText
+	for _, t := range texts {
+		if t.Lang != "" {
+			a = make([]LangText, len(texts))
+			for i, t := range texts {
+				a[i] = LangText{Lang: t.Lang, Text: t.Body}
+			}
+			break
+		}
+	}
+	return a
+}
+
+// langElements encodes texts as elements named name with their xml:lang attribute.
+func langElements(name string, texts []LangText) string {
+	var s string
+	for _, t := range texts {
+		s += "<" + name
+		if t.Lang != "" {
+			s += " xml:lang='" + xmlEscape(t.Lang) + "'"
+		}
+		s += ">" + xmlEscape(t.Text) + "</" + name + ">"
+	}
+	return s
 }
 
 func (m *clientMessage) OtherStrings() []string {
@@ -973,9 +1933,39 @@ func (m *clientMessage) OtherStrings() []string {
 	return a
 }
 
+// XMLElement is a child element the client does not model, like an application
+// specific payload of a message.
 type XMLElement struct {
 	XMLName  xml.Name
-	InnerXML string `xml:",innerxml"`
+	Attrs    []xml.Attr `xml:",any,attr"` // without namespace declarations
+	InnerXML string     `xml:",innerxml"`
+}
+
+func (e *XMLElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var inner struct {
+		InnerXML string `xml:",innerxml"`
+	}
+	if err := d.DecodeElement(&inner, &start); err != nil {
+		return err
+	}
+	e.XMLName, e.InnerXML, e.Attrs = start.Name, inner.InnerXML, nil
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" || a.Name == (xml.Name{Local: "xmlns"}) {
+			continue
+		}
+		e.Attrs = append(e.Attrs, a)
+	}
+	return nil
+}
+
+// Attr returns the value of the attribute local of the element, in any namespace.
+func (e *XMLElement) Attr(local string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
 }
 
 func (e *XMLElement) String() string {
@@ -1000,13 +1990,9 @@ func (e *XMLElement) String() string {
 	return buf.String()
 }
 
-type Delay struct {
-	Stamp string `xml:"stamp,attr"`
-}
-
 type clientText struct {
-	Lang string `xml:",attr"`
-	Body string `xml:"chardata"`
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Body string `xml:",chardata"`
 }
 
 type clientPresence struct {
@@ -1019,8 +2005,13 @@ type clientPresence struct {
 
 	Show     string `xml:"show"`   // away, chat, dnd, xa
 	Status   string `xml:"status"` // sb []clientText
-	Priority string `xml:"priority,attr"`
+	Priority string `xml:"priority"`
 	Error    *clientError
+	MUCUser  *clientMUCUser
+	Nick     string `xml:"http://jabber.org/protocol/nick nick"`
+
+	// XEP-0421
+	OccupantID *clientOccupantID `xml:"urn:xmpp:occupant-id:0 occupant-id"`
 }
 
 type clientIQ struct {
@@ -1033,11 +2024,55 @@ type clientIQ struct {
 	Query   XMLElement `xml:",any"`
 	Error   clientError
 	Bind    bindBind
+
+	InnerXML []byte `xml:",innerxml"`
+}
+
+// queryAttr returns the attribute name of the child element of the IQ.
+func (iq *clientIQ) queryAttr(name string) string {
+	d := xml.NewDecoder(bytes.NewReader(iq.InnerXML))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			for _, a := range start.Attr {
+				if a.Name.Space == "" && a.Name.Local == name {
+					return a.Value
+				}
+			}
+			return ""
+		}
+	}
+}
+
+// decodeQuery unmarshals the child element of the IQ, with its attributes, into v.
+func (iq *clientIQ) decodeQuery(v interface{}) error {
+	if iq.InnerXML != nil {
+		d := xml.NewDecoder(bytes.NewReader(iq.InnerXML))
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				break
+			}
+			if start, ok := tok.(xml.StartElement); ok && start.Name == iq.Query.XMLName {
+				return d.DecodeElement(v, &start)
+			} else if ok {
+				d.Skip()
+			}
+		}
+	}
+	b, err := xml.Marshal(iq.Query)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(b, v)
 }
 
 type clientError struct {
 	XMLName  xml.Name `xml:"jabber:client error"`
-	Code     string   `xml:",attr"`
+	Code     string   `xml:"code,attr"`
 	Type     string   `xml:"type,attr"`
 	Any      xml.Name
 	InnerXML []byte `xml:",innerxml"`
@@ -1050,10 +2085,11 @@ type clientQuery struct {
 
 type rosterItem struct {
 	XMLName      xml.Name `xml:"jabber:iq:roster item"`
-	Jid          string   `xml:",attr"`
-	Name         string   `xml:",attr"`
-	Subscription string   `xml:",attr"`
-	Group        []string
+	Jid          string   `xml:"jid,attr"`
+	Name         string   `xml:"name,attr"`
+	Subscription string   `xml:"subscription,attr"`
+	Ask          string   `xml:"ask,attr"`
+	Group        []string `xml:"group"`
 }
 
 // Scan XML token stream to find next StartElement.
@@ -1073,6 +2109,7 @@ func nextStart(p *xml.Decoder) (xml.StartElement, error) {
 // Scan XML token stream for next element and save into val.
 // If val == nil, allocate new element based on proto map.
 // Either way, return val.
+// A stream error is returned as a *StreamError.
 func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	// Read start element to find out what type we want.
 	se, err := nextStart(p)
@@ -1096,9 +2133,9 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	case nsSASL + " mechanisms":
 		nv = &saslMechanisms{}
 	case nsSASL + " challenge":
-		nv = ""
+		nv = new(saslChallenge)
 	case nsSASL + " response":
-		nv = ""
+		nv = new(saslResponse)
 	case nsSASL + " abort":
 		nv = &saslAbort{}
 	case nsSASL + " success":
@@ -1107,6 +2144,16 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 		nv = &saslFailure{}
 	case nsBind + " bind":
 		nv = &bindBind{}
+	case nsSM + " enabled":
+		nv = &smEnabled{}
+	case nsSM + " failed":
+		nv = &smFailed{}
+	case nsSM + " resumed":
+		nv = &smResumed{}
+	case nsSM + " r":
+		nv = &smRequest{}
+	case nsSM + " a":
+		nv = &smAnswer{}
 	case nsClient + " message":
 		nv = &clientMessage{}
 	case nsClient + " presence":
@@ -1116,14 +2163,23 @@ func next(p *xml.Decoder) (xml.Name, interface{}, error) {
 	case nsClient + " error":
 		nv = &clientError{}
 	default:
-		return xml.Name{}, nil, errors.New("unexpected XMPP message " +
-			se.Name.Space + " <" + se.Name.Local + "/>")
+		// An element of an extension we do not know: keep it rather than fail the stream.
+		var raw struct {
+			InnerXML string `xml:",innerxml"`
+		}
+		if err = p.DecodeElement(&raw, &se); err != nil {
+			return xml.Name{}, nil, err
+		}
+		return se.Name, &RawStanza{Name: se.Name, Attr: se.Attr, InnerXML: raw.InnerXML}, nil
 	}
 
 	// Unmarshal into that storage.
 	if err = p.DecodeElement(nv, &se); err != nil {
 		return xml.Name{}, nil, err
 	}
+	if e, ok := nv.(*streamError); ok {
+		return se.Name, nil, parseStreamError(e.InnerXML)
+	}
 
 	return se.Name, nv, err
 }
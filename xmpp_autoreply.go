@@ -0,0 +1,135 @@
+package xmpp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nsVersion = "jabber:iq:version"
+	nsTime    = "urn:xmpp:time"
+)
+
+// AutoReplyPolicy says whose version, time, last activity and ping queries the client
+// answers on its own.
+type AutoReplyPolicy int
+
+const (
+	// AutoReplyEveryone answers every query.
+	AutoReplyEveryone AutoReplyPolicy = iota
+	// AutoReplyContacts answers the JIDs on our roster and the ones of Options.AutoReplyAllow.
+	// The client learns the roster from GetRoster, GetRosterSince or Roster and keeps it
+	// up to date with roster pushes; until it is fetched, everybody but the allowed JIDs
+	// is a stranger.
+	AutoReplyContacts
+	// AutoReplyAllowed answers only the JIDs of Options.AutoReplyAllow.
+	AutoReplyAllowed
+)
+
+// mayAutoReply reports whether the policy lets us answer a query from the address from.
+// Our own account and our server are always answered, lest the server take us for dead.
+func (c *Client) mayAutoReply(from string) bool {
+	bare := strings.ToLower(strings.SplitN(from, "/", 2)[0])
+	if from == "" || bare == strings.ToLower(c.serverDomain()) || bare == strings.ToLower(strings.SplitN(c.JID(), "/", 2)[0]) {
+		return true
+	}
+	if c.autoReply == AutoReplyEveryone {
+		return true
+	}
+	domain := bare[strings.Index(bare, "@")+1:]
+	for _, allowed := range c.autoReplyAllow {
+		if allowed = strings.ToLower(allowed); allowed == bare || allowed == domain {
+			return true
+		}
+	}
+	if c.autoReply != AutoReplyContacts {
+		return false
+	}
+	c.rosterMutex.Lock()
+	defer c.rosterMutex.Unlock()
+	return c.contacts[bare]
+}
+
+// setContacts replaces the JIDs known to be on our roster.
+func (c *Client) setContacts(jids []string) {
+	c.rosterMutex.Lock()
+	defer c.rosterMutex.Unlock()
+	c.contacts = make(map[string]bool, len(jids))
+	for _, jid := range jids {
+		c.contacts[strings.ToLower(jid)] = true
+	}
+}
+
+// updateContact applies a roster push to the JIDs known to be on our roster.
+func (c *Client) updateContact(entry RosterEntry) {
+	c.rosterMutex.Lock()
+	defer c.rosterMutex.Unlock()
+	if c.contacts == nil {
+		c.contacts = make(map[string]bool)
+	}
+	if entry.Subscription == "remove" {
+		delete(c.contacts, strings.ToLower(entry.JID))
+	} else {
+		c.contacts[strings.ToLower(entry.JID)] = true
+	}
+}
+
+// handleAutoReply answers a software version query, xep-0092, an entity time query,
+// xep-0202, or a last activity query, xep-0012, addressed to us and reports whether iq
+// was one. A query the policy does not let us answer gets service-unavailable, as if
+// the client did not support it.
+func (c *Client) handleAutoReply(iq *clientIQ) (bool, error) {
+	if iq.Type != IQTypeGet || !c.isMe(iq.To) {
+		return false, nil
+	}
+	var query string
+	switch iq.Query.XMLName.Space {
+	case nsVersion:
+		query = "<query xmlns='" + nsVersion + "'><name>" + xmlEscape(c.software.name) + "</name>"
+		if c.software.version != "" {
+			query += "<version>" + xmlEscape(c.software.version) + "</version>"
+		}
+		if c.software.os != "" {
+			query += "<os>" + xmlEscape(c.software.os) + "</os>"
+		}
+		query += "</query>"
+	case nsTime:
+		now := time.Now()
+		query = "<time xmlns='" + nsTime + "'><tzo>" + now.Format("-07:00") + "</tzo>" +
+			"<utc>" + now.UTC().Format("2006-01-02T15:04:05Z") + "</utc></time>"
+	case nsLast:
+		query = "<query xmlns='" + nsLast + "' seconds='" + strconv.FormatInt(int64(c.idle()/time.Second), 10) + "'/>"
+	default:
+		return false, nil
+	}
+	if !c.mayAutoReply(iq.From) {
+		return true, c.refuseIQ(iq)
+	}
+	_, err := c.sendf("<iq type='result'%s id='%s'>%s</iq>", replyAttrs(iq), xmlEscape(iq.ID), query)
+	return true, err
+}
+
+// refuseIQ answers iq with service-unavailable.
+func (c *Client) refuseIQ(iq *clientIQ) error {
+	return c.replyIQError(iq, "cancel", "service-unavailable")
+}
+
+// replyIQError answers iq with an error of type errType and the stanza error condition.
+func (c *Client) replyIQError(iq *clientIQ, errType, condition string) error {
+	_, err := c.sendf("<iq type='error'%s id='%s'><error type='%s'><%s xmlns='%s'/></error></iq>",
+		replyAttrs(iq), xmlEscape(iq.ID), errType, condition, nsStanzas)
+	return err
+}
+
+// replyAttrs returns the from and to attributes of a reply to iq.
+func replyAttrs(iq *clientIQ) string {
+	var attrs string
+	if iq.To != "" {
+		attrs += " from='" + xmlEscape(iq.To) + "'"
+	}
+	if iq.From != "" {
+		attrs += " to='" + xmlEscape(iq.From) + "'"
+	}
+	return attrs
+}
@@ -1,11 +1,17 @@
 package xmpp
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"strconv"
 )
 
@@ -123,3 +129,48 @@ func (c *Client) AvatarRequestDataByID(jid, id string) {
 func (c *Client) AvatarRequestMetadata(jid string) {
 	c.PubsubRequestLastItems(XMPPNS_AVATAR_PEP_METADATA, jid)
 }
+
+// PublishAvatar publishes data, an image of type mimeType like "image/png", as our
+// avatar, xep-0084 4.1, and waits for the result. The data is published first, then
+// the metadata, whose notification tells our contacts to fetch the new avatar.
+// The width and height are given for PNG, JPEG and GIF images.
+func (c *Client) PublishAvatar(data []byte, mimeType string) error {
+	sum := sha1.Sum(data)
+	id := hex.EncodeToString(sum[:])
+	item := fmt.Sprintf("<data xmlns='%s'>%s</data>", XMPPNS_AVATAR_PEP_DATA, base64.StdEncoding.EncodeToString(data))
+	if _, err := c.sendIQ("", IQTypeSet, pubsubPublishStanza(XMPPNS_AVATAR_PEP_DATA, id, item)); err != nil {
+		return err
+	}
+
+	info := fmt.Sprintf("<info bytes='%d' id='%s' type='%s'", len(data), id, xmlEscape(mimeType))
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info += fmt.Sprintf(" width='%d' height='%d'", cfg.Width, cfg.Height)
+	}
+	item = fmt.Sprintf("<metadata xmlns='%s'>%s/></metadata>", XMPPNS_AVATAR_PEP_METADATA, info)
+	_, err := c.sendIQ("", IQTypeSet, pubsubPublishStanza(XMPPNS_AVATAR_PEP_METADATA, id, item))
+	return err
+}
+
+// GetAvatar fetches the avatar of jid with the id advertised in its AvatarMetadata,
+// xep-0084 4.2, and waits for it. The SHA-1 of the data must match id.
+// Recv returns the AvatarMetadata of our contacts' new avatars if they are subscribed
+// with AvatarSubscribeMetadata, or if AddFeature announced
+// XMPPNS_AVATAR_PEP_METADATA+"+notify" before sending presence.
+func (c *Client) GetAvatar(jid, id string) ([]byte, error) {
+	body := fmt.Sprintf("<items node='%s'><item id='%s'/></items>", XMPPNS_AVATAR_PEP_DATA, xmlEscape(id))
+	iq, err := c.sendIQ(jid, IQTypeGet, pubsubStanza(body))
+	if err != nil {
+		return nil, err
+	}
+	var p clientPubsubItems
+	if err = xml.Unmarshal([]byte(iq.Query.InnerXML), &p); err != nil {
+		return nil, err
+	}
+	for _, item := range p.Items {
+		if item.ID == id {
+			a, err := handleAvatarData(item.Body, jid, id)
+			return a.Data, err
+		}
+	}
+	return nil, errors.New("xmpp: avatar " + id + " not found")
+}
@@ -0,0 +1,131 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+const nsBlocking = "urn:xmpp:blocking"
+
+// xep-0191  Blocking Command
+type clientBlockItems struct {
+	XMLName xml.Name
+	Items   []clientBlockItem `xml:"item"`
+}
+
+type clientBlockItem struct {
+	JID string `xml:"jid,attr"`
+}
+
+// BlockList returns the JIDs on our block list. The first call fetches the list from
+// the server; later calls return a local copy that is kept up to date by the block and
+// unblock pushes the server sends when the list changes. The server's response is read
+// by Recv, which has to be running in another goroutine.
+func (c *Client) BlockList() ([]string, error) {
+	c.blockMutex.Lock()
+	for c.blockFetch != nil && !c.blockFetched {
+		// Wait for the fetch of another call, and fetch again if it failed.
+		fetch := c.blockFetch
+		c.blockMutex.Unlock()
+		<-fetch
+		c.blockMutex.Lock()
+	}
+	if c.blockFetched {
+		list := append([]string(nil), c.blocked...)
+		c.blockMutex.Unlock()
+		return list, nil
+	}
+	fetch := make(chan struct{})
+	c.blockFetch = fetch
+	c.blockMutex.Unlock()
+	defer close(fetch)
+
+	iq, err := c.sendIQ("", IQTypeGet, "<blocklist xmlns='"+nsBlocking+"'/>")
+	var items clientBlockItems
+	if err == nil {
+		err = iq.decodeQuery(&items)
+	}
+
+	c.blockMutex.Lock()
+	defer c.blockMutex.Unlock()
+	pushes := c.blockPushes
+	c.blockFetch, c.blockPushes = nil, nil
+	if err != nil {
+		return nil, err
+	}
+	c.blocked = nil
+	for _, item := range items.Items {
+		c.blocked = append(c.blocked, item.JID)
+	}
+	// Pushes received while the list was being fetched may or may not be reflected
+	// in it. Blocking and unblocking are idempotent, so simply apply them again.
+	for _, push := range pushes {
+		c.applyBlockPush(push)
+	}
+	c.blockFetched = true
+	return append([]string(nil), c.blocked...), nil
+}
+
+// handleBlockPush applies a block or unblock push from the server to the local block
+// list and acknowledges it. It reports whether iq was such a push.
+func (c *Client) handleBlockPush(iq *clientIQ) bool {
+	if iq.Type != IQTypeSet || iq.Query.XMLName.Space != nsBlocking {
+		return false
+	}
+	// Pushes only ever come from our own account.
+	if iq.From != "" && iq.From != strings.SplitN(c.JID(), "/", 2)[0] {
+		return false
+	}
+	var items clientBlockItems
+	if err := iq.decodeQuery(&items); err != nil {
+		return false
+	}
+
+	c.blockMutex.Lock()
+	switch {
+	case c.blockFetched:
+		c.applyBlockPush(items)
+	case c.blockFetch != nil:
+		c.blockPushes = append(c.blockPushes, items)
+	}
+	c.blockMutex.Unlock()
+
+	c.sendf("<iq type='result' id='%s'/>", xmlEscape(iq.ID))
+	return true
+}
+
+// applyBlockPush updates the local block list; c.blockMutex must be held.
+func (c *Client) applyBlockPush(items clientBlockItems) {
+	switch items.XMLName.Local {
+	case "block":
+		for _, item := range items.Items {
+			c.blocked = appendUnique(c.blocked, item.JID)
+		}
+	case "unblock":
+		if len(items.Items) == 0 {
+			// An empty unblock push means everybody was unblocked.
+			c.blocked = nil
+		}
+		for _, item := range items.Items {
+			c.blocked = removeString(c.blocked, item.JID)
+		}
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func removeString(list []string, s string) []string {
+	for i, v := range list {
+		if v == s {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
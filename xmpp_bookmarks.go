@@ -0,0 +1,169 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+const (
+	nsBookmarks        = "urn:xmpp:bookmarks:1"
+	nsPrivate          = "jabber:iq:private"
+	nsStorageBookmarks = "storage:bookmarks"
+)
+
+// Bookmark is a bookmarked room, xep-0402.
+type Bookmark struct {
+	JID      string
+	Name     string
+	Nick     string
+	Password string
+	Autojoin bool // whether to join the room on login
+}
+
+// clientConference is a bookmark in either format; the legacy one, xep-0048, has the JID
+// as an attribute, while the PEP one has it as the item id.
+type clientConference struct {
+	JID      string `xml:"jid,attr"`
+	Name     string `xml:"name,attr"`
+	Autojoin string `xml:"autojoin,attr"`
+	Nick     string `xml:"nick"`
+	Password string `xml:"password"`
+}
+
+func (b clientConference) bookmark(jid string) Bookmark {
+	return Bookmark{JID: jid, Name: b.Name, Nick: b.Nick, Password: b.Password, Autojoin: b.Autojoin == "true" || b.Autojoin == "1"}
+}
+
+// conferenceElement encodes b as a <conference/> element, in the PEP format or, if legacy
+// is set, in the one of the private storage, with the JID as an attribute.
+func conferenceElement(b Bookmark, legacy bool) string {
+	s := "<conference xmlns='" + nsBookmarks + "'"
+	if legacy {
+		s = "<conference jid='" + xmlEscape(b.JID) + "'"
+	}
+	if b.Name != "" {
+		s += " name='" + xmlEscape(b.Name) + "'"
+	}
+	s += fmt.Sprintf(" autojoin='%t'>", b.Autojoin)
+	if b.Nick != "" {
+		s += "<nick>" + xmlEscape(b.Nick) + "</nick>"
+	}
+	if b.Password != "" {
+		s += "<password>" + xmlEscape(b.Password) + "</password>"
+	}
+	return s + "</conference>"
+}
+
+// bookmarkPublishOptions keep the bookmarks private and make the node hold all of them,
+// xep-0402 5.
+const bookmarkPublishOptions = "<publish-options><x xmlns='jabber:x:data' type='submit'>" +
+	"<field var='FORM_TYPE' type='hidden'><value>http://jabber.org/protocol/pubsub#publish-options</value></field>" +
+	"<field var='pubsub#persist_items'><value>true</value></field>" +
+	"<field var='pubsub#max_items'><value>max</value></field>" +
+	"<field var='pubsub#send_last_published_item'><value>never</value></field>" +
+	"<field var='pubsub#access_model'><value>whitelist</value></field>" +
+	"</x></publish-options>"
+
+// GetBookmarks fetches our bookmarks from PEP, xep-0402, and falls back to the private
+// XML storage, xep-0048, if that fails, e.g. because the server does not support PEP.
+func (c *Client) GetBookmarks() ([]Bookmark, error) {
+	bookmarks, pepErr := c.pepBookmarks()
+	if pepErr == nil {
+		return bookmarks, nil
+	}
+	bookmarks, err := c.privateBookmarks()
+	if err != nil {
+		return nil, fmt.Errorf("xmpp: getting bookmarks failed with PEP (%v) and with private storage: %w", pepErr, err)
+	}
+	return bookmarks, nil
+}
+
+// SetBookmarks replaces our bookmarks with bookmarks, in PEP, xep-0402, or in the private
+// XML storage, xep-0048, if the server does not support PEP.
+func (c *Client) SetBookmarks(bookmarks []Bookmark) error {
+	old, pepErr := c.pepBookmarks()
+	if pepErr == nil {
+		pepErr = c.publishBookmarks(old, bookmarks)
+	}
+	if pepErr == nil {
+		return nil
+	}
+	storage := "<storage xmlns='" + nsStorageBookmarks + "'>"
+	for _, b := range bookmarks {
+		storage += conferenceElement(b, true)
+	}
+	err := c.PrivateStorageSet(storage + "</storage>")
+	if err != nil {
+		return fmt.Errorf("xmpp: setting bookmarks failed with PEP (%v) and with private storage: %w", pepErr, err)
+	}
+	return nil
+}
+
+// pepBookmarks fetches the bookmarks from PEP. A missing node holds no bookmarks.
+func (c *Client) pepBookmarks() ([]Bookmark, error) {
+	items, err := c.PubsubGetItems(nsBookmarks, "")
+	var se *StanzaError
+	if errors.As(err, &se) && se.Condition == "item-not-found" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bookmarks []Bookmark
+	for _, item := range items {
+		var b clientConference
+		if err := xml.Unmarshal(item.InnerXML, &b); err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, b.bookmark(item.ID))
+	}
+	return bookmarks, nil
+}
+
+// publishBookmarks publishes bookmarks to PEP, one item per room, and retracts the
+// ones of old that are gone.
+func (c *Client) publishBookmarks(old, bookmarks []Bookmark) error {
+	keep := make(map[string]bool)
+	for _, b := range bookmarks {
+		keep[b.JID] = true
+		body := fmt.Sprintf("<publish node='%s'><item id='%s'>%s</item></publish>%s",
+			nsBookmarks, xmlEscape(b.JID), conferenceElement(b, false), bookmarkPublishOptions)
+		if _, err := c.sendIQ("", IQTypeSet, pubsubStanza(body)); err != nil {
+			return err
+		}
+	}
+	for _, b := range old {
+		if keep[b.JID] {
+			continue
+		}
+		body := fmt.Sprintf("<retract node='%s' notify='true'><item id='%s'/></retract>", nsBookmarks, xmlEscape(b.JID))
+		if _, err := c.sendIQ("", IQTypeSet, pubsubStanza(body)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// privateBookmarks fetches the bookmarks from the private XML storage.
+func (c *Client) privateBookmarks() ([]Bookmark, error) {
+	data, err := c.PrivateStorageGet(nsStorageBookmarks, "storage")
+	if err == ErrPrivateStorageNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var storage struct {
+		XMLName     xml.Name           `xml:"storage:bookmarks storage"`
+		Conferences []clientConference `xml:"conference"`
+	}
+	if err = xml.Unmarshal(data, &storage); err != nil {
+		return nil, err
+	}
+	var bookmarks []Bookmark
+	for _, b := range storage.Conferences {
+		bookmarks = append(bookmarks, b.bookmark(b.JID))
+	}
+	return bookmarks, nil
+}
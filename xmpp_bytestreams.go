@@ -0,0 +1,246 @@
+package xmpp
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const nsBytestreams = "http://jabber.org/protocol/bytestreams"
+
+// Streamhost is a host relaying SOCKS5 bytestreams, xep-0065, like a proxy of our server.
+type Streamhost struct {
+	JID  string
+	Host string
+	Port int
+}
+
+// S5BRequest is returned from Recv when From wants to open a SOCKS5 bytestream to us,
+// xep-0065 5.3.1, through one of Streamhosts. Answer it with AcceptS5B or RejectS5B.
+type S5BRequest struct {
+	From        string
+	SID         string
+	Streamhosts []Streamhost
+
+	iq *clientIQ
+}
+
+// xep-0065  SOCKS5 Bytestreams
+type clientBytestreams struct {
+	XMLName     xml.Name `xml:"http://jabber.org/protocol/bytestreams query"`
+	SID         string   `xml:"sid,attr"`
+	Mode        string   `xml:"mode,attr"`
+	Streamhosts []struct {
+		JID  string `xml:"jid,attr"`
+		Host string `xml:"host,attr"`
+		Port int    `xml:"port,attr"`
+	} `xml:"streamhost"`
+	Used *struct {
+		JID string `xml:"jid,attr"`
+	} `xml:"streamhost-used"`
+}
+
+func (q *clientBytestreams) streamhosts() []Streamhost {
+	var hosts []Streamhost
+	for _, h := range q.Streamhosts {
+		if h.Port == 0 {
+			h.Port = 1080
+		}
+		hosts = append(hosts, Streamhost{JID: h.JID, Host: h.Host, Port: h.Port})
+	}
+	return hosts
+}
+
+// RequestStreamhosts returns the streamhosts of the SOCKS5 bytestream proxies among the
+// items of our server, xep-0065 4, to be offered with OfferS5B.
+func (c *Client) RequestStreamhosts() ([]Streamhost, error) {
+	items, err := c.DiscoItems(c.serverDomain())
+	if err != nil {
+		return nil, err
+	}
+	var hosts []Streamhost
+	for _, item := range items {
+		info, err := c.DiscoInfo(item.JID)
+		if err != nil || !info.HasIdentity("proxy", "bytestreams") {
+			continue
+		}
+		iq, err := c.sendIQ(item.JID, IQTypeGet, "<query xmlns='"+nsBytestreams+"'/>")
+		if err != nil {
+			continue
+		}
+		var q clientBytestreams
+		if err := iq.decodeQuery(&q); err == nil {
+			hosts = append(hosts, q.streamhosts()...)
+		}
+	}
+	return hosts, nil
+}
+
+// OfferS5B offers the entity with the full JID to a SOCKS5 bytestream with the id sid
+// through one of hosts, which have to be proxies like the ones RequestStreamhosts
+// returns, and waits for it to connect, xep-0065 6. It then connects to the same proxy,
+// asks the proxy to activate the bytestream and returns the connection. If to could not
+// connect to any of hosts, the IQ error is returned; OpenIBB may still work.
+func (c *Client) OfferS5B(ctx context.Context, to, sid string, hosts []Streamhost) (net.Conn, error) {
+	body := "<query xmlns='" + nsBytestreams + "' sid='" + xmlEscape(sid) + "' mode='tcp'>"
+	for _, h := range hosts {
+		body += "<streamhost jid='" + xmlEscape(h.JID) + "' host='" + xmlEscape(h.Host) + "' port='" + strconv.Itoa(h.Port) + "'/>"
+	}
+	iq, err := c.sendIQContext(ctx, to, IQTypeSet, body+"</query>")
+	if err != nil {
+		return nil, err
+	}
+	var q clientBytestreams
+	if err := iq.decodeQuery(&q); err != nil {
+		return nil, err
+	}
+	var host *Streamhost
+	for i := range hosts {
+		if q.Used != nil && hosts[i].JID == q.Used.JID {
+			host = &hosts[i]
+		}
+	}
+	if host == nil {
+		return nil, errors.New("xmpp: SOCKS5 bytestream target used a streamhost not offered")
+	}
+	conn, err := c.connectStreamhost(ctx, *host, sid, c.JID(), to)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.sendIQContext(ctx, host.JID, IQTypeSet, "<query xmlns='"+nsBytestreams+"' sid='"+xmlEscape(sid)+"'>"+
+		"<activate>"+xmlEscape(to)+"</activate></query>")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// AcceptS5B connects to the first of the streamhosts of r it can reach, xep-0065 5.3.2,
+// tells the requester which one and returns the connection. If it reaches none, it
+// tells the requester, which may fall back to OpenIBB, and returns the last error.
+func (c *Client) AcceptS5B(ctx context.Context, r S5BRequest) (net.Conn, error) {
+	err := errors.New("xmpp: SOCKS5 bytestream request without streamhosts")
+	for _, h := range r.Streamhosts {
+		var conn net.Conn
+		if conn, err = c.connectStreamhost(ctx, h, r.SID, r.From, c.JID()); err != nil {
+			continue
+		}
+		_, err = c.sendf("<iq type='result'%s id='%s'><query xmlns='%s' sid='%s'><streamhost-used jid='%s'/></query></iq>",
+			replyAttrs(r.iq), xmlEscape(r.iq.ID), nsBytestreams, xmlEscape(r.SID), xmlEscape(h.JID))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	c.replyIQError(r.iq, "cancel", "item-not-found")
+	return nil, err
+}
+
+// RejectS5B declines the bytestream r.
+func (c *Client) RejectS5B(r S5BRequest) error {
+	return c.replyIQError(r.iq, "cancel", "not-acceptable")
+}
+
+// OpenBytestream opens a bytestream with the id sid to the entity with the full JID to
+// for writing: a SOCKS5 bytestream through one of hosts, see OfferS5B, or, if there are
+// none or to reaches none of them, an in-band bytestream with blocks of blockSize bytes,
+// see OpenIBB.
+func (c *Client) OpenBytestream(ctx context.Context, to, sid string, hosts []Streamhost, blockSize int) (io.WriteCloser, error) {
+	if len(hosts) > 0 {
+		conn, err := c.OfferS5B(ctx, to, sid, hosts)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return c.OpenIBB(to, sid, blockSize)
+}
+
+// handleS5B returns the S5BRequest for a SOCKS5 bytestream request and reports whether
+// iq was one.
+func (c *Client) handleS5B(iq *clientIQ) (*S5BRequest, bool, error) {
+	if iq.Type != IQTypeSet || iq.Query.XMLName.Space != nsBytestreams {
+		return nil, false, nil
+	}
+	var q clientBytestreams
+	if err := iq.decodeQuery(&q); err != nil || q.SID == "" || len(q.Streamhosts) == 0 {
+		return nil, true, c.replyIQError(iq, "modify", "bad-request")
+	}
+	if q.Mode == "udp" {
+		return nil, true, c.replyIQError(iq, "cancel", "feature-not-implemented")
+	}
+	return &S5BRequest{From: iq.From, SID: q.SID, Streamhosts: q.streamhosts(), iq: iq}, true, nil
+}
+
+// connectStreamhost connects to the streamhost h for the bytestream sid from requester
+// to target, xep-0065 5.3.2.
+func (c *Client) connectStreamhost(ctx context.Context, h Streamhost, sid, requester, target string) (net.Conn, error) {
+	d := c.dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(h.Host, strconv.Itoa(h.Port)))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(sid + requester + target))
+	n := watchContext(ctx, conn)
+	err = socks5Connect(conn, hex.EncodeToString(sum[:]))
+	if cerr := n.stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("xmpp: SOCKS5 streamhost %s: %w", h.JID, err)
+	}
+	return conn, nil
+}
+
+// socks5Connect asks the SOCKS5 server conn is connected to for a connection to the
+// domain addr, port 0, without authentication, RFC 1928.
+func socks5Connect(conn net.Conn, addr string) error {
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return err
+	}
+	var b [5]byte
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != 5 || b[1] != 0 {
+		return errors.New("authentication refused")
+	}
+	req := append([]byte{5, 1, 0, 3, byte(len(addr))}, addr...)
+	if _, err := conn.Write(append(req, 0, 0)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:5]); err != nil {
+		return err
+	}
+	if b[0] != 5 || b[1] != 0 {
+		return fmt.Errorf("connection refused with code %d", b[1])
+	}
+	// Skip the bound address and port.
+	var rest int
+	switch b[3] {
+	case 1:
+		rest = 4 - 1 + 2
+	case 3:
+		rest = int(b[4]) + 2
+	case 4:
+		rest = 16 - 1 + 2
+	default:
+		return fmt.Errorf("unknown address type %d", b[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, rest))
+	return err
+}
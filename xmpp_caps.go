@@ -0,0 +1,48 @@
+package xmpp
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"sort"
+)
+
+const nsCaps = "http://jabber.org/protocol/caps"
+
+// capsVer computes the verification string of entity capabilities, xep-0115 5.1,
+// hashed with sha-1.
+func capsVer(identities []DiscoIdentity, features []string) string {
+	ids := make([]string, len(identities))
+	for i, id := range identities {
+		ids[i] = id.Category + "/" + id.Type + "/" + id.Lang + "/" + id.Name
+	}
+	sort.Strings(ids)
+	fs := append([]string(nil), features...)
+	// Sort before appending "<", which sorts after "+" and would put "mood+notify"
+	// before "mood".
+	sort.Strings(fs)
+	var s string
+	for _, v := range append(ids, fs...) {
+		s += v + "<"
+	}
+	sum := sha1.Sum([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// AddFeature registers a feature the client supports, like "urn:xmpp:receipts", for the
+// entity capabilities and the replies to disco#info queries, see Options.CapsNode.
+// Contacts learn about features added later when presence is sent again.
+func (c *Client) AddFeature(ns string) {
+	c.discoMutex.Lock()
+	defer c.discoMutex.Unlock()
+	c.features = appendUnique(c.features, ns)
+}
+
+// capsElement returns the element advertising our entity capabilities in presence,
+// xep-0115 4, or "" if Options.CapsNode is not set.
+func (c *Client) capsElement() string {
+	if c.capsNode == "" {
+		return ""
+	}
+	ver := capsVer([]DiscoIdentity{defaultIdentity}, c.discoFeatures())
+	return "<c xmlns='" + nsCaps + "' hash='sha-1' node='" + xmlEscape(c.capsNode) + "' ver='" + ver + "'/>"
+}
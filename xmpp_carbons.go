@@ -0,0 +1,57 @@
+package xmpp
+
+import "strings"
+
+const nsCarbons = "urn:xmpp:carbons:2"
+
+// Values of Chat.Carbon.
+const (
+	CarbonSent     = "sent"
+	CarbonReceived = "received"
+)
+
+// EnableCarbons asks the server to copy the messages our other resources send and
+// receive to us, xep-0280 4, and waits for the result. Recv returns the copies with
+// Chat.Carbon set.
+func (c *Client) EnableCarbons() error {
+	_, err := c.sendIQ("", IQTypeSet, "<enable xmlns='"+nsCarbons+"'/>")
+	return err
+}
+
+// DisableCarbons stops the copies requested with EnableCarbons, xep-0280 5.
+func (c *Client) DisableCarbons() error {
+	_, err := c.sendIQ("", IQTypeSet, "<disable xmlns='"+nsCarbons+"'/>")
+	return err
+}
+
+// XEP-0280  Message Carbons
+type clientCarbon struct {
+	Forwarded *clientForwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// carbon unwraps the message carried by a carbon copy and reports whether it should be
+// returned from Recv. Carbons not sent by our own account, which would allow others to
+// forge messages, copies of messages sent by this resource and duplicates, see
+// Options.DedupMessages, are dropped.
+func (c *Client) carbon(m *clientMessage) (Chat, bool) {
+	kind, wrapper := CarbonReceived, m.CarbonReceived
+	if m.CarbonSent != nil {
+		kind, wrapper = CarbonSent, m.CarbonSent
+	}
+	jid := c.JID()
+	bare := strings.SplitN(jid, "/", 2)[0]
+	if m.From != "" && !strings.EqualFold(m.From, bare) {
+		return Chat{}, false
+	}
+	fw := wrapper.Forwarded
+	if fw == nil || fw.Message == nil || fw.Message.From == jid || c.duplicate(fw.Message) {
+		return Chat{}, false
+	}
+	chat := fw.Message.chat()
+	if kind == CarbonSent {
+		// The other party of a message we sent is its recipient.
+		chat.Remote = fw.Message.To
+	}
+	chat.Carbon = kind
+	return chat, true
+}
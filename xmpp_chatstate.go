@@ -0,0 +1,43 @@
+package xmpp
+
+import "errors"
+
+const nsChatStates = "http://jabber.org/protocol/chatstates"
+
+// Chat states, xep-0085 2.
+const (
+	ChatStateActive    = "active"
+	ChatStateComposing = "composing"
+	ChatStatePaused    = "paused"
+	ChatStateInactive  = "inactive"
+	ChatStateGone      = "gone"
+)
+
+// SendChatState sends a chat state notification without a body, like ChatStateComposing
+// when the user starts typing, xep-0085 5, and returns the id of the message.
+func (c *Client) SendChatState(to, state string) (id string, err error) {
+	if !isChatState(state) {
+		return "", errors.New("xmpp: unknown chat state " + state)
+	}
+	id = NewID()
+	_, err = c.Send(Chat{Remote: to, Type: "chat", ID: id, ChatState: state})
+	return id, err
+}
+
+func isChatState(state string) bool {
+	switch state {
+	case ChatStateActive, ChatStateComposing, ChatStatePaused, ChatStateInactive, ChatStateGone:
+		return true
+	}
+	return false
+}
+
+// chatState returns the chat state notification among the extension elements of a message.
+func chatState(elems []XMLElement) string {
+	for _, e := range elems {
+		if e.XMLName.Space == nsChatStates && isChatState(e.XMLName.Local) {
+			return e.XMLName.Local
+		}
+	}
+	return ""
+}
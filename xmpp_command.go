@@ -0,0 +1,163 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+const nsCommands = "http://jabber.org/protocol/commands"
+
+// Statuses of an ad-hoc command session, xep-0050 6.
+const (
+	CommandExecuting = "executing"
+	CommandCompleted = "completed"
+	CommandCanceled  = "canceled"
+)
+
+// Actions advancing an ad-hoc command session, xep-0050 6.
+const (
+	CommandExecute  = "execute"
+	CommandNext     = "next"
+	CommandPrev     = "prev"
+	CommandComplete = "complete"
+	CommandCancel   = "cancel"
+)
+
+// CommandNote is a note the responder attached to a stage of a command.
+type CommandNote struct {
+	Type string // info, warn, or error
+	Text string
+}
+
+// CommandSession is an ad-hoc command being executed, xep-0050, as of its last stage.
+type CommandSession struct {
+	To        string
+	Node      string
+	SessionID string
+	Status    string // CommandExecuting, CommandCompleted, or CommandCanceled
+	// Actions are the actions the current stage allows besides cancel, like
+	// CommandNext; Execute is the one CommandExecute stands for.
+	Actions []string
+	Execute string
+	Form    *DataForm // form to fill out, or the result of a completed command
+	Notes   []CommandNote
+
+	c *Client
+}
+
+type clientCommand struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/commands command"`
+	Node      string   `xml:"node,attr"`
+	SessionID string   `xml:"sessionid,attr"`
+	Status    string   `xml:"status,attr"`
+	Actions   *struct {
+		Execute string    `xml:"execute,attr"`
+		Next    *struct{} `xml:"next"`
+		Prev    *struct{} `xml:"prev"`
+		Final   *struct{} `xml:"complete"`
+	} `xml:"actions"`
+	Form  *DataForm `xml:"jabber:x:data x"`
+	Notes []struct {
+		Type string `xml:"type,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"note"`
+}
+
+// Commands lists the ad-hoc commands the entity to offers, xep-0050 2.
+// The Node of an item is the node to pass to ExecuteCommand.
+func (c *Client) Commands(to string) ([]DiscoItem, error) {
+	return c.discoItems(to, nsCommands)
+}
+
+// ExecuteCommand starts the ad-hoc command node of the entity to, xep-0050 3, and waits
+// for the first stage, usually a form to fill out and Submit.
+func (c *Client) ExecuteCommand(to, node string) (*CommandSession, error) {
+	s := &CommandSession{To: to, Node: node, c: c}
+	if err := s.send(CommandExecute, ""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Submit submits form, which may be nil, with the default action of the current stage
+// and waits for the next stage. form is usually Form filled out with DataForm.Set.
+func (s *CommandSession) Submit(form *DataForm) error {
+	return s.Action(CommandExecute, form)
+}
+
+// Action advances the command with action, one of Actions, CommandExecute or
+// CommandCancel, submitting form, which may be nil, and waits for the next stage.
+func (s *CommandSession) Action(action string, form *DataForm) error {
+	if s.Status != CommandExecuting {
+		return fmt.Errorf("xmpp: command %s is %s", s.Node, s.Status)
+	}
+	if !s.allows(action) {
+		return fmt.Errorf("xmpp: command %s does not allow %s now", s.Node, action)
+	}
+	var payload string
+	if form != nil {
+		b, err := xml.Marshal(form.Submit())
+		if err != nil {
+			return err
+		}
+		payload = string(b)
+	}
+	return s.send(action, payload)
+}
+
+// Cancel cancels the command.
+func (s *CommandSession) Cancel() error {
+	return s.Action(CommandCancel, nil)
+}
+
+func (s *CommandSession) allows(action string) bool {
+	if action == CommandExecute || action == CommandCancel {
+		return true
+	}
+	for _, a := range s.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a stage of the command and updates s with the response.
+func (s *CommandSession) send(action, payload string) error {
+	attrs := "node='" + xmlEscape(s.Node) + "'"
+	if s.SessionID != "" {
+		attrs += " sessionid='" + xmlEscape(s.SessionID) + "'"
+	}
+	iq, err := s.c.sendIQ(s.To, IQTypeSet, "<command xmlns='"+nsCommands+"' "+attrs+" action='"+action+"'>"+payload+"</command>")
+	if err != nil {
+		return err
+	}
+	var cmd clientCommand
+	if err = iq.decodeQuery(&cmd); err != nil {
+		return err
+	}
+	if cmd.Status == "" {
+		return errors.New("xmpp: command response lacks a status")
+	}
+	s.SessionID = cmd.SessionID
+	s.Status = cmd.Status
+	s.Form = cmd.Form
+	s.Actions, s.Execute, s.Notes = nil, "", nil
+	if a := cmd.Actions; a != nil {
+		if a.Prev != nil {
+			s.Actions = append(s.Actions, CommandPrev)
+		}
+		if a.Next != nil {
+			s.Actions = append(s.Actions, CommandNext)
+		}
+		if a.Final != nil {
+			s.Actions = append(s.Actions, CommandComplete)
+		}
+		s.Execute = a.Execute
+	}
+	for _, n := range cmd.Notes {
+		s.Notes = append(s.Notes, CommandNote{Type: n.Type, Text: n.Text})
+	}
+	return nil
+}
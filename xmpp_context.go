@@ -0,0 +1,111 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, which makes blocked reads and writes fail at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// negotiation aborts the reads and writes on a connection once its context is done.
+// A nil negotiation never aborts anything.
+type negotiation struct {
+	ctx   context.Context
+	conn  net.Conn
+	stopc chan struct{}
+
+	mu      sync.Mutex
+	done    bool // whether the connection was aborted
+	stopped bool
+}
+
+// watchContext aborts the reads and writes on conn once ctx is done, until stop is called.
+func watchContext(ctx context.Context, conn net.Conn) *negotiation {
+	if ctx.Done() == nil {
+		return nil
+	}
+	n := &negotiation{ctx: ctx, conn: conn, stopc: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			if !n.stopped {
+				n.done = true
+				conn.SetDeadline(aLongTimeAgo)
+			}
+			n.mu.Unlock()
+		case <-n.stopc:
+		}
+	}()
+	return n
+}
+
+// stop stops watching the context. It returns the context's error if the connection
+// was aborted, and nil otherwise.
+func (n *negotiation) stop() error {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.stopped {
+		n.stopped = true
+		close(n.stopc)
+	}
+	if n.done {
+		return n.ctx.Err()
+	}
+	return nil
+}
+
+// setReadDeadline limits the time the next read on conn may take to timeout, if positive,
+// unless the connection was aborted already.
+func (n *negotiation) setReadDeadline(conn net.Conn, timeout time.Duration) {
+	if n != nil {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.done {
+			return
+		}
+	}
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// SetRecvTimeout makes Recv fail if nothing is received from the server for d, as on a
+// connection that died without being closed; zero, the default, waits forever. The
+// stream cannot be used after such a timeout: Recv reconnects if Options.AutoReconnect
+// is set, and the client should be closed otherwise. Pings, see PingC2S, keep a healthy
+// but quiet connection from timing out.
+func (c *Client) SetRecvTimeout(d time.Duration) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	c.recvTimeout = d
+}
+
+// armRecvTimeout sets the read deadline for the next stanza Recv reads and returns the
+// timeout, or clears the deadline if there is none any longer.
+func (c *Client) armRecvTimeout() time.Duration {
+	c.sendMutex.Lock()
+	d, conn := c.recvTimeout, c.conn
+	c.sendMutex.Unlock()
+	switch {
+	case d > 0:
+		conn.SetReadDeadline(time.Now().Add(d))
+		c.recvDeadline = true
+	case c.recvDeadline:
+		conn.SetReadDeadline(time.Time{})
+		c.recvDeadline = false
+	}
+	return d
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
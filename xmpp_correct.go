@@ -0,0 +1,19 @@
+package xmpp
+
+import "strings"
+
+const nsCorrect = "urn:xmpp:message-correct:0"
+
+// Corrects reports whether the message is a correction, xep-0308, of the earlier message
+// received: its ReplaceID is the id of earlier and both come from the same sender,
+// the same occupant for a groupchat message or the same bare JID otherwise. Any other
+// correction must not replace the earlier message.
+func (c Chat) Corrects(earlier Chat) bool {
+	if c.ReplaceID == "" || c.ReplaceID != earlier.ID {
+		return false
+	}
+	if c.Type == "groupchat" {
+		return c.Remote == earlier.Remote
+	}
+	return strings.EqualFold(strings.SplitN(c.Remote, "/", 2)[0], strings.SplitN(earlier.Remote, "/", 2)[0])
+}
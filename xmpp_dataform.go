@@ -0,0 +1,153 @@
+package xmpp
+
+import (
+	"encoding/xml"
+)
+
+// DataForm is a XEP-0004 data form.
+type DataForm struct {
+	XMLName      xml.Name        `xml:"jabber:x:data x"`
+	Type         string          `xml:"type,attr"` // cancel, form, result, or submit
+	Title        string          `xml:"title,omitempty"`
+	Instructions []string        `xml:"instructions"`
+	Fields       []DataFormField `xml:"field"`
+	// Reported and Items are the columns and the rows of a form of type result
+	// carrying several items, xep-0004 3.4.
+	Reported *DataFormItem  `xml:"reported"`
+	Items    []DataFormItem `xml:"item"`
+}
+
+// DataFormItem is an item of a result form, or the fields it reports.
+type DataFormItem struct {
+	Fields []DataFormField `xml:"field"`
+}
+
+// DataFormField is a single field of a data form.
+type DataFormField struct {
+	Var      string           `xml:"var,attr,omitempty"`
+	Type     string           `xml:"type,attr,omitempty"` // e.g. text-single, list-multi, or hidden
+	Label    string           `xml:"label,attr,omitempty"`
+	Desc     string           `xml:"desc,omitempty"`
+	Required bool             `xml:"-"`
+	Values   []string         `xml:"value"`
+	Options  []DataFormOption `xml:"option"` // choices of a list field
+}
+
+// DataFormOption is an option of a list-single or list-multi field.
+type DataFormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// xmlDataFormField is the XML encoding of a DataFormField; <required/> has no value.
+type xmlDataFormField struct {
+	Var      string           `xml:"var,attr,omitempty"`
+	Type     string           `xml:"type,attr,omitempty"`
+	Label    string           `xml:"label,attr,omitempty"`
+	Desc     string           `xml:"desc,omitempty"`
+	Required *struct{}        `xml:"required"`
+	Values   []string         `xml:"value"`
+	Options  []DataFormOption `xml:"option"`
+}
+
+// MarshalXML encodes Required as the empty <required/> element.
+func (f DataFormField) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := xmlDataFormField{Var: f.Var, Type: f.Type, Label: f.Label, Desc: f.Desc, Values: f.Values, Options: f.Options}
+	if f.Required {
+		v.Required = &struct{}{}
+	}
+	start.Name.Local = "field"
+	return e.EncodeElement(v, start)
+}
+
+// UnmarshalXML sets Required if the field has a <required/> element.
+func (f *DataFormField) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v xmlDataFormField
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*f = DataFormField{Var: v.Var, Type: v.Type, Label: v.Label, Desc: v.Desc, Required: v.Required != nil, Values: v.Values, Options: v.Options}
+	return nil
+}
+
+// ParseDataForm parses a <x xmlns='jabber:x:data'/> element.
+func ParseDataForm(data []byte) (*DataForm, error) {
+	f := &DataForm{}
+	if err := xml.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Field returns the field named name, or nil if the form has none.
+func (f *DataForm) Field(name string) *DataFormField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == name {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of the field named name, if any.
+func (f *DataForm) Value(name string) string {
+	if field := f.Field(name); field != nil && len(field.Values) > 0 {
+		return field.Values[0]
+	}
+	return ""
+}
+
+// Set sets the values of the field named name, adding the field if the form has none.
+func (f *DataForm) Set(name string, values ...string) {
+	if field := f.Field(name); field != nil {
+		field.Values = values
+		return
+	}
+	f.Fields = append(f.Fields, DataFormField{Var: name, Values: values})
+}
+
+// Submit returns the form of type submit answering f, a form of type form: the values
+// of its fields, leaving out the fixed ones, xep-0004 3.3. Fill out f with Set first.
+func (f *DataForm) Submit() *DataForm {
+	s := &DataForm{Type: "submit"}
+	for _, field := range f.Fields {
+		if field.Var == "" || field.Type == "fixed" {
+			continue
+		}
+		s.Fields = append(s.Fields, DataFormField{Var: field.Var, Values: field.Values})
+	}
+	return s
+}
+
+// Missing returns the names of the required fields that have no value.
+func (f *DataForm) Missing() []string {
+	var names []string
+	for _, field := range f.Fields {
+		if field.Required && len(field.Values) == 0 {
+			names = append(names, field.Var)
+		}
+	}
+	return names
+}
+
+// FormType returns the value of the hidden FORM_TYPE field of the form, if any.
+func (f *DataForm) FormType() string {
+	for _, field := range f.Fields {
+		if field.Var == "FORM_TYPE" && len(field.Values) > 0 {
+			return field.Values[0]
+		}
+	}
+	return ""
+}
+
+// submitForm encodes form.Submit() carrying the given FORM_TYPE, unless form has one.
+func submitForm(form *DataForm, formType string) (string, error) {
+	f := form.Submit()
+	if field := f.Field("FORM_TYPE"); field != nil {
+		field.Type = "hidden"
+	} else {
+		f.Fields = append([]DataFormField{{Var: "FORM_TYPE", Type: "hidden", Values: []string{formType}}}, f.Fields...)
+	}
+	b, err := xml.Marshal(f)
+	return string(b), err
+}
@@ -0,0 +1,80 @@
+package xmpp
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// dedupWindow is the number of messages whose ids are remembered, see Options.DedupMessages.
+const dedupWindow = 1000
+
+// dedup remembers the ids of the messages delivered last, least recently seen first out.
+type dedup struct {
+	mu    sync.Mutex
+	size  int
+	keys  map[string]*list.Element
+	order *list.List // of keys, most recently seen first
+}
+
+func newDedup(size int) *dedup {
+	return &dedup{size: size, keys: make(map[string]*list.Element), order: list.New()}
+}
+
+// seen reports whether a message with any of keys was delivered before, and remembers
+// keys for the messages to come.
+func (d *dedup) seen(keys []string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dup := false
+	for _, k := range keys {
+		_, ok := d.keys[k]
+		dup = dup || ok
+	}
+	for _, k := range keys {
+		if e, ok := d.keys[k]; ok {
+			d.order.MoveToFront(e)
+			continue
+		}
+		d.keys[k] = d.order.PushFront(k)
+		if d.order.Len() > d.size {
+			delete(d.keys, d.order.Remove(d.order.Back()).(string))
+		}
+	}
+	return dup
+}
+
+// dedupKeys returns the keys a message is known by: the stanza ids we trust, xep-0359
+// 3.1, which are the archive ids as well, and the origin-id its sender gave it, 3.2.
+func (m *clientMessage) dedupKeys() []string {
+	var keys []string
+	for _, id := range m.stanzaIDs() {
+		keys = append(keys, "sid "+strings.ToLower(id.By)+" "+id.ID)
+	}
+	if id := m.originID(); id != "" {
+		keys = append(keys, "oid "+strings.ToLower(m.From)+" "+id)
+	}
+	return keys
+}
+
+// duplicate reports whether Recv delivered m already, directly or as a carbon, or
+// QueryMAM returned it, if Options.DedupMessages is set.
+func (c *Client) duplicate(m *clientMessage) bool {
+	if c.dedup == nil || m.Type == "error" {
+		return false
+	}
+	return c.dedup.seen(m.dedupKeys())
+}
+
+// duplicateArchived is duplicate for a message with archive id found in the archive
+// of archive.
+func (c *Client) duplicateArchived(archive, id string, m *clientMessage) bool {
+	if c.dedup == nil {
+		return false
+	}
+	keys := m.dedupKeys()
+	if id != "" {
+		keys = append(keys, "sid "+strings.ToLower(archive)+" "+id)
+	}
+	return c.dedup.seen(keys)
+}
@@ -0,0 +1,40 @@
+package xmpp
+
+import "time"
+
+const (
+	nsDelay       = "urn:xmpp:delay"
+	nsLegacyDelay = "jabber:x:delay"
+)
+
+// Delay is a delayed delivery element, xep-0203, or its legacy form, xep-0091.
+type Delay struct {
+	Stamp string `xml:"stamp,attr"`
+	From  string `xml:"from,attr"` // who delayed the stanza, e.g. our server for offline messages
+}
+
+// time returns the time the stanza was originally sent. The legacy form is in UTC
+// without separators, like "20020910T23:08:25".
+func (d *Delay) time() (time.Time, bool) {
+	if d == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, d.Stamp)
+	if err != nil {
+		if t, err = time.Parse("20060102T15:04:05", d.Stamp); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return t, true
+}
+
+// delay returns the time the message was originally sent, whether its delivery was
+// delayed, e.g. because we were offline, and by whom.
+func (m *clientMessage) delay() (time.Time, bool, string) {
+	for _, d := range []*Delay{m.Delay, m.LegacyDelay} {
+		if t, ok := d.time(); ok {
+			return t, true, d.From
+		}
+	}
+	return time.Time{}, false, ""
+}
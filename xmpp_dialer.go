@@ -0,0 +1,125 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Dialer dials the connection to the server; see Options.Dialer. *net.Dialer and the
+// proxy.ContextDialer implementations of golang.org/x/net/proxy, like its SOCKS5 dialer,
+// satisfy it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialerFunc lets an ordinary function dial the connection to the server.
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext calls f(ctx, network, addr).
+func (f DialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// HTTPConnectDialer dials through an HTTP proxy, tunneling the connection with the
+// CONNECT method. Without Options.Dialer, the client uses one for the proxy of the
+// HTTP_PROXY environment variable, unless NO_PROXY exempts the server.
+type HTTPConnectDialer struct {
+	// Proxy is the address of the proxy, as "hostname:port".
+	Proxy string
+	// User, if set, authenticates with the proxy using Basic authentication.
+	User *url.Userinfo
+	// Forward dials the connection to the proxy; a net.Dialer if nil.
+	Forward Dialer
+}
+
+// DialContext connects to addr through the proxy.
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	c, err := forward.DialContext(ctx, network, d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	n := watchContext(ctx, c)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\n", addr)
+	fmt.Fprintf(c, "Host: %s\r\n", addr)
+	if d.User != nil {
+		password, _ := d.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(d.User.Username() + ":" + password))
+		fmt.Fprintf(c, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	fmt.Fprintf(c, "\r\n")
+	br := bufio.NewReader(c)
+	req, _ := http.NewRequest("CONNECT", addr, nil)
+	resp, err := http.ReadResponse(br, req)
+	if cerr := n.stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		c.Close()
+		f := strings.SplitN(resp.Status, " ", 2)
+		return nil, errors.New(f[len(f)-1])
+	}
+	return c, nil
+}
+
+// dialer returns the Dialer connecting to addr: Options.Dialer if set, or else one going
+// through the HTTP proxy of the environment, if any, or else a net.Dialer.
+func (o *Options) dialer(addr string) Dialer {
+	if o.Dialer != nil {
+		return o.Dialer
+	}
+	direct := &net.Dialer{}
+	proxy := os.Getenv("HTTP_PROXY")
+	if proxy == "" {
+		proxy = os.Getenv("http_proxy")
+	}
+	if proxy == "" {
+		return direct
+	}
+	// test for no proxy, takes a comma separated list with substrings to match
+	noproxy := os.Getenv("NO_PROXY")
+	if noproxy == "" {
+		noproxy = os.Getenv("no_proxy")
+	}
+	if noproxy != "" {
+		nplist := strings.Split(noproxy, ",")
+		for _, s := range nplist {
+			if containsIgnoreCase(addr, s) {
+				return direct
+			}
+		}
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return direct
+	}
+	return &HTTPConnectDialer{Proxy: u.Host, User: u.User, Forward: direct}
+}
+
+// dial connects to addr with the Dialer of o, limiting the time it may take to
+// o.DialTimeout.
+func (o *Options) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if o.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.DialTimeout)
+		defer cancel()
+	}
+	return o.dialer(addr).DialContext(ctx, "tcp", addr)
+}
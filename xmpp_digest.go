@@ -0,0 +1,159 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// digestChallenge is a DIGEST-MD5 challenge, RFC 2831 2.1.1.
+type digestChallenge struct {
+	realms  []string // in the order the server offered them
+	nonce   string
+	qop     []string
+	charset string
+	rspauth string
+}
+
+// parseDigestChallenge parses the comma-separated directives of a DIGEST-MD5 challenge.
+// Values may be quoted strings with backslash escapes, and realm may be repeated.
+func parseDigestChallenge(s string) (*digestChallenge, error) {
+	ch := &digestChallenge{}
+	for s = strings.TrimLeft(s, " \t\r\n,"); s != ""; s = strings.TrimLeft(s, " \t\r\n,") {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, errors.New("xmpp: DIGEST-MD5 directive without a value: " + s)
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t\r\n")
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errors.New("xmpp: unterminated quoted string in DIGEST-MD5 challenge")
+			}
+			val, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+
+		switch key {
+		case "realm":
+			ch.realms = append(ch.realms, val)
+		case "nonce":
+			ch.nonce = val
+		case "qop":
+			for _, q := range strings.Split(val, ",") {
+				ch.qop = append(ch.qop, strings.TrimSpace(q))
+			}
+		case "charset":
+			ch.charset = val
+		case "rspauth":
+			ch.rspauth = val
+		}
+	}
+	return ch, nil
+}
+
+// realm picks the realm to authenticate in: the one naming the domain if the server
+// offers several, the domain if it offers none.
+func (ch *digestChallenge) realm(domain string) string {
+	for _, r := range ch.realms {
+		if strings.EqualFold(r, domain) {
+			return r
+		}
+	}
+	if len(ch.realms) == 0 {
+		return domain
+	}
+	return ch.realms[0]
+}
+
+// digestQuote quotes s as an RFC 2831 quoted-string.
+func digestQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// authDigestMD5 starts DIGEST-MD5 authentication, RFC 2831, and answers the server's
+// challenge. It returns the rspauth the server must prove it knows the password with;
+// the caller checks it against the second challenge, or the data of <success/>.
+func (c *Client) authDigestMD5(user, domain string, o *Options) (string, error) {
+	c.sendf("<auth xmlns='%s' mechanism='DIGEST-MD5'/>\n", nsSASL)
+	c.setStepDeadline(o)
+	name, val, err := next(c.p)
+	if err != nil {
+		return "", stepError("SASL challenge", err, err)
+	}
+	var challenge string
+	switch v := val.(type) {
+	case *saslChallenge:
+		challenge = string(*v)
+	case *saslFailure:
+		return "", &AuthError{Condition: v.Any.Local, Text: v.Text}
+	default:
+		return "", errors.New("expected <challenge> or <failure>, got <" + name.Local + "> in " + name.Space)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(challenge))
+	if err != nil {
+		return "", err
+	}
+	ch, err := parseDigestChallenge(string(b))
+	if err != nil {
+		return "", err
+	}
+	if ch.nonce == "" {
+		return "", errors.New("xmpp: DIGEST-MD5 challenge lacks a nonce")
+	}
+	// Only authentication is supported, not integrity or privacy protection.
+	auth := len(ch.qop) == 0
+	for _, q := range ch.qop {
+		auth = auth || q == "auth"
+	}
+	if !auth {
+		return "", fmt.Errorf("xmpp: DIGEST-MD5 server does not offer qop=auth: %v", ch.qop)
+	}
+
+	realm := ch.realm(domain)
+	cnonceStr := cnonce()
+	digestURI := "xmpp/" + domain
+	nonceCount := fmt.Sprintf("%08x", 1)
+	digest := saslDigestResponse(user, realm, o.Password, ch.nonce, cnonceStr, "AUTHENTICATE", digestURI, nonceCount)
+	message := "username=" + digestQuote(user) + ",realm=" + digestQuote(realm) + ",nonce=" + digestQuote(ch.nonce) +
+		",cnonce=" + digestQuote(cnonceStr) + ",nc=" + nonceCount + ",qop=auth,digest-uri=" + digestQuote(digestURI) +
+		",response=" + digest
+	if ch.charset != "" {
+		message += ",charset=" + ch.charset
+	}
+	c.sendf("<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte(message)))
+
+	return saslDigestResponse(user, realm, o.Password, ch.nonce, cnonceStr, "", digestURI, nonceCount), nil
+}
+
+// checkDigestRspAuth checks the base64 encoded rspauth sent by the server against the expected one.
+func checkDigestRspAuth(data, expected string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+	ch, err := parseDigestChallenge(string(b))
+	if err != nil {
+		return err
+	}
+	if ch.rspauth != expected {
+		return errors.New("xmpp: DIGEST-MD5 server sent a wrong rspauth")
+	}
+	return nil
+}
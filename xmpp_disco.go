@@ -0,0 +1,168 @@
+package xmpp
+
+import "encoding/xml"
+
+const (
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+)
+
+// DiscoInfo is the identity and the features of an entity, xep-0030 3.1.
+type DiscoInfo struct {
+	Identities []DiscoIdentity
+	Features   []string // feature vars, like "http://jabber.org/protocol/muc"
+}
+
+// HasFeature reports whether the entity supports the feature var.
+func (d *DiscoInfo) HasFeature(feature string) bool {
+	for _, f := range d.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// HasIdentity reports whether the entity has an identity of category and typ, like
+// "proxy" and "bytestreams".
+func (d *DiscoInfo) HasIdentity(category, typ string) bool {
+	for _, id := range d.Identities {
+		if id.Category == category && id.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoItem is an item associated with an entity, xep-0030 4.1.
+type DiscoItem struct {
+	JID  string `xml:"jid,attr"`
+	Node string `xml:"node,attr"`
+	Name string `xml:"name,attr"`
+}
+
+// DiscoIdentity is an identity of an entity, xep-0030 3.1.
+type DiscoIdentity struct {
+	Category string `xml:"category,attr"` // e.g. "client"
+	Type     string `xml:"type,attr"`     // e.g. "bot"
+	Name     string `xml:"name,attr"`
+	Lang     string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+}
+
+// defaultIdentity is the identity the client answers disco#info queries with.
+var defaultIdentity = DiscoIdentity{Category: "client", Type: "bot", Name: "go-xmpp"}
+
+// discoFeatures returns the features the client answers disco#info queries with.
+func (c *Client) discoFeatures() []string {
+	c.discoMutex.Lock()
+	defer c.discoMutex.Unlock()
+	features := []string{nsDiscoInfo, nsCaps, nsPing, nsVersion, nsTime, nsLast, nsCorrect, nsRetract}
+	for _, f := range c.features {
+		features = appendUnique(features, f)
+	}
+	return features
+}
+
+// handleDiscoInfo answers a disco#info query addressed to us, xep-0030 3.1, if
+// Options.CapsNode is set, and reports whether iq was one. A query to a node other
+// than our caps node, xep-0115 6.2, is answered with item-not-found.
+func (c *Client) handleDiscoInfo(iq *clientIQ) (bool, error) {
+	if c.capsNode == "" || iq.Type != IQTypeGet || iq.Query.XMLName.Space != nsDiscoInfo || !c.isMe(iq.To) {
+		return false, nil
+	}
+	identities, features := []DiscoIdentity{defaultIdentity}, c.discoFeatures()
+	node := iq.queryAttr("node")
+
+	var attrs, nodeAttr string
+	if iq.To != "" {
+		attrs += " from='" + xmlEscape(iq.To) + "'"
+	}
+	if iq.From != "" {
+		attrs += " to='" + xmlEscape(iq.From) + "'"
+	}
+	if node != "" {
+		nodeAttr = " node='" + xmlEscape(node) + "'"
+	}
+	if node != "" && node != c.capsNode+"#"+capsVer(identities, features) {
+		_, err := c.sendf("<iq type='error'%s id='%s'><query xmlns='%s'%s/>"+
+			"<error type='cancel'><item-not-found xmlns='%s'/></error></iq>",
+			attrs, xmlEscape(iq.ID), nsDiscoInfo, nodeAttr, nsStanzas)
+		return true, err
+	}
+
+	var query string
+	for _, id := range identities {
+		query += "<identity category='" + xmlEscape(id.Category) + "' type='" + xmlEscape(id.Type) + "'"
+		if id.Lang != "" {
+			query += " xml:lang='" + xmlEscape(id.Lang) + "'"
+		}
+		if id.Name != "" {
+			query += " name='" + xmlEscape(id.Name) + "'"
+		}
+		query += "/>"
+	}
+	for _, f := range features {
+		query += "<feature var='" + xmlEscape(f) + "'/>"
+	}
+	_, err := c.sendf("<iq type='result'%s id='%s'><query xmlns='%s'%s>%s</query></iq>",
+		attrs, xmlEscape(iq.ID), nsDiscoInfo, nodeAttr, query)
+	return true, err
+}
+
+type clientDiscoInfo struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Identities []DiscoIdentity `xml:"identity"`
+	Features   []struct {
+		Var string `xml:"var,attr"`
+	} `xml:"feature"`
+}
+
+type clientDiscoItems struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/disco#items query"`
+	Items   []DiscoItem `xml:"item"`
+}
+
+// DiscoInfo queries the identities and the features of the entity to, xep-0030 3.1, and
+// waits for the result. An empty to queries our server.
+func (c *Client) DiscoInfo(to string) (*DiscoInfo, error) {
+	iq, err := c.sendIQ(to, IQTypeGet, "<query xmlns='"+nsDiscoInfo+"'/>")
+	if err != nil {
+		return nil, err
+	}
+	var q clientDiscoInfo
+	if err = iq.decodeQuery(&q); err != nil {
+		return nil, err
+	}
+	info := &DiscoInfo{Identities: q.Identities}
+	for _, f := range q.Features {
+		info.Features = append(info.Features, f.Var)
+	}
+	return info, nil
+}
+
+// DiscoItems queries the items associated with the entity to, xep-0030 4.1, like the
+// rooms of a MUC service, and waits for the result. An empty to queries our server.
+func (c *Client) DiscoItems(to string) ([]DiscoItem, error) {
+	return c.discoItems(to, "")
+}
+
+// discoItems queries the items associated with node of the entity to, or with the
+// entity itself if node is empty.
+func (c *Client) discoItems(to, node string) ([]DiscoItem, error) {
+	var nodeAttr string
+	if node != "" {
+		nodeAttr = " node='" + xmlEscape(node) + "'"
+	}
+	iq, err := c.sendIQ(to, IQTypeGet, "<query xmlns='"+nsDiscoItems+"'"+nodeAttr+"/>")
+	if err != nil {
+		return nil, err
+	}
+	if iq.Query.XMLName.Local == "" {
+		return nil, nil
+	}
+	var q clientDiscoItems
+	if err = iq.decodeQuery(&q); err != nil {
+		return nil, err
+	}
+	return q.Items, nil
+}
@@ -0,0 +1,167 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+const (
+	nsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	nsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+)
+
+// StanzaError is the error condition of a stanza of type error, RFC 6120 8.3.
+type StanzaError struct {
+	Type      string // auth, cancel, continue, modify, or wait
+	Condition string // e.g. "service-unavailable"
+	Code      string // legacy error code, if the server sent one
+	// Text is the human-readable description of the error, in the language of
+	// Options.ErrorLanguages that matches best.
+	Text string
+	// App is the application-specific condition, like the pubsub specific ones in
+	// XMPPNS_PUBSUB_ERRORS, if the entity sent one.
+	App xml.Name
+}
+
+func (e *StanzaError) Error() string {
+	msg := "xmpp: " + e.Type + " error: " + e.Condition
+	if e.App.Local != "" {
+		msg += " (" + e.App.Space + " " + e.App.Local + ")"
+	}
+	if e.Text != "" {
+		msg += " (" + e.Text + ")"
+	}
+	return msg
+}
+
+// StreamError is the error the server sent before closing the stream, RFC 6120 4.9.
+type StreamError struct {
+	Condition string // e.g. "conflict" or "system-shutdown", in the namespace urn:ietf:params:xml:ns:xmpp-streams
+	Text      string // human-readable description of the error, if any
+	// App is the application-specific condition, an element in a namespace of the
+	// server's choice, if the server sent one.
+	App xml.Name
+}
+
+func (e *StreamError) Error() string {
+	msg := "xmpp: stream error: " + e.Condition
+	if e.App.Local != "" {
+		msg += " (" + e.App.Space + " " + e.App.Local + ")"
+	}
+	if e.Text != "" {
+		msg += " (" + e.Text + ")"
+	}
+	return msg
+}
+
+// stanzaError converts the <error/> element of a stanza into a *StanzaError.
+func (c *Client) stanzaError(e *clientError) error {
+	return newStanzaError(e, c.errorLangs)
+}
+
+// newStanzaError converts the <error/> element of a stanza into a *StanzaError, picking
+// the text in the language best matching langs.
+func newStanzaError(e *clientError, langs []string) *StanzaError {
+	se := parseStanzaError(e.InnerXML, langs)
+	se.Type = e.Type
+	se.Code = e.Code
+	return se
+}
+
+// parseStanzaError extracts the defined condition and the text from the inner XML of
+// a stanza <error/> element. If there are texts in several languages, the one best
+// matching langs, in order of preference, is picked.
+func parseStanzaError(innerXML []byte, langs []string) *StanzaError {
+	condition, text, app := parseCondition(innerXML, nsStanzas, langs)
+	return &StanzaError{Condition: condition, Text: text, App: app}
+}
+
+// parseStreamError extracts the defined condition and the text from the inner XML of
+// a <stream:error/> element.
+func parseStreamError(innerXML []byte) *StreamError {
+	condition, text, app := parseCondition(innerXML, nsStreams, nil)
+	return &StreamError{Condition: condition, Text: text, App: app}
+}
+
+// parseCondition returns the first element in the namespace ns, the text best matching
+// langs and the first element in another namespace, the application-specific condition,
+// of an error element with the inner XML innerXML.
+func parseCondition(innerXML []byte, ns string, langs []string) (condition, text string, app xml.Name) {
+	var texts []langText
+	d := xml.NewDecoder(bytes.NewReader(innerXML))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case start.Name.Space == ns && start.Name.Local == "text":
+			var t string
+			if d.DecodeElement(&t, &start) != nil {
+				continue
+			}
+			texts = append(texts, langText{strings.ToLower(xmlLang(start)), strings.TrimSpace(t)})
+		case start.Name.Space == ns && condition == "":
+			condition = start.Name.Local
+			d.Skip()
+		case start.Name.Space != ns && start.Name.Space != "" && app.Local == "":
+			app = start.Name
+			d.Skip()
+		default:
+			d.Skip()
+		}
+	}
+	if condition == "" {
+		condition = "undefined-condition"
+	}
+	return condition, matchLang(texts, langs), app
+}
+
+type langText struct {
+	lang string
+	text string
+}
+
+// matchLang returns the text whose language best matches langs, in order of preference.
+// A language tag also matches texts in its subtags and its parent tags, so "de" picks
+// "de-CH" and "en-US" picks "en". Without a match, the text without a language is
+// returned, and otherwise the first one.
+func matchLang(texts []langText, langs []string) string {
+	for _, lang := range langs {
+		lang = strings.ToLower(lang)
+		for _, t := range texts {
+			if t.lang == lang {
+				return t.text
+			}
+		}
+		for _, t := range texts {
+			if t.lang != "" && (strings.HasPrefix(t.lang, lang+"-") || strings.HasPrefix(lang, t.lang+"-")) {
+				return t.text
+			}
+		}
+	}
+	for _, t := range texts {
+		if t.lang == "" {
+			return t.text
+		}
+	}
+	if len(texts) > 0 {
+		return texts[0].text
+	}
+	return ""
+}
+
+// xmlLang returns the xml:lang attribute of an element.
+func xmlLang(start xml.StartElement) string {
+	for _, a := range start.Attr {
+		if a.Name.Local == "lang" && (a.Name.Space == "xml" || a.Name.Space == "http://www.w3.org/XML/1998/namespace") {
+			return a.Value
+		}
+	}
+	return ""
+}
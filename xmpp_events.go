@@ -0,0 +1,63 @@
+package xmpp
+
+import "sync"
+
+// defaultEventBufferSize is the capacity of the Events channel if Options.EventBufferSize is not set.
+const defaultEventBufferSize = 64
+
+// events is the state of the reader goroutine started by Events.
+type events struct {
+	once sync.Once
+	ch   chan interface{}
+	size int
+
+	mutex sync.Mutex
+	err   error // why the reader stopped
+}
+
+// Events starts a goroutine that reads the stream with Recv and returns the channel
+// it sends the stanzas to: Chat, Presence, IQ and whatever else Recv returns. The
+// channel is closed once Recv fails; Err then tells why. Later calls return the same
+// channel. Recv must not be called once Events was.
+//
+// The reader waits while the channel is full, and so do the IQ requests whose
+// responses are not read yet: keep receiving from the channel while e.g. DiscoInfo
+// waits for its result.
+func (c *Client) Events() <-chan interface{} {
+	e := &c.events
+	e.once.Do(func() {
+		size := e.size
+		if size <= 0 {
+			size = defaultEventBufferSize
+		}
+		e.ch = make(chan interface{}, size)
+		go c.readEvents(e.ch)
+	})
+	return e.ch
+}
+
+// readEvents sends what Recv returns to ch until it fails.
+func (c *Client) readEvents(ch chan<- interface{}) {
+	defer close(ch)
+	for {
+		v, err := c.Recv()
+		if err != nil {
+			if c.isClosed() {
+				err = nil
+			}
+			c.events.mutex.Lock()
+			c.events.err = err
+			c.events.mutex.Unlock()
+			return
+		}
+		ch <- v
+	}
+}
+
+// Err returns the error that made Events close its channel, or nil if the channel is
+// still open or was closed by Close.
+func (c *Client) Err() error {
+	c.events.mutex.Lock()
+	defer c.events.mutex.Unlock()
+	return c.events.err
+}
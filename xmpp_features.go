@@ -0,0 +1,99 @@
+package xmpp
+
+import "encoding/xml"
+
+// StreamFeatures are the features the server advertised while the stream was negotiated,
+// RFC 6120 4.3.2, on any of the streams before and after STARTTLS and authentication.
+type StreamFeatures struct {
+	StartTLS         bool
+	StartTLSRequired bool
+	Mechanisms       []string // SASL mechanisms, like "SCRAM-SHA-1"
+	Bind             bool
+	// Session is set if the server advertises sessions, RFC 3921 3, and SessionOptional
+	// if it does not require them, so that Options.Session can be left unset.
+	Session          bool
+	SessionOptional  bool
+	StreamManagement bool     // xep-0198
+	Register         bool     // in-band registration, xep-0077
+	Compression      []string // compression methods, xep-0138, like "zlib"
+	RosterVersioning bool     // RFC 6121 2.6, see GetRosterSince
+	// Other holds the names of the other features.
+	Other []xml.Name
+}
+
+type sessionFeature struct {
+	XMLName  xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-session session"`
+	Optional *string  `xml:"optional"`
+}
+
+type compressionFeature struct {
+	XMLName xml.Name `xml:"http://jabber.org/features/compress compression"`
+	Methods []string `xml:"method"`
+}
+
+// StreamFeatures returns the features the server advertised.
+func (c *Client) StreamFeatures() StreamFeatures {
+	f := c.serverFeatures
+	f.Mechanisms = append([]string(nil), f.Mechanisms...)
+	f.Compression = append([]string(nil), f.Compression...)
+	f.Other = append([]xml.Name(nil), f.Other...)
+	return f
+}
+
+// names returns the names of the features in f, for error messages.
+func (f *streamFeatures) names() []string {
+	var names []string
+	add := func(present bool, name string) {
+		if present {
+			names = append(names, name)
+		}
+	}
+	add(f.StartTLS != nil, "starttls")
+	add(len(f.Mechanisms.Mechanism) > 0, "mechanisms")
+	add(f.Bind.XMLName.Local != "", "bind")
+	add(f.Session != nil, "session")
+	add(f.SM != nil, "sm")
+	add(f.Register != nil, "register")
+	add(f.Compression != nil, "compression")
+	add(f.RosterVer != nil, "ver")
+	for _, o := range f.Other {
+		names = append(names, o.XMLName.Local)
+	}
+	return names
+}
+
+// add records the features f the server advertised on a new stream.
+func (s *StreamFeatures) add(f *streamFeatures) {
+	if f.StartTLS != nil {
+		s.StartTLS = true
+		s.StartTLSRequired = s.StartTLSRequired || f.StartTLS.Required != nil
+	}
+	for _, m := range f.Mechanisms.Mechanism {
+		s.Mechanisms = appendUnique(s.Mechanisms, m)
+	}
+	s.Bind = s.Bind || f.Bind.XMLName.Local != ""
+	if f.Session != nil {
+		s.Session = true
+		s.SessionOptional = f.Session.Optional != nil
+	}
+	s.StreamManagement = s.StreamManagement || f.SM != nil
+	s.Register = s.Register || f.Register != nil
+	s.RosterVersioning = s.RosterVersioning || f.RosterVer != nil
+	if f.Compression != nil {
+		for _, m := range f.Compression.Methods {
+			s.Compression = appendUnique(s.Compression, m)
+		}
+	}
+	for _, o := range f.Other {
+		s.Other = appendName(s.Other, o.XMLName)
+	}
+}
+
+func appendName(names []xml.Name, name xml.Name) []xml.Name {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
@@ -0,0 +1,33 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+const nsForward = "urn:xmpp:forward:0"
+
+// Forwarded is a message forwarded by another entity, XEP-0297.
+type Forwarded struct {
+	// Stamp is the time the message was originally sent, if the forwarder tells us.
+	Stamp time.Time
+	Chat  Chat
+}
+
+// XEP-0297  Stanza Forwarding
+type clientForwarded struct {
+	XMLName xml.Name       `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay   *Delay         `xml:"urn:xmpp:delay delay"`
+	Message *clientMessage `xml:"jabber:client message"`
+}
+
+func (f *clientForwarded) forwarded() *Forwarded {
+	if f == nil || f.Message == nil {
+		return nil
+	}
+	fw := &Forwarded{Chat: f.Message.chat()}
+	if f.Delay != nil {
+		fw.Stamp, _ = f.Delay.time()
+	}
+	return fw
+}
@@ -0,0 +1,302 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const nsIBB = "http://jabber.org/protocol/ibb"
+
+// IBBMaxBlockSize is the largest block size of an in-band bytestream, xep-0047 2.1.
+const IBBMaxBlockSize = 65535
+
+// IBBOpen is returned from Recv when From wants to open an in-band bytestream to us,
+// xep-0047 2.1, e.g. the one of a JingleOffer with JingleTransportIBB. Answer it with
+// AcceptIBB or RejectIBB.
+type IBBOpen struct {
+	From      string
+	SID       string
+	BlockSize int
+
+	iq *clientIQ
+}
+
+// xep-0047  In-Band Bytestreams
+type clientIBB struct {
+	XMLName   xml.Name
+	SID       string `xml:"sid,attr"`
+	Seq       string `xml:"seq,attr"`
+	BlockSize int    `xml:"block-size,attr"`
+	Stanza    string `xml:"stanza,attr"`
+	Data      string `xml:",chardata"`
+}
+
+// OpenIBB opens an in-band bytestream with the id sid to the entity with the full JID to,
+// xep-0047 2.1, and waits for it to be accepted. The data written to the stream is sent
+// in blocks of blockSize bytes, each one after the previous was acknowledged, so that
+// Write blocks while the receiver lags behind; Close sends the last block and closes the
+// stream. The responses are read by Recv, which has to be running in another goroutine.
+// The stream is not safe for concurrent use.
+func (c *Client) OpenIBB(to, sid string, blockSize int) (io.WriteCloser, error) {
+	if blockSize <= 0 || blockSize > IBBMaxBlockSize {
+		return nil, errors.New("xmpp: IBB block size out of range: " + strconv.Itoa(blockSize))
+	}
+	_, err := c.sendIQ(to, IQTypeSet, "<open xmlns='"+nsIBB+"' block-size='"+strconv.Itoa(blockSize)+
+		"' sid='"+xmlEscape(sid)+"' stanza='iq'/>")
+	if err != nil {
+		return nil, err
+	}
+	return &ibbWriter{c: c, to: to, sid: sid, blockSize: blockSize}, nil
+}
+
+type ibbWriter struct {
+	c         *Client
+	to, sid   string
+	blockSize int
+	seq       uint16 // wraps around to 0 after 65535, xep-0047 2.2
+	buf       []byte
+	closed    bool
+}
+
+func (w *ibbWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("xmpp: write to closed IBB stream")
+	}
+	var n int
+	for len(p) > 0 {
+		k := w.blockSize - len(w.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		w.buf = append(w.buf, p[:k]...)
+		p, n = p[k:], n+k
+		if len(w.buf) == w.blockSize {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush sends the buffered block and waits for the acknowledgement.
+func (w *ibbWriter) flush() error {
+	_, err := w.c.sendIQ(w.to, IQTypeSet, "<data xmlns='"+nsIBB+"' seq='"+strconv.Itoa(int(w.seq))+
+		"' sid='"+xmlEscape(w.sid)+"'>"+base64.StdEncoding.EncodeToString(w.buf)+"</data>")
+	if err != nil {
+		return err
+	}
+	w.seq++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *ibbWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	_, err := w.c.sendIQ(w.to, IQTypeSet, "<close xmlns='"+nsIBB+"' sid='"+xmlEscape(w.sid)+"'/>")
+	return err
+}
+
+// AcceptIBB accepts the bytestream o and returns it for reading. Read returns io.EOF
+// once the sender closed the stream. Each block is acknowledged when it is read, so the
+// sender waits for the reader. Closing the stream before the sender did cancels it.
+func (c *Client) AcceptIBB(o IBBOpen) (io.ReadCloser, error) {
+	r := &ibbReader{c: c, peer: o.From, sid: o.SID, blockSize: o.BlockSize}
+	r.cond = sync.NewCond(&r.mu)
+	c.ibbMutex.Lock()
+	if c.ibbStreams == nil {
+		c.ibbStreams = make(map[string]*ibbReader)
+	}
+	if _, ok := c.ibbStreams[r.key()]; ok {
+		c.ibbMutex.Unlock()
+		return nil, c.replyIQError(o.iq, "cancel", "not-acceptable")
+	}
+	c.ibbStreams[r.key()] = r
+	c.ibbMutex.Unlock()
+	if _, err := c.sendf("<iq type='result'%s id='%s'/>", replyAttrs(o.iq), xmlEscape(o.iq.ID)); err != nil {
+		c.removeIBB(r)
+		return nil, err
+	}
+	return r, nil
+}
+
+// RejectIBB declines the bytestream o.
+func (c *Client) RejectIBB(o IBBOpen) error {
+	return c.replyIQError(o.iq, "cancel", "not-acceptable")
+}
+
+type ibbReader struct {
+	c         *Client
+	peer, sid string
+	blockSize int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	blocks []ibbBlock // received but not read yet
+	buf    []byte     // rest of the block being read
+	seq    uint16     // seq of the next block
+	err    error      // io.EOF once the sender closed the stream, or why it ended
+}
+
+// ibbBlock is a block of data and the IQ that carried it, acknowledged once it is read.
+type ibbBlock struct {
+	data []byte
+	iq   *clientIQ
+}
+
+func (r *ibbReader) key() string {
+	return r.peer + " " + r.sid
+}
+
+func (r *ibbReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	var acks []*clientIQ
+	for len(r.buf) == 0 {
+		for len(r.blocks) == 0 && r.err == nil {
+			r.cond.Wait()
+		}
+		if len(r.blocks) == 0 {
+			err := r.err
+			r.mu.Unlock()
+			r.ack(acks)
+			return 0, err
+		}
+		b := r.blocks[0]
+		r.blocks, r.buf = r.blocks[1:], b.data
+		acks = append(acks, b.iq)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.mu.Unlock()
+	// Not holding r.mu, which handleIBB needs, while writing.
+	r.ack(acks)
+	return n, nil
+}
+
+// ack acknowledges the blocks carried by iqs.
+func (r *ibbReader) ack(iqs []*clientIQ) {
+	for _, iq := range iqs {
+		r.c.sendf("<iq type='result'%s id='%s'/>", replyAttrs(iq), xmlEscape(iq.ID))
+	}
+}
+
+func (r *ibbReader) Close() error {
+	r.mu.Lock()
+	done := r.err != nil
+	r.end(errors.New("xmpp: read from closed IBB stream"))
+	pending := r.blocks
+	r.blocks = nil
+	r.mu.Unlock()
+	r.c.removeIBB(r)
+	// The sender waits for the answers to the blocks not read.
+	for _, b := range pending {
+		r.c.replyIQError(b.iq, "cancel", "item-not-found")
+	}
+	if done {
+		return nil
+	}
+	_, err := r.c.sendIQ(r.peer, IQTypeSet, "<close xmlns='"+nsIBB+"' sid='"+xmlEscape(r.sid)+"'/>")
+	return err
+}
+
+// end ends the stream with err, unless it has ended already. r.mu must be held.
+func (r *ibbReader) end(err error) {
+	if r.err == nil {
+		r.err = err
+		r.cond.Broadcast()
+	}
+}
+
+func (c *Client) removeIBB(r *ibbReader) {
+	c.ibbMutex.Lock()
+	defer c.ibbMutex.Unlock()
+	if c.ibbStreams[r.key()] == r {
+		delete(c.ibbStreams, r.key())
+	}
+}
+
+// handleIBB handles an in-band bytestream request and reports whether iq was one. It
+// returns an IBBOpen for a stream to be opened, nil for the data and the close of the
+// streams accepted with AcceptIBB.
+func (c *Client) handleIBB(iq *clientIQ) (*IBBOpen, bool, error) {
+	if iq.Type != IQTypeSet || iq.Query.XMLName.Space != nsIBB {
+		return nil, false, nil
+	}
+	var m clientIBB
+	if err := iq.decodeQuery(&m); err != nil || m.SID == "" {
+		return nil, true, c.replyIQError(iq, "modify", "bad-request")
+	}
+	if m.XMLName.Local == "open" {
+		switch {
+		case m.Stanza != "" && m.Stanza != "iq":
+			return nil, true, c.replyIQError(iq, "cancel", "feature-not-implemented")
+		case m.BlockSize <= 0 || m.BlockSize > IBBMaxBlockSize:
+			return nil, true, c.replyIQError(iq, "modify", "resource-constraint")
+		}
+		return &IBBOpen{From: iq.From, SID: m.SID, BlockSize: m.BlockSize, iq: iq}, true, nil
+	}
+
+	c.ibbMutex.Lock()
+	r := c.ibbStreams[iq.From+" "+m.SID]
+	c.ibbMutex.Unlock()
+	if r == nil {
+		return nil, true, c.replyIQError(iq, "cancel", "item-not-found")
+	}
+	switch m.XMLName.Local {
+	case "data":
+		seq, err := strconv.ParseUint(m.Seq, 10, 16)
+		data, derr := base64.StdEncoding.DecodeString(strings.TrimSpace(m.Data))
+		r.mu.Lock()
+		if r.err != nil {
+			// closed by the reader meanwhile
+			r.mu.Unlock()
+			return nil, true, c.replyIQError(iq, "cancel", "item-not-found")
+		}
+		if err != nil || uint16(seq) != r.seq || derr != nil || len(data) > r.blockSize {
+			// A block out of order or too large closes the stream, xep-0047 2.2.
+			r.end(errors.New("xmpp: IBB stream broken by a bad block"))
+			r.mu.Unlock()
+			c.removeIBB(r)
+			return nil, true, c.replyIQError(iq, "cancel", "unexpected-request")
+		}
+		r.seq++
+		r.blocks = append(r.blocks, ibbBlock{data: data, iq: iq})
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		return nil, true, nil
+	case "close":
+		r.mu.Lock()
+		r.end(io.EOF)
+		r.mu.Unlock()
+		c.removeIBB(r)
+		_, err := c.sendf("<iq type='result'%s id='%s'/>", replyAttrs(iq), xmlEscape(iq.ID))
+		return nil, true, err
+	}
+	return nil, true, c.replyIQError(iq, "cancel", "feature-not-implemented")
+}
+
+// abortIBB ends the bytestreams being received once the stream is gone.
+func (c *Client) abortIBB() {
+	c.ibbMutex.Lock()
+	streams := c.ibbStreams
+	c.ibbStreams = nil
+	c.ibbMutex.Unlock()
+	for _, r := range streams {
+		r.mu.Lock()
+		r.end(errors.New("xmpp: connection closed while receiving IBB stream"))
+		r.mu.Unlock()
+	}
+}
@@ -1,31 +1,178 @@
 package xmpp
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
 	"strconv"
+	"sync"
 )
 
 const IQTypeGet = "get"
 const IQTypeSet = "set"
 const IQTypeResult = "result"
+const IQTypeError = "error"
+
+// IDPrefix starts the ids of the stanzas whose responses the client matches on its own.
+// The ids of stanzas sent with RawInformation and the like should not start with it,
+// or their responses may be taken for the client's.
+const IDPrefix = "_xmpp_"
+
+// iqPayloads holds the types registered with RegisterIQNamespace.
+var iqPayloads struct {
+	sync.RWMutex
+	m map[xml.Name]func() interface{}
+}
+
+// RegisterIQNamespace makes Recv decode the child element local in namespace ns of the
+// IQs it returns into a value made by proto, and set it as IQ.Payload. proto must return
+// a pointer that encoding/xml can unmarshal into, e.g.
+//
+//	xmpp.RegisterIQNamespace("urn:example:weather", "forecast", func() interface{} { return new(Forecast) })
+//
+// Registering a name again replaces the previous type. The IQs the client handles on its
+// own, like pings and roster pushes, are not affected.
+func RegisterIQNamespace(ns, local string, proto func() interface{}) {
+	iqPayloads.Lock()
+	defer iqPayloads.Unlock()
+	if iqPayloads.m == nil {
+		iqPayloads.m = make(map[xml.Name]func() interface{})
+	}
+	iqPayloads.m[xml.Name{Space: ns, Local: local}] = proto
+}
+
+// payload decodes the child element of the IQ into the type registered for its name,
+// if any.
+func (iq *clientIQ) payload() (interface{}, error) {
+	iqPayloads.RLock()
+	proto := iqPayloads.m[iq.Query.XMLName]
+	iqPayloads.RUnlock()
+	if proto == nil {
+		return nil, nil
+	}
+	v := proto()
+	if err := iq.decodeQuery(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// rawQuery returns the child element of the IQ as the server sent it, attributes and all.
+func (iq *clientIQ) rawQuery() ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(iq.InnerXML))
+	for {
+		offset := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			// not found, e.g. for a namespace declared on the IQ itself
+			return xml.Marshal(iq.Query)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+			if start.Name == iq.Query.XMLName {
+				return iq.InnerXML[offset:d.InputOffset()], nil
+			}
+		}
+	}
+}
 
 func (c *Client) Discovery() (string, error) {
 	const namespace = "http://jabber.org/protocol/disco#items"
 	// use getCookie for a pseudo random id.
 	reqID := strconv.FormatUint(uint64(getCookie()), 10)
-	return c.RawInformationQuery(c.jid, c.domain, reqID, IQTypeGet, namespace, "")
+	return c.RawInformationQuery(c.JID(), c.serverDomain(), reqID, IQTypeGet, namespace, "")
 }
 
 // RawInformationQuery sends an information query request to the server.
 func (c *Client) RawInformationQuery(from, to, id, iqType, requestNamespace, body string) (string, error) {
 	const xmlIQ = "<iq from='%s' to='%s' id='%s' type='%s'><query xmlns='%s'>%s</query></iq>"
-	_, err := fmt.Fprintf(c.conn, xmlIQ, xmlEscape(from), xmlEscape(to), id, iqType, requestNamespace, body)
+	_, err := c.sendf(xmlIQ, xmlEscape(from), xmlEscape(to), id, iqType, requestNamespace, body)
 	return id, err
 }
 
 // rawInformation send a IQ request with the the payload body to the server
 func (c *Client) RawInformation(from, to, id, iqType, body string) (string, error) {
 	const xmlIQ = "<iq from='%s' to='%s' id='%s' type='%s'>%s</iq>"
-	_, err := fmt.Fprintf(c.conn, xmlIQ, xmlEscape(from), xmlEscape(to), id, iqType, body)
+	_, err := c.sendf(xmlIQ, xmlEscape(from), xmlEscape(to), id, iqType, body)
 	return id, err
 }
+
+// sendIQ sends an IQ request with the payload body to the entity to and waits for
+// the matching result. An IQ of type error is returned together with an error
+// describing it. The response is read by Recv, which has to be running in another
+// goroutine, and is not returned from there.
+func (c *Client) sendIQ(to, iqType, body string) (*clientIQ, error) {
+	return c.sendIQContext(context.Background(), to, iqType, body)
+}
+
+// sendIQContext is sendIQ, but gives up waiting for the response once ctx is done.
+func (c *Client) sendIQContext(ctx context.Context, to, iqType, body string) (*clientIQ, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	id := IDPrefix + strconv.FormatUint(uint64(getCookie()), 10)
+	ch := make(chan *clientIQ, 1)
+	c.iqMutex.Lock()
+	if c.iqPending == nil {
+		c.iqPending = make(map[string]chan *clientIQ)
+	}
+	c.iqPending[id] = ch
+	c.iqMutex.Unlock()
+
+	var toAttr string
+	if to != "" {
+		toAttr = " to='" + xmlEscape(to) + "'"
+	}
+	if _, err := c.sendf("<iq from='%s'%s id='%s' type='%s'>%s</iq>", xmlEscape(c.JID()), toAttr, id, iqType, body); err != nil {
+		c.iqMutex.Lock()
+		delete(c.iqPending, id)
+		c.iqMutex.Unlock()
+		return nil, err
+	}
+
+	var iq *clientIQ
+	var ok bool
+	select {
+	case iq, ok = <-ch:
+	case <-ctx.Done():
+		c.iqMutex.Lock()
+		delete(c.iqPending, id)
+		c.iqMutex.Unlock()
+		return nil, ctx.Err()
+	}
+	if !ok {
+		return nil, errors.New("xmpp: connection closed while waiting for IQ response")
+	}
+	if iq.Type == IQTypeError {
+		return iq, c.stanzaError(&iq.Error)
+	}
+	return iq, nil
+}
+
+// deliverIQ hands a response to the sendIQ call waiting for it and reports whether there was one.
+func (c *Client) deliverIQ(iq *clientIQ) bool {
+	if iq.Type != IQTypeResult && iq.Type != IQTypeError {
+		return false
+	}
+	c.iqMutex.Lock()
+	ch, ok := c.iqPending[iq.ID]
+	delete(c.iqPending, iq.ID)
+	c.iqMutex.Unlock()
+	if ok {
+		ch <- iq
+	}
+	return ok
+}
+
+// abortIQs wakes up all sendIQ calls still waiting for a response once the stream is gone.
+func (c *Client) abortIQs() {
+	c.iqMutex.Lock()
+	for id, ch := range c.iqPending {
+		close(ch)
+		delete(c.iqPending, id)
+	}
+	c.iqMutex.Unlock()
+}
@@ -0,0 +1,171 @@
+package xmpp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// JID is an XMPP address, RFC 7622, like "juliet@example.com/balcony".
+type JID struct {
+	Local    string // e.g. "juliet", empty for a server or a service
+	Domain   string
+	Resource string // e.g. "balcony", empty for a bare JID
+}
+
+// maxJIDPart is the maximum length in bytes of each part of a JID, RFC 7622 3.
+const maxJIDPart = 1023
+
+// ParseJID splits s into its parts, RFC 7622 3.1, and checks them. The localpart and the
+// domainpart are case-folded and a trailing dot of the domain is dropped, so that JIDs
+// compare equal when the server would take them for the same; the resourcepart is kept
+// as is. This approximates the PRECIS profiles of RFC 7622 well for ASCII addresses,
+// but does not apply Unicode normalization.
+func ParseJID(s string) (JID, error) {
+	if !utf8.ValidString(s) {
+		return JID{}, errors.New("xmpp: JID is not valid UTF-8: " + s)
+	}
+	var j JID
+	rest := s
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest, j.Resource = rest[:i], rest[i+1:]
+		if j.Resource == "" {
+			return JID{}, errors.New("xmpp: JID has an empty resourcepart: " + s)
+		}
+	}
+	if i := strings.IndexByte(rest, '@'); i >= 0 {
+		j.Local, rest = rest[:i], rest[i+1:]
+		if j.Local == "" {
+			return JID{}, errors.New("xmpp: JID has an empty localpart: " + s)
+		}
+		if i := strings.IndexFunc(j.Local, invalidLocalRune); i >= 0 {
+			return JID{}, errors.New("xmpp: JID localpart contains " + quoteRune(j.Local[i:]) + ": " + s)
+		}
+	}
+	j.Domain = strings.TrimSuffix(rest, ".")
+	if j.Domain == "" {
+		return JID{}, errors.New("xmpp: JID has an empty domainpart: " + s)
+	}
+	if strings.IndexFunc(j.Domain, func(r rune) bool { return r == '@' || unicode.IsSpace(r) }) >= 0 {
+		return JID{}, errors.New("xmpp: JID domainpart contains '@' or whitespace: " + s)
+	}
+	if len(j.Local) > maxJIDPart || len(j.Domain) > maxJIDPart || len(j.Resource) > maxJIDPart {
+		return JID{}, errors.New("xmpp: JID part longer than 1023 bytes: " + s)
+	}
+	j.Local, j.Domain = strings.ToLower(j.Local), strings.ToLower(j.Domain)
+	return j, nil
+}
+
+// invalidLocalRune reports whether r may not appear in a localpart, RFC 7622 3.3.1.
+func invalidLocalRune(r rune) bool {
+	return strings.ContainsRune(`"&'/:<>@`, r) || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func quoteRune(s string) string {
+	r, _ := utf8.DecodeRuneInString(s)
+	return "'" + string(r) + "'"
+}
+
+// Bare returns the JID without its resource.
+func (j JID) Bare() JID {
+	j.Resource = ""
+	return j
+}
+
+// WithResource returns the JID with the resource r, or without one if r is empty.
+func (j JID) WithResource(r string) JID {
+	j.Resource = r
+	return j
+}
+
+// IsBare reports whether the JID has no resource.
+func (j JID) IsBare() bool {
+	return j.Resource == ""
+}
+
+// String returns the JID as it is written in stanzas.
+func (j JID) String() string {
+	s := j.Domain
+	if j.Local != "" {
+		s = j.Local + "@" + s
+	}
+	if j.Resource != "" {
+		s += "/" + j.Resource
+	}
+	return s
+}
+
+// isJIDEscape reports whether s starts with the code of an escaped character, xep-0106.
+func isJIDEscape(s string) bool {
+	if len(s) < 2 {
+		return false
+	}
+	switch s[:2] {
+	case "20", "22", "26", "27", "2f", "3a", "3c", "3e", "40", "5c":
+		return true
+	}
+	return false
+}
+
+// EscapeLocalpart escapes the characters that may not appear in a localpart, xep-0106,
+// so that e.g. "d'artagnan" becomes "d\27artagnan". A backslash is escaped only where it
+// would otherwise be taken for the start of an escape.
+func EscapeLocalpart(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '"', '&', '\'', '/', ':', '<', '>', '@':
+			b.WriteString(`\` + strconv.FormatUint(uint64(c), 16))
+		case '\\':
+			if isJIDEscape(s[i+1:]) {
+				b.WriteString(`\5c`)
+			} else {
+				b.WriteByte(c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeLocalpart reverses EscapeLocalpart, for showing a localpart to people.
+func UnescapeLocalpart(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && isJIDEscape(s[i+1:]) {
+			c, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			b.WriteByte(byte(c))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// escapeJID escapes the localpart of the JID s if it holds characters a localpart may
+// not, like the space in "user name@example.com". A localpart that needs no escaping is
+// left alone, so that JIDs escaped already are not escaped twice.
+func escapeJID(s string) string {
+	bare, resource := s, ""
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		bare, resource = s[:i], s[i:]
+	}
+	i := strings.LastIndexByte(bare, '@')
+	if i < 0 || strings.IndexFunc(bare[:i], invalidLocalRune) < 0 {
+		return s
+	}
+	return EscapeLocalpart(bare[:i]) + bare[i:] + resource
+}
+
+// splitUser splits the account user@domain at its last '@', as a domain cannot hold one.
+func splitUser(user string) (local, domain string, ok bool) {
+	i := strings.LastIndexByte(user, '@')
+	if i < 0 {
+		return "", "", false
+	}
+	return user[:i], user[i+1:], true
+}
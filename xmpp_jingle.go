@@ -0,0 +1,265 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nsJingle   = "urn:xmpp:jingle:1"
+	nsJingleFT = "urn:xmpp:jingle:apps:file-transfer:5"
+	nsHashes   = "urn:xmpp:hashes:2"
+)
+
+// Namespaces of the Jingle transports, used as JingleTransport.Namespace.
+const (
+	JingleTransportIBB = "urn:xmpp:jingle:transports:ibb:1"
+	JingleTransportS5B = "urn:xmpp:jingle:transports:s5b:1"
+)
+
+// Jingle actions, xep-0166 7.2.
+const (
+	JingleSessionInitiate  = "session-initiate"
+	JingleSessionAccept    = "session-accept"
+	JingleSessionTerminate = "session-terminate"
+	JingleSessionInfo      = "session-info"
+	JingleTransportInfo    = "transport-info"
+	JingleTransportReplace = "transport-replace"
+	JingleTransportAccept  = "transport-accept"
+	JingleTransportReject  = "transport-reject"
+)
+
+// JingleSession identifies a Jingle session, xep-0166, and the one content of it.
+type JingleSession struct {
+	Peer      string // full JID of the other party
+	SID       string
+	Initiator string // full JID of the party that initiated the session
+	Content   string // name of the content
+	Creator   string // "initiator" or "responder"
+}
+
+// JingleFile describes a file offered for transfer, xep-0234 4. Zero fields are left out.
+type JingleFile struct {
+	Name      string
+	MediaType string
+	Size      int64
+	Date      time.Time // last modification
+	Desc      string
+	Hashes    []FileHash
+}
+
+// FileHash is a hash of a file, xep-0300, like Algo "sha-256" and the base64 encoded Value.
+type FileHash struct {
+	Algo  string
+	Value string
+}
+
+// JingleTransport is the transport of a Jingle session, like JingleTransportIBB. The
+// bytes are sent over the bytestream with SID, in blocks of BlockSize with IBB.
+type JingleTransport struct {
+	Namespace string
+	SID       string
+	BlockSize int
+}
+
+// JingleOffer is returned from Recv when Session.Peer offers us a file, xep-0234 6.1.
+// Answer it with AcceptFile, or with TerminateJingle and the reason "decline".
+type JingleOffer struct {
+	Session   JingleSession
+	File      JingleFile
+	Transport JingleTransport
+}
+
+// JingleAction is returned from Recv for the Jingle actions other than file offers, like
+// JingleSessionAccept after OfferFile, or JingleSessionTerminate. Recv does not keep
+// track of the sessions, so it is up to the caller to check that Session.Peer is the
+// other party of the session with Session.SID.
+type JingleAction struct {
+	Session   JingleSession
+	Action    string
+	Transport *JingleTransport // of session-accept and the transport actions
+	Reason    string           // condition of session-terminate, like "success" or "decline"
+}
+
+// xep-0166  Jingle
+type clientJingle struct {
+	XMLName   xml.Name              `xml:"urn:xmpp:jingle:1 jingle"`
+	Action    string                `xml:"action,attr"`
+	Initiator string                `xml:"initiator,attr"`
+	SID       string                `xml:"sid,attr"`
+	Contents  []clientJingleContent `xml:"content"`
+	Reason    *struct {
+		Conditions []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"reason"`
+}
+
+type clientJingleContent struct {
+	Creator     string `xml:"creator,attr"`
+	Name        string `xml:"name,attr"`
+	Description *struct {
+		File clientJingleFile `xml:"file"`
+	} `xml:"urn:xmpp:jingle:apps:file-transfer:5 description"`
+	Transport *struct {
+		XMLName   xml.Name
+		SID       string `xml:"sid,attr"`
+		BlockSize int    `xml:"block-size,attr"`
+	} `xml:"transport"`
+}
+
+type clientJingleFile struct {
+	Name      string `xml:"name"`
+	MediaType string `xml:"media-type"`
+	Size      int64  `xml:"size"`
+	Date      string `xml:"date"`
+	Desc      string `xml:"desc"`
+	Hashes    []struct {
+		Algo  string `xml:"algo,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// OfferFile offers the file to the entity with the full JID to, xep-0234 6.1, to be
+// sent over transport, and waits for the acknowledgement. Recv returns the answer, a
+// JingleAction with JingleSessionAccept or JingleSessionTerminate, later.
+func (c *Client) OfferFile(ctx context.Context, to string, file JingleFile, transport JingleTransport) (*JingleSession, error) {
+	s := &JingleSession{Peer: to, SID: NewID(), Initiator: c.JID(), Content: "file", Creator: "initiator"}
+	content := "<description xmlns='" + nsJingleFT + "'>" + file.element() + "</description>" + transport.element()
+	if err := c.sendJingle(ctx, *s, JingleSessionInitiate, content, ""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptFile accepts the offer, xep-0234 6.1, to be sent over transport, usually the
+// transport of the offer, and waits for the acknowledgement.
+func (c *Client) AcceptFile(ctx context.Context, offer JingleOffer, transport JingleTransport) error {
+	content := "<description xmlns='" + nsJingleFT + "'>" + offer.File.element() + "</description>" + transport.element()
+	return c.sendJingle(ctx, offer.Session, JingleSessionAccept, content, "")
+}
+
+// TerminateJingle ends the session for reason, xep-0166 7.4, like "success" once the
+// file was transferred, "decline" to reject an offer or "cancel", and waits for the
+// acknowledgement.
+func (c *Client) TerminateJingle(ctx context.Context, s JingleSession, reason string) error {
+	if reason == "" || strings.Trim(reason, "abcdefghijklmnopqrstuvwxyz-") != "" {
+		return errors.New("xmpp: invalid Jingle reason " + reason)
+	}
+	return c.sendJingle(ctx, s, JingleSessionTerminate, "", "<reason><"+reason+"/></reason>")
+}
+
+// SendJingleTransport sends one of the transport actions, like JingleTransportReplace
+// to fall back to another transport, xep-0166 7.2, and waits for the acknowledgement.
+func (c *Client) SendJingleTransport(ctx context.Context, s JingleSession, action string, transport JingleTransport) error {
+	switch action {
+	case JingleTransportInfo, JingleTransportReplace, JingleTransportAccept, JingleTransportReject:
+	default:
+		return errors.New("xmpp: not a Jingle transport action: " + action)
+	}
+	return c.sendJingle(ctx, s, action, transport.element(), "")
+}
+
+// sendJingle sends the Jingle action of session s with the content and the reason
+// elements, if any.
+func (c *Client) sendJingle(ctx context.Context, s JingleSession, action, content, reason string) error {
+	body := "<jingle xmlns='" + nsJingle + "' action='" + xmlEscape(action) + "' initiator='" + xmlEscape(s.Initiator) +
+		"' sid='" + xmlEscape(s.SID) + "'>"
+	if content != "" {
+		body += "<content creator='" + xmlEscape(s.Creator) + "' name='" + xmlEscape(s.Content) + "'>" + content + "</content>"
+	}
+	_, err := c.sendIQContext(ctx, s.Peer, IQTypeSet, body+reason+"</jingle>")
+	return err
+}
+
+func (f JingleFile) element() string {
+	e := "<file>"
+	if !f.Date.IsZero() {
+		e += "<date>" + f.Date.UTC().Format(time.RFC3339) + "</date>"
+	}
+	if f.Desc != "" {
+		e += "<desc>" + xmlEscape(f.Desc) + "</desc>"
+	}
+	if f.MediaType != "" {
+		e += "<media-type>" + xmlEscape(f.MediaType) + "</media-type>"
+	}
+	if f.Name != "" {
+		e += "<name>" + xmlEscape(f.Name) + "</name>"
+	}
+	if f.Size > 0 {
+		e += "<size>" + strconv.FormatInt(f.Size, 10) + "</size>"
+	}
+	for _, h := range f.Hashes {
+		e += "<hash xmlns='" + nsHashes + "' algo='" + xmlEscape(h.Algo) + "'>" + xmlEscape(h.Value) + "</hash>"
+	}
+	return e + "</file>"
+}
+
+func (t JingleTransport) element() string {
+	e := "<transport xmlns='" + xmlEscape(t.Namespace) + "'"
+	if t.SID != "" {
+		e += " sid='" + xmlEscape(t.SID) + "'"
+	}
+	if t.BlockSize > 0 {
+		e += " block-size='" + strconv.Itoa(t.BlockSize) + "'"
+	}
+	return e + "/>"
+}
+
+// jingle acknowledges a Jingle action and returns the JingleOffer or JingleAction for
+// it. It reports whether iq was one; offers of anything but a file are left to the caller.
+func (c *Client) jingle(iq *clientIQ) (interface{}, bool) {
+	if iq.Type != IQTypeSet || iq.Query.XMLName.Space != nsJingle {
+		return nil, false
+	}
+	var j clientJingle
+	if err := iq.decodeQuery(&j); err != nil || j.SID == "" {
+		return nil, false
+	}
+	s := JingleSession{Peer: iq.From, SID: j.SID, Initiator: j.Initiator}
+	var content clientJingleContent
+	if len(j.Contents) > 0 {
+		content = j.Contents[0]
+		s.Content, s.Creator = content.Name, content.Creator
+	}
+	var transport *JingleTransport
+	if t := content.Transport; t != nil {
+		transport = &JingleTransport{Namespace: t.XMLName.Space, SID: t.SID, BlockSize: t.BlockSize}
+	}
+
+	var v interface{}
+	if j.Action == JingleSessionInitiate {
+		if content.Description == nil || transport == nil {
+			return nil, false
+		}
+		// The one offering the file is the initiator, whatever it says.
+		s.Initiator = iq.From
+		v = JingleOffer{Session: s, File: content.Description.File.file(), Transport: *transport}
+	} else {
+		a := JingleAction{Session: s, Action: j.Action, Transport: transport}
+		if j.Reason != nil {
+			for _, cond := range j.Reason.Conditions {
+				if cond.XMLName.Local != "text" {
+					a.Reason = cond.XMLName.Local
+					break
+				}
+			}
+		}
+		v = a
+	}
+	c.sendf("<iq type='result'%s id='%s'/>", replyAttrs(iq), xmlEscape(iq.ID))
+	return v, true
+}
+
+func (f *clientJingleFile) file() JingleFile {
+	file := JingleFile{Name: f.Name, MediaType: f.MediaType, Size: f.Size, Desc: f.Desc}
+	file.Date, _ = time.Parse(time.RFC3339, strings.TrimSpace(f.Date))
+	for _, h := range f.Hashes {
+		file.Hashes = append(file.Hashes, FileHash{Algo: h.Algo, Value: strings.TrimSpace(h.Value)})
+	}
+	return file
+}
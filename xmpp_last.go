@@ -0,0 +1,49 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+const nsLast = "jabber:iq:last"
+
+type clientLast struct {
+	XMLName xml.Name `xml:"jabber:iq:last query"`
+	Seconds uint64   `xml:"seconds,attr"`
+	Status  string   `xml:",chardata"`
+}
+
+// LastActivity queries the last activity of jid, xep-0012, and waits for the answer.
+// For a bare JID, the server answers with the seconds since the account went offline
+// and the status it left with; for a full JID, the client answers with the seconds it
+// has been idle; for a server, with its uptime. If the entity does not let us know,
+// the error is a *StanzaError, e.g. forbidden.
+func (c *Client) LastActivity(jid string) (seconds uint64, status string, err error) {
+	iq, err := c.sendIQ(jid, IQTypeGet, "<query xmlns='"+nsLast+"'/>")
+	if err != nil {
+		return 0, "", err
+	}
+	var q clientLast
+	if err = iq.decodeQuery(&q); err != nil {
+		return 0, "", err
+	}
+	return q.Seconds, strings.TrimSpace(q.Status), nil
+}
+
+// idle returns the time since we last sent a message or presence.
+func (c *Client) idle() time.Duration {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if c.lastActive.IsZero() {
+		return 0
+	}
+	return time.Since(c.lastActive)
+}
+
+// isActivity reports whether sending s counts as activity of the user: automatic
+// replies to IQs do not.
+func isActivity(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "<message") || strings.HasPrefix(s, "<presence")
+}
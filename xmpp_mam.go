@@ -0,0 +1,166 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nsMAM = "urn:xmpp:mam:2"
+	nsRSM = "http://jabber.org/protocol/rsm"
+)
+
+// MAMQuery selects archived messages, xep-0313 4.1, and a page of them, xep-0059.
+// Zero fields do not restrict the query.
+type MAMQuery struct {
+	To     string // archive to query, like a MUC room; empty for our own archive
+	With   string // only messages exchanged with this JID
+	Start  time.Time
+	End    time.Time
+	Max    int    // maximum number of messages in the page
+	After  string // page after the message with this archive ID, e.g. MAMFin.Last
+	Before string // page before the message with this archive ID, e.g. MAMFin.First
+	Latest bool   // page of the most recent messages, if Before is empty
+}
+
+// ArchivedMessage is a message from a message archive.
+type ArchivedMessage struct {
+	ID    string // archive ID, usable as MAMQuery.After or MAMQuery.Before
+	Stamp time.Time
+	Chat  Chat
+}
+
+// MAMFin describes the page of the messages returned by QueryMAM.
+type MAMFin struct {
+	Complete bool   // whether this is the last page in the direction of the query
+	First    string // archive ID of the first message in the page
+	Last     string // archive ID of the last message in the page
+	Count    int    // number of all messages matching the query, if the server tells
+}
+
+// mamCollector gathers the results of a running query.
+type mamCollector struct {
+	from     string // archive the results have to come from
+	messages []ArchivedMessage
+}
+
+// XEP-0313  Message Archive Management
+type clientMAMResult struct {
+	XMLName   xml.Name         `xml:"urn:xmpp:mam:2 result"`
+	QueryID   string           `xml:"queryid,attr"`
+	ID        string           `xml:"id,attr"`
+	Forwarded *clientForwarded `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+type clientMAMFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete string   `xml:"complete,attr"`
+	Set      struct {
+		First string `xml:"first"`
+		Last  string `xml:"last"`
+		Count int    `xml:"count"`
+	} `xml:"http://jabber.org/protocol/rsm set"`
+}
+
+// QueryMAM queries a message archive and waits for the page of messages it returns,
+// oldest first. To fetch the next page, query again with After set to fin.Last, or
+// with Before set to fin.First when paging backwards, until fin.Complete is set.
+// The messages are read by Recv, which has to be running in another goroutine,
+// and are not returned from there.
+func (c *Client) QueryMAM(ctx context.Context, q MAMQuery) ([]ArchivedMessage, *MAMFin, error) {
+	form := &DataForm{}
+	if q.With != "" {
+		form.Fields = append(form.Fields, DataFormField{Var: "with", Values: []string{q.With}})
+	}
+	if !q.Start.IsZero() {
+		form.Fields = append(form.Fields, DataFormField{Var: "start", Values: []string{q.Start.UTC().Format(time.RFC3339)}})
+	}
+	if !q.End.IsZero() {
+		form.Fields = append(form.Fields, DataFormField{Var: "end", Values: []string{q.End.UTC().Format(time.RFC3339)}})
+	}
+	x, err := submitForm(form, nsMAM)
+	if err != nil {
+		return nil, nil, err
+	}
+	var set string
+	if q.Max > 0 {
+		set += "<max>" + strconv.Itoa(q.Max) + "</max>"
+	}
+	if q.After != "" {
+		set += "<after>" + xmlEscape(q.After) + "</after>"
+	}
+	if q.Before != "" {
+		set += "<before>" + xmlEscape(q.Before) + "</before>"
+	} else if q.Latest {
+		set += "<before/>"
+	}
+	if set != "" {
+		set = "<set xmlns='" + nsRSM + "'>" + set + "</set>"
+	}
+
+	queryID := strconv.FormatUint(uint64(getCookie()), 10)
+	col := &mamCollector{from: strings.ToLower(q.To)}
+	c.mamMutex.Lock()
+	if c.mamQueries == nil {
+		c.mamQueries = make(map[string]*mamCollector)
+	}
+	c.mamQueries[queryID] = col
+	c.mamMutex.Unlock()
+	defer func() {
+		c.mamMutex.Lock()
+		delete(c.mamQueries, queryID)
+		c.mamMutex.Unlock()
+	}()
+
+	iq, err := c.sendIQContext(ctx, q.To, IQTypeSet, "<query xmlns='"+nsMAM+"' queryid='"+queryID+"'>"+x+set+"</query>")
+	if err != nil {
+		return nil, nil, err
+	}
+	var f clientMAMFin
+	if err = iq.decodeQuery(&f); err != nil {
+		return nil, nil, err
+	}
+	c.mamMutex.Lock()
+	messages := col.messages
+	c.mamMutex.Unlock()
+	return messages, &MAMFin{
+		Complete: f.Complete == "true" || f.Complete == "1",
+		First:    f.Set.First,
+		Last:     f.Set.Last,
+		Count:    f.Set.Count,
+	}, nil
+}
+
+// deliverMAM hands an archived message to the query it belongs to and reports whether
+// there was one. Results claiming to come from another archive are dropped.
+func (c *Client) deliverMAM(m *clientMessage) bool {
+	r := m.MAMResult
+	if r == nil || r.QueryID == "" {
+		return false
+	}
+	c.mamMutex.Lock()
+	defer c.mamMutex.Unlock()
+	col, ok := c.mamQueries[r.QueryID]
+	if !ok {
+		return false
+	}
+	from := strings.ToLower(m.From)
+	if col.from == "" {
+		if from != "" && from != strings.ToLower(strings.SplitN(c.JID(), "/", 2)[0]) {
+			return true
+		}
+	} else if from != col.from {
+		return true
+	}
+	archive := col.from
+	if archive == "" {
+		archive = strings.SplitN(c.JID(), "/", 2)[0]
+	}
+	if fw := r.Forwarded.forwarded(); fw != nil && !c.duplicateArchived(archive, r.ID, r.Forwarded.Message) {
+		col.messages = append(col.messages, ArchivedMessage{ID: r.ID, Stamp: fw.Stamp, Chat: fw.Chat})
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package xmpp
+
+const nsChatMarkers = "urn:xmpp:chat-markers:0"
+
+// Chat marker types, xep-0333 3.
+const (
+	MarkerReceived     = "received"
+	MarkerDisplayed    = "displayed"
+	MarkerAcknowledged = "acknowledged"
+)
+
+// ChatMarker tells that the message with ID was received, displayed or acknowledged.
+type ChatMarker struct {
+	Type string // MarkerReceived, MarkerDisplayed or MarkerAcknowledged
+	ID   string // id of the marked message
+}
+
+// SendDisplayed tells the sender of the markable message with id that the user has read it,
+// xep-0333 3.3. The type should be the one of the marked message, "chat" or "groupchat".
+func (c *Client) SendDisplayed(to, typ, id string) error {
+	return c.SendChatMarker(to, typ, ChatMarker{Type: MarkerDisplayed, ID: id})
+}
+
+// SendChatMarker sends a chat marker for a message of type typ received from to.
+func (c *Client) SendChatMarker(to, typ string, m ChatMarker) error {
+	_, err := c.sendf("<message to='%s' type='%s' id='%s'><%s xmlns='%s' id='%s'/></message>",
+		xmlEscape(to), xmlEscape(typ), NewID(), xmlEscape(m.Type), nsChatMarkers, xmlEscape(m.ID))
+	return err
+}
+
+// XEP-0333  Chat Markers
+type clientChatMarker struct {
+	ID string `xml:"id,attr"`
+}
+
+// marker returns the chat marker of a message, if it has any.
+func (m *clientMessage) marker() *ChatMarker {
+	switch {
+	case m.Received != nil:
+		return &ChatMarker{Type: MarkerReceived, ID: m.Received.ID}
+	case m.Displayed != nil:
+		return &ChatMarker{Type: MarkerDisplayed, ID: m.Displayed.ID}
+	case m.Acknowledged != nil:
+		return &ChatMarker{Type: MarkerAcknowledged, ID: m.Acknowledged.ID}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+const (
+	nsMood     = "http://jabber.org/protocol/mood"
+	nsActivity = "http://jabber.org/protocol/activity"
+)
+
+// Mood is the mood of From, xep-0107, like "happy", with an optional text. Recv returns
+// it for the moods our contacts publish if AddFeature announced
+// "http://jabber.org/protocol/mood+notify" before sending presence. An empty Mood means
+// the contact cleared it.
+type Mood struct {
+	From string
+	Mood string
+	Text string
+}
+
+// Activity is the activity of From, xep-0108, like General "relaxing" and Specific
+// "reading", with an optional text. Recv returns it for the activities our contacts
+// publish if AddFeature announced "http://jabber.org/protocol/activity+notify" before
+// sending presence. An empty General means the contact cleared it.
+type Activity struct {
+	From     string
+	General  string
+	Specific string
+	Text     string
+}
+
+// XEP-0107  User Mood
+type clientMood struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/mood mood"`
+	Values  []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+	Text string `xml:"text"`
+}
+
+// XEP-0108  User Activity
+type clientActivity struct {
+	XMLName  xml.Name `xml:"http://jabber.org/protocol/activity activity"`
+	Generals []struct {
+		XMLName   xml.Name
+		Specifics []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:",any"`
+	Text string `xml:"text"`
+}
+
+// PublishMood publishes our mood, like "happy", xep-0107 2.1, and waits for the result.
+// An empty mood clears it.
+func (c *Client) PublishMood(mood, text string) error {
+	if !isPEPValue(mood) {
+		return errors.New("xmpp: invalid mood " + mood)
+	}
+	item := "<mood xmlns='" + nsMood + "'>"
+	if mood != "" {
+		item += "<" + mood + "/>" + textElement(text)
+	}
+	_, err := c.PubsubPublish(nsMood, "", "", item+"</mood>")
+	return err
+}
+
+// PublishActivity publishes our activity, like general "relaxing" and specific "reading",
+// xep-0108 2.1, and waits for the result. specific may be empty; an empty general clears
+// the activity.
+func (c *Client) PublishActivity(general, specific, text string) error {
+	if !isPEPValue(general) || !isPEPValue(specific) || general == "" && specific != "" {
+		return errors.New("xmpp: invalid activity " + general + "/" + specific)
+	}
+	item := "<activity xmlns='" + nsActivity + "'>"
+	switch {
+	case specific != "":
+		item += "<" + general + "><" + specific + "/></" + general + ">" + textElement(text)
+	case general != "":
+		item += "<" + general + "/>" + textElement(text)
+	}
+	_, err := c.PubsubPublish(nsActivity, "", "", item+"</activity>")
+	return err
+}
+
+// isPEPValue reports whether s can be the name of a mood or an activity element, like
+// "in_love", or is empty.
+func isPEPValue(s string) bool {
+	return strings.Trim(s, "abcdefghijklmnopqrstuvwxyz_") == ""
+}
+
+func textElement(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "<text>" + xmlEscape(text) + "</text>"
+}
+
+// moodEvent returns the Mood in the PEP notification event from from.
+func moodEvent(event clientPubsubEvent, from string) Mood {
+	m := Mood{From: from}
+	if len(event.Items.Items) == 0 {
+		return m
+	}
+	var mood clientMood
+	if xml.Unmarshal(event.Items.Items[0].Body, &mood) != nil {
+		return m
+	}
+	if len(mood.Values) > 0 {
+		m.Mood, m.Text = mood.Values[0].XMLName.Local, mood.Text
+	}
+	return m
+}
+
+// activityEvent returns the Activity in the PEP notification event from from.
+func activityEvent(event clientPubsubEvent, from string) Activity {
+	a := Activity{From: from}
+	if len(event.Items.Items) == 0 {
+		return a
+	}
+	var activity clientActivity
+	if xml.Unmarshal(event.Items.Items[0].Body, &activity) != nil {
+		return a
+	}
+	if len(activity.Generals) > 0 {
+		g := activity.Generals[0]
+		a.General, a.Text = g.XMLName.Local, activity.Text
+		if len(g.Specifics) > 0 {
+			a.Specific = g.Specifics[0].XMLName.Local
+		}
+	}
+	return a
+}
@@ -8,14 +8,19 @@
 package xmpp
 
 import (
+	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
 	nsMUC          = "http://jabber.org/protocol/muc"
 	nsMUCUser      = "http://jabber.org/protocol/muc#user"
+	nsMUCAdmin     = "http://jabber.org/protocol/muc#admin"
 	NoHistory      = 0
 	CharHistory    = 1
 	StanzaHistory  = 2
@@ -23,17 +28,130 @@ const (
 	SinceHistory   = 4
 )
 
+// MUC status codes, xep-0045 15.6
+const (
+	MUCStatusNonAnonymous    = 100
+	MUCStatusSelfPresence    = 110
+	MUCStatusRoomCreated     = 201
+	MUCStatusNickModified    = 210
+	MUCStatusBanned          = 301
+	MUCStatusNickChanged     = 303
+	MUCStatusKicked          = 307
+	MUCStatusAffiliationLost = 321
+	MUCStatusMembersOnly     = 322
+	MUCStatusShutdown        = 332
+)
+
+// MUCUser is the occupant information a room adds to the presence of its occupants.
+type MUCUser struct {
+	// JID is the real JID of the occupant, if the room discloses it to us.
+	JID         string
+	Affiliation string // owner, admin, member, outcast, or none
+	Role        string // moderator, participant, visitor, or none
+	// Nick is the new nick of the occupant if it changed its nick (status code 303).
+	Nick   string
+	Reason string
+	// StatusCodes lists the status codes of the presence, e.g. MUCStatusKicked.
+	StatusCodes []int
+}
+
+// HasStatus reports whether the presence carries the given status code.
+func (u *MUCUser) HasStatus(code int) bool {
+	for _, c := range u.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// MUCDestroy describes the destruction of a room, xep-0045 10.9.
+type MUCDestroy struct {
+	// JID is the address of an alternate room the occupants are invited to join, if any.
+	JID      string
+	Password string
+	Reason   string
+}
+
+type clientMUCUser struct {
+	XMLName xml.Name          `xml:"http://jabber.org/protocol/muc#user x"`
+	Item    *clientMUCItem    `xml:"item"`
+	Status  []clientMUCStatus `xml:"status"`
+	Destroy *clientMUCDestroy `xml:"destroy"`
+}
+
+type clientMUCItem struct {
+	Affiliation string `xml:"affiliation,attr"`
+	Role        string `xml:"role,attr"`
+	JID         string `xml:"jid,attr"`
+	Nick        string `xml:"nick,attr"`
+	Reason      string `xml:"reason"`
+}
+
+type clientMUCStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type clientMUCDestroy struct {
+	JID      string `xml:"jid,attr"`
+	Password string `xml:"password"`
+	Reason   string `xml:"reason"`
+}
+
+func (x *clientMUCUser) user() *MUCUser {
+	if x == nil {
+		return nil
+	}
+	u := &MUCUser{}
+	if x.Item != nil {
+		u.JID = x.Item.JID
+		u.Affiliation = x.Item.Affiliation
+		u.Role = x.Item.Role
+		u.Nick = x.Item.Nick
+		u.Reason = x.Item.Reason
+	}
+	for _, s := range x.Status {
+		u.StatusCodes = append(u.StatusCodes, s.Code)
+	}
+	return u
+}
+
+func (x *clientMUCUser) destroy() *MUCDestroy {
+	if x == nil || x.Destroy == nil {
+		return nil
+	}
+	return &MUCDestroy{
+		JID:      x.Destroy.JID,
+		Password: x.Destroy.Password,
+		Reason:   x.Destroy.Reason,
+	}
+}
+
+func (x *clientMUCUser) hasStatus(code int) bool {
+	if x == nil {
+		return false
+	}
+	for _, s := range x.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
 // Send sends room topic wrapped inside an XMPP message stanza body.
 func (c *Client) SendTopic(chat Chat) (n int, err error) {
-	return fmt.Fprintf(c.conn, "<message to='%s' type='%s' xml:lang='en'>"+"<subject>%s</subject></message>",
+	return c.sendf("<message to='%s' type='%s' xml:lang='en'>"+"<subject>%s</subject></message>",
 		xmlEscape(chat.Remote), xmlEscape(chat.Type), xmlEscape(chat.Text))
 }
 
 func (c *Client) JoinMUCNoHistory(jid, nick string) (n int, err error) {
+	jid = escapeJID(jid)
 	if nick == "" {
-		nick = c.jid
+		nick = c.JID()
 	}
-	return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+	c.resetOccupants(jid)
+	return c.sendf("<presence to='%s/%s'>\n"+
 		"<x xmlns='%s'>"+
 		"<history maxchars='0'/></x>\n"+
 		"</presence>",
@@ -42,36 +160,38 @@ func (c *Client) JoinMUCNoHistory(jid, nick string) (n int, err error) {
 
 // xep-0045 7.2
 func (c *Client) JoinMUC(jid, nick string, history_type, history int, history_date *time.Time) (n int, err error) {
+	jid = escapeJID(jid)
 	if nick == "" {
-		nick = c.jid
+		nick = c.JID()
 	}
+	c.resetOccupants(jid)
 	switch history_type {
 	case NoHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s' />\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC)
 	case CharHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<history maxchars='%d'/></x>\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC, history)
 	case StanzaHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<history maxstanzas='%d'/></x>\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC, history)
 	case SecondsHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<history seconds='%d'/></x>\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC, history)
 	case SinceHistory:
 		if history_date != nil {
-			return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+			return c.sendf("<presence to='%s/%s'>\n"+
 				"<x xmlns='%s'>\n"+
 				"<history since='%s'/></x>\n"+
 				"</presence>",
@@ -83,33 +203,35 @@ func (c *Client) JoinMUC(jid, nick string, history_type, history int, history_da
 
 // xep-0045 7.2.6
 func (c *Client) JoinProtectedMUC(jid, nick string, password string, history_type, history int, history_date *time.Time) (n int, err error) {
+	jid = escapeJID(jid)
 	if nick == "" {
-		nick = c.jid
+		nick = c.JID()
 	}
+	c.resetOccupants(jid)
 	switch history_type {
 	case NoHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<password>%s</password>"+
 			"</x>\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC, xmlEscape(password))
 	case CharHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<password>%s</password>\n"+
 			"<history maxchars='%d'/></x>\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC, xmlEscape(password), history)
 	case StanzaHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<password>%s</password>\n"+
 			"<history maxstanzas='%d'/></x>\n"+
 			"</presence>",
 			xmlEscape(jid), xmlEscape(nick), nsMUC, xmlEscape(password), history)
 	case SecondsHistory:
-		return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+		return c.sendf("<presence to='%s/%s'>\n"+
 			"<x xmlns='%s'>\n"+
 			"<password>%s</password>\n"+
 			"<history seconds='%d'/></x>\n"+
@@ -117,7 +239,7 @@ func (c *Client) JoinProtectedMUC(jid, nick string, password string, history_typ
 			xmlEscape(jid), xmlEscape(nick), nsMUC, xmlEscape(password), history)
 	case SinceHistory:
 		if history_date != nil {
-			return fmt.Fprintf(c.conn, "<presence to='%s/%s'>\n"+
+			return c.sendf("<presence to='%s/%s'>\n"+
 				"<x xmlns='%s'>\n"+
 				"<password>%s</password>\n"+
 				"<history since='%s'/></x>\n"+
@@ -130,6 +252,284 @@ func (c *Client) JoinProtectedMUC(jid, nick string, password string, history_typ
 
 // xep-0045 7.14
 func (c *Client) LeaveMUC(jid string) (n int, err error) {
-	return fmt.Fprintf(c.conn, "<presence from='%s' to='%s' type='unavailable' />",
-		c.jid, xmlEscape(jid))
+	return c.sendf("<presence from='%s' to='%s' type='unavailable' />",
+		c.JID(), xmlEscape(jid))
+}
+
+// EnterMUC joins the room roomJID as nick and waits until the room confirms the join by
+// reflecting our own presence (status code 110). password may be empty if the room is not
+// password protected. If the room rejects the join, e.g. because of a nick conflict, the
+// presence error is returned, or a *MUCPasswordError for a missing or wrong password.
+// It fails if another join of the room is still waiting, and waits forever for a room
+// that never answers; see EnterMUCContext. The room's response is read by Recv,
+// which has to be running in another goroutine.
+// xep-0045 7.2
+func (c *Client) EnterMUC(roomJID, nick, password string) error {
+	return c.EnterMUCContext(context.Background(), roomJID, nick, password)
+}
+
+// EnterMUCContext is EnterMUC, but gives up waiting for the room once ctx is done.
+func (c *Client) EnterMUCContext(ctx context.Context, roomJID, nick, password string) error {
+	return c.enterMUC(ctx, roomJID, nick, mucPasswordElement(password))
+}
+
+// mucPasswordElement returns the <password/> element of a join, none for an empty password.
+func mucPasswordElement(password string) string {
+	if password == "" {
+		return ""
+	}
+	return "<password>" + xmlEscape(password) + "</password>"
+}
+
+// enterMUC sends our presence to the room with the given muc payload and waits for the
+// self-presence. Only one join of a room can wait at a time.
+func (c *Client) enterMUC(ctx context.Context, roomJID, nick, payload string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	roomJID = escapeJID(roomJID)
+	room := strings.ToLower(roomJID)
+	ch := make(chan *clientPresence, 1)
+	c.mucMutex.Lock()
+	if _, ok := c.mucJoins[room]; ok {
+		c.mucMutex.Unlock()
+		return errors.New("xmpp: already joining " + roomJID)
+	}
+	if c.mucJoins == nil {
+		c.mucJoins = make(map[string]chan *clientPresence)
+	}
+	c.mucJoins[room] = ch
+	c.mucMutex.Unlock()
+	c.resetOccupants(roomJID)
+	stopWaiting := func() {
+		c.mucMutex.Lock()
+		if c.mucJoins[room] == ch {
+			delete(c.mucJoins, room)
+		}
+		c.mucMutex.Unlock()
+	}
+
+	_, err := c.sendf("<presence to='%s/%s'><x xmlns='%s'>%s</x></presence>",
+		xmlEscape(roomJID), xmlEscape(nick), nsMUC, payload)
+	if err != nil {
+		stopWaiting()
+		return err
+	}
+
+	var p *clientPresence
+	var ok bool
+	select {
+	case p, ok = <-ch:
+	case <-ctx.Done():
+		stopWaiting()
+		return ctx.Err()
+	}
+	if !ok {
+		return errors.New("xmpp: connection closed while joining " + roomJID)
+	}
+	if p.Type == "error" {
+		if p.Error == nil {
+			return errors.New("xmpp: failed to join " + roomJID)
+		}
+		se := c.stanzaError(p.Error).(*StanzaError)
+		if se.Condition == "not-authorized" {
+			return &MUCPasswordError{Room: roomJID, Err: se}
+		}
+		return se
+	}
+	return nil
+}
+
+// MUCPasswordError is returned when joining a password-protected room without the
+// right password, xep-0045 7.2.6.
+type MUCPasswordError struct {
+	Room string
+	Err  *StanzaError
+}
+
+func (e *MUCPasswordError) Error() string {
+	return "xmpp: wrong or missing password for " + e.Room + ": " + e.Err.Error()
+}
+
+func (e *MUCPasswordError) Unwrap() error {
+	return e.Err
+}
+
+// MUCHistory limits the discussion history a room sends when we join it, xep-0045 7.2.14.
+// Only the non-zero limits are sent. The zero value requests no history at all.
+type MUCHistory struct {
+	MaxStanzas int
+	MaxChars   int
+	Seconds    int
+	Since      time.Time
+}
+
+func (h *MUCHistory) String() string {
+	var attrs string
+	if h != nil {
+		if h.MaxChars > 0 {
+			attrs += fmt.Sprintf(" maxchars='%d'", h.MaxChars)
+		}
+		if h.MaxStanzas > 0 {
+			attrs += fmt.Sprintf(" maxstanzas='%d'", h.MaxStanzas)
+		}
+		if h.Seconds > 0 {
+			attrs += fmt.Sprintf(" seconds='%d'", h.Seconds)
+		}
+		if !h.Since.IsZero() {
+			attrs += fmt.Sprintf(" since='%s'", h.Since.UTC().Format(time.RFC3339))
+		}
+	}
+	if attrs == "" {
+		attrs = " maxstanzas='0'"
+	}
+	return "<history" + attrs + "/>"
+}
+
+// JoinMUCWithHistory joins the room roomJID as nick, requesting only the discussion history
+// allowed by hist; a nil hist requests no history. Like EnterMUC, it waits until the room
+// confirms the join.
+func (c *Client) JoinMUCWithHistory(roomJID, nick string, hist *MUCHistory) error {
+	return c.enterMUC(context.Background(), roomJID, nick, hist.String())
+}
+
+// JoinProtectedMUCWithHistory is JoinMUCWithHistory for a password-protected room.
+func (c *Client) JoinProtectedMUCWithHistory(roomJID, nick, password string, hist *MUCHistory) error {
+	return c.enterMUC(context.Background(), roomJID, nick, mucPasswordElement(password)+hist.String())
+}
+
+// ExitMUC leaves the room roomJID, in which we are present as nick.
+// xep-0045 7.14
+func (c *Client) ExitMUC(roomJID, nick string) error {
+	_, err := c.sendf("<presence to='%s/%s' type='unavailable'/>",
+		xmlEscape(escapeJID(roomJID)), xmlEscape(nick))
+	return err
+}
+
+// deliverMUCPresence hands our self-presence, or a presence error, from a room to the
+// EnterMUC call waiting for it.
+func (c *Client) deliverMUCPresence(p *clientPresence) {
+	if p.Type != "error" && !p.MUCUser.hasStatus(MUCStatusSelfPresence) {
+		return
+	}
+	room := strings.ToLower(strings.SplitN(p.From, "/", 2)[0])
+	c.mucMutex.Lock()
+	ch, ok := c.mucJoins[room]
+	delete(c.mucJoins, room)
+	c.mucMutex.Unlock()
+	if ok {
+		ch <- p
+	}
+}
+
+// MUCOccupant is an occupant of a room we joined, xep-0045 7.2.4.
+type MUCOccupant struct {
+	Nick        string
+	JID         string // real JID, if the room discloses it to us
+	Affiliation string
+	Role        string
+	OccupantID  string // stable id the room gave the occupant, see MUCSupportsOccupantID
+}
+
+// MUCOccupants returns the occupants of the room roomJID, including us, ordered by nick,
+// as announced by the presences Recv read since we last joined the room. Joining a room
+// again, e.g. after a reconnect, forgets the occupants from before, so the list reflects
+// the presences the room sends on the new join.
+func (c *Client) MUCOccupants(roomJID string) []MUCOccupant {
+	c.mucMutex.Lock()
+	defer c.mucMutex.Unlock()
+	var occupants []MUCOccupant
+	for _, o := range c.mucRooms[strings.ToLower(roomJID)] {
+		occupants = append(occupants, o)
+	}
+	sort.Slice(occupants, func(i, j int) bool { return occupants[i].Nick < occupants[j].Nick })
+	return occupants
+}
+
+// resetOccupants forgets the occupants of the room roomJID before we join it.
+func (c *Client) resetOccupants(roomJID string) {
+	c.mucMutex.Lock()
+	defer c.mucMutex.Unlock()
+	if c.mucRooms == nil {
+		c.mucRooms = make(map[string]map[string]MUCOccupant)
+	}
+	c.mucRooms[strings.ToLower(roomJID)] = make(map[string]MUCOccupant)
+}
+
+// trackOccupant updates the occupants of a room we joined with a presence from the room.
+func (c *Client) trackOccupant(p *clientPresence) {
+	if p.MUCUser == nil || p.Type == "error" {
+		return
+	}
+	a := strings.SplitN(p.From, "/", 2)
+	if len(a) != 2 {
+		return
+	}
+	room, nick := strings.ToLower(a[0]), a[1]
+	c.mucMutex.Lock()
+	defer c.mucMutex.Unlock()
+	occupants, ok := c.mucRooms[room]
+	if !ok {
+		return
+	}
+	switch {
+	case p.Type == "unavailable" && p.MUCUser.hasStatus(MUCStatusSelfPresence) && !p.MUCUser.hasStatus(MUCStatusNickChanged):
+		// we left the room
+		delete(c.mucRooms, room)
+	case p.Type == "unavailable":
+		// the occupant left, or changed its nick and comes back with the new one
+		delete(occupants, nick)
+	default:
+		u := p.MUCUser.user()
+		occupants[nick] = MUCOccupant{Nick: nick, JID: u.JID, Affiliation: u.Affiliation, Role: u.Role,
+			OccupantID: p.OccupantID.id()}
+	}
+}
+
+// abortMUCJoins wakes up all EnterMUC calls still waiting once the stream is gone.
+func (c *Client) abortMUCJoins() {
+	c.mucMutex.Lock()
+	for room, ch := range c.mucJoins {
+		close(ch)
+		delete(c.mucJoins, room)
+	}
+	c.mucMutex.Unlock()
+}
+
+// MUCSetRole changes the role of the occupant nick in the room roomJID, e.g. to
+// "moderator", "participant", "visitor" or "none", and waits for the result.
+// If the room refuses the change, the IQ error is returned.
+// xep-0045 8.2, 8.4, 8.5
+func (c *Client) MUCSetRole(roomJID, nick, role, reason string) error {
+	return c.mucAdmin(roomJID, fmt.Sprintf("<item nick='%s' role='%s'>", xmlEscape(nick), xmlEscape(role)), reason)
+}
+
+// MUCSetAffiliation changes the affiliation of userJID with the room roomJID, e.g. to
+// "owner", "admin", "member", "outcast" or "none", and waits for the result.
+// If the room refuses the change, the IQ error is returned.
+// xep-0045 9.1, 9.3, 10.3
+func (c *Client) MUCSetAffiliation(roomJID, userJID, affiliation, reason string) error {
+	return c.mucAdmin(roomJID, fmt.Sprintf("<item jid='%s' affiliation='%s'>", xmlEscape(userJID), xmlEscape(affiliation)), reason)
+}
+
+// MUCKick kicks the occupant nick out of the room roomJID by setting its role to none.
+// xep-0045 8.2
+func (c *Client) MUCKick(roomJID, nick, reason string) error {
+	return c.MUCSetRole(roomJID, nick, "none", reason)
+}
+
+// MUCBan bans userJID from the room roomJID by setting its affiliation to outcast.
+// xep-0045 9.1
+func (c *Client) MUCBan(roomJID, userJID, reason string) error {
+	return c.MUCSetAffiliation(roomJID, userJID, "outcast", reason)
+}
+
+// mucAdmin sends an admin request with the opening item tag and the reason to the room.
+func (c *Client) mucAdmin(roomJID, item, reason string) error {
+	if reason != "" {
+		item += "<reason>" + xmlEscape(reason) + "</reason>"
+	}
+	body := fmt.Sprintf("<query xmlns='%s'>%s</item></query>", nsMUCAdmin, item)
+	_, err := c.sendIQ(roomJID, IQTypeSet, body)
+	return err
 }
@@ -0,0 +1,45 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// sendOAuth sends the <auth/> element of the OAuth mechanism for the account user@domain.
+func (c *Client) sendOAuth(mechanism, user, domain string, o *Options) {
+	if mechanism == "OAUTHBEARER" {
+		c.sendf("<auth xmlns='%s' mechanism='OAUTHBEARER'>%s</auth>\n", nsSASL,
+			base64.StdEncoding.EncodeToString([]byte(oauthBearerPayload(user+"@"+domain, o.OAuthToken))))
+		return
+	}
+	// X-OAUTH2: send base64-encoded \x00 user \x00 token, with the namespace of the service.
+	enc := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + o.OAuthToken))
+	if o.OAuthXmlNs == "" {
+		c.sendf("<auth xmlns='%s' mechanism='X-OAUTH2'>%s</auth>\n", nsSASL, enc)
+		return
+	}
+	c.sendf("<auth xmlns='%s' mechanism='X-OAUTH2' auth:service='oauth2' "+
+		"xmlns:auth='%s'>%s</auth>\n", nsSASL, xmlEscape(o.OAuthXmlNs), enc)
+}
+
+// oauthBearerPayload returns the initial client response of OAUTHBEARER, RFC 7628 3.1,
+// for the authorization identity authzid.
+func oauthBearerPayload(authzid, token string) string {
+	authzid = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(authzid)
+	return "n,a=" + authzid + ",\x01auth=Bearer " + token + "\x01\x01"
+}
+
+// oauthBearerStatus returns the status of the error an OAUTHBEARER server sends as a
+// challenge when it rejects the token, RFC 7628 3.2.2, like "invalid_token".
+func oauthBearerStatus(challenge string) string {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(challenge))
+	if err != nil {
+		return ""
+	}
+	var e struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(b, &e)
+	return e.Status
+}
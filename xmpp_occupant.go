@@ -0,0 +1,35 @@
+package xmpp
+
+const nsOccupantID = "urn:xmpp:occupant-id:0"
+
+// XEP-0421  Anonymous unique occupant identifiers for MUCs
+type clientOccupantID struct {
+	ID string `xml:"id,attr"`
+}
+
+func (o *clientOccupantID) id() string {
+	if o == nil {
+		return ""
+	}
+	return o.ID
+}
+
+// MUCSupportsOccupantID reports whether the room roomJID gives its occupants stable
+// ids, xep-0421 3, like Chat.OccupantID and Presence.OccupantID. Other rooms pass on
+// the ids occupants made up, so those must not be trusted.
+func (c *Client) MUCSupportsOccupantID(roomJID string) (bool, error) {
+	info, err := c.DiscoInfo(roomJID)
+	if err != nil {
+		return false, err
+	}
+	return info.HasFeature(nsOccupantID), nil
+}
+
+// occupantIDElement returns the occupant-id element of a message, if any. A room that
+// supports xep-0421 replaces it with the id it gave us, xep-0421 4.
+func occupantIDElement(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "<occupant-id xmlns='" + nsOccupantID + "' id='" + xmlEscape(id) + "'/>"
+}
@@ -0,0 +1,31 @@
+package xmpp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// verifyPins checks the certificate the server presented on t against
+// Options.PinnedCertSHA256, if set.
+func (o *Options) verifyPins(t *tls.Conn) error {
+	if len(o.PinnedCertSHA256) == 0 {
+		return nil
+	}
+	certs := t.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("xmpp: server presented no certificate to check against PinnedCertSHA256")
+	}
+	certSum := sha256.Sum256(certs[0].Raw)
+	keySum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	for _, pin := range o.PinnedCertSHA256 {
+		pin = strings.ToLower(strings.Replace(pin, ":", "", -1))
+		if pin == hex.EncodeToString(certSum[:]) || pin == hex.EncodeToString(keySum[:]) {
+			return nil
+		}
+	}
+	return errors.New("xmpp: server certificate " + hex.EncodeToString(certSum[:]) +
+		" (public key " + hex.EncodeToString(keySum[:]) + ") matches none of PinnedCertSHA256")
+}
@@ -1,17 +1,19 @@
 package xmpp
 
 import (
-	"fmt"
+	"strings"
 )
 
+const nsPing = "urn:xmpp:ping"
+
 func (c *Client) PingC2S(jid, server string) error {
 	if jid == "" {
-		jid = c.jid
+		jid = c.JID()
 	}
 	if server == "" {
-		server = c.domain
+		server = c.serverDomain()
 	}
-	_, err := fmt.Fprintf(c.conn, "<iq from='%s' to='%s' id='c2s1' type='get'>\n"+
+	_, err := c.sendf("<iq from='%s' to='%s' id='c2s1' type='get'>\n"+
 		"<ping xmlns='urn:xmpp:ping'/>\n"+
 		"</iq>",
 		xmlEscape(jid), xmlEscape(server))
@@ -19,7 +21,7 @@ func (c *Client) PingC2S(jid, server string) error {
 }
 
 func (c *Client) PingS2S(fromServer, toServer string) error {
-	_, err := fmt.Fprintf(c.conn, "<iq from='%s' to='%s' id='s2s1' type='get'>\n"+
+	_, err := c.sendf("<iq from='%s' to='%s' id='s2s1' type='get'>\n"+
 		"<ping xmlns='urn:xmpp:ping'/>\n"+
 		"</iq>",
 		xmlEscape(fromServer), xmlEscape(toServer))
@@ -27,7 +29,28 @@ func (c *Client) PingS2S(fromServer, toServer string) error {
 }
 
 func (c *Client) SendResultPing(id, toServer string) error {
-	_, err := fmt.Fprintf(c.conn, "<iq type='result' to='%s' id='%s'/>",
+	_, err := c.sendf("<iq type='result' to='%s' id='%s'/>",
 		xmlEscape(toServer), xmlEscape(id))
 	return err
 }
+
+// handlePing answers a ping addressed to us, xep-0199 4.1, as far as Options.AutoReply
+// allows, and reports whether iq was one.
+func (c *Client) handlePing(iq *clientIQ) (bool, error) {
+	if iq.Type != IQTypeGet || iq.Query.XMLName.Space != nsPing || !c.isMe(iq.To) {
+		return false, nil
+	}
+	if !c.mayAutoReply(iq.From) {
+		return true, c.refuseIQ(iq)
+	}
+	_, err := c.sendf("<iq type='result'%s id='%s'/>", replyAttrs(iq), xmlEscape(iq.ID))
+	return true, err
+}
+
+// isMe reports whether a stanza sent to the address to is meant for us: the server
+// leaves out to for stanzas to the connected resource.
+func (c *Client) isMe(to string) bool {
+	jid := c.JID()
+	bare := strings.SplitN(jid, "/", 2)[0]
+	return to == "" || to == jid || strings.EqualFold(to, bare)
+}
@@ -0,0 +1,69 @@
+package xmpp
+
+import (
+	"context"
+	"strconv"
+)
+
+// SendPresenceWait sends presence, typically directed presence to a contact or a room,
+// and waits until ctx is done for an error in response, matched by the id of the
+// presence, which is generated if presence.ID is empty. It returns the *StanzaError
+// of the response, or nil if none arrived before ctx was done: presence is not
+// acknowledged on success. The response is read by Recv, which has to be running in
+// another goroutine, and is not returned from there.
+func (c *Client) SendPresenceWait(ctx context.Context, presence Presence) error {
+	if presence.ID == "" {
+		presence.ID = IDPrefix + strconv.FormatUint(uint64(getCookie()), 10)
+	}
+	ch := make(chan *clientPresence, 1)
+	c.presenceMutex.Lock()
+	if c.presencePending == nil {
+		c.presencePending = make(map[string]chan *clientPresence)
+	}
+	c.presencePending[presence.ID] = ch
+	c.presenceMutex.Unlock()
+	defer func() {
+		c.presenceMutex.Lock()
+		delete(c.presencePending, presence.ID)
+		c.presenceMutex.Unlock()
+	}()
+
+	if _, err := c.SendPresence(presence); err != nil {
+		return err
+	}
+	select {
+	case p, ok := <-ch:
+		if !ok || p.Error == nil {
+			return nil
+		}
+		return c.stanzaError(p.Error)
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// deliverPresenceError hands a presence error to the SendPresenceWait call waiting for
+// it and reports whether there was one.
+func (c *Client) deliverPresenceError(p *clientPresence) bool {
+	if p.Type != "error" || p.ID == "" {
+		return false
+	}
+	c.presenceMutex.Lock()
+	ch, ok := c.presencePending[p.ID]
+	delete(c.presencePending, p.ID)
+	c.presenceMutex.Unlock()
+	if ok {
+		ch <- p
+	}
+	return ok
+}
+
+// abortPresences wakes up all SendPresenceWait calls still waiting once the stream is gone.
+func (c *Client) abortPresences() {
+	c.presenceMutex.Lock()
+	for id, ch := range c.presencePending {
+		close(ch)
+		delete(c.presencePending, id)
+	}
+	c.presenceMutex.Unlock()
+}
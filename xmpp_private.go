@@ -0,0 +1,74 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+// ErrPrivateStorageNotFound is returned by PrivateStorageGet if nothing is stored.
+var ErrPrivateStorageNotFound = errors.New("xmpp: nothing stored in private storage")
+
+// PrivateStorageGet fetches the element named element in namespace from our private XML
+// storage, xep-0049, and waits for it. If nothing is stored there, the error is
+// ErrPrivateStorageNotFound.
+func (c *Client) PrivateStorageGet(namespace, element string) ([]byte, error) {
+	iq, err := c.sendIQ("", IQTypeGet, "<query xmlns='"+nsPrivate+"'><"+element+" xmlns='"+xmlEscape(namespace)+"'/></query>")
+	var se *StanzaError
+	if errors.As(err, &se) && se.Condition == "item-not-found" {
+		return nil, ErrPrivateStorageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(strings.TrimSpace(iq.Query.InnerXML))
+	if isEmptyElement(data) {
+		return nil, ErrPrivateStorageNotFound
+	}
+	return data, nil
+}
+
+// PrivateStorageSet stores payload in our private XML storage, xep-0049, replacing
+// what was stored with the same element name and namespace, and waits for the result.
+// payload is either raw XML, as a string or []byte, or a value encoding/xml marshals;
+// it must be in a namespace of its own.
+func (c *Client) PrivateStorageSet(payload interface{}) error {
+	s, err := marshalPayload(payload)
+	if err != nil {
+		return err
+	}
+	_, err = c.sendIQ("", IQTypeSet, "<query xmlns='"+nsPrivate+"'>"+s+"</query>")
+	return err
+}
+
+// isEmptyElement reports whether data is a single element without attributes
+// other than its namespace, and without content.
+func isEmptyElement(data []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return depth == 0
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				return false
+			}
+			for _, a := range t.Attr {
+				if a.Name.Local != "xmlns" && a.Name.Space != "xmlns" {
+					return false
+				}
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return false
+			}
+		}
+	}
+}
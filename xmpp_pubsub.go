@@ -8,6 +8,10 @@ import (
 const (
 	XMPPNS_PUBSUB       = "http://jabber.org/protocol/pubsub"
 	XMPPNS_PUBSUB_EVENT = "http://jabber.org/protocol/pubsub#event"
+	XMPPNS_PUBSUB_OWNER = "http://jabber.org/protocol/pubsub#owner"
+
+	XMPPNS_PUBSUB_NODE_CONFIG = "http://jabber.org/protocol/pubsub#node_config"
+	XMPPNS_PUBSUB_ERRORS      = "http://jabber.org/protocol/pubsub#errors"
 )
 
 type clientPubsubItem struct {
@@ -20,11 +24,18 @@ type clientPubsubItems struct {
 	XMLName xml.Name           `xml:"items"`
 	Node    string             `xml:"node,attr"`
 	Items   []clientPubsubItem `xml:"item"`
+	Retract []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"retract"`
 }
 
 type clientPubsub struct {
 	XMLName xml.Name          `xml:"pubsub"`
 	Items   clientPubsubItems `xml:"items"`
+	Publish struct {
+		Items []clientPubsubItem `xml:"item"`
+	} `xml:"publish"`
+	Subscription *clientPubsubSubscription `xml:"subscription"`
 }
 
 type clientPubsubEvent struct {
@@ -45,8 +56,9 @@ type clientPubsubSubscription struct {
 }
 
 type PubsubEvent struct {
-	Node  string
-	Items []PubsubItem
+	Node      string
+	Items     []PubsubItem
+	Retracted []string // ids of the items deleted from the node
 }
 
 type PubsubSubscription struct {
@@ -81,10 +93,14 @@ func pubsubItemsToReturn(items []clientPubsubItem) []PubsubItem {
 }
 
 func pubsubClientToReturn(event clientPubsubEvent) PubsubEvent {
-	return PubsubEvent{
+	e := PubsubEvent{
 		Node:  event.Items.Node,
 		Items: pubsubItemsToReturn(event.Items.Items),
 	}
+	for _, r := range event.Items.Retract {
+		e.Retracted = append(e.Retracted, r.ID)
+	}
+	return e
 }
 
 func pubsubStanza(body string) string {
@@ -106,28 +122,161 @@ func pubsubUnsubscriptionStanza(node, jid string) string {
 	return pubsubStanza(body)
 }
 
+// ids of the pubsub requests whose results Recv decodes.
+const (
+	pubsubSubscribeID   = IDPrefix + "sub1"
+	pubsubUnsubscribeID = IDPrefix + "unsub1"
+	pubsubLastItemsID   = IDPrefix + "items1"
+	pubsubItemID        = IDPrefix + "items3"
+)
+
 func (c *Client) PubsubSubscribeNode(node, jid string) {
-	c.RawInformation(c.jid,
+	c.RawInformation(c.JID(),
 		jid,
-		"sub1",
+		pubsubSubscribeID,
 		"set",
-		pubsubSubscriptionStanza(node, c.jid))
+		pubsubSubscriptionStanza(node, c.JID()))
 }
 
 func (c *Client) PubsubUnsubscribeNode(node, jid string) {
-	c.RawInformation(c.jid,
+	c.RawInformation(c.JID(),
 		jid,
-		"unsub1",
+		pubsubUnsubscribeID,
 		"set",
-		pubsubUnsubscriptionStanza(node, c.jid))
+		pubsubUnsubscriptionStanza(node, c.JID()))
 }
 
 func (c *Client) PubsubRequestLastItems(node, jid string) {
 	body := fmt.Sprintf("<items node='%s'/>", node)
-	c.RawInformation(c.jid, jid, "items1", "get", pubsubStanza(body))
+	c.RawInformation(c.JID(), jid, pubsubLastItemsID, "get", pubsubStanza(body))
 }
 
 func (c *Client) PubsubRequestItem(node, jid, id string) {
 	body := fmt.Sprintf("<items node='%s'><item id='%s'/></items>", node, id)
-	c.RawInformation(c.jid, jid, "items3", "get", pubsubStanza(body))
+	c.RawInformation(c.JID(), jid, pubsubItemID, "get", pubsubStanza(body))
+}
+
+// pubsubPublishStanza publishes the item with the payload item and the given id to node.
+func pubsubPublishStanza(node, id, item string) string {
+	body := fmt.Sprintf("<publish node='%s'><item id='%s'>%s</item></publish>",
+		xmlEscape(node), xmlEscape(id), item)
+	return pubsubStanza(body)
+}
+
+func pubsubOwnerStanza(body string) string {
+	return fmt.Sprintf("<pubsub xmlns='%s'>%s</pubsub>",
+		XMPPNS_PUBSUB_OWNER, body)
+}
+
+// PubsubCreateNode creates node on the pubsub service jid and waits for the result.
+// If config is not nil, the node is created with that configuration.
+func (c *Client) PubsubCreateNode(node, jid string, config *DataForm) error {
+	body := fmt.Sprintf("<create node='%s'/>", xmlEscape(node))
+	if config != nil {
+		form, err := submitForm(config, XMPPNS_PUBSUB_NODE_CONFIG)
+		if err != nil {
+			return err
+		}
+		body += "<configure>" + form + "</configure>"
+	}
+	_, err := c.sendIQ(jid, IQTypeSet, pubsubStanza(body))
+	return err
+}
+
+// PubsubConfigureNode submits a new configuration for node on the pubsub service jid
+// and waits for the result.
+func (c *Client) PubsubConfigureNode(node, jid string, config *DataForm) error {
+	form, err := submitForm(config, XMPPNS_PUBSUB_NODE_CONFIG)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("<configure node='%s'>%s</configure>", xmlEscape(node), form)
+	_, err = c.sendIQ(jid, IQTypeSet, pubsubOwnerStanza(body))
+	return err
+}
+
+// PubsubDeleteNode deletes node from the pubsub service jid and waits for the result.
+func (c *Client) PubsubDeleteNode(node, jid string) error {
+	body := fmt.Sprintf("<delete node='%s'/>", xmlEscape(node))
+	_, err := c.sendIQ(jid, IQTypeSet, pubsubOwnerStanza(body))
+	return err
+}
+
+// PubsubPublish publishes an item with the payload payload to node on the pubsub service
+// jid, xep-0060 7.1, and waits for the result. An empty jid publishes to our own PEP
+// service. payload is either raw XML, as a string or []byte, or a value encoding/xml
+// marshals. If itemID is empty, the service assigns one. The id of the item is returned.
+func (c *Client) PubsubPublish(node, jid, itemID string, payload interface{}) (string, error) {
+	item, err := marshalPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	idAttr := ""
+	if itemID != "" {
+		idAttr = fmt.Sprintf(" id='%s'", xmlEscape(itemID))
+	}
+	body := fmt.Sprintf("<publish node='%s'><item%s>%s</item></publish>", xmlEscape(node), idAttr, item)
+	iq, err := c.sendIQ(jid, IQTypeSet, pubsubStanza(body))
+	if err != nil {
+		return "", err
+	}
+	var p clientPubsub
+	if iq.decodeQuery(&p) == nil && len(p.Publish.Items) > 0 && p.Publish.Items[0].ID != "" {
+		return p.Publish.Items[0].ID, nil
+	}
+	return itemID, nil
+}
+
+// PubsubSubscribe subscribes us to node on the pubsub service jid, xep-0060 6.1, and
+// waits for the result. Recv returns the items published to the node as PubsubEvent.
+func (c *Client) PubsubSubscribe(node, jid string) (*PubsubSubscription, error) {
+	iq, err := c.sendIQ(jid, IQTypeSet, pubsubSubscriptionStanza(node, c.JID()))
+	if err != nil {
+		return nil, err
+	}
+	var p clientPubsub
+	if err = iq.decodeQuery(&p); err != nil || p.Subscription == nil {
+		// The service need not tell the details.
+		return &PubsubSubscription{JID: c.JID(), Node: node}, nil
+	}
+	return &PubsubSubscription{
+		SubID: p.Subscription.SubID,
+		JID:   p.Subscription.JID,
+		Node:  p.Subscription.Node,
+	}, nil
+}
+
+// PubsubUnsubscribe unsubscribes us from node on the pubsub service jid, xep-0060 6.2,
+// and waits for the result.
+func (c *Client) PubsubUnsubscribe(node, jid string) error {
+	_, err := c.sendIQ(jid, IQTypeSet, pubsubUnsubscriptionStanza(node, c.JID()))
+	return err
+}
+
+// PubsubGetItems fetches the items of node on the pubsub service jid, xep-0060 6.5,
+// and waits for them.
+func (c *Client) PubsubGetItems(node, jid string) ([]PubsubItem, error) {
+	body := fmt.Sprintf("<items node='%s'/>", xmlEscape(node))
+	iq, err := c.sendIQ(jid, IQTypeGet, pubsubStanza(body))
+	if err != nil {
+		return nil, err
+	}
+	var p clientPubsub
+	if err = iq.decodeQuery(&p); err != nil {
+		return nil, err
+	}
+	return pubsubItemsToReturn(p.Items.Items), nil
+}
+
+// marshalPayload encodes a payload given as raw XML, as a string or []byte, or as a value
+// encoding/xml marshals.
+func marshalPayload(payload interface{}) (string, error) {
+	switch p := payload.(type) {
+	case string:
+		return p, nil
+	case []byte:
+		return string(p), nil
+	}
+	b, err := xml.Marshal(payload)
+	return string(b), err
 }
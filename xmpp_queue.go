@@ -0,0 +1,121 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultSendQueueSize is the capacity of the send queue if Options.SendQueueSize is not set.
+const defaultSendQueueSize = 64
+
+// closeTimeout bounds the time Close spends writing the stanzas still queued and the
+// end of the stream, so that a stalled connection cannot block it.
+var closeTimeout = 5 * time.Second
+
+// sendQueue buffers stanzas queued by QueueSend until a single writer goroutine sends them.
+type sendQueue struct {
+	mutex   sync.Mutex
+	ch      chan interface{}
+	stop    chan struct{} // closed by closeQueue
+	done    chan struct{} // closed once the writer is done
+	senders sync.WaitGroup
+	closed  bool
+	size    int
+	onError func(stanza interface{}, err error)
+}
+
+// QueueSend queues a Chat, a Presence or a raw XML string to be sent by a background
+// writer, and returns without waiting for the write. Queued stanzas are sent in the
+// order they were queued; write errors are passed to Options.SendErrorHandler.
+// QueueSend only blocks while the queue is full, and fails if Close is called meanwhile.
+// Close sends all stanzas still queued before closing the connection.
+func (c *Client) QueueSend(v interface{}) error {
+	switch v.(type) {
+	case Chat, Presence, string:
+	default:
+		return fmt.Errorf("xmpp: cannot queue %T", v)
+	}
+
+	q := &c.queue
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return errors.New("xmpp: send queue is closed")
+	}
+	if q.ch == nil {
+		size := q.size
+		if size <= 0 {
+			size = defaultSendQueueSize
+		}
+		q.ch = make(chan interface{}, size)
+		q.stop = make(chan struct{})
+		q.done = make(chan struct{})
+		go c.drainQueue(q.ch, q.stop, q.done)
+	}
+	ch, stop := q.ch, q.stop
+	q.senders.Add(1)
+	q.mutex.Unlock()
+	defer q.senders.Done()
+
+	select {
+	case ch <- v:
+		return nil
+	case <-stop:
+		return errors.New("xmpp: send queue is closed")
+	}
+}
+
+// drainQueue sends the stanzas from ch until stop is closed, and then the ones still
+// queued.
+func (c *Client) drainQueue(ch <-chan interface{}, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		select {
+		case v := <-ch:
+			c.sendQueued(v)
+			continue
+		case <-stop:
+		}
+		break
+	}
+	// No stanza is queued once the QueueSend calls in progress returned.
+	c.queue.senders.Wait()
+	for len(ch) > 0 {
+		c.sendQueued(<-ch)
+	}
+}
+
+func (c *Client) sendQueued(v interface{}) {
+	var err error
+	switch v := v.(type) {
+	case Chat:
+		_, err = c.Send(v)
+	case Presence:
+		_, err = c.SendPresence(v)
+	case string:
+		_, err = c.SendOrg(v)
+	}
+	if err != nil && c.queue.onError != nil {
+		c.queue.onError(v, err)
+	}
+}
+
+// closeQueue stops accepting stanzas and waits until all queued ones are sent.
+func (c *Client) closeQueue() {
+	q := &c.queue
+	q.mutex.Lock()
+	stop, done := q.stop, q.done
+	if q.closed {
+		stop = nil
+	}
+	q.closed = true
+	if stop != nil {
+		close(stop)
+	}
+	q.mutex.Unlock()
+	if stop != nil {
+		<-done
+	}
+}
@@ -0,0 +1,173 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Backoff is the policy for the delays between the attempts to reconnect, see
+// Options.AutoReconnect. The delay doubles with every attempt.
+type Backoff struct {
+	Initial    time.Duration // delay before the first attempt; a second if zero
+	Max        time.Duration // limit of the delay; two minutes if zero
+	MaxRetries int           // attempts before giving up; no limit if zero
+}
+
+// delay returns the delay before the given attempt, counting from 1.
+func (b Backoff) delay(attempt int) time.Duration {
+	d, max := b.Initial, b.Max
+	if d <= 0 {
+		d = time.Second
+	}
+	if max <= 0 {
+		max = 2 * time.Minute
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Reconnected is returned by Recv once it reconnected after the connection was lost,
+// see Options.AutoReconnect.
+type Reconnected struct {
+	Attempts int  // attempts it took to reconnect
+	Resumed  bool // whether the stream management session was resumed, see Client.Resumed
+	// Rooms are the rooms we had joined. Unless the session was resumed, the rooms no
+	// longer know us and have to be joined again.
+	Rooms []string
+}
+
+// reconnect connects to the server again after Recv failed with cause, if
+// Options.AutoReconnect is set, until it succeeds, gives up or the client is closed.
+func (c *Client) reconnect(cause error) (*Reconnected, error) {
+	if c.reconnectOpts == nil || c.isClosed() || isFinalStreamError(cause) {
+		return nil, cause
+	}
+	c.sendMutex.Lock()
+	o := *c.reconnectOpts
+	c.streamOpen = false
+	c.conn.Close()
+	c.sendMutex.Unlock()
+	if data, err := c.ExportSMState(); err == nil {
+		o.ImportSMState(data)
+	}
+	r := &Reconnected{Rooms: c.joinedRooms()}
+	c.logf("xmpp: connection lost, reconnecting: %v", cause)
+
+	closed := c.closedChan()
+	for {
+		r.Attempts++
+		select {
+		case <-time.After(o.ReconnectBackoff.delay(r.Attempts)):
+		case <-closed:
+			return nil, cause
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-done:
+			}
+		}()
+		n, err := o.newClient(ctx)
+		close(done)
+		cancel()
+		if err == nil {
+			if !c.takeOver(n) {
+				n.Close()
+				return nil, cause
+			}
+			break
+		}
+		if c.isClosed() {
+			return nil, cause
+		}
+		if o.ReconnectBackoff.MaxRetries > 0 && r.Attempts >= o.ReconnectBackoff.MaxRetries {
+			c.logf("xmpp: giving up reconnecting after %d attempts: %v", r.Attempts, err)
+			return nil, err
+		}
+		c.logf("xmpp: reconnection attempt %d failed: %v", r.Attempts, err)
+	}
+
+	r.Resumed = c.Resumed()
+	o.sendInitialPresence(c)
+	if o.OnReconnect != nil {
+		go o.OnReconnect(c, *r)
+	}
+	return r, nil
+}
+
+// takeOver makes c use the stream n negotiated, unless c was closed meanwhile.
+func (c *Client) takeOver(n *Client) bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	// Close reads c.conn holding only c.closeMutex.
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+	c.idMutex.Lock()
+	c.jid, c.domain = n.jid, n.domain
+	c.idMutex.Unlock()
+	c.conn, c.p = n.conn, n.p
+	c.sm, c.streamOpen, c.serverFeatures = n.sm, n.streamOpen, n.serverFeatures
+	return true
+}
+
+// isFinalStreamError reports whether err is a stream error that connecting again would
+// only repeat: another connection took over our resource, RFC 6120 4.9.3.3, which would
+// then be kicked off in turn, or the server does not want us.
+func isFinalStreamError(err error) bool {
+	var se *StreamError
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.Condition {
+	case "conflict", "not-authorized", "policy-violation":
+		return true
+	}
+	return false
+}
+
+// joinedRooms returns the rooms we joined, in order.
+func (c *Client) joinedRooms() []string {
+	c.mucMutex.Lock()
+	defer c.mucMutex.Unlock()
+	var rooms []string
+	for room := range c.mucRooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// closedChan returns a channel that Close closes.
+func (c *Client) closedChan() chan struct{} {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closed == nil {
+		c.closed = make(chan struct{})
+	}
+	return c.closed
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closedChan():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,24 @@
+package xmpp
+
+import "strings"
+
+const nsRegister = "jabber:iq:register"
+
+// ChangePassword changes the password of our account on the server, xep-0077 3.3,
+// and waits for the result. If the server refuses, e.g. with not-authorized or with
+// bad-request for a weak password, the error is a *StanzaError. Reconnecting with
+// Options.AutoReconnect uses the new password.
+func (c *Client) ChangePassword(newPassword string) error {
+	user := strings.SplitN(c.JID(), "@", 2)[0]
+	_, err := c.sendIQ(c.serverDomain(), IQTypeSet, "<query xmlns='"+nsRegister+"'><username>"+xmlEscape(user)+
+		"</username><password>"+xmlEscape(newPassword)+"</password></query>")
+	if err != nil {
+		return err
+	}
+	c.sendMutex.Lock()
+	if c.reconnectOpts != nil {
+		c.reconnectOpts.Password = newPassword
+	}
+	c.sendMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,75 @@
+package xmpp
+
+import "strings"
+
+const nsRetract = "urn:xmpp:message-retract:0"
+
+// Retraction is returned from Recv when From retracts an earlier message, xep-0424, so
+// that clients can remove it. ID is the origin-id of the retracted message, or, in a
+// room, the stanza id the room gave it; see Retracts.
+type Retraction struct {
+	From string
+	Type string
+	ID   string
+}
+
+// XEP-0424  Message Retraction
+type clientRetract struct {
+	ID string `xml:"id,attr"`
+}
+
+type clientApplyTo struct {
+	ID      string    `xml:"id,attr"`
+	Retract *struct{} `xml:"urn:xmpp:message-retract:0 retract"`
+}
+
+// RetractMessage asks the contact to to remove the message we sent with the origin-id
+// originID, xep-0424 4, see Options.OriginID and Chat.OriginID. Clients that do not
+// support retraction show a note instead.
+func (c *Client) RetractMessage(to, originID string) error {
+	return c.retract(to, "chat", originID)
+}
+
+// RetractGroupChat asks the occupants of room to remove the message we sent with the
+// origin-id originID, like RetractMessage.
+func (c *Client) RetractGroupChat(room, originID string) error {
+	return c.retract(room, "groupchat", originID)
+}
+
+func (c *Client) retract(to, typ, id string) error {
+	_, err := c.sendf("<message to='%s' type='%s' id='%s'><retract xmlns='%s' id='%s'/>"+
+		"<fallback xmlns='urn:xmpp:fallback:0'/><body>This person attempted to retract a previous message, "+
+		"but it's unsupported by your client.</body><store xmlns='urn:xmpp:hints'/></message>",
+		xmlEscape(to), typ, NewID(), nsRetract, xmlEscape(id))
+	return err
+}
+
+// retraction returns the Retraction in m, and reports whether there is one, be it of
+// the form of RetractMessage, wrapped in an apply-to element, xep-0422, or of version 1
+// of xep-0424.
+func (m *clientMessage) retraction() (Retraction, bool) {
+	r := Retraction{From: m.From, Type: m.Type}
+	if m.Retract != nil {
+		r.ID = m.Retract.ID
+	}
+	if m.ApplyTo != nil && m.ApplyTo.Retract != nil {
+		r.ID = m.ApplyTo.ID
+	}
+	if m.Retract1 != nil {
+		r.ID = m.Retract1.ID
+	}
+	return r, r.ID != ""
+}
+
+// Retracts reports whether r retracts the earlier message received: r.ID is the
+// origin-id of earlier, or, for a groupchat message, the id the room gave it, and both
+// come from the same sender, the same occupant for a groupchat message or the same
+// bare JID otherwise. Any other retraction must not remove the earlier message.
+func (r Retraction) Retracts(earlier Chat) bool {
+	if r.Type == "groupchat" {
+		room := strings.SplitN(earlier.Remote, "/", 2)[0]
+		return r.From == earlier.Remote && (r.ID == earlier.OriginID || r.ID == earlier.StanzaID(room))
+	}
+	return r.ID == earlier.OriginID &&
+		strings.EqualFold(strings.SplitN(r.From, "/", 2)[0], strings.SplitN(earlier.Remote, "/", 2)[0])
+}
@@ -0,0 +1,183 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const nsRoster = "jabber:iq:roster"
+
+// RosterEntry is an item of our roster, RFC 6121 2.1.2.
+type RosterEntry struct {
+	JID          string
+	Name         string
+	Subscription string // none, to, from, or both; remove in a RosterPush for a removed item
+	Ask          string // "subscribe" while our subscription request is pending
+	Groups       []string
+}
+
+// RFC 6121  jabber:iq:roster
+type clientRosterQuery struct {
+	XMLName xml.Name     `xml:"jabber:iq:roster query"`
+	Ver     *string      `xml:"ver,attr"`
+	Items   []rosterItem `xml:"item"`
+}
+
+// RosterPush is returned from Recv when the server tells us about a change of our roster,
+// e.g. made by another of our resources. RFC 6121 2.1.6
+type RosterPush struct {
+	Entry RosterEntry
+	// Version is the version of the roster with the change, if the server supports
+	// roster versioning. RosterVersion returns it as well.
+	Version string
+}
+
+func rosterEntries(items []rosterItem) []RosterEntry {
+	var entries []RosterEntry
+	for _, item := range items {
+		entries = append(entries, RosterEntry{
+			JID:          item.Jid,
+			Name:         item.Name,
+			Subscription: item.Subscription,
+			Ask:          item.Ask,
+			Groups:       item.Group,
+		})
+	}
+	return entries
+}
+
+// GetRoster fetches our roster from the server and waits for it. An empty roster is
+// returned as a nil slice. The server's response is read by Recv, which has to be
+// running in another goroutine.
+func (c *Client) GetRoster() ([]RosterEntry, error) {
+	iq, err := c.sendIQ("", IQTypeGet, "<query xmlns='"+nsRoster+"'/>")
+	if err != nil {
+		return nil, err
+	}
+	if iq.Query.XMLName.Local == "" {
+		return nil, nil
+	}
+	var q clientRosterQuery
+	if err = iq.decodeQuery(&q); err != nil {
+		return nil, err
+	}
+	entries := rosterEntries(q.Items)
+	c.setContacts(rosterJIDs(entries))
+	c.setRosterVersion(q.Ver)
+	return entries, nil
+}
+
+// GetRosterSince fetches our roster like GetRoster, but if the server supports roster
+// versioning, RFC 6121 2.6, it asks for the changes since version ver of the roster, which
+// an earlier call or roster push reported through RosterVersion. cached is the roster of
+// version ver the caller stored along with it; an empty ver asks for the whole roster. If
+// the server answers with the changes only, unchanged is set and cached is returned and
+// taken as our roster, e.g. for Options.AutoReply set to AutoReplyContacts; the server then
+// sends the changes, if any, as roster pushes that Recv returns.
+func (c *Client) GetRosterSince(ver string, cached []RosterEntry) (entries []RosterEntry, unchanged bool, err error) {
+	if !c.serverFeatures.RosterVersioning {
+		entries, err = c.GetRoster()
+		return entries, false, err
+	}
+	iq, err := c.sendIQ("", IQTypeGet, "<query xmlns='"+nsRoster+"' ver='"+xmlEscape(ver)+"'/>")
+	if err != nil {
+		return nil, false, err
+	}
+	if iq.Query.XMLName.Local == "" {
+		c.setContacts(rosterJIDs(cached))
+		c.setRosterVersion(&ver)
+		return cached, true, nil
+	}
+	var q clientRosterQuery
+	if err = iq.decodeQuery(&q); err != nil {
+		return nil, false, err
+	}
+	entries = rosterEntries(q.Items)
+	c.setContacts(rosterJIDs(entries))
+	c.setRosterVersion(q.Ver)
+	return entries, false, nil
+}
+
+// RosterVersion returns the version of our roster after the last roster or roster push
+// the server sent, or "" if the server does not support roster versioning.
+func (c *Client) RosterVersion() string {
+	c.rosterMutex.Lock()
+	defer c.rosterMutex.Unlock()
+	return c.rosterVer
+}
+
+func (c *Client) setRosterVersion(ver *string) {
+	if ver == nil {
+		return
+	}
+	c.rosterMutex.Lock()
+	defer c.rosterMutex.Unlock()
+	c.rosterVer = *ver
+}
+
+// RosterAdd adds jid to our roster with the given name and groups and waits for the result.
+func (c *Client) RosterAdd(jid, name string, groups []string) error {
+	return c.RosterUpdate(RosterEntry{JID: jid, Name: name, Groups: groups})
+}
+
+// RosterUpdate replaces the name and the groups of the roster item entry.JID, adding it
+// if it is not on our roster yet, and waits for the result. The subscription state of an
+// item is controlled by presence subscriptions, so entry.Subscription and entry.Ask are
+// ignored. If the server rejects the change, the IQ error is returned.
+func (c *Client) RosterUpdate(entry RosterEntry) error {
+	item := fmt.Sprintf("<item jid='%s'", xmlEscape(escapeJID(entry.JID)))
+	if entry.Name != "" {
+		item += fmt.Sprintf(" name='%s'", xmlEscape(entry.Name))
+	}
+	item += ">"
+	for _, group := range entry.Groups {
+		item += "<group>" + xmlEscape(group) + "</group>"
+	}
+	return c.rosterSet(item + "</item>")
+}
+
+// RosterRemove removes jid from our roster, cancelling all subscriptions with it,
+// and waits for the result.
+func (c *Client) RosterRemove(jid string) error {
+	return c.rosterSet(fmt.Sprintf("<item jid='%s' subscription='remove'/>", xmlEscape(escapeJID(jid))))
+}
+
+func (c *Client) rosterSet(item string) error {
+	_, err := c.sendIQ("", IQTypeSet, "<query xmlns='"+nsRoster+"'>"+item+"</query>")
+	return err
+}
+
+// rosterPush acknowledges a roster push from the server and returns it. It reports whether
+// iq was a roster push.
+func (c *Client) rosterPush(iq *clientIQ) (RosterPush, bool) {
+	if iq.Type != IQTypeSet || iq.Query.XMLName.Space != nsRoster {
+		return RosterPush{}, false
+	}
+	// Pushes only ever come from our own account.
+	if iq.From != "" && iq.From != strings.SplitN(c.JID(), "/", 2)[0] {
+		return RosterPush{}, false
+	}
+	var q clientRosterQuery
+	if err := iq.decodeQuery(&q); err != nil || len(q.Items) != 1 {
+		return RosterPush{}, false
+	}
+
+	c.sendf("<iq type='result' id='%s'/>", xmlEscape(iq.ID))
+	entry := rosterEntries(q.Items)[0]
+	c.updateContact(entry)
+	c.setRosterVersion(q.Ver)
+	push := RosterPush{Entry: entry}
+	if q.Ver != nil {
+		push.Version = *q.Ver
+	}
+	return push, true
+}
+
+func rosterJIDs(entries []RosterEntry) []string {
+	var jids []string
+	for _, e := range entries {
+		jids = append(jids, e.JID)
+	}
+	return jids
+}
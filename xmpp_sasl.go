@@ -0,0 +1,56 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// saslPreference lists the SASL mechanisms the client implements, the most preferred first.
+// DIGEST-MD5 is historic, RFC 6331, and only used when nothing else is offered.
+var saslPreference = []string{"SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN", "EXTERNAL", "ANONYMOUS", "OAUTHBEARER", "X-OAUTH2", "DIGEST-MD5"}
+
+// hasMechanism reports whether the server offers the SASL mechanism.
+func hasMechanism(mechanisms []string, mechanism string) bool {
+	for _, m := range mechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// canAuthenticate reports whether o holds the credentials the SASL mechanism needs.
+func canAuthenticate(mechanism string, o *Options, encrypted bool) bool {
+	switch mechanism {
+	case "SCRAM-SHA-256", "SCRAM-SHA-1", "PLAIN", "DIGEST-MD5":
+		return o.User != "" && o.Password != ""
+	case "EXTERNAL":
+		// The server takes the identity from our TLS client certificate.
+		return encrypted && hasClientCertificate(o.TLSConfig)
+	case "ANONYMOUS":
+		return o.User == "" && o.Password == "" && o.OAuthToken == ""
+	case "OAUTHBEARER", "X-OAUTH2":
+		return o.User != "" && o.OAuthToken != ""
+	}
+	return false
+}
+
+func hasClientCertificate(config *tls.Config) bool {
+	return config != nil && (len(config.Certificates) > 0 || config.GetClientCertificate != nil)
+}
+
+// chooseMechanism returns the most preferred SASL mechanism the server offers and o has
+// the credentials for.
+func chooseMechanism(offered []string, o *Options, encrypted bool) (string, error) {
+	var usable []string
+	for _, m := range saslPreference {
+		if !canAuthenticate(m, o, encrypted) {
+			continue
+		}
+		if hasMechanism(offered, m) {
+			return m, nil
+		}
+		usable = append(usable, m)
+	}
+	return "", fmt.Errorf("xmpp: no SASL mechanism in common: server offers %v, client supports %v with the given credentials", offered, usable)
+}
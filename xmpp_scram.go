@@ -0,0 +1,156 @@
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scramGS2Header is the GS2 header of our SCRAM messages: no channel binding and no
+// authorization identity, RFC 5802 7.
+const scramGS2Header = "n,,"
+
+// scramNonce returns the client nonce of a SCRAM exchange; tests replace it.
+var scramNonce = cnonce
+
+// scramHash returns the hash function of the SCRAM mechanism.
+func scramHash(mechanism string) func() hash.Hash {
+	if mechanism == "SCRAM-SHA-256" {
+		return sha256.New
+	}
+	return sha1.New
+}
+
+// scramName escapes a user name as an RFC 5802 saslname.
+func scramName(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+// parseSCRAM parses the comma-separated attributes of a SCRAM message.
+func parseSCRAM(s string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, a := range strings.Split(s, ",") {
+		if len(a) >= 2 && a[1] == '=' {
+			attrs[a[0]] = a[2:]
+		}
+	}
+	return attrs
+}
+
+// scramHi is the Hi function of RFC 5802 2.2, PBKDF2 with HMAC as the pseudorandom
+// function and a single block of output.
+func scramHi(newHash func() hash.Hash, password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	hi := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range hi {
+			hi[j] ^= u[j]
+		}
+	}
+	return hi
+}
+
+func scramHMAC(newHash func() hash.Hash, key []byte, s string) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// scramProof computes the client-final-message answering the server-first-message,
+// and the server signature the server-final-message must carry, RFC 5802 3.
+func scramProof(newHash func() hash.Hash, password, clientFirstBare, serverFirst, clientNonce string) (clientFinal, serverSignature string, err error) {
+	attrs := parseSCRAM(serverFirst)
+	if _, ok := attrs['m']; ok {
+		return "", "", errors.New("xmpp: SCRAM server requires an unsupported extension")
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, clientNonce) || len(nonce) == len(clientNonce) {
+		return "", "", errors.New("xmpp: SCRAM server sent a nonce not extending ours")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return "", "", errors.New("xmpp: SCRAM server sent an invalid salt")
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return "", "", errors.New("xmpp: SCRAM server sent an invalid iteration count")
+	}
+
+	salted := scramHi(newHash, password, salt, iterations)
+	clientKey := scramHMAC(newHash, salted, "Client Key")
+	h := newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := scramHMAC(newHash, storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverKey := scramHMAC(newHash, salted, "Server Key")
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof),
+		base64.StdEncoding.EncodeToString(scramHMAC(newHash, serverKey, authMessage)), nil
+}
+
+// authSCRAM starts SCRAM-SHA-256 or SCRAM-SHA-1 authentication, RFC 5802 and RFC 7677,
+// and answers the server's challenge. It returns the server signature the server must
+// prove it knows the password with; the caller checks it against the data of <success/>,
+// or a last challenge.
+func (c *Client) authSCRAM(mechanism, user string, o *Options) (string, error) {
+	clientNonce := scramNonce()
+	clientFirstBare := "n=" + scramName(user) + ",r=" + clientNonce
+	c.sendf("<auth xmlns='%s' mechanism='%s'>%s</auth>\n", nsSASL, mechanism,
+		base64.StdEncoding.EncodeToString([]byte(scramGS2Header+clientFirstBare)))
+	c.setStepDeadline(o)
+	name, val, err := next(c.p)
+	if err != nil {
+		return "", stepError("SASL challenge", err, err)
+	}
+	var challenge string
+	switch v := val.(type) {
+	case *saslChallenge:
+		challenge = string(*v)
+	case *saslFailure:
+		return "", &AuthError{Condition: v.Any.Local, Text: v.Text}
+	default:
+		return "", errors.New("expected <challenge> or <failure>, got <" + name.Local + "> in " + name.Space)
+	}
+	serverFirst, err := base64.StdEncoding.DecodeString(strings.TrimSpace(challenge))
+	if err != nil {
+		return "", err
+	}
+	clientFinal, serverSignature, err := scramProof(scramHash(mechanism), o.Password, clientFirstBare, string(serverFirst), clientNonce)
+	if err != nil {
+		return "", err
+	}
+	c.sendf("<response xmlns='%s'>%s</response>\n", nsSASL, base64.StdEncoding.EncodeToString([]byte(clientFinal)))
+	return serverSignature, nil
+}
+
+// checkSCRAMServerFinal checks the base64 encoded server-final-message against the
+// expected server signature.
+func checkSCRAMServerFinal(data, expected string) error {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+	attrs := parseSCRAM(string(b))
+	if e, ok := attrs['e']; ok {
+		return errors.New("xmpp: SCRAM server error: " + e)
+	}
+	if !hmac.Equal([]byte(attrs['v']), []byte(expected)) {
+		return errors.New("xmpp: SCRAM server sent a wrong signature")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"sort"
+)
+
+const nsSearch = "jabber:iq:search"
+
+// SearchResult is an entry found by a user directory search, xep-0055.
+type SearchResult struct {
+	JID   string
+	First string
+	Last  string
+	Nick  string
+	Email string
+	// Other holds the fields of a data form result beyond the ones above, by var.
+	Other map[string]string
+}
+
+type clientSearchQuery struct {
+	XMLName xml.Name           `xml:"jabber:iq:search query"`
+	Items   []clientSearchItem `xml:"item"`
+	Form    *DataForm          `xml:"jabber:x:data x"`
+}
+
+type clientSearchItem struct {
+	JID   string `xml:"jid,attr"`
+	First string `xml:"first"`
+	Last  string `xml:"last"`
+	Nick  string `xml:"nick"`
+	Email string `xml:"email"`
+}
+
+// Search searches the user directory to, xep-0055 2, for the entries matching fields,
+// like "last" or "email", and waits for the results, both legacy and as a data form.
+func (c *Client) Search(to string, fields map[string]string) ([]SearchResult, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var query string
+	for _, name := range names {
+		query += "<" + name + ">" + xmlEscape(fields[name]) + "</" + name + ">"
+	}
+	return c.search(to, query)
+}
+
+// SearchForm searches the user directory to with a data form, xep-0055 3, filled in
+// from the one the directory sent when asked for its search fields.
+func (c *Client) SearchForm(to string, form *DataForm) ([]SearchResult, error) {
+	x, err := submitForm(form, nsSearch)
+	if err != nil {
+		return nil, err
+	}
+	return c.search(to, x)
+}
+
+func (c *Client) search(to, query string) ([]SearchResult, error) {
+	iq, err := c.sendIQ(to, IQTypeSet, "<query xmlns='"+nsSearch+"'>"+query+"</query>")
+	if err != nil {
+		return nil, err
+	}
+	if iq.Query.XMLName.Local == "" {
+		return nil, nil
+	}
+	var q clientSearchQuery
+	if err = iq.decodeQuery(&q); err != nil {
+		return nil, err
+	}
+	return q.results(), nil
+}
+
+// results normalizes the legacy items and the items of a data form result.
+func (q *clientSearchQuery) results() []SearchResult {
+	var results []SearchResult
+	for _, item := range q.Items {
+		results = append(results, SearchResult{JID: item.JID, First: item.First, Last: item.Last, Nick: item.Nick, Email: item.Email})
+	}
+	if q.Form == nil {
+		return results
+	}
+	for _, item := range q.Form.Items {
+		var r SearchResult
+		for _, f := range item.Fields {
+			var v string
+			if len(f.Values) > 0 {
+				v = f.Values[0]
+			}
+			switch f.Var {
+			case "jid":
+				r.JID = v
+			case "first":
+				r.First = v
+			case "last":
+				r.Last = v
+			case "nick":
+				r.Nick = v
+			case "email":
+				r.Email = v
+			case "FORM_TYPE":
+			default:
+				if r.Other == nil {
+					r.Other = make(map[string]string)
+				}
+				r.Other[f.Var] = v
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,64 @@
+package xmpp
+
+import "strings"
+
+const nsSID = "urn:xmpp:sid:0"
+
+// StanzaID is an id an entity assigned to a message, xep-0359 3, like the id of the
+// message in the archive of our server or of a room.
+type StanzaID struct {
+	ID string
+	By string // entity that assigned the id
+}
+
+type clientStanzaID struct {
+	ID string `xml:"id,attr"`
+	By string `xml:"by,attr"`
+}
+
+// StanzaID returns the id the entity by assigned to the message, if any, e.g. the
+// bare JID of our account or of a room.
+func (c Chat) StanzaID(by string) string {
+	for _, id := range c.StanzaIDs {
+		if strings.EqualFold(id.By, by) {
+			return id.ID
+		}
+	}
+	return ""
+}
+
+// stanzaIDs returns the stanza ids of the message that can be trusted, xep-0359 4: the
+// ones of our server, for a message to us, and the ones of the room, for a groupchat
+// message. Anyone else could have made them up.
+func (m *clientMessage) stanzaIDs() []StanzaID {
+	var ids []StanzaID
+	for _, id := range m.StanzaIDs {
+		trusted := strings.EqualFold(id.By, strings.SplitN(m.To, "/", 2)[0])
+		if m.Type == "groupchat" {
+			trusted = strings.EqualFold(id.By, strings.SplitN(m.From, "/", 2)[0])
+		}
+		if trusted && id.ID != "" {
+			ids = append(ids, StanzaID{ID: id.ID, By: id.By})
+		}
+	}
+	return ids
+}
+
+func (m *clientMessage) originID() string {
+	if m.OriginID == nil {
+		return ""
+	}
+	return m.OriginID.ID
+}
+
+// originIDElement returns the origin-id element of a message with the given id sent
+// by Send, if Options.OriginID is set or chat asks for one.
+func (c *Client) originIDElement(chat Chat, id string) string {
+	switch {
+	case chat.OriginID != "":
+		id = chat.OriginID
+	case !c.originIDs:
+		return ""
+	}
+	return "<origin-id xmlns='" + nsSID + "' id='" + xmlEscape(id) + "'/>"
+}
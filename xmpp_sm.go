@@ -0,0 +1,363 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const nsSM = "urn:xmpp:sm:3"
+
+// defaultSMAckEvery is the number of stanzas sent between ack requests unless
+// Options.StreamManagementAckEvery says otherwise.
+const defaultSMAckEvery = 5
+
+// smState holds the XEP-0198 stream management state of a client.
+// It is guarded by Client.sendMutex.
+type smState struct {
+	enabled   bool
+	resumable bool // whether the server allows the session to be resumed
+	resumed   bool // whether the session was resumed rather than started
+	id        string
+	location  string
+	inbound   uint32   // number of stanzas received from the server
+	outbound  uint32   // number of stanzas sent to the server
+	unacked   []string // sent stanzas the server has not acknowledged yet, oldest first
+	ackEvery  int      // stanzas sent between ack requests, never if not positive
+	requested uint64   // number of ack requests sent
+	answered  uint64   // number of acks received
+	waiters   []smAckWaiter
+}
+
+// smAckWaiter is a RequestAckWait call waiting for the ack to the request n.
+type smAckWaiter struct {
+	n  uint64
+	ch chan uint32
+}
+
+// sent records a stanza written to the server and reports whether it is time to
+// request an ack.
+func (s *smState) sent(stanza string) bool {
+	if !s.enabled || !isStanza(stanza) {
+		return false
+	}
+	s.outbound++
+	s.unacked = append(s.unacked, stanza)
+	return s.ackEvery > 0 && s.outbound%uint32(s.ackEvery) == 0
+}
+
+func smAckEvery(o *Options) int {
+	if o.StreamManagementAckEvery == 0 {
+		return defaultSMAckEvery
+	}
+	return o.StreamManagementAckEvery
+}
+
+// ack drops the stanzas the server acknowledged by telling us it handled h stanzas.
+func (s *smState) ack(h uint32) {
+	acked := len(s.unacked) - int(s.outbound-h)
+	if acked < 0 || acked > len(s.unacked) {
+		return
+	}
+	s.unacked = s.unacked[acked:]
+}
+
+func isStanza(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "<message") || strings.HasPrefix(s, "<presence") || strings.HasPrefix(s, "<iq")
+}
+
+// smSnapshot is the state needed to resume a stream management session.
+type smSnapshot struct {
+	ID       string   `json:"id"`
+	Location string   `json:"location,omitempty"`
+	JID      string   `json:"jid"`
+	Inbound  uint32   `json:"inbound"`
+	Outbound uint32   `json:"outbound"`
+	Unacked  []string `json:"unacked,omitempty"`
+}
+
+// XEP-0198  Stream Management
+type smFeature struct {
+	XMLName  xml.Name `xml:"urn:xmpp:sm:3 sm"`
+	Required *string  `xml:"required"`
+	Optional *string  `xml:"optional"`
+}
+
+type smEnabled struct {
+	XMLName  xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	ID       string   `xml:"id,attr"`
+	Resume   string   `xml:"resume,attr"`
+	Location string   `xml:"location,attr"`
+	Max      string   `xml:"max,attr"`
+}
+
+type smResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	PrevID  string   `xml:"previd,attr"`
+	H       string   `xml:"h,attr"`
+}
+
+type smFailed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	Any     xml.Name `xml:",any"`
+}
+
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+type smAnswer struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       string   `xml:"h,attr"`
+}
+
+// enableStreamManagement enables stream management if the server advertises it in f
+// and o.StreamManagement is set. If the server marks stream management as required,
+// not requesting it, or the server failing to enable it, is an error.
+func (c *Client) enableStreamManagement(f *streamFeatures, o *Options) error {
+	switch {
+	case f.SM == nil:
+		// the server does not support stream management
+		return nil
+	case !o.StreamManagement && f.SM.Required != nil:
+		return errors.New("xmpp: server requires stream management but it was not requested")
+	case !o.StreamManagement:
+		return nil
+	}
+
+	c.sendf("<enable xmlns='%s' resume='true'/>\n", nsSM)
+	c.setStepDeadline(o)
+	name, val, err := next(c.p)
+	if err != nil {
+		return stepError("stream management result", err, err)
+	}
+	switch v := val.(type) {
+	case *smEnabled:
+		c.sendMutex.Lock()
+		c.sm = smState{
+			enabled:   true,
+			resumable: v.Resume == "true" || v.Resume == "1",
+			id:        v.ID,
+			location:  v.Location,
+			ackEvery:  smAckEvery(o),
+		}
+		c.sendMutex.Unlock()
+	case *smFailed:
+		if f.SM.Required != nil {
+			return errors.New("xmpp: server failed to enable required stream management: " + v.Any.Local)
+		}
+	default:
+		return errors.New("expected <enabled> or <failed>, got <" + name.Local + "> in " + name.Space)
+	}
+	return nil
+}
+
+// resumeStreamManagement tries to resume the session imported with Options.ImportSMState,
+// if the server supports stream management, and reports whether it was resumed.
+// The stanzas the server did not receive before the session was interrupted are sent again.
+func (c *Client) resumeStreamManagement(f *streamFeatures, o *Options) (bool, error) {
+	s := o.smResume
+	if s == nil || f.SM == nil {
+		return false, nil
+	}
+
+	c.sendf("<resume xmlns='%s' previd='%s' h='%d'/>\n", nsSM, xmlEscape(s.ID), s.Inbound)
+	c.setStepDeadline(o)
+	name, val, err := next(c.p)
+	if err != nil {
+		return false, stepError("stream resumption result", err, err)
+	}
+	switch v := val.(type) {
+	case *smResumed:
+		h, err := strconv.ParseUint(v.H, 10, 32)
+		if err != nil {
+			return false, errors.New("xmpp: invalid h in <resumed>: " + v.H)
+		}
+		c.sendMutex.Lock()
+		defer c.sendMutex.Unlock()
+		c.sm = smState{
+			enabled:   true,
+			resumable: true,
+			resumed:   true,
+			id:        s.ID,
+			location:  s.Location,
+			inbound:   s.Inbound,
+			outbound:  s.Outbound,
+			unacked:   append([]string(nil), s.Unacked...),
+			ackEvery:  smAckEvery(o),
+		}
+		c.sm.ack(uint32(h))
+		for _, stanza := range c.sm.unacked {
+			if _, err := c.write(stanza); err != nil {
+				return false, err
+			}
+		}
+		c.idMutex.Lock()
+		c.jid = s.JID
+		c.idMutex.Unlock()
+		return true, nil
+	case *smFailed:
+		// The session is gone; start a new one.
+		return false, nil
+	default:
+		return false, errors.New("expected <resumed> or <failed>, got <" + name.Local + "> in " + name.Space)
+	}
+}
+
+// handleSM counts the stanzas received while stream management is enabled and
+// handles the acknowledgement elements. It reports whether val was such an element.
+func (c *Client) handleSM(val interface{}) (bool, error) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.sm.enabled {
+		return false, nil
+	}
+	switch v := val.(type) {
+	case *clientMessage, *clientPresence, *clientIQ:
+		c.sm.inbound++
+	case *smRequest:
+		_, err := c.write("<a xmlns='" + nsSM + "' h='" + strconv.FormatUint(uint64(c.sm.inbound), 10) + "'/>")
+		return true, err
+	case *smAnswer:
+		h, err := strconv.ParseUint(v.H, 10, 32)
+		if err != nil {
+			return true, nil
+		}
+		c.sm.ack(uint32(h))
+		// Acks answer the requests in order, xep-0198 4.
+		c.sm.answered++
+		waiters := c.sm.waiters[:0]
+		for _, w := range c.sm.waiters {
+			if w.n <= c.sm.answered {
+				w.ch <- uint32(h)
+			} else {
+				waiters = append(waiters, w)
+			}
+		}
+		c.sm.waiters = waiters
+		return true, nil
+	}
+	return false, nil
+}
+
+// RequestAck asks the server to acknowledge the stanzas it received, xep-0198 4, so that
+// they need not be sent again on resumption. The client does so on its own every
+// Options.StreamManagementAckEvery stanzas; call it e.g. before going idle. See
+// RequestAckWait to wait for the answer.
+func (c *Client) RequestAck() error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.sm.enabled {
+		return errors.New("xmpp: stream management is not enabled")
+	}
+	return c.requestAck()
+}
+
+// requestAck sends an ack request. c.sendMutex must be held.
+func (c *Client) requestAck() error {
+	_, err := c.write("<r xmlns='" + nsSM + "'/>")
+	if err == nil {
+		c.sm.requested++
+	}
+	return err
+}
+
+// RequestAckWait is RequestAck, but waits until ctx is done for the server to answer,
+// and returns the number of stanzas the server says it handled. A server that does not
+// answer within a few seconds is likely gone, so that, with a deadline on ctx, this
+// detects a dead connection sooner than keepalives do. The answer is read by Recv,
+// which has to be running in another goroutine.
+func (c *Client) RequestAckWait(ctx context.Context) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	ch := make(chan uint32, 1)
+	c.sendMutex.Lock()
+	if !c.sm.enabled {
+		c.sendMutex.Unlock()
+		return 0, errors.New("xmpp: stream management is not enabled")
+	}
+	if err := c.requestAck(); err != nil {
+		c.sendMutex.Unlock()
+		return 0, err
+	}
+	w := smAckWaiter{n: c.sm.requested, ch: ch}
+	c.sm.waiters = append(c.sm.waiters, w)
+	c.sendMutex.Unlock()
+
+	select {
+	case h, ok := <-ch:
+		if !ok {
+			return 0, errors.New("xmpp: connection closed while waiting for ack")
+		}
+		return h, nil
+	case <-ctx.Done():
+		c.sendMutex.Lock()
+		for i := range c.sm.waiters {
+			if c.sm.waiters[i] == w {
+				c.sm.waiters = append(c.sm.waiters[:i], c.sm.waiters[i+1:]...)
+				break
+			}
+		}
+		c.sendMutex.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// abortAcks wakes up all RequestAckWait calls still waiting once the stream is gone.
+func (c *Client) abortAcks() {
+	c.sendMutex.Lock()
+	for _, w := range c.sm.waiters {
+		close(w.ch)
+	}
+	c.sm.waiters = nil
+	c.sendMutex.Unlock()
+}
+
+// Resumed reports whether NewClient resumed the stream management session imported with
+// Options.ImportSMState. The presence and the subscriptions of a resumed session are
+// still in place, while a fresh session has to send presence and join rooms again.
+func (c *Client) Resumed() bool {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	return c.sm.resumed
+}
+
+// ExportSMState returns the state of the stream management session, serialized as JSON,
+// so that a later connection, possibly made by another process, can resume the session
+// with Options.ImportSMState. It fails if the server does not allow resuming the session.
+func (c *Client) ExportSMState() ([]byte, error) {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if !c.sm.enabled || !c.sm.resumable {
+		return nil, errors.New("xmpp: stream management session cannot be resumed")
+	}
+	return json.Marshal(smSnapshot{
+		ID:       c.sm.id,
+		Location: c.sm.location,
+		JID:      c.JID(),
+		Inbound:  c.sm.inbound,
+		Outbound: c.sm.outbound,
+		Unacked:  c.sm.unacked,
+	})
+}
+
+// ImportSMState makes NewClient try to resume the stream management session exported with
+// Client.ExportSMState instead of binding a new resource. If the server no longer knows the
+// session, a new one is started. The exported state also holds the address the server
+// prefers for reconnecting, if any; it is not used unless set as Host.
+func (o *Options) ImportSMState(data []byte) error {
+	var s smSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s.ID == "" {
+		return errors.New("xmpp: stream management state lacks an id")
+	}
+	o.smResume = &s
+	return nil
+}
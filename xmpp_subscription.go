@@ -1,20 +1,48 @@
 package xmpp
 
-import (
-	"fmt"
-)
+const nsNick = "http://jabber.org/protocol/nick"
 
-func (c *Client) ApproveSubscription(jid string) {
-	fmt.Fprintf(c.conn, "<presence to='%s' type='subscribed'/>",
-		xmlEscape(jid))
+// ApproveSubscription approves the subscription request of jid to our presence.
+func (c *Client) ApproveSubscription(jid string) error {
+	return c.sendSubscription(jid, "subscribed")
 }
 
-func (c *Client) RevokeSubscription(jid string) {
-	fmt.Fprintf(c.conn, "<presence to='%s' type='unsubscribed'/>",
-		xmlEscape(jid))
+// DenySubscription declines the subscription request of jid to our presence.
+func (c *Client) DenySubscription(jid string) error {
+	return c.sendSubscription(jid, "unsubscribed")
 }
 
-func (c *Client) RequestSubscription(jid string) {
-	fmt.Fprintf(c.conn, "<presence to='%s' type='subscribe'/>",
-		xmlEscape(jid))
+// RevokeSubscription cancels the subscription of jid to our presence.
+func (c *Client) RevokeSubscription(jid string) error {
+	return c.sendSubscription(jid, "unsubscribed")
+}
+
+// RequestSubscription asks jid for a subscription to its presence.
+func (c *Client) RequestSubscription(jid string) error {
+	return c.sendSubscription(jid, "subscribe")
+}
+
+// RequestSubscriptionNick asks jid for a subscription to its presence like
+// RequestSubscription, telling it our nickname, xep-0172 4.1, so that it knows who asks.
+func (c *Client) RequestSubscriptionNick(jid, nick string) error {
+	_, err := c.SendPresence(Presence{To: jid, Type: "subscribe", Nickname: nick})
+	return err
+}
+
+// Unsubscribe cancels our subscription to the presence of jid.
+func (c *Client) Unsubscribe(jid string) error {
+	return c.sendSubscription(jid, "unsubscribe")
+}
+
+func (c *Client) sendSubscription(jid, subscriptionType string) error {
+	_, err := c.SendPresence(Presence{To: jid, Type: subscriptionType})
+	return err
+}
+
+// nickElement returns the element with the nickname of the sender, if any, xep-0172.
+func nickElement(nick string) string {
+	if nick == "" {
+		return ""
+	}
+	return "<nick xmlns='" + nsNick + "'>" + xmlEscape(nick) + "</nick>"
 }
@@ -1,11 +1,32 @@
 package xmpp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
 	"io"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -80,25 +101,25 @@ func TestStanzaError(t *testing.T) {
 
 	chat := Chat{
 		Type: "error",
+		ID:   "3",
 		Other: []string{
 			"\n\t\t{\"random\": \"<text>\"}\n\t",
-			"\n\t\t\n\t\t\n\t",
 		},
 		OtherElem: []XMLElement{
 			XMLElement{
 				XMLName:  xml.Name{Space: "google:mobile:data", Local: "gcm"},
 				InnerXML: "\n\t\t{\"random\": \"&lt;text&gt;\"}\n\t",
 			},
-			XMLElement{
-				XMLName: xml.Name{Space: "jabber:client", Local: "error"},
-				InnerXML: `
-		<bad-request xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/>
-		<text xmlns="urn:ietf:params:xml:ns:xmpp-stanzas">
-			InvalidJson: JSON_PARSING_ERROR : Missing Required Field: message_id\n
-		</text>
-	`,
-			},
 		},
+		Error: &StanzaError{
+			Type:      "modify",
+			Condition: "bad-request",
+			Code:      "400",
+			Text:      `InvalidJson: JSON_PARSING_ERROR : Missing Required Field: message_id\n`,
+		},
+	}
+	if got, ok := v.(Chat); ok && !reflect.DeepEqual(got.Error, chat.Error) {
+		t.Errorf("Error = %#v; want %#v", got.Error, chat.Error)
 	}
 	if !reflect.DeepEqual(v, chat) {
 		t.Errorf("Recv() = %#v; want %#v", v, chat)
@@ -114,3 +135,4166 @@ func TestEOFError(t *testing.T) {
 		t.Errorf("Recv() did not return io.EOF on end of input stream")
 	}
 }
+
+// scriptConn is a net.Conn that replays a scripted server stream and
+// records everything the client writes. Once the script is exhausted,
+// reads block until the read deadline, if one is set.
+type scriptConn struct {
+	*strings.Reader
+	out      bytes.Buffer
+	deadline time.Time
+}
+
+func tScript(s string) *scriptConn {
+	return &scriptConn{Reader: strings.NewReader(s)}
+}
+
+func (c *scriptConn) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	return n, c.wait(err)
+}
+
+func (c *scriptConn) ReadByte() (byte, error) {
+	b, err := c.Reader.ReadByte()
+	return b, c.wait(err)
+}
+
+func (c *scriptConn) wait(err error) error {
+	if err == io.EOF && !c.deadline.IsZero() {
+		time.Sleep(time.Until(c.deadline))
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func (c *scriptConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (*scriptConn) Close() error {
+	return nil
+}
+
+func (*scriptConn) LocalAddr() net.Addr {
+	return &localAddr{}
+}
+
+func (*scriptConn) RemoteAddr() net.Addr {
+	return &localAddr{}
+}
+
+func (c *scriptConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *scriptConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (*scriptConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+const (
+	scriptStreamHeader = `<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' id='1' version='1.0'>`
+	scriptAuth         = scriptStreamHeader +
+		`<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`
+	scriptBindResult = `<iq type='result' id='_xmpp_bind1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>user@example.com/bot</jid></bind></iq>`
+)
+
+func TestStreamManagementEnable(t *testing.T) {
+	tests := []struct {
+		name      string
+		features  string
+		requested bool
+		response  string
+		enabled   bool
+		fail      bool
+	}{
+		{"advertised and requested", `<sm xmlns='urn:xmpp:sm:3'><optional/></sm>`, true, `<enabled xmlns='urn:xmpp:sm:3' id='sm1'/>`, true, false},
+		{"advertised only", `<sm xmlns='urn:xmpp:sm:3'><optional/></sm>`, false, ``, false, false},
+		{"requested only", ``, true, ``, false, false},
+		{"required but not requested", `<sm xmlns='urn:xmpp:sm:3'><required/></sm>`, false, ``, false, true},
+		{"optional and failed", `<sm xmlns='urn:xmpp:sm:3'/>`, true, `<failed xmlns='urn:xmpp:sm:3'><unexpected-request xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></failed>`, false, false},
+	}
+	for _, tt := range tests {
+		conn := tScript(scriptAuth + scriptStreamHeader +
+			`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>` + tt.features + `</stream:features>` +
+			scriptBindResult + tt.response)
+		c := &Client{conn: conn}
+		err := c.init(&Options{
+			User:                         "user@example.com",
+			Password:                     "secret",
+			InsecureAllowUnencryptedAuth: true,
+			NoTLS:                        true,
+			StreamManagement:             tt.requested,
+		})
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%s: init() succeeded; want error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: init() = %v", tt.name, err)
+			continue
+		}
+		if c.sm.enabled != tt.enabled {
+			t.Errorf("%s: stream management enabled = %v; want %v", tt.name, c.sm.enabled, tt.enabled)
+		}
+		if sent := strings.Contains(conn.out.String(), "<enable xmlns='urn:xmpp:sm:3' resume='true'/>"); sent != (tt.requested && tt.features != "") {
+			t.Errorf("%s: <enable/> sent = %v", tt.name, sent)
+		}
+	}
+}
+
+func TestStreamManagementResume(t *testing.T) {
+	conn := tScript(scriptStreamHeader + `<a xmlns='urn:xmpp:sm:3' h='1'/><r xmlns='urn:xmpp:sm:3'/>` +
+		`<message from='romeo@example.net' type='chat'><body>hi</body></message>`)
+	c := &Client{conn: conn, jid: "user@example.com/bot"}
+	c.p = xml.NewDecoder(conn)
+	if _, err := nextStart(c.p); err != nil {
+		t.Fatal(err)
+	}
+	c.sm = smState{enabled: true, resumable: true, id: "sm1"}
+	for _, text := range []string{"one", "two", "three"} {
+		if _, err := c.Send(Chat{Remote: "romeo@example.net", Type: "chat", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(conn.out.String(), "<a xmlns='urn:xmpp:sm:3' h='0'/>") {
+		t.Errorf("no answer to ack request in %q", conn.out.String())
+	}
+	state, err := c.ExportSMState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Options{User: "user@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true}
+	if err := o.ImportSMState(state); err != nil {
+		t.Fatal(err)
+	}
+	conn = tScript(scriptAuth + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/><sm xmlns='urn:xmpp:sm:3'/></stream:features>` +
+		`<resumed xmlns='urn:xmpp:sm:3' previd='sm1' h='2'/>`)
+	c = &Client{conn: conn}
+	if err := c.init(o); err != nil {
+		t.Fatal(err)
+	}
+	out := conn.out.String()
+	if !strings.Contains(out, "<resume xmlns='urn:xmpp:sm:3' previd='sm1' h='1'/>") {
+		t.Errorf("no <resume/> in %q", out)
+	}
+	if strings.Contains(out, "urn:ietf:params:xml:ns:xmpp-bind") {
+		t.Errorf("resumed session bound a resource: %q", out)
+	}
+	if strings.Contains(out, "two") || !strings.Contains(out, "three") {
+		t.Errorf("replayed stanzas in %q; want only the unacknowledged one", out)
+	}
+	if c.jid != "user@example.com/bot" || !c.Resumed() {
+		t.Errorf("jid = %q, Resumed() = %v", c.jid, c.Resumed())
+	}
+	if c.sm.outbound != 3 || c.sm.inbound != 1 || len(c.sm.unacked) != 1 {
+		t.Errorf("sm state = %+v", c.sm)
+	}
+}
+
+// tStanza is a stanza sent by the client, as seen by a fake server.
+type tStanza struct {
+	XMLName  xml.Name
+	ID       string `xml:"id,attr"`
+	To       string `xml:"to,attr"`
+	Type     string `xml:"type,attr"`
+	InnerXML string `xml:",innerxml"`
+}
+
+// tServer returns a client connected to a fake server through an in-memory pipe.
+// Every stanza the client sends is passed to handle, and its return value, if not
+// empty, is written back to the client. Recv runs in the background.
+func tServer(t *testing.T, handle func(s tStanza) string) *Client {
+	cli, srv := net.Pipe()
+	c := &Client{conn: cli, jid: "user@example.com/bot", domain: "example.com", p: xml.NewDecoder(cli)}
+	go func() {
+		d := xml.NewDecoder(srv)
+		for {
+			var s tStanza
+			if err := d.Decode(&s); err != nil {
+				return
+			}
+			if reply := handle(s); reply != "" {
+				srv.Write([]byte(reply))
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return c
+}
+
+func TestPubsubCreateDeleteNode(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		if strings.Contains(s.InnerXML, "<delete node='missing'/>") {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+
+	config := &DataForm{Fields: []DataFormField{{Var: "pubsub#max_items", Values: []string{"10"}}}}
+	if err := c.PubsubCreateNode("sensors", "pubsub.example.com", config); err != nil {
+		t.Fatalf("PubsubCreateNode() = %v", err)
+	}
+	if err := c.PubsubDeleteNode("sensors", "pubsub.example.com"); err != nil {
+		t.Fatalf("PubsubDeleteNode() = %v", err)
+	}
+	if err := c.PubsubDeleteNode("missing", "pubsub.example.com"); err == nil || !strings.Contains(err.Error(), "item-not-found") {
+		t.Errorf("PubsubDeleteNode() = %v; want item-not-found error", err)
+	}
+
+	create := `<pubsub xmlns='http://jabber.org/protocol/pubsub'><create node='sensors'/><configure>` +
+		`<x xmlns="jabber:x:data" type="submit">` +
+		`<field var="FORM_TYPE" type="hidden"><value>http://jabber.org/protocol/pubsub#node_config</value></field>` +
+		`<field var="pubsub#max_items"><value>10</value></field></x></configure></pubsub>`
+	if got[0].Type != "set" || got[0].To != "pubsub.example.com" || got[0].InnerXML != create {
+		t.Errorf("create request = %#v", got[0])
+	}
+	remove := `<pubsub xmlns='http://jabber.org/protocol/pubsub#owner'><delete node='sensors'/></pubsub>`
+	if got[1].Type != "set" || got[1].InnerXML != remove {
+		t.Errorf("delete request = %#v", got[1])
+	}
+}
+
+func TestEnterMUC(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		switch s.To {
+		case "room@conference.example.com/bot":
+			return `<presence xmlns='jabber:client' from='room@conference.example.com/bot'>` +
+				`<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='none' role='participant'/>` +
+				`<status code='110'/></x></presence>`
+		case "busy@conference.example.com/bot":
+			return `<presence xmlns='jabber:client' from='busy@conference.example.com/bot' type='error'>` +
+				`<error type='cancel' code='409'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>`
+		case "secret@conference.example.com/bot":
+			return `<presence xmlns='jabber:client' from='secret@conference.example.com/bot' type='error'>` +
+				`<error type='auth' code='401'><not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>`
+		}
+		return ""
+	})
+
+	if err := c.EnterMUC("room@conference.example.com", "bot", "secret"); err != nil {
+		t.Fatalf("EnterMUC() = %v", err)
+	}
+	want := "<x xmlns='http://jabber.org/protocol/muc'><password>secret</password></x>"
+	if got[0].XMLName.Local != "presence" || got[0].InnerXML != want {
+		t.Errorf("join presence = %#v", got[0])
+	}
+	if err := c.EnterMUC("busy@conference.example.com", "bot", ""); err == nil || !strings.Contains(err.Error(), "conflict") {
+		t.Errorf("EnterMUC() = %v; want conflict error", err)
+	}
+
+	err := c.JoinProtectedMUCWithHistory("secret@conference.example.com", "bot", "wrong", nil)
+	want = "<x xmlns='http://jabber.org/protocol/muc'><password>wrong</password><history maxstanzas='0'/></x>"
+	if got[2].InnerXML != want {
+		t.Errorf("join presence = %#v", got[2])
+	}
+	var pwErr *MUCPasswordError
+	var se *StanzaError
+	if !errors.As(err, &pwErr) || pwErr.Room != "secret@conference.example.com" || !errors.As(err, &se) || se.Type != "auth" {
+		t.Errorf("JoinProtectedMUCWithHistory() = %v; want *MUCPasswordError", err)
+	}
+	if err := c.JoinProtectedMUCWithHistory("room@conference.example.com", "bot", "", nil); err != nil {
+		t.Errorf("JoinProtectedMUCWithHistory() = %v", err)
+	}
+	want = "<x xmlns='http://jabber.org/protocol/muc'><history maxstanzas='0'/></x>"
+	if got[3].InnerXML != want {
+		t.Errorf("join presence without a password = %#v", got[3])
+	}
+
+	// A room that never answers: the join gives up with the context, and a second join
+	// of the room meanwhile is refused.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	joined := make(chan error, 1)
+	go func() { joined <- c.EnterMUCContext(ctx, "silent@conference.example.com", "bot", "") }()
+	for {
+		c.mucMutex.Lock()
+		_, waiting := c.mucJoins["silent@conference.example.com"]
+		c.mucMutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.EnterMUC("silent@conference.example.com", "bot2", ""); err == nil {
+		t.Error("second EnterMUC() of a room being joined succeeded")
+	}
+	if err := <-joined; err != context.DeadlineExceeded {
+		t.Errorf("EnterMUCContext() = %v; want %v", err, context.DeadlineExceeded)
+	}
+	c.mucMutex.Lock()
+	defer c.mucMutex.Unlock()
+	if len(c.mucJoins) != 0 {
+		t.Errorf("joins still waiting: %v", c.mucJoins)
+	}
+}
+
+func TestMUCDestroy(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<presence xmlns='jabber:client' from='old@conference.example.com/bot' type='unavailable'>` +
+		`<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='none' role='none'/>` +
+		`<destroy jid='new@conference.example.com'><reason>Moved to a new home</reason></destroy>` +
+		`<status code='110'/></x></presence>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	p, ok := v.(Presence)
+	if !ok {
+		t.Fatalf("Recv() = %#v; want Presence", v)
+	}
+	want := &MUCDestroy{JID: "new@conference.example.com", Reason: "Moved to a new home"}
+	if !reflect.DeepEqual(p.MUCDestroy, want) {
+		t.Errorf("MUCDestroy = %#v; want %#v", p.MUCDestroy, want)
+	}
+}
+
+func TestMUCHistory(t *testing.T) {
+	since := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		hist *MUCHistory
+		want string
+	}{
+		{nil, "<history maxstanzas='0'/>"},
+		{&MUCHistory{}, "<history maxstanzas='0'/>"},
+		{&MUCHistory{MaxStanzas: 20}, "<history maxstanzas='20'/>"},
+		{&MUCHistory{MaxChars: 65000, Seconds: 180}, "<history maxchars='65000' seconds='180'/>"},
+		{&MUCHistory{MaxStanzas: 5, Since: since}, "<history maxstanzas='5' since='2020-01-02T03:04:05Z'/>"},
+	}
+	for _, tt := range tests {
+		if got := tt.hist.String(); got != tt.want {
+			t.Errorf("%#v.String() = %q; want %q", tt.hist, got, tt.want)
+		}
+	}
+}
+
+func TestQueueSend(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	c.queue.size = 4
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		s := fmt.Sprintf("<message id='%d'/>", i)
+		if err := c.QueueSend(s); err != nil {
+			t.Fatalf("QueueSend() = %v", err)
+		}
+		want.WriteString(s)
+	}
+	if err := c.QueueSend(42); err == nil {
+		t.Errorf("QueueSend(42) succeeded; want error")
+	}
+	c.Close()
+	if got := conn.out.String(); got != want.String() {
+		t.Errorf("written stanzas = %q; want %q", got, want.String())
+	}
+	if err := c.QueueSend("<message/>"); err == nil {
+		t.Errorf("QueueSend() after Close succeeded; want error")
+	}
+}
+
+func TestQueueSendStalled(t *testing.T) {
+	defer func(d time.Duration) { closeTimeout = d }(closeTimeout)
+	closeTimeout = 100 * time.Millisecond
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	c := &Client{conn: cli}
+	c.queue.size = 1
+	failed := make(chan interface{}, 2)
+	c.queue.onError = func(v interface{}, err error) { failed <- v }
+
+	// Nobody reads from srv, so the writer stalls on the first stanza, the second fills
+	// the queue and the third waits for room.
+	if err := c.QueueSend("<message id='1'/>"); err != nil {
+		t.Fatalf("QueueSend() = %v", err)
+	}
+	for len(c.queue.ch) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.QueueSend("<message id='2'/>"); err != nil {
+		t.Fatalf("QueueSend() = %v", err)
+	}
+	third := make(chan error, 1)
+	go func() { third <- c.QueueSend("<message id='3'/>") }()
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() blocked on the stalled queue")
+	}
+	if err := <-third; err == nil {
+		t.Error("QueueSend() on a full queue succeeded after Close")
+	}
+	if len(failed) != 2 {
+		t.Errorf("%d stanzas failed; want 2", len(failed))
+	}
+}
+
+func TestMUCModeration(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		if strings.Contains(s.InnerXML, "affiliation='outcast'") {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='auth'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+
+	if err := c.MUCKick("room@conference.example.com", "troll", "Be nice"); err != nil {
+		t.Fatalf("MUCKick() = %v", err)
+	}
+	want := "<query xmlns='http://jabber.org/protocol/muc#admin'><item nick='troll' role='none'><reason>Be nice</reason></item></query>"
+	if got[0].To != "room@conference.example.com" || got[0].Type != "set" || got[0].InnerXML != want {
+		t.Errorf("kick request = %#v", got[0])
+	}
+	if err := c.MUCBan("room@conference.example.com", "troll@example.com", ""); err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Errorf("MUCBan() = %v; want forbidden error", err)
+	}
+}
+
+func TestBlockListConcurrent(t *testing.T) {
+	asked, release := make(chan struct{}), make(chan struct{})
+	fetches := 0
+	c := tServer(t, func(s tStanza) string {
+		if s.Type != "get" {
+			return ""
+		}
+		if fetches++; fetches == 1 {
+			close(asked)
+			<-release
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>" +
+			"<blocklist xmlns='urn:xmpp:blocking'><item jid='a@example.com'/></blocklist></iq>"
+	})
+
+	lists := make(chan []string, 2)
+	get := func() {
+		list, err := c.BlockList()
+		if err != nil {
+			t.Errorf("BlockList() = %v", err)
+		}
+		lists <- list
+	}
+	go get()
+	<-asked
+	go get()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	want := []string{"a@example.com"}
+	for i := 0; i < 2; i++ {
+		if got := <-lists; !reflect.DeepEqual(got, want) {
+			t.Errorf("BlockList() = %v; want %v", got, want)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("block list fetched %d times; want once", fetches)
+	}
+}
+
+func TestBlockListPushes(t *testing.T) {
+	pushed := make(chan struct{})
+	c := tServer(t, func(s tStanza) string {
+		switch {
+		case s.Type == "get" && strings.Contains(s.InnerXML, "blocklist"):
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>" +
+				"<blocklist xmlns='urn:xmpp:blocking'><item jid='a@example.com'/><item jid='b@example.com'/></blocklist></iq>" +
+				"<iq xmlns='jabber:client' type='set' id='push1'><block xmlns='urn:xmpp:blocking'><item jid='c@example.com'/></block></iq>" +
+				"<iq xmlns='jabber:client' type='set' id='push2' from='mallory@example.com'><unblock xmlns='urn:xmpp:blocking'/></iq>" +
+				"<iq xmlns='jabber:client' type='set' id='push3' from='user@example.com'><unblock xmlns='urn:xmpp:blocking'><item jid='a@example.com'/></unblock></iq>"
+		case s.Type == "result" && s.ID == "push3":
+			close(pushed)
+		}
+		return ""
+	})
+
+	if _, err := c.BlockList(); err != nil {
+		t.Fatalf("BlockList() = %v", err)
+	}
+	<-pushed
+	list, err := c.BlockList()
+	if err != nil {
+		t.Fatalf("BlockList() = %v", err)
+	}
+	if want := []string{"b@example.com", "c@example.com"}; !reflect.DeepEqual(list, want) {
+		t.Errorf("BlockList() after pushes = %v; want %v", list, want)
+	}
+}
+
+func TestMUCUserPresence(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<presence xmlns='jabber:client' from='room@conference.example.com/old' type='unavailable'>` +
+		`<x xmlns='http://jabber.org/protocol/muc#user'>` +
+		`<item affiliation='member' role='participant' jid='alice@example.com/phone' nick='new'/>` +
+		`<status code='303'/></x></presence>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	p, ok := v.(Presence)
+	if !ok {
+		t.Fatalf("Recv() = %#v; want Presence", v)
+	}
+	want := &MUCUser{
+		JID:         "alice@example.com/phone",
+		Affiliation: "member",
+		Role:        "participant",
+		Nick:        "new",
+		StatusCodes: []int{MUCStatusNickChanged},
+	}
+	if !reflect.DeepEqual(p.MUC, want) {
+		t.Errorf("MUC = %#v; want %#v", p.MUC, want)
+	}
+	if p.Type != "unavailable" || p.MUCDestroy != nil {
+		t.Errorf("Recv() = %#v", p)
+	}
+}
+
+func TestNegotiationTimeout(t *testing.T) {
+	conn := tScript(scriptAuth + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`)
+	c := &Client{conn: conn}
+	err := c.init(&Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		InsecureAllowUnencryptedAuth: true,
+		NoTLS:                        true,
+		NegotiationTimeout:           10 * time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for bind result") {
+		t.Fatalf("init() = %v; want bind timeout", err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("init() = %v; want it to wrap os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestGetRoster(t *testing.T) {
+	empty := false
+	c := tServer(t, func(s tStanza) string {
+		if empty {
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='jabber:iq:roster'/></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='jabber:iq:roster'>" +
+			"<item jid='juliet@example.com' name='Juliet' subscription='both'><group>Friends</group><group>Family</group></item>" +
+			"<item jid='romeo@example.net' subscription='none' ask='subscribe'/>" +
+			"</query></iq>"
+	})
+
+	roster, err := c.GetRoster()
+	if err != nil {
+		t.Fatalf("GetRoster() = %v", err)
+	}
+	want := []RosterEntry{
+		{JID: "juliet@example.com", Name: "Juliet", Subscription: "both", Groups: []string{"Friends", "Family"}},
+		{JID: "romeo@example.net", Subscription: "none", Ask: "subscribe"},
+	}
+	if !reflect.DeepEqual(roster, want) {
+		t.Errorf("GetRoster() = %#v; want %#v", roster, want)
+	}
+
+	empty = true
+	if roster, err = c.GetRoster(); roster != nil || err != nil {
+		t.Errorf("GetRoster() = %#v, %v; want nil, nil", roster, err)
+	}
+}
+
+func TestGetRosterSince(t *testing.T) {
+	var queries []string
+	c := tServer(t, func(s tStanza) string {
+		queries = append(queries, s.InnerXML)
+		if strings.Contains(s.InnerXML, "ver='ver14'") {
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='jabber:iq:roster' ver='ver11'>" +
+			"<item jid='juliet@example.com' subscription='both'/></query></iq>"
+	})
+
+	// Without versioning the server gets a plain query.
+	roster, unchanged, err := c.GetRosterSince("ver14", nil)
+	if err != nil || unchanged || len(roster) != 1 {
+		t.Fatalf("GetRosterSince() = %#v, %v, %v", roster, unchanged, err)
+	}
+	if queries[0] != "<query xmlns='jabber:iq:roster'/>" {
+		t.Errorf("sent %q", queries[0])
+	}
+
+	c.serverFeatures.RosterVersioning = true
+	roster, unchanged, err = c.GetRosterSince("", nil)
+	if err != nil || unchanged || len(roster) != 1 || c.RosterVersion() != "ver11" {
+		t.Errorf("GetRosterSince(\"\") = %#v, %v, %v; version %q", roster, unchanged, err, c.RosterVersion())
+	}
+	if queries[1] != "<query xmlns='jabber:iq:roster' ver=''/>" {
+		t.Errorf("sent %q", queries[1])
+	}
+	cached := []RosterEntry{{JID: "Romeo@example.net", Subscription: "both"}}
+	roster, unchanged, err = c.GetRosterSince("ver14", cached)
+	if err != nil || !unchanged || !reflect.DeepEqual(roster, cached) || c.RosterVersion() != "ver14" {
+		t.Errorf("GetRosterSince(ver14) = %#v, %v, %v; version %q", roster, unchanged, err, c.RosterVersion())
+	}
+	c.autoReply = AutoReplyContacts
+	if !c.mayAutoReply("romeo@example.net/orchard") || c.mayAutoReply("juliet@example.com/balcony") {
+		t.Errorf("contacts = %v; want the cached roster", c.contacts)
+	}
+}
+
+func TestForwardedMessage(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<message xmlns='jabber:client' from='romeo@example.net/orchard' type='chat'>` +
+		`<body>Look what Juliet wrote</body>` +
+		`<forwarded xmlns='urn:xmpp:forward:0'>` +
+		`<delay xmlns='urn:xmpp:delay' stamp='2010-07-10T23:08:25.123Z'/>` +
+		`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'><body>Wherefore art thou?</body></message>` +
+		`</forwarded></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	chat, ok := v.(Chat)
+	if !ok || chat.Forwarded == nil {
+		t.Fatalf("Recv() = %#v; want Chat with Forwarded", v)
+	}
+	if chat.Text != "Look what Juliet wrote" || len(chat.OtherElem) != 0 {
+		t.Errorf("Recv() = %#v", chat)
+	}
+	want := &Forwarded{
+		Stamp: time.Date(2010, 7, 10, 23, 8, 25, 123000000, time.UTC),
+		Chat: Chat{
+			Remote:    "juliet@example.com/balcony",
+			Type:      "chat",
+			Text:      "Wherefore art thou?",
+			Other:     []string{},
+			OtherElem: nil,
+		},
+	}
+	if !reflect.DeepEqual(chat.Forwarded, want) {
+		t.Errorf("Forwarded = %#v; want %#v", chat.Forwarded, want)
+	}
+}
+
+func TestRosterSet(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		if strings.Contains(s.InnerXML, "jid='bad@'") {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='modify'><bad-request xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+
+	if err := c.RosterAdd("juliet@example.com", "Juliet & co", []string{"Friends"}); err != nil {
+		t.Fatalf("RosterAdd() = %v", err)
+	}
+	if err := c.RosterRemove("romeo@example.net"); err != nil {
+		t.Fatalf("RosterRemove() = %v", err)
+	}
+	if err := c.RosterUpdate(RosterEntry{JID: "bad@"}); err == nil || !strings.Contains(err.Error(), "bad-request") {
+		t.Errorf("RosterUpdate() = %v; want bad-request error", err)
+	}
+
+	want := []string{
+		"<query xmlns='jabber:iq:roster'><item jid='juliet@example.com' name='Juliet &amp; co'><group>Friends</group></item></query>",
+		"<query xmlns='jabber:iq:roster'><item jid='romeo@example.net' subscription='remove'/></query>",
+	}
+	for i, w := range want {
+		if got[i].Type != "set" || got[i].InnerXML != w {
+			t.Errorf("request %d = %#v; want %q", i, got[i], w)
+		}
+	}
+}
+
+// tListen starts a fake server on a local TCP port and returns its address. The server
+// handles a single connection, where for each step it waits until the client has sent the
+// first string of the step and then replies with the second.
+func tListen(t *testing.T, steps ...[2]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if tLockstep(conn, steps...) {
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// tLockstep answers each step[0] the client writes to conn with step[1] and reports
+// whether all steps were taken.
+func tLockstep(conn net.Conn, steps ...[2]string) bool {
+	var received []byte
+	buf := make([]byte, 4096)
+	for _, step := range steps {
+		for !bytes.Contains(received, []byte(step[0])) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return false
+			}
+			received = append(received, buf[:n]...)
+		}
+		received = received[bytes.Index(received, []byte(step[0]))+len(step[0]):]
+		if _, err := conn.Write([]byte(step[1])); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// tTLSConfig returns a server TLS config with a self-signed certificate for example.com.
+func tTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestCredentials(t *testing.T) {
+	features := scriptStreamHeader +
+		`<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`
+	addr := tListen(t,
+		[2]string{"<stream:stream", features},
+		[2]string{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		[2]string{"<bind", scriptBindResult})
+	o := Options{
+		Host:                         addr,
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+	}
+	if err := o.TestCredentials(); err != nil {
+		t.Errorf("TestCredentials() = %v", err)
+	}
+
+	o.Host = tListen(t,
+		[2]string{"<stream:stream", features},
+		[2]string{"<auth", `<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>`})
+	err := o.TestCredentials()
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || authErr.Condition != "not-authorized" {
+		t.Errorf("TestCredentials() = %v; want not-authorized *AuthError", err)
+	}
+}
+
+func TestRosterPush(t *testing.T) {
+	conn := tScript(`<iq xmlns='jabber:client' type='set' id='a78b4q6ha463'>` +
+		`<query xmlns='jabber:iq:roster'><item jid='nurse@example.com' subscription='remove'/></query></iq>`)
+	c := &Client{conn: conn, jid: "juliet@example.com/balcony"}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	want := RosterPush{Entry: RosterEntry{JID: "nurse@example.com", Subscription: "remove"}}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("Recv() = %#v; want %#v", v, want)
+	}
+	if got := conn.out.String(); got != "<iq type='result' id='a78b4q6ha463'/>" {
+		t.Errorf("reply = %q", got)
+	}
+
+	c.conn = tConnect(`<iq xmlns='jabber:client' type='set' id='a78b4q6ha464'>` +
+		`<query xmlns='jabber:iq:roster' ver='ver34'><item jid='romeo@example.net' subscription='both'/></query></iq>`)
+	c.p = xml.NewDecoder(c.conn)
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if push := v.(RosterPush); push.Version != "ver34" || c.RosterVersion() != "ver34" {
+		t.Errorf("Recv() = %#v; version %q", push, c.RosterVersion())
+	}
+}
+
+func TestStanzaErrorLanguage(t *testing.T) {
+	inner := []byte(`<service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas' xml:lang='en'>Service unavailable</text>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas' xml:lang='de-CH'>Dienst nicht verfügbar</text>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas' xml:lang='fr'>Service indisponible</text>`)
+	tests := []struct {
+		langs []string
+		want  string
+	}{
+		{nil, "Service unavailable"},
+		{[]string{"fr", "en"}, "Service indisponible"},
+		{[]string{"it", "de"}, "Dienst nicht verfügbar"},
+		{[]string{"en-GB"}, "Service unavailable"},
+		{[]string{"ja"}, "Service unavailable"},
+	}
+	for _, tt := range tests {
+		se := parseStanzaError(inner, tt.langs)
+		if se.Condition != "service-unavailable" || se.Text != tt.want {
+			t.Errorf("parseStanzaError(%v) = %#v; want text %q", tt.langs, se, tt.want)
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	c.RequestSubscription("juliet@example.com")
+	c.ApproveSubscription("romeo@example.net")
+	c.DenySubscription("nurse@example.com")
+	c.Unsubscribe("tybalt@example.com'")
+	want := "<presence to='juliet@example.com' type='subscribe'/>" +
+		"<presence to='romeo@example.net' type='subscribed'/>" +
+		"<presence to='nurse@example.com' type='unsubscribed'/>" +
+		"<presence to='tybalt@example.com&#39;' type='unsubscribe'/>"
+	if got := conn.out.String(); got != want {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+}
+
+func TestPingResponder(t *testing.T) {
+	conn := tScript(`<iq xmlns='jabber:client' type='get' id='p1' from='juliet@example.com/balcony' to='romeo@example.net/orchard'><ping xmlns='urn:xmpp:ping'/></iq>` +
+		`<iq xmlns='jabber:client' type='get' id='p2' from='juliet@example.com/balcony' to='romeo@example.net/garden'><ping xmlns='urn:xmpp:ping'/></iq>`)
+	c := &Client{conn: conn, jid: "romeo@example.net/orchard"}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if iq, ok := v.(IQ); !ok || iq.ID != "p2" {
+		t.Errorf("Recv() = %#v; want the ping to another resource", v)
+	}
+	want := "<iq type='result' from='romeo@example.net/orchard' to='juliet@example.com/balcony' id='p1'/>"
+	if got := conn.out.String(); got != want {
+		t.Errorf("pong = %q; want %q", got, want)
+	}
+}
+
+func TestSendPresence(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	c.SendPresence(Presence{Show: "dnd", Status: "In a <meeting>", Priority: -1})
+	c.SendPresence(Presence{To: "room@conference.example.com/bot", Type: "unavailable"})
+	want := "<presence><show>dnd</show><status>In a &lt;meeting&gt;</status><priority>-1</priority></presence>" +
+		"<presence to='room@conference.example.com/bot' type='unavailable'/>"
+	if got := conn.out.String(); got != want {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+
+	c.conn = tConnect(`<presence xmlns='jabber:client' from='juliet@example.com/balcony'>` +
+		`<show>away</show><status>Be right back</status><priority>5</priority></presence>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	p := Presence{From: "juliet@example.com/balcony", Show: "away", Status: "Be right back", Priority: 5}
+	if !reflect.DeepEqual(v, p) {
+		t.Errorf("Recv() = %#v; want %#v", v, p)
+	}
+}
+
+func TestLocalizedBodies(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat' xml:lang='en'>` +
+		`<body xml:lang='de'>Wo bist du?</body><body>Where are you?</body><subject>Weather</subject></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	chat := v.(Chat)
+	if chat.Text != "Where are you?" || chat.Subject != "Weather" || chat.Subjects != nil {
+		t.Errorf("Recv() = %#v", chat)
+	}
+	want := []LangText{{"de", "Wo bist du?"}, {"", "Where are you?"}}
+	if !reflect.DeepEqual(chat.Bodies, want) {
+		t.Errorf("Bodies = %#v; want %#v", chat.Bodies, want)
+	}
+
+	conn := tScript("")
+	c.conn = conn
+	c.Send(Chat{Remote: "room@conference.example.com", Type: "groupchat",
+		Bodies: []LangText{{"en", "100% done"}, {"fr", "Fini à 100%"}}})
+	if got := conn.out.String(); !strings.Contains(got, "<body xml:lang='en'>100% done</body><body xml:lang='fr'>Fini à 100%</body></message>") ||
+		strings.Contains(got, "<body>") {
+		t.Errorf("sent %q", got)
+	}
+
+	conn.out.Reset()
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m1", Text: "50% off", Thread: "t%d",
+		Subjects: []LangText{{"en", "50% off"}}, ReplaceID: "m%s", Nickname: "100%"})
+	sent := "<message to='juliet@example.com' type='chat' id='m1' xml:lang='en'><subject xml:lang='en'>50% off</subject>" +
+		"<body>50% off</body><thread>t%d</thread><replace xmlns='urn:xmpp:message-correct:0' id='m%s'/>" +
+		"<nick xmlns='http://jabber.org/protocol/nick'>100%</nick></message>"
+	if got := conn.out.String(); got != sent {
+		t.Errorf("sent %q; want %q", got, sent)
+	}
+}
+
+func TestHasPayload(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' id='m2'>` +
+		`<received xmlns='urn:xmpp:receipts' id='m1'/></message>` +
+		`<message xmlns='jabber:client' from='juliet@example.com/balcony' id='m3'/>`)
+	c.p = xml.NewDecoder(c.conn)
+	for _, want := range []bool{true, false} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		chat, ok := v.(Chat)
+		if !ok {
+			t.Fatalf("Recv() = %#v; want Chat", v)
+		}
+		if chat.HasPayload() != want {
+			t.Errorf("HasPayload() = %v for %#v", !want, chat)
+		}
+	}
+}
+
+func TestChatStates(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	id, err := c.SendChatState("juliet@example.com", ChatStateComposing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SendChatState("juliet@example.com", "sleeping"); err == nil {
+		t.Error("SendChatState() with unknown state succeeded")
+	}
+	got := conn.out.String()
+	if !strings.Contains(got, "id='"+id+"'") || !strings.Contains(got, "<composing xmlns='http://jabber.org/protocol/chatstates'/></message>") || strings.Contains(got, "<body>") {
+		t.Errorf("sent %q", got)
+	}
+
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'>` +
+		`<paused xmlns='http://jabber.org/protocol/chatstates'/></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if chat := v.(Chat); chat.ChatState != ChatStatePaused {
+		t.Errorf("ChatState = %q; want %q", chat.ChatState, ChatStatePaused)
+	}
+}
+
+func TestChatMarkers(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m1", Text: "Hi", Markable: true})
+	if got := conn.out.String(); !strings.Contains(got, "id='m1'") || !strings.Contains(got, "<markable xmlns='urn:xmpp:chat-markers:0'/>") {
+		t.Errorf("sent %q", got)
+	}
+	conn.out.Reset()
+	c.SendDisplayed("juliet@example.com/balcony", "chat", "m0")
+	if got := conn.out.String(); !strings.Contains(got, "<displayed xmlns='urn:xmpp:chat-markers:0' id='m0'/>") {
+		t.Errorf("sent %q", got)
+	}
+
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat' id='m2'>` +
+		`<displayed xmlns='urn:xmpp:chat-markers:0' id='m1'/></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	chat := v.(Chat)
+	if want := (&ChatMarker{Type: MarkerDisplayed, ID: "m1"}); !reflect.DeepEqual(chat.Marker, want) {
+		t.Errorf("Marker = %#v; want %#v", chat.Marker, want)
+	}
+	if chat.ID != "m2" || chat.Markable || !chat.HasPayload() {
+		t.Errorf("Recv() = %#v", chat)
+	}
+}
+
+func TestCapsDiscoResponder(t *testing.T) {
+	// xep-0115 5.2
+	exodus := capsVer([]DiscoIdentity{{Category: "client", Type: "pc", Name: "Exodus 0.9.1"}},
+		[]string{"http://jabber.org/protocol/caps", "http://jabber.org/protocol/disco#info",
+			"http://jabber.org/protocol/disco#items", "http://jabber.org/protocol/muc"})
+	if exodus != "QgayPKawpkPSDYmwT/WM94uAlu0=" {
+		t.Errorf("capsVer() = %q", exodus)
+	}
+	// "<" must not take part in sorting, or "mood+notify" comes first.
+	if got := capsVer([]DiscoIdentity{defaultIdentity}, []string{nsMood + "+notify", nsMood}); got != "0J6NycafANwf8eGNA+eSzu+hihs=" {
+		t.Errorf("capsVer() with a feature prefixing another = %q", got)
+	}
+
+	identities := []DiscoIdentity{defaultIdentity}
+	ver := capsVer(identities, []string{nsDiscoInfo, nsCaps, nsPing, nsVersion, nsTime, nsLast, nsCorrect, nsRetract})
+	conn := tScript(`<iq xmlns='jabber:client' type='get' id='d1' from='juliet@example.com/balcony' to='user@example.com/bot'>` +
+		`<query xmlns='http://jabber.org/protocol/disco#info' node='https://example.com/bot#` + ver + `'/></iq>` +
+		`<iq xmlns='jabber:client' type='get' id='d2' from='juliet@example.com/balcony' to='user@example.com/bot'>` +
+		`<query xmlns='http://jabber.org/protocol/disco#info' node='https://example.com/bot#stale'/></iq>`)
+	c := &Client{conn: conn, jid: "user@example.com/bot", capsNode: "https://example.com/bot"}
+	c.p = xml.NewDecoder(c.conn)
+	if _, err := c.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v; want EOF", err)
+	}
+
+	var replies struct {
+		IQ []struct {
+			Type  string `xml:"type,attr"`
+			ID    string `xml:"id,attr"`
+			To    string `xml:"to,attr"`
+			Query struct {
+				Node       string          `xml:"node,attr"`
+				Identities []DiscoIdentity `xml:"identity"`
+				Features   []struct {
+					Var string `xml:"var,attr"`
+				} `xml:"feature"`
+			} `xml:"query"`
+		} `xml:"iq"`
+	}
+	if err := xml.Unmarshal([]byte("<r>"+conn.out.String()+"</r>"), &replies); err != nil || len(replies.IQ) != 2 {
+		t.Fatalf("replies %q: %v", conn.out.String(), err)
+	}
+	r := replies.IQ[0]
+	if r.Type != "result" || r.ID != "d1" || r.To != "juliet@example.com/balcony" || r.Query.Node != "https://example.com/bot#"+ver {
+		t.Errorf("reply = %+v", r)
+	}
+	var features []string
+	for _, f := range r.Query.Features {
+		features = append(features, f.Var)
+	}
+	if got := capsVer(r.Query.Identities, features); got != ver {
+		t.Errorf("reply hashes to %q; want %q", got, ver)
+	}
+	if r := replies.IQ[1]; r.Type != "error" || r.ID != "d2" {
+		t.Errorf("reply to unknown node = %+v", r)
+	}
+}
+
+func TestDisco(t *testing.T) {
+	c := tServer(t, func(s tStanza) string {
+		switch {
+		case s.To == "nobody.example.com":
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'><error type='cancel'>" +
+				"<service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		case strings.Contains(s.InnerXML, "disco#info"):
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/disco#info'>" +
+				"<identity category='conference' type='text' name='Chatrooms'/>" +
+				"<feature var='http://jabber.org/protocol/disco#info'/><feature var='http://jabber.org/protocol/muc'/>" +
+				"</query></iq>"
+		default:
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/disco#items'>" +
+				"<item jid='heath@chat.example.com' name='A Lonely Heath'/><item jid='chat.example.com' node='rooms'/>" +
+				"</query></iq>"
+		}
+	})
+
+	info, err := c.DiscoInfo("chat.example.com")
+	if err != nil {
+		t.Fatalf("DiscoInfo() = %v", err)
+	}
+	want := &DiscoInfo{
+		Identities: []DiscoIdentity{{Category: "conference", Type: "text", Name: "Chatrooms"}},
+		Features:   []string{"http://jabber.org/protocol/disco#info", "http://jabber.org/protocol/muc"},
+	}
+	if !reflect.DeepEqual(info, want) || !info.HasFeature("http://jabber.org/protocol/muc") {
+		t.Errorf("DiscoInfo() = %#v; want %#v", info, want)
+	}
+
+	items, err := c.DiscoItems("chat.example.com")
+	if err != nil {
+		t.Fatalf("DiscoItems() = %v", err)
+	}
+	wantItems := []DiscoItem{{JID: "heath@chat.example.com", Name: "A Lonely Heath"}, {JID: "chat.example.com", Node: "rooms"}}
+	if !reflect.DeepEqual(items, wantItems) {
+		t.Errorf("DiscoItems() = %#v; want %#v", items, wantItems)
+	}
+
+	var se *StanzaError
+	if _, err := c.DiscoInfo("nobody.example.com"); !errors.As(err, &se) || se.Condition != "service-unavailable" {
+		t.Errorf("DiscoInfo() = %v; want service-unavailable", err)
+	}
+}
+
+func TestBoundResource(t *testing.T) {
+	conn := tScript(scriptAuth + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` +
+		`<iq type='result' id='_xmpp_bind1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>user@example.com/bot-ab12</jid></bind></iq>`)
+	c := &Client{conn: conn}
+	err := c.init(&Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		Resource:                     "bot",
+		InsecureAllowUnencryptedAuth: true,
+		NoTLS:                        true,
+	})
+	if err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if !strings.Contains(conn.out.String(), "<resource>bot</resource>") {
+		t.Errorf("bind request %q lacks the resource", conn.out.String())
+	}
+	if c.JID() != "user@example.com/bot-ab12" || c.Resource() != "bot-ab12" {
+		t.Errorf("JID() = %q, Resource() = %q; want the bound resource bot-ab12", c.JID(), c.Resource())
+	}
+}
+
+func TestBindConflict(t *testing.T) {
+	conn := tScript(scriptAuth + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` +
+		`<iq type='error' id='_xmpp_bind1'><error type='modify'><conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`)
+	c := &Client{conn: conn}
+	err := c.init(&Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		Resource:                     "work-laptop",
+		InsecureAllowUnencryptedAuth: true,
+		NoTLS:                        true,
+	})
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "conflict" || !strings.Contains(err.Error(), "work-laptop") {
+		t.Errorf("init() = %v; want a conflict binding work-laptop", err)
+	}
+}
+
+func TestCapsAdvertisement(t *testing.T) {
+	conn := tScript(`<iq xmlns='jabber:client' type='get' id='d1' from='juliet@example.com/balcony'>` +
+		`<query xmlns='http://jabber.org/protocol/disco#info'/></iq>`)
+	c := &Client{conn: conn, jid: "user@example.com/bot", capsNode: "https://example.com/bot"}
+	c.p = xml.NewDecoder(c.conn)
+	c.AddFeature("urn:xmpp:receipts")
+	c.AddFeature("urn:xmpp:receipts")
+	ver := capsVer([]DiscoIdentity{defaultIdentity}, []string{nsDiscoInfo, nsCaps, nsPing, nsVersion, nsTime, nsLast, nsCorrect, nsRetract, "urn:xmpp:receipts"})
+
+	c.SendPresence(Presence{Show: "chat"})
+	c.SendPresence(Presence{To: "juliet@example.com", Type: "subscribed"})
+	want := "<presence><show>chat</show><c xmlns='http://jabber.org/protocol/caps' hash='sha-1' node='https://example.com/bot' ver='" + ver + "'/></presence>" +
+		"<presence to='juliet@example.com' type='subscribed'/>"
+	if got := conn.out.String(); got != want {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+
+	conn.out.Reset()
+	if _, err := c.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v; want EOF", err)
+	}
+	if got := conn.out.String(); strings.Count(got, "<feature ") != 9 || !strings.Contains(got, "<feature var='urn:xmpp:receipts'/>") {
+		t.Errorf("disco#info reply %q lacks the registered feature", got)
+	}
+}
+
+func TestQueryMAM(t *testing.T) {
+	var query string
+	c := tServer(t, func(s tStanza) string {
+		query = s.InnerXML
+		i := strings.Index(query, "queryid='") + len("queryid='")
+		queryID := query[i : i+strings.Index(query[i:], "'")]
+		result := func(from, id, body string) string {
+			return "<message xmlns='jabber:client' from='" + from + "'>" +
+				"<result xmlns='urn:xmpp:mam:2' queryid='" + queryID + "' id='" + id + "'>" +
+				"<forwarded xmlns='urn:xmpp:forward:0'><delay xmlns='urn:xmpp:delay' stamp='2010-07-10T23:08:25Z'/>" +
+				"<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'><body>" + body + "</body></message>" +
+				"</forwarded></result></message>"
+		}
+		return result("user@example.com", "28482-98726-73623", "Call me but love") +
+			result("mallory@example.com", "forged", "Not from our archive") +
+			result("user@example.com", "09af3-cc343-b409f", "And I'll be new baptized") +
+			"<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><fin xmlns='urn:xmpp:mam:2'>" +
+			"<set xmlns='http://jabber.org/protocol/rsm'><first index='0'>28482-98726-73623</first>" +
+			"<last>09af3-cc343-b409f</last><count>20</count></set></fin></iq>"
+	})
+
+	messages, fin, err := c.QueryMAM(context.Background(), MAMQuery{
+		With:  "juliet@example.com",
+		Start: time.Date(2010, 6, 7, 0, 0, 0, 0, time.UTC),
+		Max:   2,
+	})
+	if err != nil {
+		t.Fatalf("QueryMAM() = %v", err)
+	}
+	for _, want := range []string{
+		"<field var=\"with\"><value>juliet@example.com</value></field>",
+		"<field var=\"start\"><value>2010-06-07T00:00:00Z</value></field>",
+		"<set xmlns='http://jabber.org/protocol/rsm'><max>2</max></set>",
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query %q lacks %q", query, want)
+		}
+	}
+	if len(messages) != 2 || messages[0].ID != "28482-98726-73623" || messages[1].Chat.Text != "And I'll be new baptized" ||
+		!messages[0].Stamp.Equal(time.Date(2010, 7, 10, 23, 8, 25, 0, time.UTC)) {
+		t.Errorf("QueryMAM() = %#v", messages)
+	}
+	want := &MAMFin{First: "28482-98726-73623", Last: "09af3-cc343-b409f", Count: 20}
+	if !reflect.DeepEqual(fin, want) {
+		t.Errorf("fin = %#v; want %#v", fin, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := c.QueryMAM(ctx, MAMQuery{Latest: true}); err != context.Canceled {
+		t.Errorf("QueryMAM() with canceled context = %v", err)
+	}
+}
+
+func TestRequiredStartTLS(t *testing.T) {
+	conn := tScript(scriptStreamHeader +
+		`<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls>` +
+		`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`)
+	c := &Client{conn: conn}
+	err := c.init(&Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "requires STARTTLS") {
+		t.Errorf("init() = %v; want error about required STARTTLS", err)
+	}
+	if out := conn.out.String(); strings.Contains(out, "<auth") || strings.Contains(out, "<starttls") {
+		t.Errorf("sent %q after the server required STARTTLS", out)
+	}
+}
+
+func TestCarbons(t *testing.T) {
+	var got []string
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s.InnerXML)
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+	if err := c.EnableCarbons(); err != nil {
+		t.Fatalf("EnableCarbons() = %v", err)
+	}
+	if err := c.DisableCarbons(); err != nil {
+		t.Fatalf("DisableCarbons() = %v", err)
+	}
+	if len(got) != 2 || got[0] != "<enable xmlns='urn:xmpp:carbons:2'/>" || got[1] != "<disable xmlns='urn:xmpp:carbons:2'/>" {
+		t.Errorf("requests = %q", got)
+	}
+
+	carbon := func(from, kind, inner string) string {
+		return "<message xmlns='jabber:client' from='" + from + "' to='user@example.com/bot' type='chat'>" +
+			"<" + kind + " xmlns='urn:xmpp:carbons:2'><forwarded xmlns='urn:xmpp:forward:0'>" + inner +
+			"</forwarded></" + kind + "></message>"
+	}
+	var d Client
+	d.jid = "user@example.com/bot"
+	d.conn = tConnect(carbon("mallory@example.com", "received",
+		"<message xmlns='jabber:client' from='mallory@example.com/x' to='user@example.com' type='chat'><body>forged</body></message>") +
+		carbon("user@example.com", "sent",
+			"<message xmlns='jabber:client' from='user@example.com/bot' to='juliet@example.com' type='chat'><body>mine</body></message>") +
+		carbon("user@example.com", "sent",
+			"<message xmlns='jabber:client' from='user@example.com/phone' to='juliet@example.com' type='chat'><body>from my phone</body></message>") +
+		carbon("user@example.com", "received",
+			"<message xmlns='jabber:client' from='juliet@example.com/balcony' to='user@example.com/phone' type='chat'><body>to my phone</body></message>"))
+	d.p = xml.NewDecoder(d.conn)
+	for _, want := range []Chat{
+		{Remote: "juliet@example.com", Text: "from my phone", Carbon: CarbonSent},
+		{Remote: "juliet@example.com/balcony", Text: "to my phone", Carbon: CarbonReceived},
+	} {
+		v, err := d.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		chat, ok := v.(Chat)
+		if !ok || chat.Remote != want.Remote || chat.Text != want.Text || chat.Carbon != want.Carbon {
+			t.Errorf("Recv() = %#v; want %#v", v, want)
+		}
+	}
+}
+
+func TestDedupMessages(t *testing.T) {
+	msg := func(ids, body string) string {
+		return "<message xmlns='jabber:client' from='juliet@example.com/balcony' to='user@example.com/bot' type='chat'>" +
+			"<body>" + body + "</body>" + ids + "</message>"
+	}
+	sid := "<stanza-id xmlns='urn:xmpp:sid:0' by='user@example.com' id='a1'/>"
+	oid := "<origin-id xmlns='urn:xmpp:sid:0' id='o1'/>"
+	var c Client
+	c.jid = "user@example.com/bot"
+	c.dedup = newDedup(dedupWindow)
+	c.conn = tConnect(msg(sid+oid, "one") + msg(oid, "one again") +
+		"<message xmlns='jabber:client' from='user@example.com' to='user@example.com/bot' type='chat'>" +
+		"<received xmlns='urn:xmpp:carbons:2'><forwarded xmlns='urn:xmpp:forward:0'>" + msg(sid, "carbon of one") +
+		"</forwarded></received></message>" +
+		msg("", "two") + msg("", "two"))
+	c.p = xml.NewDecoder(c.conn)
+	var got []string
+	for {
+		v, err := c.Recv()
+		if err != nil {
+			break
+		}
+		got = append(got, v.(Chat).Text)
+	}
+	if want := []string{"one", "two", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Recv() returned %q; want %q", got, want)
+	}
+
+	s := tServer(t, func(s tStanza) string {
+		i := strings.Index(s.InnerXML, "queryid='") + len("queryid='")
+		queryID := s.InnerXML[i : i+strings.Index(s.InnerXML[i:], "'")]
+		result := func(id, body string) string {
+			return "<message xmlns='jabber:client' from='user@example.com'>" +
+				"<result xmlns='urn:xmpp:mam:2' queryid='" + queryID + "' id='" + id + "'>" +
+				"<forwarded xmlns='urn:xmpp:forward:0'>" + msg("", body) + "</forwarded></result></message>"
+		}
+		return msg(sid, "live") + result("a1", "archived live") + result("a2", "archived") +
+			"<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><fin xmlns='urn:xmpp:mam:2' complete='true'/></iq>"
+	})
+	s.dedup = newDedup(dedupWindow)
+	messages, _, err := s.QueryMAM(context.Background(), MAMQuery{})
+	if err != nil {
+		t.Fatalf("QueryMAM() = %v", err)
+	}
+	if len(messages) != 1 || messages[0].ID != "a2" {
+		t.Errorf("QueryMAM() = %#v", messages)
+	}
+}
+
+func TestPresenceAvailability(t *testing.T) {
+	var c Client
+	c.conn = tConnect(`<presence xmlns='jabber:client' from='juliet@example.com/balcony'><show>away</show></presence>` +
+		`<presence xmlns='jabber:client' from='juliet@example.com/balcony' type='unavailable'/>` +
+		`<presence xmlns='jabber:client' from='romeo@example.net' type='subscribe'/>` +
+		`<presence xmlns='jabber:client' from='romeo@example.net' type='subscribed'/>`)
+	c.p = xml.NewDecoder(c.conn)
+	for _, want := range [][3]bool{
+		{true, false, false},
+		{false, true, false},
+		{false, false, true},
+		{false, false, false},
+	} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		p := v.(Presence)
+		if got := [3]bool{p.IsAvailable(), p.IsUnavailable(), p.IsSubscriptionRequest()}; got != want {
+			t.Errorf("%q presence: IsAvailable, IsUnavailable, IsSubscriptionRequest = %v; want %v", p.Type, got, want)
+		}
+	}
+}
+
+func TestStreamManagementAckRequests(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	if err := c.RequestAck(); err == nil {
+		t.Error("RequestAck() without stream management succeeded")
+	}
+	c.sm = smState{enabled: true, ackEvery: 2}
+	for i := 0; i < 3; i++ {
+		c.SendPresence(Presence{})
+	}
+	c.SendKeepAlive()
+	if err := c.RequestAck(); err != nil {
+		t.Fatalf("RequestAck() = %v", err)
+	}
+	want := "<presence/><presence/><r xmlns='urn:xmpp:sm:3'/><presence/> <r xmlns='urn:xmpp:sm:3'/>"
+	if got := conn.out.String(); got != want {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+	if c.sm.outbound != 3 || len(c.sm.unacked) != 3 || c.Resumed() {
+		t.Errorf("sm state = %+v", c.sm)
+	}
+}
+
+func TestRequestAckWait(t *testing.T) {
+	// The server answers the first request only.
+	answered := false
+	c := tServer(t, func(s tStanza) string {
+		if s.XMLName.Local == "r" && !answered {
+			answered = true
+			return "<a xmlns='urn:xmpp:sm:3' h='7'/>"
+		}
+		return ""
+	})
+	if _, err := c.RequestAckWait(context.Background()); err == nil {
+		t.Error("RequestAckWait() without stream management succeeded")
+	}
+	c.sendMutex.Lock()
+	c.sm = smState{enabled: true}
+	c.sendMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if h, err := c.RequestAckWait(ctx); err != nil || h != 7 {
+		t.Errorf("RequestAckWait() = %d, %v; want 7", h, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.RequestAckWait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("RequestAckWait() without answer = %v; want %v", err, context.DeadlineExceeded)
+	}
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if len(c.sm.waiters) != 0 || c.sm.requested != 2 || c.sm.answered != 1 {
+		t.Errorf("sm state = %+v", c.sm)
+	}
+}
+
+func TestSendPresenceWait(t *testing.T) {
+	c := tServer(t, func(s tStanza) string {
+		if s.To != "room@conference.example.com/bot" {
+			return ""
+		}
+		return "<presence xmlns='jabber:client' from='room@conference.example.com/bot' id='" + s.ID + "' type='error'>" +
+			"<error type='cancel'><not-allowed xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></presence>"
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.SendPresenceWait(ctx, Presence{To: "room@conference.example.com/bot", ID: "dp1"})
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "not-allowed" {
+		t.Errorf("SendPresenceWait() = %v; want not-allowed", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.SendPresenceWait(ctx, Presence{To: "juliet@example.com"}); err != nil {
+		t.Errorf("SendPresenceWait() = %v; want nil without an error response", err)
+	}
+}
+
+// tFramedConn is a transport framing the stream like XMPP over WebSocket, RFC 7395 3.3,
+// on top of a scripted connection.
+type tFramedConn struct {
+	*scriptConn
+}
+
+func (tFramedConn) openStream(domain string) string {
+	return "<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' to='" + domain + "' version='1.0'/>"
+}
+
+func (tFramedConn) isStreamOpen(se xml.StartElement) bool {
+	return se.Name.Space == "urn:ietf:params:xml:ns:xmpp-framing" && se.Name.Local == "open"
+}
+
+func (tFramedConn) closeStream() string {
+	return "<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>"
+}
+
+func (tFramedConn) encrypted() bool {
+	return true
+}
+
+func TestTransport(t *testing.T) {
+	const open = `<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' from='example.com' id='1' version='1.0'/>`
+	conn := tFramedConn{tScript(open +
+		`<stream:features xmlns:stream='http://etherx.jabber.org/streams'>` +
+		`<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>` +
+		`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + open +
+		`<stream:features xmlns:stream='http://etherx.jabber.org/streams'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` +
+		`<iq xmlns='jabber:client' type='result' id='_xmpp_bind1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>user@example.com/bot</jid></bind></iq>` +
+		`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'><body>Hi</body></message>`)}
+	c := &Client{conn: conn}
+	if err := c.init(&Options{User: "user@example.com", Password: "secret", StartTLS: true}); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if !c.IsEncrypted() || c.JID() != "user@example.com/bot" {
+		t.Errorf("IsEncrypted() = %v, JID() = %q", c.IsEncrypted(), c.JID())
+	}
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if chat, ok := v.(Chat); !ok || chat.Text != "Hi" {
+		t.Errorf("Recv() = %#v", v)
+	}
+	c.Close()
+	out := conn.out.String()
+	if strings.Count(out, "<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' to='example.com' version='1.0'/>") != 2 ||
+		strings.Contains(out, "<stream:stream") || strings.Contains(out, "<starttls") ||
+		!strings.HasSuffix(out, "<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>") {
+		t.Errorf("sent %q", out)
+	}
+}
+
+// tWebSocket returns the URL of a fake XMPP over WebSocket server that answers the
+// client's messages in lockstep, like tListen. It pings the client before every answer
+// and records the messages it received, pongs included, until done is closed.
+func tWebSocket(t *testing.T, received *[]string, steps ...[2]string) (url string, done <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil || req.Header.Get("Sec-WebSocket-Protocol") != "xmpp" {
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: xmpp\r\n\r\n", wsAccept(req.Header.Get("Sec-WebSocket-Key")))
+		for _, step := range steps {
+			for {
+				op, payload, err := readFrame(r)
+				if err != nil {
+					return
+				}
+				*received = append(*received, fmt.Sprintf("%d:%s", op, payload))
+				if op == wsText && strings.Contains(string(payload), step[0]) {
+					break
+				}
+			}
+			writeFrame(conn, wsPing, []byte("p"), false)
+			writeFrame(conn, wsText, []byte(step[1]), false)
+		}
+		for {
+			op, payload, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			*received = append(*received, fmt.Sprintf("%d:%s", op, payload))
+			if op == wsClose {
+				return
+			}
+		}
+	}()
+	return "ws://" + l.Addr().String() + "/xmpp-websocket", ch
+}
+
+func TestWebSocket(t *testing.T) {
+	const open = `<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' from='example.com' id='1' version='1.0'/>`
+	var received []string
+	url, done := tWebSocket(t, &received,
+		[2]string{"<open", open + `<stream:features xmlns:stream='http://etherx.jabber.org/streams'>` +
+			`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+		[2]string{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		[2]string{"<open", open + `<stream:features xmlns:stream='http://etherx.jabber.org/streams'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		[2]string{"<bind", `<iq xmlns='jabber:client' type='result' id='_xmpp_bind1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>user@example.com/bot</jid></bind></iq>`})
+	c, err := NewClientWebSocket(url, Options{User: "user@example.com", Password: "secret", InsecureAllowUnencryptedAuth: true})
+	if err != nil {
+		t.Fatalf("NewClientWebSocket() = %v", err)
+	}
+	if c.JID() != "user@example.com/bot" || c.IsEncrypted() {
+		t.Errorf("JID() = %q, IsEncrypted() = %v", c.JID(), c.IsEncrypted())
+	}
+	c.Close()
+	<-done
+	got := strings.Join(received, "\n")
+	for _, want := range []string{
+		"1:<open xmlns='urn:ietf:params:xml:ns:xmpp-framing' to='example.com' version='1.0'/>",
+		"10:p",
+		"1:<presence xml:lang='en'>",
+		"1:<close xmlns='urn:ietf:params:xml:ns:xmpp-framing'/>\n8:",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("server received %q; want %q", got, want)
+		}
+	}
+}
+
+func TestInternalIDs(t *testing.T) {
+	conn := tScript(scriptAuth + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` +
+		`<iq type='result' id='x'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>mallory@example.com/x</jid></bind></iq>` +
+		scriptBindResult)
+	c := &Client{conn: conn}
+	if err := c.init(&Options{User: "user@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true}); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if c.JID() != "user@example.com/bot" {
+		t.Errorf("JID() = %q; want the one of the bind result", c.JID())
+	}
+	if !strings.Contains(conn.out.String(), "id='"+IDPrefix+"bind1'") {
+		t.Errorf("bind request %q lacks the reserved id", conn.out.String())
+	}
+
+	c = tServer(t, func(s tStanza) string {
+		if s.ID == "x" || strings.HasPrefix(s.ID, IDPrefix) {
+			return "<iq xmlns='jabber:client' type='result' id='x'/><iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+		}
+		return ""
+	})
+	if _, err := c.DiscoItems(""); err != nil {
+		t.Errorf("DiscoItems() = %v", err)
+	}
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	addr := tListen(t,
+		[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+		[2]string{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		[2]string{"<bind", scriptBindResult})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClientFromConn(conn, Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+	})
+	if err != nil {
+		t.Fatalf("NewClientFromConn() = %v", err)
+	}
+	defer c.Close()
+	if c.JID() != "user@example.com/bot" || c.conn != conn {
+		t.Errorf("JID() = %q; conn replaced: %v", c.JID(), c.conn != conn)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	legacy := "<query xmlns='jabber:iq:search'>" +
+		"<item jid='juliet@capulet.com'><first>Juliet</first><last>Capulet</last><nick>JuliC</nick><email>juliet@shakespeare.lit</email></item>" +
+		"</query>"
+	form := "<query xmlns='jabber:iq:search'><x xmlns='jabber:x:data' type='result'>" +
+		"<field type='hidden' var='FORM_TYPE'><value>jabber:iq:search</value></field>" +
+		"<reported><field var='first' label='Given Name'/><field var='jid' label='JID'/><field var='x-gender'/></reported>" +
+		"<item><field var='first'><value>Juliet</value></field><field var='last'><value>Capulet</value></field>" +
+		"<field var='nick'><value>JuliC</value></field><field var='email'><value>juliet@shakespeare.lit</value></field>" +
+		"<field var='jid'><value>juliet@capulet.com</value></field><field var='x-gender'><value>female</value></field></item>" +
+		"</x></query>"
+	var got []string
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s.InnerXML)
+		if strings.Contains(s.InnerXML, "jabber:x:data") {
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>" + form + "</iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>" + legacy + "</iq>"
+	})
+	want := SearchResult{JID: "juliet@capulet.com", First: "Juliet", Last: "Capulet", Nick: "JuliC", Email: "juliet@shakespeare.lit"}
+
+	results, err := c.Search("search.shakespeare.lit", map[string]string{"last": "Capulet", "first": "Juliet"})
+	if err != nil {
+		t.Fatalf("Search() = %v", err)
+	}
+	if !reflect.DeepEqual(results, []SearchResult{want}) {
+		t.Errorf("Search() = %#v; want %#v", results, want)
+	}
+	if got[0] != "<query xmlns='jabber:iq:search'><first>Juliet</first><last>Capulet</last></query>" {
+		t.Errorf("search request = %q", got[0])
+	}
+
+	// The form as the directory sent it, filled in.
+	fields := &DataForm{Type: "form", Title: "User Directory Search", Fields: []DataFormField{
+		{Type: "fixed", Values: []string{"Fill in a field"}},
+		{Var: "last", Type: "text-single", Label: "Family Name", Values: []string{"Capulet"}},
+		{Var: "x-gender", Type: "list-single", Label: "Gender", Options: []DataFormOption{{Label: "Female", Value: "female"}}},
+	}}
+	results, err = c.SearchForm("search.shakespeare.lit", fields)
+	if err != nil {
+		t.Fatalf("SearchForm() = %v", err)
+	}
+	if want := "<query xmlns='jabber:iq:search'><x xmlns=\"jabber:x:data\" type=\"submit\">" +
+		"<field var=\"FORM_TYPE\" type=\"hidden\"><value>jabber:iq:search</value></field>" +
+		"<field var=\"last\"><value>Capulet</value></field><field var=\"x-gender\"></field></x></query>"; got[1] != want {
+		t.Errorf("search request = %q; want %q", got[1], want)
+	}
+	want.Other = map[string]string{"x-gender": "female"}
+	if !reflect.DeepEqual(results, []SearchResult{want}) {
+		t.Errorf("SearchForm() = %#v; want %#v", results, want)
+	}
+}
+
+func TestNewClientContext(t *testing.T) {
+	// The server answers the stream header, but never the authentication.
+	addr := tListen(t,
+		[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`})
+	o := Options{
+		Host:                         addr,
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := o.NewClientContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("NewClientContext() with a stalled SASL negotiation = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// The server never answers the TLS handshake.
+	o.Host = tListen(t)
+	o.NoTLS, o.DirectTLS = false, true
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := o.NewClientContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewClientContext() canceled during the TLS handshake = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestAutoReplyPolicy(t *testing.T) {
+	version := func(id, from string) string {
+		return `<iq xmlns='jabber:client' type='get' id='` + id + `' from='` + from + `' to='user@example.com/bot'>` +
+			`<query xmlns='jabber:iq:version'/></iq>`
+	}
+	conn := tScript(`<iq xmlns='jabber:client' type='set' id='push1'><query xmlns='jabber:iq:roster'>` +
+		`<item jid='juliet@example.com' subscription='both'/></query></iq>` +
+		version("v1", "romeo@montague.lit/orchard") +
+		version("v2", "juliet@example.com/balcony") +
+		version("v3", "nurse@capulet.lit/kitchen") +
+		`<iq xmlns='jabber:client' type='get' id='t1' from='romeo@montague.lit/orchard' to='user@example.com/bot'>` +
+		`<time xmlns='urn:xmpp:time'/></iq>` +
+		`<iq xmlns='jabber:client' type='get' id='p1' from='example.com' to='user@example.com/bot'>` +
+		`<ping xmlns='urn:xmpp:ping'/></iq>`)
+	c := &Client{conn: conn, jid: "user@example.com/bot", domain: "example.com",
+		autoReply: AutoReplyContacts, autoReplyAllow: []string{"capulet.lit"}}
+	c.software.name, c.software.version = "bot", "1.0"
+	c.p = xml.NewDecoder(c.conn)
+	for {
+		if _, err := c.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+	}
+
+	var replies struct {
+		IQ []struct {
+			Type  string `xml:"type,attr"`
+			ID    string `xml:"id,attr"`
+			Query struct {
+				Name    string `xml:"name"`
+				Version string `xml:"version"`
+			} `xml:"query"`
+			Error *struct {
+				Condition xml.Name `xml:",any"`
+			} `xml:"error"`
+		} `xml:"iq"`
+	}
+	if err := xml.Unmarshal([]byte("<r>"+conn.out.String()+"</r>"), &replies); err != nil || len(replies.IQ) != 6 {
+		t.Fatalf("replies %q: %v", conn.out.String(), err)
+	}
+	for _, r := range replies.IQ[1:] {
+		switch r.ID {
+		case "v1", "t1":
+			if r.Type != "error" || r.Error == nil || r.Error.Condition.Local != "service-unavailable" {
+				t.Errorf("reply to a stranger = %+v; want service-unavailable", r)
+			}
+		case "v2", "v3":
+			if r.Type != "result" || r.Query.Name != "bot" || r.Query.Version != "1.0" {
+				t.Errorf("reply to %s = %+v", r.ID, r)
+			}
+		case "p1":
+			if r.Type != "result" {
+				t.Errorf("reply to the server's ping = %+v", r)
+			}
+		default:
+			t.Errorf("unexpected reply %+v", r)
+		}
+	}
+}
+
+func TestDialer(t *testing.T) {
+	steps := [][2]string{
+		{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+		{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		{"<bind", scriptBindResult},
+	}
+	o := Options{
+		Host:                         "xmpp.example.com",
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+	}
+
+	server := tListen(t, steps...)
+	var dialed string
+	o.Dialer = DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return (&net.Dialer{}).DialContext(ctx, network, server)
+	})
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() with a DialerFunc = %v", err)
+	}
+	c.Close()
+	if dialed != "xmpp.example.com:5222" {
+		t.Errorf("dialed %q", dialed)
+	}
+
+	// A proxy that tunnels to the server if the client authenticates.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server = tListen(t, steps...)
+	requests := make(chan *http.Request, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			requests <- req
+			if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("proxyuser:proxypass")) {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				conn.Close()
+				continue
+			}
+			upstream, err := net.Dial("tcp", server)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+
+	o.Dialer = &HTTPConnectDialer{Proxy: l.Addr().String(), User: url.User("proxyuser")}
+	if _, err := o.NewClient(); err == nil || !strings.Contains(err.Error(), "Proxy Authentication Required") {
+		t.Errorf("NewClient() with a wrong proxy password = %v", err)
+	}
+	<-requests
+
+	o.Dialer = &HTTPConnectDialer{Proxy: l.Addr().String(), User: url.UserPassword("proxyuser", "proxypass")}
+	c, err = o.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() through the proxy = %v", err)
+	}
+	c.Close()
+	if req := <-requests; req.Method != "CONNECT" || req.Host != "xmpp.example.com:5222" {
+		t.Errorf("proxy request = %s %s", req.Method, req.Host)
+	}
+}
+
+func TestMUCOccupantsRejoin(t *testing.T) {
+	occupant := func(nick, role string, self bool) string {
+		s := `<presence xmlns='jabber:client' from='room@conference.example.com/` + nick + `'>` +
+			`<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='member' role='` + role + `'/>`
+		if self {
+			s += `<status code='110'/>`
+		}
+		return s + `</x></presence>`
+	}
+	conn := tScript(occupant("alice", "moderator", false) + occupant("bob", "participant", false) + occupant("bot", "participant", true) +
+		// after the rejoin, bob is gone
+		occupant("alice", "moderator", false) + occupant("bot", "visitor", true))
+	c := &Client{conn: conn, jid: "user@example.com/bot"}
+	c.p = xml.NewDecoder(c.conn)
+	recv := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := c.Recv(); err != nil {
+				t.Fatalf("Recv() = %v", err)
+			}
+		}
+	}
+	nicks := func() []string {
+		var nicks []string
+		for _, o := range c.MUCOccupants("room@conference.example.com") {
+			nicks = append(nicks, o.Nick+":"+o.Role)
+		}
+		return nicks
+	}
+
+	if _, err := c.JoinMUCNoHistory("room@conference.example.com", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	recv(3)
+	if got, want := nicks(), []string{"alice:moderator", "bob:participant", "bot:participant"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("occupants = %v; want %v", got, want)
+	}
+
+	if _, err := c.JoinMUCNoHistory("room@conference.example.com", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	if got := nicks(); len(got) != 0 {
+		t.Errorf("occupants on rejoin = %v; want none", got)
+	}
+	recv(2)
+	if got, want := nicks(), []string{"alice:moderator", "bot:visitor"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("occupants after rejoin = %v; want %v", got, want)
+	}
+}
+
+func TestDirectTLS(t *testing.T) {
+	server := tTLSConfig(t)
+	steps := [][2]string{
+		{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+		{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		{"<bind", scriptBindResult},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	plain := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// A client starting with TLS sends a handshake record, not a stream header.
+			buf := make([]byte, 1)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				conn.Close()
+				continue
+			}
+			plain <- buf[0] == '<'
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if buf[0] == '<' {
+					// STARTTLS, then the stream again on top of TLS
+					if !tLockstep(conn, [2]string{"stream:stream", scriptStreamHeader +
+						`<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/></stream:features>`},
+						[2]string{"<starttls", `<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>`}) {
+						return
+					}
+					conn = tls.Server(conn, server)
+				} else {
+					conn = tls.Server(&tPrefixConn{conn, buf}, server)
+				}
+				if tLockstep(conn, steps...) {
+					io.Copy(io.Discard, conn)
+				}
+			}(conn)
+		}
+	}()
+
+	for _, direct := range []bool{true, false} {
+		c, err := Options{
+			Host:      l.Addr().String(),
+			User:      "user@example.com",
+			Password:  "secret",
+			DirectTLS: direct,
+			TLSConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+		}.NewClient()
+		if err != nil {
+			t.Fatalf("NewClient() with DirectTLS %v = %v", direct, err)
+		}
+		if !c.IsEncrypted() || c.JID() != "user@example.com/bot" {
+			t.Errorf("DirectTLS %v: IsEncrypted() = %v, JID() = %q", direct, c.IsEncrypted(), c.JID())
+		}
+		c.Close()
+		if p := <-plain; p == direct {
+			t.Errorf("DirectTLS %v: stream started in plain text: %v", direct, p)
+		}
+	}
+}
+
+// tPrefixConn is a net.Conn whose first bytes were read already.
+type tPrefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *tPrefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// tShortConn accepts only half of every write, without an error.
+type tShortConn struct {
+	*scriptConn
+}
+
+func (c tShortConn) Write(p []byte) (int, error) {
+	return c.scriptConn.Write(p[:len(p)/2])
+}
+
+func TestShortWrite(t *testing.T) {
+	conn := tShortConn{tScript("")}
+	c := &Client{conn: conn, jid: "user@example.com/bot"}
+	if _, err := c.Send(Chat{Remote: "juliet@example.com", Type: "chat", Text: "Hi"}); err != io.ErrShortWrite {
+		t.Errorf("Send() = %v; want %v", err, io.ErrShortWrite)
+	}
+	if _, err := c.SendPresence(Presence{Show: "away"}); err != io.ErrShortWrite {
+		t.Errorf("SendPresence() = %v; want %v", err, io.ErrShortWrite)
+	}
+}
+
+func TestStartTLSMissing(t *testing.T) {
+	conn := tScript(scriptStreamHeader +
+		`<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`)
+	c := &Client{conn: conn}
+	err := c.init(&Options{User: "user@example.com", Password: "secret", InsecureAllowUnencryptedAuth: true})
+	if err == nil || !strings.Contains(err.Error(), "does not support STARTTLS") {
+		t.Errorf("init() = %v; want an error about the missing STARTTLS", err)
+	}
+	if strings.Contains(conn.out.String(), "<auth") {
+		t.Errorf("authenticated unencrypted: %q", conn.out.String())
+	}
+}
+
+func TestPinnedCert(t *testing.T) {
+	server := tTLSConfig(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if tLockstep(conn,
+					[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+					[2]string{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+					[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+					[2]string{"<bind", scriptBindResult}) {
+					io.Copy(io.Discard, conn)
+				}
+			}()
+		}
+	}()
+
+	sum := sha256.Sum256(server.Certificates[0].Certificate[0])
+	pin := strings.ToUpper(hex.EncodeToString(sum[:]))
+	o := Options{
+		Host:             l.Addr().String(),
+		User:             "user@example.com",
+		Password:         "secret",
+		DirectTLS:        true,
+		TLSConfig:        &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+		PinnedCertSHA256: []string{strings.Repeat("ab", 32), pin},
+	}
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() with a matching pin = %v", err)
+	}
+	c.Close()
+
+	o.PinnedCertSHA256 = []string{strings.Repeat("ab", 32)}
+	if _, err := o.NewClient(); err == nil || !strings.Contains(err.Error(), "matches none of PinnedCertSHA256") {
+		t.Errorf("NewClient() with a wrong pin = %v", err)
+	}
+}
+
+func TestDebugWriters(t *testing.T) {
+	addr := tListen(t,
+		[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+		[2]string{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		[2]string{"<bind", scriptBindResult})
+	var read, written bytes.Buffer
+	c, err := Options{
+		Host:                         addr,
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+		DebugReader:                  &read,
+		DebugWriter:                  &written,
+	}.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	c.Close()
+	if !strings.Contains(read.String(), "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>") || strings.Contains(read.String(), "<auth") {
+		t.Errorf("DebugReader got %q", read.String())
+	}
+	if !strings.Contains(written.String(), "<auth ") || !strings.Contains(written.String(), "<presence") || strings.Contains(written.String(), "<success") {
+		t.Errorf("DebugWriter got %q", written.String())
+	}
+}
+
+func TestStreamFeatures(t *testing.T) {
+	conn := tScript(scriptStreamHeader + `<stream:features>` +
+		`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>DIGEST-MD5</mechanism><mechanism>PLAIN</mechanism></mechanisms>` +
+		`<register xmlns='http://jabber.org/features/iq-register'/>` +
+		`<compression xmlns='http://jabber.org/features/compress'><method>zlib</method></compression>` +
+		`</stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader + `<stream:features>` +
+		`<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>` +
+		`<session xmlns='urn:ietf:params:xml:ns:xmpp-session'><optional/></session>` +
+		`<ver xmlns='urn:xmpp:features:rosterver'/>` +
+		`</stream:features>` + scriptBindResult)
+	c := &Client{conn: conn}
+	err := c.init(&Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		InsecureAllowUnencryptedAuth: true,
+		NoTLS:                        true,
+	})
+	if err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	want := StreamFeatures{
+		Mechanisms:       []string{"DIGEST-MD5", "PLAIN"},
+		Bind:             true,
+		Session:          true,
+		SessionOptional:  true,
+		Register:         true,
+		Compression:      []string{"zlib"},
+		RosterVersioning: true,
+	}
+	if got := c.StreamFeatures(); !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamFeatures() = %#v; want %#v", got, want)
+	}
+	if c.JID() != "user@example.com/bot" {
+		t.Errorf("JID() = %q", c.JID())
+	}
+}
+
+func TestAutoReconnect(t *testing.T) {
+	login := [][2]string{
+		{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+		{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+		{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+		{"<bind", scriptBindResult},
+		{"<presence", `<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'><body>Hi</body></message>`},
+	}
+	// serve logs in every client and drops the connection after the message, but
+	// the last one, which it keeps open.
+	serve := func(conns int) (string, net.Listener) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for i := 1; ; i++ {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func(i int) {
+					defer conn.Close()
+					if tLockstep(conn, login...) && i == conns {
+						io.Copy(io.Discard, conn)
+					}
+				}(i)
+			}
+		}()
+		return l.Addr().String(), l
+	}
+	o := Options{
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+		AutoReconnect:                true,
+		ReconnectBackoff:             Backoff{Initial: 10 * time.Millisecond, MaxRetries: 2},
+	}
+
+	var l net.Listener
+	o.Host, l = serve(2)
+	hooked := make(chan Reconnected, 1)
+	o.OnReconnect = func(c *Client, r Reconnected) { hooked <- r }
+	c, err := o.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	c.mucRooms = map[string]map[string]MUCOccupant{"room@conference.example.com": {}}
+	for _, want := range []interface{}{
+		Chat{Remote: "juliet@example.com/balcony", Type: "chat", Text: "Hi"},
+		Reconnected{Attempts: 1, Rooms: []string{"room@conference.example.com"}},
+		Chat{Remote: "juliet@example.com/balcony", Type: "chat", Text: "Hi"},
+	} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v; want %#v", err, want)
+		}
+		if chat, ok := v.(Chat); ok {
+			v = Chat{Remote: chat.Remote, Type: chat.Type, Text: chat.Text}
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("Recv() = %#v; want %#v", v, want)
+		}
+	}
+	if r := <-hooked; r.Attempts != 1 {
+		t.Errorf("OnReconnect got %#v", r)
+	}
+
+	// The server goes away for good.
+	l.Close()
+	c.conn.Close()
+	if _, err := c.Recv(); err == nil {
+		t.Errorf("Recv() succeeded after giving up")
+	}
+	c.Close()
+
+	// Close stops the wait for the next attempt.
+	o.Host, _ = serve(0)
+	o.ReconnectBackoff = Backoff{Initial: time.Hour}
+	o.OnReconnect = nil
+	c, err = o.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Recv() still waiting to reconnect after Close()")
+	}
+}
+
+func TestReconnectWhileSending(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for i := 1; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int) {
+				defer conn.Close()
+				// The first stream drops after the message, the second stays open.
+				if tLockstep(conn,
+					[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`},
+					[2]string{"<auth", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`},
+					[2]string{"<stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+					[2]string{"<bind", scriptBindResult},
+					[2]string{"<presence", `<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'><body>Hi</body></message>`},
+				) && i > 1 {
+					io.Copy(io.Discard, conn)
+				}
+			}(i)
+		}
+	}()
+	c, err := Options{
+		Host:                         l.Addr().String(),
+		User:                         "user@example.com",
+		Password:                     "secret",
+		NoTLS:                        true,
+		InsecureAllowUnencryptedAuth: true,
+		AutoReconnect:                true,
+		ReconnectBackoff:             Backoff{Initial: 10 * time.Millisecond, MaxRetries: 2},
+	}.NewClient()
+	if err != nil {
+		t.Fatalf("NewClient() = %v", err)
+	}
+	defer c.Close()
+
+	// Run with -race: the reconnect replaces the identity the sender reads.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.PingC2S("", "")
+			c.Resource()
+		}
+	}()
+	for _, want := range []string{"Chat", "Reconnected", "Chat"} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v; want %s", err, want)
+		}
+		if got := reflect.TypeOf(v).Name(); got != want {
+			t.Errorf("Recv() = %#v; want %s", v, want)
+		}
+	}
+	close(stop)
+	<-done
+	if c.JID() != "user@example.com/bot" {
+		t.Errorf("JID() = %q", c.JID())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	c := &Client{conn: cli, jid: "user@example.com/bot", domain: "example.com", p: xml.NewDecoder(cli)}
+	go func() {
+		d := xml.NewDecoder(srv)
+		var s tStanza
+		if err := d.Decode(&s); err != nil {
+			return
+		}
+		srv.Write([]byte(`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'><body>Hi</body></message>` +
+			`<presence xmlns='jabber:client' from='juliet@example.com/balcony'><show>away</show></presence>` +
+			`<iq xmlns='jabber:client' type='result' id='` + s.ID + `'><query xmlns='http://jabber.org/protocol/disco#info'><feature var='urn:xmpp:ping'/></query></iq>`))
+		srv.Close()
+	}()
+
+	events := c.Events()
+	if c.Events() != events {
+		t.Errorf("Events() returned another channel")
+	}
+	info, err := c.DiscoInfo("example.com")
+	if err != nil {
+		t.Fatalf("DiscoInfo() = %v", err)
+	}
+	if !reflect.DeepEqual(info.Features, []string{"urn:xmpp:ping"}) {
+		t.Errorf("DiscoInfo() features = %v", info.Features)
+	}
+	var got []string
+	for v := range events {
+		switch v := v.(type) {
+		case Chat:
+			got = append(got, "chat "+v.Text)
+		case Presence:
+			got = append(got, "presence "+v.Show)
+		default:
+			got = append(got, fmt.Sprintf("%T", v))
+		}
+	}
+	if want := []string{"chat Hi", "presence away"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; want %q", got, want)
+	}
+	if c.Err() == nil {
+		t.Errorf("Err() = nil after the server closed the stream")
+	}
+
+	// Closing the client ends the events without an error.
+	cli, srv = net.Pipe()
+	defer srv.Close()
+	c = &Client{conn: cli, jid: "user@example.com/bot", domain: "example.com", p: xml.NewDecoder(cli)}
+	events = c.Events()
+	c.Close()
+	for range events {
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("Err() = %v after Close", err)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	const streamErr = `<stream:error><conflict xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+		`<text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>Replaced by new connection</text></stream:error>`
+	want := &StreamError{Condition: "conflict", Text: "Replaced by new connection"}
+
+	// instead of the features
+	c := &Client{conn: tScript(scriptStreamHeader + streamErr)}
+	err := c.init(&Options{User: "user@example.com", Password: "secret", NoTLS: true})
+	var se *StreamError
+	if !errors.As(err, &se) || !reflect.DeepEqual(se, want) {
+		t.Errorf("init() = %#v; want %#v", err, want)
+	}
+
+	// in the middle of the stream, with an application-specific condition
+	c = &Client{conn: tScript(scriptStreamHeader + `<stream:error><system-shutdown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>` +
+		`<maintenance xmlns='urn:example:errors'/></stream:error>`)}
+	c.p = xml.NewDecoder(c.conn)
+	nextStart(c.p)
+	_, err = c.Recv()
+	want = &StreamError{Condition: "system-shutdown", App: xml.Name{Space: "urn:example:errors", Local: "maintenance"}}
+	if !errors.As(err, &se) || !reflect.DeepEqual(se, want) {
+		t.Errorf("Recv() = %#v; want %#v", err, want)
+	}
+	if msg := "xmpp: stream error: system-shutdown (urn:example:errors maintenance)"; err.Error() != msg {
+		t.Errorf("Error() = %q; want %q", err.Error(), msg)
+	}
+
+	// a conflict is final even with AutoReconnect; a reconnect would wait an hour
+	c = &Client{conn: tScript(scriptStreamHeader + streamErr),
+		reconnectOpts: &Options{AutoReconnect: true, ReconnectBackoff: Backoff{Initial: time.Hour}}}
+	c.p = xml.NewDecoder(c.conn)
+	nextStart(c.p)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Recv()
+		errc <- err
+	}()
+	select {
+	case err = <-errc:
+		if !errors.As(err, &se) || se.Condition != "conflict" {
+			t.Errorf("Recv() = %#v; want the conflict", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Recv() reconnects after a conflict")
+		c.Close()
+	}
+
+	// SASL failures are errors too
+	c = &Client{conn: tScript(scriptStreamHeader +
+		`<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+		`<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>`)}
+	err = c.init(&Options{User: "user@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true})
+	var ae *AuthError
+	if !errors.As(err, &ae) || ae.Condition != "not-authorized" {
+		t.Errorf("init() = %#v; want an AuthError with not-authorized", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	var uploaded string
+	var header http.Header
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("method = %s; want PUT", r.Method)
+		}
+		b, _ := io.ReadAll(r.Body)
+		uploaded, header = string(b), r.Header
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer hs.Close()
+
+	var request string
+	c := tServer(t, func(s tStanza) string {
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "' from='" + s.To + "'>"
+		switch {
+		case strings.Contains(s.InnerXML, nsDiscoItems):
+			reply += "<query xmlns='" + nsDiscoItems + "'><item jid='conference.example.com'/><item jid='upload.example.com'/></query>"
+		case strings.Contains(s.InnerXML, nsDiscoInfo) && s.To == "upload.example.com":
+			reply += "<query xmlns='" + nsDiscoInfo + "'><feature var='urn:xmpp:http:upload:0'/></query>"
+		case strings.Contains(s.InnerXML, nsDiscoInfo):
+			reply += "<query xmlns='" + nsDiscoInfo + "'><feature var='http://jabber.org/protocol/muc'/></query>"
+		case strings.Contains(s.InnerXML, "<request"):
+			request = s.InnerXML
+			reply += "<slot xmlns='urn:xmpp:http:upload:0'><put url='" + hs.URL + "/put/cat.png'>" +
+				"<header name='Authorization'>Basic Base64String==</header><header name='Host'>evil.example.com</header></put>" +
+				"<get url='https://upload.example.com/get/cat.png'/></slot>"
+		}
+		return reply + "</iq>"
+	})
+
+	service, err := c.DiscoverUploadService()
+	if err != nil || service != "upload.example.com" {
+		t.Fatalf("DiscoverUploadService() = %q, %v", service, err)
+	}
+	slot, err := c.RequestUploadSlot(service, "cat & dog.png", 5, "image/png")
+	if err != nil {
+		t.Fatalf("RequestUploadSlot() = %v", err)
+	}
+	if want := `<request xmlns='urn:xmpp:http:upload:0' filename='cat &amp; dog.png' size='5' content-type='image/png'/>`; request != want {
+		t.Errorf("request = %s; want %s", request, want)
+	}
+	if slot.Get != "https://upload.example.com/get/cat.png" || slot.Header.Get("Authorization") != "Basic Base64String==" || slot.Header.Get("Host") != "" {
+		t.Errorf("slot = %#v", slot)
+	}
+	if err := c.UploadFile(slot, strings.NewReader("hello world")); err != nil {
+		t.Fatalf("UploadFile() = %v", err)
+	}
+	if uploaded != "hello" || header.Get("Authorization") != "Basic Base64String==" || header.Get("Content-Type") != "image/png" {
+		t.Errorf("uploaded %q with %v", uploaded, header)
+	}
+}
+
+func TestOOB(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m1", Ooburl: "https://upload.example.com/cat.png", Oobdesc: "A cat"})
+	if want := `<message to='juliet@example.com' type='chat' id='m1' xml:lang='en'><body>https://upload.example.com/cat.png</body>` +
+		`<x xmlns="jabber:x:oob"><url>https://upload.example.com/cat.png</url><desc>A cat</desc></x></message>`; conn.out.String() != want {
+		t.Errorf("sent %q; want %q", conn.out.String(), want)
+	}
+	conn.out.Reset()
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m2", Text: "Look", Ooburl: "https://upload.example.com/cat.png"})
+	if got := conn.out.String(); !strings.Contains(got, "<body>Look</body>") {
+		t.Errorf("sent %q", got)
+	}
+	conn.out.Reset()
+	c.SendOOB(Chat{Remote: "juliet@example.com", Type: "chat", Ooburl: "https://upload.example.com/my%20cat.png", Oobdesc: "100%"})
+	if got := conn.out.String(); !strings.HasSuffix(got, `<x xmlns="jabber:x:oob"><url>https://upload.example.com/my%20cat.png</url>`+
+		`<desc>100%</desc></x></message>`) {
+		t.Errorf("sent %q", got)
+	}
+
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat'>` +
+		`<body>https://upload.example.com/dog.png</body><x xmlns='jabber:x:oob'><url>https://upload.example.com/dog.png</url><desc>A dog</desc></x></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if chat := v.(Chat); chat.Ooburl != "https://upload.example.com/dog.png" || chat.Oobdesc != "A dog" {
+		t.Errorf("Recv() = %#v", chat)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		if strings.Contains(s.InnerXML, "<password>weak</password>") {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='modify'><bad-request xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+	c.reconnectOpts = &Options{Password: "old"}
+
+	if err := c.ChangePassword("n3w&secret"); err != nil {
+		t.Fatalf("ChangePassword() = %v", err)
+	}
+	if want := "<query xmlns='jabber:iq:register'><username>user</username><password>n3w&amp;secret</password></query>"; got[0].To != "example.com" || got[0].Type != "set" || got[0].InnerXML != want {
+		t.Errorf("sent %#v; want %s", got[0], want)
+	}
+	if c.reconnectOpts.Password != "n3w&secret" {
+		t.Errorf("reconnecting with password %q", c.reconnectOpts.Password)
+	}
+
+	err := c.ChangePassword("weak")
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "bad-request" {
+		t.Errorf("ChangePassword() = %v; want a bad-request StanzaError", err)
+	}
+	if c.reconnectOpts.Password != "n3w&secret" {
+		t.Errorf("refused password %q kept for reconnecting", c.reconnectOpts.Password)
+	}
+}
+
+func TestAvatar(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 3)))
+	data := img.Bytes()
+	sum := sha1.Sum(data)
+	id := hex.EncodeToString(sum[:])
+
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>"
+		if s.Type == "get" {
+			reply += "<pubsub xmlns='http://jabber.org/protocol/pubsub'><items node='urn:xmpp:avatar:data'><item id='" + id + "'>" +
+				"<data xmlns='urn:xmpp:avatar:data'>" + base64.StdEncoding.EncodeToString(data) + "</data></item></items></pubsub>"
+		}
+		return reply + "</iq>"
+	})
+
+	if err := c.PublishAvatar(data, "image/png"); err != nil {
+		t.Fatalf("PublishAvatar() = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("sent %d stanzas; want 2", len(got))
+	}
+	if want := "<publish node='urn:xmpp:avatar:data'><item id='" + id + "'><data xmlns='urn:xmpp:avatar:data'>"; !strings.Contains(got[0].InnerXML, want) {
+		t.Errorf("published %s; want %s", got[0].InnerXML, want)
+	}
+	if want := fmt.Sprintf("<metadata xmlns='urn:xmpp:avatar:metadata'><info bytes='%d' id='%s' type='image/png' width='4' height='3'/></metadata>", len(data), id); !strings.Contains(got[1].InnerXML, want) {
+		t.Errorf("published %s; want %s", got[1].InnerXML, want)
+	}
+
+	b, err := c.GetAvatar("juliet@example.com", id)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("GetAvatar() = %x, %v; want %x", b, err, data)
+	}
+	if _, err := c.GetAvatar("juliet@example.com", strings.Repeat("0", 40)); err == nil {
+		t.Errorf("GetAvatar() of an unknown id succeeded")
+	}
+
+	c = &Client{conn: tConnect(`<message xmlns='jabber:client' from='juliet@example.com'><event xmlns='http://jabber.org/protocol/pubsub#event'>` +
+		`<items node='urn:xmpp:avatar:metadata'><item id='` + id + `'><metadata xmlns='urn:xmpp:avatar:metadata'>` +
+		`<info bytes='10' id='` + id + `' type='image/png' width='4' height='3'/></metadata></item></items></event></message>`)}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if want := (AvatarMetadata{From: "juliet@example.com", Bytes: 10, Width: 4, Height: 3, ID: id, Type: "image/png"}); err != nil || v != want {
+		t.Errorf("Recv() = %#v, %v; want %#v", v, err, want)
+	}
+}
+
+func TestPubsubPublishSubscribe(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><pubsub xmlns='http://jabber.org/protocol/pubsub'>"
+		switch {
+		case strings.Contains(s.InnerXML, "node='closed'"):
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'><error type='auth'>" +
+				"<forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/><closed-node xmlns='http://jabber.org/protocol/pubsub#errors'/></error></iq>"
+		case strings.Contains(s.InnerXML, "<publish"):
+			reply += "<publish node='sensors'><item id='ae890ac52d0df67ed7cfdf51b644e901'/></publish>"
+		case strings.Contains(s.InnerXML, "<subscribe"):
+			reply += "<subscription node='sensors' jid='user@example.com/bot' subid='ba49252aaa4f5d320c24d3766f0bdcade78c78d3' subscription='subscribed'/>"
+		case strings.Contains(s.InnerXML, "<items"):
+			reply += "<items node='sensors'><item id='t1'><temp xmlns='urn:example:sensor'>21.5</temp></item><item id='t2'><temp xmlns='urn:example:sensor'>22</temp></item></items>"
+		}
+		return reply + "</pubsub></iq>"
+	})
+
+	type temp struct {
+		XMLName xml.Name `xml:"urn:example:sensor temp"`
+		Value   float64  `xml:",chardata"`
+	}
+	id, err := c.PubsubPublish("sensors", "pubsub.example.com", "", temp{Value: 21.5})
+	if err != nil || id != "ae890ac52d0df67ed7cfdf51b644e901" {
+		t.Errorf("PubsubPublish() = %q, %v", id, err)
+	}
+	if want := `<publish node='sensors'><item><temp xmlns="urn:example:sensor">21.5</temp></item></publish>`; !strings.Contains(got[0].InnerXML, want) {
+		t.Errorf("sent %s; want %s", got[0].InnerXML, want)
+	}
+
+	sub, err := c.PubsubSubscribe("sensors", "pubsub.example.com")
+	if want := (&PubsubSubscription{SubID: "ba49252aaa4f5d320c24d3766f0bdcade78c78d3", JID: "user@example.com/bot", Node: "sensors"}); err != nil || !reflect.DeepEqual(sub, want) {
+		t.Errorf("PubsubSubscribe() = %#v, %v; want %#v", sub, err, want)
+	}
+	if err := c.PubsubUnsubscribe("sensors", "pubsub.example.com"); err != nil {
+		t.Errorf("PubsubUnsubscribe() = %v", err)
+	}
+
+	items, err := c.PubsubGetItems("sensors", "pubsub.example.com")
+	if err != nil || len(items) != 2 || items[1].ID != "t2" || string(items[1].InnerXML) != "<temp xmlns='urn:example:sensor'>22</temp>" {
+		t.Errorf("PubsubGetItems() = %q, %v", items, err)
+	}
+
+	_, err = c.PubsubPublish("closed", "pubsub.example.com", "t3", "<temp xmlns='urn:example:sensor'>23</temp>")
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "forbidden" || se.App != (xml.Name{Space: XMPPNS_PUBSUB_ERRORS, Local: "closed-node"}) {
+		t.Errorf("PubsubPublish() = %#v; want forbidden with closed-node", err)
+	}
+
+	c = &Client{conn: tConnect(`<message xmlns='jabber:client' from='pubsub.example.com'><event xmlns='http://jabber.org/protocol/pubsub#event'>` +
+		`<items node='sensors'><retract id='t1'/></items></event></message>`)}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if want := (PubsubEvent{Node: "sensors", Retracted: []string{"t1"}}); err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("Recv() = %#v, %v; want %#v", v, err, want)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>"
+		switch {
+		case strings.Contains(s.InnerXML, nsDiscoItems):
+			reply += "<query xmlns='" + nsDiscoItems + "' node='http://jabber.org/protocol/commands'>" +
+				"<item jid='example.com' node='http://jabber.org/protocol/admin#announce' name='Send Announcement'/></query>"
+		case strings.Contains(s.InnerXML, "action='execute'") && !strings.Contains(s.InnerXML, "sessionid"):
+			reply += "<command xmlns='http://jabber.org/protocol/commands' node='http://jabber.org/protocol/admin#announce' sessionid='s1' status='executing'>" +
+				"<actions execute='complete'><complete/></actions>" +
+				"<x xmlns='jabber:x:data' type='form'><field var='body' type='text-multi'/></x></command>"
+		case strings.Contains(s.InnerXML, "action='complete'"):
+			reply += "<command xmlns='http://jabber.org/protocol/commands' node='http://jabber.org/protocol/admin#announce' sessionid='s1' status='completed'>" +
+				"<note type='info'>Announcement sent</note></command>"
+		}
+		return reply + "</iq>"
+	})
+
+	cmds, err := c.Commands("example.com")
+	if err != nil || len(cmds) != 1 || cmds[0].Node != "http://jabber.org/protocol/admin#announce" {
+		t.Fatalf("Commands() = %v, %v", cmds, err)
+	}
+	if !strings.Contains(got[0].InnerXML, "node='http://jabber.org/protocol/commands'") {
+		t.Errorf("sent %s", got[0].InnerXML)
+	}
+
+	s, err := c.ExecuteCommand("example.com", cmds[0].Node)
+	if err != nil {
+		t.Fatalf("ExecuteCommand() = %v", err)
+	}
+	if s.SessionID != "s1" || s.Status != CommandExecuting || s.Execute != CommandComplete ||
+		!reflect.DeepEqual(s.Actions, []string{CommandComplete}) || s.Form == nil || s.Form.Fields[0].Var != "body" {
+		t.Fatalf("ExecuteCommand() = %#v", s)
+	}
+	if err := s.Action(CommandNext, nil); err == nil {
+		t.Errorf("Action(next) succeeded while the stage only allows complete")
+	}
+
+	form := &DataForm{Fields: []DataFormField{{Var: "body", Values: []string{"Maintenance at 10"}}}}
+	if err := s.Action(CommandComplete, form); err != nil {
+		t.Fatalf("Action() = %v", err)
+	}
+	if want := `<command xmlns='http://jabber.org/protocol/commands' node='http://jabber.org/protocol/admin#announce' sessionid='s1' action='complete'>` +
+		`<x xmlns="jabber:x:data" type="submit"><field var="body"><value>Maintenance at 10</value></field></x></command>`; got[len(got)-1].InnerXML != want {
+		t.Errorf("sent %s; want %s", got[len(got)-1].InnerXML, want)
+	}
+	if s.Status != CommandCompleted || !reflect.DeepEqual(s.Notes, []CommandNote{{Type: "info", Text: "Announcement sent"}}) {
+		t.Errorf("completed session = %#v", s)
+	}
+	if err := s.Submit(nil); err == nil {
+		t.Errorf("Submit() succeeded on a completed command")
+	}
+}
+
+func TestDataForm(t *testing.T) {
+	f, err := ParseDataForm([]byte(`<x xmlns='jabber:x:data' type='form'><title>Bot Configuration</title>` +
+		`<instructions>Fill out this form to configure your new bot!</instructions>` +
+		`<field type='hidden' var='FORM_TYPE'><value>jabber:bot</value></field>` +
+		`<field type='fixed'><value>Section 1: Bot Info</value></field>` +
+		`<field type='text-single' label='The name of your bot' var='botname'><required/></field>` +
+		`<field type='list-single' label='Maximum number of subscribers' var='maxsubs'><value>20</value>` +
+		`<option label='10'><value>10</value></option><option label='20'><value>20</value></option></field></x>`))
+	if err != nil {
+		t.Fatalf("ParseDataForm() = %v", err)
+	}
+	if f.FormType() != "jabber:bot" || f.Instructions[0] != "Fill out this form to configure your new bot!" ||
+		!f.Field("botname").Required || f.Field("maxsubs").Required || len(f.Field("maxsubs").Options) != 2 {
+		t.Errorf("ParseDataForm() = %#v", f)
+	}
+	if m := f.Missing(); !reflect.DeepEqual(m, []string{"botname"}) {
+		t.Errorf("Missing() = %q", m)
+	}
+	f.Set("botname", "The Jabber Google Bot")
+	f.Set("features", "news", "search")
+	if f.Value("botname") != "The Jabber Google Bot" || f.Missing() != nil {
+		t.Errorf("Set() did not fill out the form: %#v", f)
+	}
+	b, err := xml.Marshal(f.Submit())
+	if want := `<x xmlns="jabber:x:data" type="submit"><field var="FORM_TYPE"><value>jabber:bot</value></field>` +
+		`<field var="botname"><value>The Jabber Google Bot</value></field><field var="maxsubs"><value>20</value></field>` +
+		`<field var="features"><value>news</value><value>search</value></field></x>`; err != nil || string(b) != want {
+		t.Errorf("Submit() = %s, %v; want %s", b, err, want)
+	}
+	b, _ = xml.Marshal(f.Fields[2])
+	if want := `<field var="botname" type="text-single" label="The name of your bot"><required></required><value>The Jabber Google Bot</value></field>`; string(b) != want {
+		t.Errorf("Marshal() = %s; want %s", b, want)
+	}
+}
+
+func TestSoftwareVersion(t *testing.T) {
+	c := tServer(t, func(s tStanza) string {
+		if s.To == "romeo@montague.lit/orchard" {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "' from='" + s.To + "'>" +
+			"<query xmlns='jabber:iq:version'><name>Exodus</name><version>0.7.0.4</version><os>Windows-XP 5.01.2600</os></query></iq>"
+	})
+	name, version, os, err := c.SoftwareVersion("juliet@capulet.com/balcony")
+	if err != nil || name != "Exodus" || version != "0.7.0.4" || os != "Windows-XP 5.01.2600" {
+		t.Errorf("SoftwareVersion() = %q, %q, %q, %v", name, version, os, err)
+	}
+	_, _, _, err = c.SoftwareVersion("romeo@montague.lit/orchard")
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "service-unavailable" {
+		t.Errorf("SoftwareVersion() = %v; want service-unavailable", err)
+	}
+
+	conn := tScript(`<iq xmlns='jabber:client' type='get' id='v1' from='example.com' to='user@example.com/bot'>` +
+		`<query xmlns='jabber:iq:version'/></iq>`)
+	c = &Client{conn: conn, jid: "user@example.com/bot", domain: "example.com"}
+	c.software.name, c.software.os = "bot", "Plan 9"
+	c.p = xml.NewDecoder(c.conn)
+	c.Recv()
+	if want := "<query xmlns='jabber:iq:version'><name>bot</name><os>Plan 9</os></query>"; !strings.Contains(conn.out.String(), want) {
+		t.Errorf("replied %q; want %s", conn.out.String(), want)
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	c := tServer(t, func(s tStanza) string {
+		if s.To == "romeo@montague.lit" {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='auth'><forbidden xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "' from='" + s.To + "'>" +
+			"<query xmlns='jabber:iq:last' seconds='903'>Heading Home</query></iq>"
+	})
+	seconds, status, err := c.LastActivity("juliet@capulet.com")
+	if err != nil || seconds != 903 || status != "Heading Home" {
+		t.Errorf("LastActivity() = %d, %q, %v", seconds, status, err)
+	}
+	_, _, err = c.LastActivity("romeo@montague.lit")
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "forbidden" {
+		t.Errorf("LastActivity() = %v; want forbidden", err)
+	}
+
+	// Answering a query is not activity; sending a message is.
+	query := `<iq xmlns='jabber:client' type='get' id='l1' from='juliet@example.com/balcony' to='user@example.com/bot'><query xmlns='jabber:iq:last'/></iq>`
+	conn := tScript(query + strings.Replace(query, "l1", "l2", 1))
+	c = &Client{conn: conn, jid: "user@example.com/bot", domain: "example.com"}
+	c.p = xml.NewDecoder(c.conn)
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", Text: "brb"})
+	c.lastActive = c.lastActive.Add(-2 * time.Minute)
+	c.Recv()
+	c.Recv()
+	if got := conn.out.String(); strings.Count(got, "<query xmlns='jabber:iq:last' seconds='120'/>") != 2 {
+		t.Errorf("replied %q; want two replies with 120 seconds", got)
+	}
+}
+
+func TestStanzaIDs(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn, originIDs: true}
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m1", Text: "Hi"})
+	c.originIDs = false
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m2", Text: "Hi", OriginID: "o2"})
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m3", Text: "Hi"})
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m4", Text: "Hi", OriginID: "50%s"})
+	got := conn.out.String()
+	if !strings.Contains(got, "<origin-id xmlns='urn:xmpp:sid:0' id='m1'/>") || !strings.Contains(got, "<origin-id xmlns='urn:xmpp:sid:0' id='o2'/>") ||
+		!strings.Contains(got, "<body>Hi</body><origin-id xmlns='urn:xmpp:sid:0' id='50%s'/></message>") ||
+		strings.Count(got, "<origin-id") != 3 {
+		t.Errorf("sent %q", got)
+	}
+
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' to='user@example.com/bot' type='chat'><body>Hi</body>` +
+		`<origin-id xmlns='urn:xmpp:sid:0' id='de305d54'/>` +
+		`<stanza-id xmlns='urn:xmpp:sid:0' id='5f3dbc5e' by='user@example.com'/>` +
+		`<stanza-id xmlns='urn:xmpp:sid:0' id='forged' by='example.net'/></message>` +
+		`<message xmlns='jabber:client' from='room@conference.example.com/juliet' to='user@example.com/bot' type='groupchat'><body>Hi</body>` +
+		`<stanza-id xmlns='urn:xmpp:sid:0' id='forged' by='user@example.com'/>` +
+		`<stanza-id xmlns='urn:xmpp:sid:0' id='r1' by='room@conference.example.com'/></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	for _, want := range []struct {
+		origin string
+		ids    []StanzaID
+	}{
+		{"de305d54", []StanzaID{{ID: "5f3dbc5e", By: "user@example.com"}}},
+		{"", []StanzaID{{ID: "r1", By: "room@conference.example.com"}}},
+	} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		chat := v.(Chat)
+		if chat.OriginID != want.origin || !reflect.DeepEqual(chat.StanzaIDs, want.ids) {
+			t.Errorf("Recv() ids = %q, %v; want %q, %v", chat.OriginID, chat.StanzaIDs, want.origin, want.ids)
+		}
+		if chat.StanzaID(want.ids[0].By) != want.ids[0].ID {
+			t.Errorf("StanzaID(%q) = %q", want.ids[0].By, chat.StanzaID(want.ids[0].By))
+		}
+	}
+}
+
+func TestMessageCorrection(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	c.Send(Chat{Remote: "juliet@example.com", Type: "chat", ID: "m2", Text: "But soft, what light through yonder window breaks?", ReplaceID: "m1"})
+	if got := conn.out.String(); !strings.Contains(got, "<replace xmlns='urn:xmpp:message-correct:0' id='m1'/>") {
+		t.Errorf("sent %q", got)
+	}
+
+	c.conn = tConnect(`<message xmlns='jabber:client' from='juliet@example.com/balcony' type='chat' id='m4'>` +
+		`<body>Wherefore art thou, Romeo?</body><replace xmlns='urn:xmpp:message-correct:0' id='m3'/></message>`)
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	chat := v.(Chat)
+	if chat.ReplaceID != "m3" {
+		t.Errorf("ReplaceID = %q; want m3", chat.ReplaceID)
+	}
+	for _, tt := range []struct {
+		earlier Chat
+		want    bool
+	}{
+		{Chat{Remote: "juliet@example.com/garden", Type: "chat", ID: "m3"}, true},
+		{Chat{Remote: "nurse@example.com/kitchen", Type: "chat", ID: "m3"}, false},
+		{Chat{Remote: "juliet@example.com/balcony", Type: "chat", ID: "m2"}, false},
+	} {
+		if got := chat.Corrects(tt.earlier); got != tt.want {
+			t.Errorf("Corrects(%v) = %v; want %v", tt.earlier, got, tt.want)
+		}
+	}
+	room := Chat{Remote: "room@conference.example.com/juliet", Type: "groupchat", ReplaceID: "g1"}
+	if room.Corrects(Chat{Remote: "room@conference.example.com/nurse", Type: "groupchat", ID: "g1"}) {
+		t.Errorf("a correction replaced another occupant's message")
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	orchard := Bookmark{JID: "orchard@conference.example.com", Name: "The Orchard", Nick: "romeo", Autojoin: true}
+	coven := Bookmark{JID: "coven@chat.shakespeare.lit", Name: "The Coven", Password: "cauldron"}
+
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>"
+		if s.Type == "get" {
+			reply += "<pubsub xmlns='http://jabber.org/protocol/pubsub'><items node='urn:xmpp:bookmarks:1'>" +
+				"<item id='orchard@conference.example.com'><conference xmlns='urn:xmpp:bookmarks:1' name='The Orchard' autojoin='true'><nick>romeo</nick></conference></item>" +
+				"<item id='theplay@conference.shakespeare.lit'><conference xmlns='urn:xmpp:bookmarks:1' name='The Play'/></item>" +
+				"</items></pubsub>"
+		}
+		return reply + "</iq>"
+	})
+	bookmarks, err := c.GetBookmarks()
+	if want := []Bookmark{orchard, {JID: "theplay@conference.shakespeare.lit", Name: "The Play"}}; err != nil || !reflect.DeepEqual(bookmarks, want) {
+		t.Errorf("GetBookmarks() = %+v, %v; want %+v", bookmarks, err, want)
+	}
+	got = nil
+	if err := c.SetBookmarks([]Bookmark{orchard, coven}); err != nil {
+		t.Fatalf("SetBookmarks() = %v", err)
+	}
+	if len(got) != 4 || !strings.Contains(got[2].InnerXML, "<item id='coven@chat.shakespeare.lit'><conference xmlns='urn:xmpp:bookmarks:1' name='The Coven' autojoin='false'><password>cauldron</password></conference></item>") ||
+		!strings.Contains(got[2].InnerXML, "<value>whitelist</value>") ||
+		!strings.Contains(got[3].InnerXML, "<retract node='urn:xmpp:bookmarks:1' notify='true'><item id='theplay@conference.shakespeare.lit'/></retract>") {
+		t.Errorf("sent %+v", got)
+	}
+
+	// The server does not support PEP.
+	got = nil
+	c = tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		if strings.Contains(s.InnerXML, XMPPNS_PUBSUB) {
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='cancel'><feature-not-implemented xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>"
+		if s.Type == "get" {
+			reply += "<query xmlns='jabber:iq:private'><storage xmlns='storage:bookmarks'>" +
+				"<conference jid='orchard@conference.example.com' name='The Orchard' autojoin='1'><nick>romeo</nick></conference>" +
+				"</storage></query>"
+		}
+		return reply + "</iq>"
+	})
+	bookmarks, err = c.GetBookmarks()
+	if want := []Bookmark{orchard}; err != nil || !reflect.DeepEqual(bookmarks, want) {
+		t.Errorf("GetBookmarks() = %+v, %v; want %+v", bookmarks, err, want)
+	}
+	got = nil
+	if err := c.SetBookmarks([]Bookmark{coven}); err != nil {
+		t.Fatalf("SetBookmarks() = %v", err)
+	}
+	if want := "<query xmlns='jabber:iq:private'><storage xmlns='storage:bookmarks'><conference jid='coven@chat.shakespeare.lit' name='The Coven' autojoin='false'><password>cauldron</password></conference></storage></query>"; got[len(got)-1].InnerXML != want {
+		t.Errorf("sent %s; want %s", got[len(got)-1].InnerXML, want)
+	}
+
+	// Neither works.
+	c = tServer(t, func(s tStanza) string {
+		return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+			"<error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+	})
+	_, err = c.GetBookmarks()
+	var se *StanzaError
+	if !errors.As(err, &se) || !strings.Contains(err.Error(), "PEP") || !strings.Contains(err.Error(), "private storage") {
+		t.Errorf("GetBookmarks() = %v", err)
+	}
+}
+
+func TestPrivateStorage(t *testing.T) {
+	var got []tStanza
+	c := tServer(t, func(s tStanza) string {
+		got = append(got, s)
+		reply := "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'>"
+		switch {
+		case s.Type == "set":
+		case strings.Contains(s.InnerXML, "<exodus"):
+			reply += "<query xmlns='jabber:iq:private'><exodus xmlns='exodus:prefs'><defaultnick>Hamlet</defaultnick></exodus></query>"
+		case strings.Contains(s.InnerXML, "<prefs"):
+			reply += "<query xmlns='jabber:iq:private'><prefs xmlns='urn:example:prefs'/></query>"
+		default:
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'>" +
+				"<error type='cancel'><not-acceptable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		}
+		return reply + "</iq>"
+	})
+
+	type prefs struct {
+		XMLName     xml.Name `xml:"exodus:prefs exodus"`
+		DefaultNick string   `xml:"defaultnick"`
+	}
+	if err := c.PrivateStorageSet(prefs{DefaultNick: "Hamlet"}); err != nil {
+		t.Fatalf("PrivateStorageSet() = %v", err)
+	}
+	if want := `<query xmlns='jabber:iq:private'><exodus xmlns="exodus:prefs"><defaultnick>Hamlet</defaultnick></exodus></query>`; got[0].Type != "set" || got[0].InnerXML != want {
+		t.Errorf("sent %+v; want %s", got[0], want)
+	}
+
+	data, err := c.PrivateStorageGet("exodus:prefs", "exodus")
+	if want := "<exodus xmlns='exodus:prefs'><defaultnick>Hamlet</defaultnick></exodus>"; err != nil || string(data) != want {
+		t.Errorf("PrivateStorageGet() = %s, %v; want %s", data, err, want)
+	}
+	if _, err := c.PrivateStorageGet("urn:example:prefs", "prefs"); err != ErrPrivateStorageNotFound {
+		t.Errorf("PrivateStorageGet() of nothing = %v; want %v", err, ErrPrivateStorageNotFound)
+	}
+	_, err = c.PrivateStorageGet("jabber:client", "x")
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "not-acceptable" {
+		t.Errorf("PrivateStorageGet() = %v; want not-acceptable", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	login := func(session, result string) *scriptConn {
+		return tScript(scriptStreamHeader + `<stream:features>` +
+			`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+			`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader + `<stream:features>` +
+			`<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>` + session + `</stream:features>` + scriptBindResult + result)
+	}
+	o := &Options{User: "user@example.com", Password: "secret", InsecureAllowUnencryptedAuth: true, NoTLS: true}
+	const required = `<session xmlns='urn:ietf:params:xml:ns:xmpp-session'/>`
+	const optional = `<session xmlns='urn:ietf:params:xml:ns:xmpp-session'><optional/></session>`
+
+	for _, tt := range []struct {
+		session string
+		opt     bool
+		sent    bool
+	}{
+		{required, false, true},
+		{optional, true, true},
+		{optional, false, false},
+		{"", true, false},
+	} {
+		conn := login(tt.session, `<iq xmlns='jabber:client' type='result' id='_xmpp_session1'/>`)
+		c := &Client{conn: conn}
+		o.Session = tt.opt
+		if err := c.init(o); err != nil {
+			t.Errorf("init() with %q = %v", tt.session, err)
+		}
+		if sent := strings.Contains(conn.out.String(), "<session xmlns='urn:ietf:params:xml:ns:xmpp-session'/>"); sent != tt.sent {
+			t.Errorf("init() with %q and Session %v established a session: %v; want %v", tt.session, tt.opt, sent, tt.sent)
+		}
+	}
+
+	// a message the server sends before the result is skipped
+	conn := login(required, `<message xmlns='jabber:client' from='juliet@example.com/balcony'><body>Hi</body></message>`+
+		`<iq xmlns='jabber:client' type='result' id='_xmpp_session1'/>`)
+	if err := (&Client{conn: conn}).init(o); err != nil {
+		t.Errorf("init() with a message before the session result = %v", err)
+	}
+
+	c := &Client{conn: login(required, `<iq xmlns='jabber:client' type='error' id='_xmpp_session1'>`+
+		`<error type='wait'><internal-server-error xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`)}
+	err := c.init(o)
+	var se *StanzaError
+	if !errors.As(err, &se) || se.Condition != "internal-server-error" {
+		t.Errorf("init() = %v; want internal-server-error", err)
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	features := func(mechanisms ...string) string {
+		s := scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>`
+		for _, m := range mechanisms {
+			s += "<mechanism>" + m + "</mechanism>"
+		}
+		return s + `</mechanisms></stream:features>`
+	}
+	bound := `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` + scriptBindResult
+	o := &Options{User: "user@example.com", OAuthToken: "vF9dft4qmT", NoTLS: true, InsecureAllowUnencryptedAuth: true}
+	auth := func(conn *scriptConn) string {
+		out := conn.out.String()
+		i := strings.Index(out, "<auth")
+		return out[i : strings.Index(out[i:], "</auth>")+i+len("</auth>")]
+	}
+
+	conn := tScript(features("PLAIN", "X-OAUTH2", "OAUTHBEARER") + bound)
+	if err := (&Client{conn: conn}).init(o); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if want := "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='OAUTHBEARER'>" +
+		base64.StdEncoding.EncodeToString([]byte("n,a=user@example.com,\x01auth=Bearer vF9dft4qmT\x01\x01")) + "</auth>"; auth(conn) != want {
+		t.Errorf("sent %s; want %s", auth(conn), want)
+	}
+
+	conn = tScript(features("PLAIN", "X-OAUTH2") + bound)
+	o.OAuthXmlNs = "http://www.google.com/talk/protocol/auth"
+	if err := (&Client{conn: conn}).init(o); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if want := "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='X-OAUTH2' auth:service='oauth2' xmlns:auth='http://www.google.com/talk/protocol/auth'>" +
+		base64.StdEncoding.EncodeToString([]byte("\x00user\x00vF9dft4qmT")) + "</auth>"; auth(conn) != want {
+		t.Errorf("sent %s; want %s", auth(conn), want)
+	}
+
+	// The server rejects the token.
+	conn = tScript(features("OAUTHBEARER") +
+		`<challenge xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+		base64.StdEncoding.EncodeToString([]byte(`{"status":"invalid_token","scope":"example_scope"}`)) + `</challenge>` +
+		`<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>`)
+	err := (&Client{conn: conn}).init(o)
+	var ae *AuthError
+	if !errors.As(err, &ae) || ae.Condition != "not-authorized" || ae.Text != "invalid_token" {
+		t.Errorf("init() = %#v; want not-authorized with invalid_token", err)
+	}
+	if !strings.Contains(conn.out.String(), "<response xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>AQ==</response>") {
+		t.Errorf("sent %q; want the dummy response to the error challenge", conn.out.String())
+	}
+}
+
+func TestDigestMD5(t *testing.T) {
+	ch, err := parseDigestChallenge(`realm="other.org",realm="example.com",nonce="OA6M\"G9",qop="auth,auth-int",charset=utf-8,algorithm=md5-sess`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ch.realms, []string{"other.org", "example.com"}) || ch.nonce != `OA6M"G9` ||
+		!reflect.DeepEqual(ch.qop, []string{"auth", "auth-int"}) || ch.charset != "utf-8" {
+		t.Errorf("parseDigestChallenge() = %+v", ch)
+	}
+	if r := ch.realm("example.com"); r != "example.com" {
+		t.Errorf("realm() = %q; want example.com", r)
+	}
+
+	sasl := func(element, data string) string {
+		return "<" + element + " xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>" + base64.StdEncoding.EncodeToString([]byte(data)) + "</" + element + ">"
+	}
+	o := &Options{User: "user@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true}
+	// login authenticates against a server sending rspauth, the right one if empty,
+	// in a challenge or in <success/>.
+	login := func(rspauth string, inSuccess bool) error {
+		conn, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			var received []byte
+			buf := make([]byte, 4096)
+			until := func(s string) string {
+				for !bytes.Contains(received, []byte(s)) {
+					n, err := server.Read(buf)
+					if err != nil {
+						return ""
+					}
+					received = append(received, buf[:n]...)
+				}
+				i := bytes.Index(received, []byte(s)) + len(s)
+				got := string(received[:i])
+				received = received[i:]
+				return got
+			}
+			until("stream:stream")
+			server.Write([]byte(scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+				`<mechanism>DIGEST-MD5</mechanism></mechanisms></stream:features>`))
+			until("mechanism='DIGEST-MD5'/>")
+			server.Write([]byte(sasl("challenge", `realm="other.org",realm="example.com",nonce="OA6MG9tEQGm2hh",qop="auth",charset=utf-8,algorithm=md5-sess`)))
+			resp := until("</response>")
+			b, _ := base64.StdEncoding.DecodeString(resp[strings.Index(resp, "'>")+2 : len(resp)-len("</response>")])
+			value := func(key string) string {
+				s := string(b)[strings.Index(string(b), key+"=")+len(key)+1:]
+				if i := strings.IndexByte(s, ','); i >= 0 {
+					s = s[:i]
+				}
+				return strings.Trim(s, `"`)
+			}
+			if value("realm") != "example.com" || value("username") != "user" {
+				t.Errorf("sent response %s", b)
+			}
+			cnonce := value("cnonce")
+			if value("response") != saslDigestResponse("user", "example.com", "secret", "OA6MG9tEQGm2hh", cnonce, "AUTHENTICATE", "xmpp/example.com", "00000001") {
+				t.Errorf("sent response %s with a wrong digest", b)
+			}
+			if rspauth == "" {
+				rspauth = saslDigestResponse("user", "example.com", "secret", "OA6MG9tEQGm2hh", cnonce, "", "xmpp/example.com", "00000001")
+			}
+			if inSuccess {
+				server.Write([]byte(sasl("success", "rspauth="+rspauth)))
+			} else {
+				server.Write([]byte(sasl("challenge", "rspauth="+rspauth)))
+				tLockstep(server, [2]string{"<response xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>", `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`})
+			}
+			tLockstep(server,
+				[2]string{"stream:stream", scriptStreamHeader + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`},
+				[2]string{"<bind", scriptBindResult})
+			io.Copy(io.Discard, server)
+		}()
+		return (&Client{conn: conn}).init(o)
+	}
+
+	if err := login("", false); err != nil {
+		t.Errorf("init() = %v", err)
+	}
+	if err := login("", true); err != nil {
+		t.Errorf("init() with rspauth in <success/> = %v", err)
+	}
+	if err := login("0123456789abcdef0123456789abcdef", false); err == nil {
+		t.Error("init() accepted a wrong rspauth")
+	}
+
+	// PLAIN is preferred, whatever the order of the mechanisms.
+	conn := tScript(scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+		`<mechanism>DIGEST-MD5</mechanism><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` + scriptBindResult)
+	if err := (&Client{conn: conn}).init(o); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if !strings.Contains(conn.out.String(), "mechanism='PLAIN'") {
+		t.Errorf("sent %s; want PLAIN authentication", conn.out.String())
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	defer func(f func() string) { scramNonce = f }(scramNonce)
+	sasl := func(element, data string) string {
+		return "<" + element + " xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>" + base64.StdEncoding.EncodeToString([]byte(data)) + "</" + element + ">"
+	}
+	// The examples of RFC 5802 5 and RFC 7677 3.
+	for _, tt := range []struct {
+		mechanism, nonce, serverFirst, clientFinal, serverFinal string
+		inSuccess                                               bool
+		ok                                                      bool
+	}{
+		{
+			"SCRAM-SHA-1", "fyko+d2lbbFgONRv9qkxdawL",
+			"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=", true, true,
+		},
+		{
+			"SCRAM-SHA-256", "rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", false, true,
+		},
+		{
+			"SCRAM-SHA-256", "rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=", true, false,
+		},
+		{
+			"SCRAM-SHA-1", "fyko+d2lbbFgONRv9qkxdawL",
+			"r=someone+elses+nonce,s=QSXCR+Q6sek8bf92,i=4096",
+			"", "", true, false,
+		},
+	} {
+		scramNonce = func() string { return tt.nonce }
+		script := scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+			`<mechanism>PLAIN</mechanism><mechanism>` + tt.mechanism + `</mechanism></mechanisms></stream:features>` +
+			sasl("challenge", tt.serverFirst)
+		if tt.inSuccess {
+			script += sasl("success", tt.serverFinal)
+		} else {
+			script += sasl("challenge", tt.serverFinal) + `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`
+		}
+		conn := tScript(script + scriptStreamHeader +
+			`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` + scriptBindResult)
+		err := (&Client{conn: conn}).init(&Options{User: "user@example.com", Password: "pencil", NoTLS: true, InsecureAllowUnencryptedAuth: true})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s init() = %v; want success %v", tt.mechanism, err, tt.ok)
+		}
+		want := "<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='" + tt.mechanism + "'>" +
+			base64.StdEncoding.EncodeToString([]byte("n,,n=user,r="+tt.nonce)) + "</auth>"
+		if !strings.Contains(conn.out.String(), want) {
+			t.Errorf("%s sent %s; want %s", tt.mechanism, conn.out.String(), want)
+		}
+		if tt.clientFinal != "" && !strings.Contains(conn.out.String(), sasl("response", tt.clientFinal)) {
+			t.Errorf("%s sent %s; want the client-final-message %s", tt.mechanism, conn.out.String(), tt.clientFinal)
+		}
+	}
+
+	if s := scramName("a=b,c"); s != "a=3Db=2Cc" {
+		t.Errorf("scramName() = %q", s)
+	}
+}
+
+func TestChooseMechanism(t *testing.T) {
+	password := &Options{User: "user@example.com", Password: "secret"}
+	token := &Options{User: "user@example.com", OAuthToken: "vF9dft4qmT"}
+	cert := &Options{TLSConfig: &tls.Config{Certificates: []tls.Certificate{{}}}}
+	for _, tt := range []struct {
+		offered   []string
+		o         *Options
+		encrypted bool
+		want      string
+	}{
+		{[]string{"DIGEST-MD5", "PLAIN"}, password, true, "PLAIN"},
+		{[]string{"DIGEST-MD5", "X-OAUTH2"}, password, true, "DIGEST-MD5"},
+		{[]string{"PLAIN", "X-OAUTH2", "OAUTHBEARER"}, token, true, "OAUTHBEARER"},
+		{[]string{"PLAIN", "ANONYMOUS", "EXTERNAL"}, cert, true, "EXTERNAL"},
+		{[]string{"PLAIN", "ANONYMOUS", "EXTERNAL"}, cert, false, "ANONYMOUS"},
+		{[]string{"PLAIN", "ANONYMOUS"}, &Options{}, false, "ANONYMOUS"},
+		{[]string{"PLAIN", "ANONYMOUS"}, token, true, ""},
+		{[]string{"PLAIN", "SCRAM-SHA-1"}, password, true, "SCRAM-SHA-1"},
+		{[]string{"SCRAM-SHA-1", "SCRAM-SHA-256"}, password, true, "SCRAM-SHA-256"},
+		{[]string{"SCRAM-SHA-1", "EXTERNAL"}, cert, true, "EXTERNAL"},
+		{[]string{"SCRAM-SHA-1-PLUS"}, password, true, ""},
+	} {
+		got, err := chooseMechanism(tt.offered, tt.o, tt.encrypted)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("chooseMechanism(%v) = %q, %v; want %q", tt.offered, got, err, tt.want)
+		}
+	}
+
+	conn := tScript(scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+		`<mechanism>SCRAM-SHA-1-PLUS</mechanism><mechanism>EXTERNAL</mechanism></mechanisms></stream:features>`)
+	err := (&Client{conn: conn}).init(&Options{User: "user@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true})
+	if err == nil || !strings.Contains(err.Error(), "[SCRAM-SHA-1-PLUS EXTERNAL]") || !strings.Contains(err.Error(), "[SCRAM-SHA-256 SCRAM-SHA-1 PLAIN DIGEST-MD5]") {
+		t.Errorf("init() = %v; want an error listing the offered and the supported mechanisms", err)
+	}
+}
+
+func TestRequireEncryption(t *testing.T) {
+	script := scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>` +
+		`<mechanism>PLAIN</mechanism><mechanism>ANONYMOUS</mechanism></mechanisms></stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` + scriptBindResult
+	for _, tt := range []struct {
+		o  *Options
+		ok bool
+	}{
+		// The zero Options refuse to authenticate over the plain connection.
+		{&Options{}, false},
+		{&Options{NoTLS: true}, false},
+		{&Options{NoTLS: true, AllowUnencryptedAnonymous: true}, true},
+		{&Options{NoTLS: true, InsecureAllowUnencryptedAuth: true}, true},
+		{&Options{NoTLS: true, User: "user@example.com", Password: "secret"}, false},
+		{&Options{NoTLS: true, User: "user@example.com", Password: "secret", AllowUnencryptedAnonymous: true}, false},
+	} {
+		conn := tScript(script)
+		err := (&Client{conn: conn}).init(tt.o)
+		if (err == nil) != tt.ok {
+			t.Errorf("init(%+v) = %v", tt.o, err)
+		}
+		if !tt.ok && strings.Contains(conn.out.String(), "<auth") {
+			t.Errorf("sent %s over an unencrypted connection", conn.out.String())
+		}
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	conn := tScript("")
+	var written bytes.Buffer
+	c := &Client{conn: conn, debugOut: &written}
+	raw := `<message to='room@conference.example.com' type='groupchat'><x xmlns='urn:example:unsupported'/></message>`
+	if err := c.SendRaw(raw); err != nil {
+		t.Fatal(err)
+	}
+	if conn.out.String() != raw || written.String() != raw {
+		t.Errorf("sent %q, logged %q; want %q", conn.out.String(), written.String(), raw)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	conn := tScript("")
+	c := &Client{conn: conn}
+	id1, err := c.SendMessage("juliet@example.com", "hi & bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := c.SendGroupChat("room@conference.example.com", "hello all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == "" || id1 == id2 {
+		t.Errorf("ids %q and %q", id1, id2)
+	}
+	got := conn.out.String()
+	for _, want := range []string{
+		"<message to='juliet@example.com' type='chat' id='" + id1 + "'",
+		"<body>hi &amp; bye</body>",
+		"<message to='room@conference.example.com' type='groupchat' id='" + id2 + "'",
+		"<body>hello all</body>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sent %q; want %q", got, want)
+		}
+	}
+}
+
+func TestRegisterIQNamespace(t *testing.T) {
+	type forecast struct {
+		City string `xml:"city,attr"`
+		Sky  string `xml:"sky"`
+	}
+	RegisterIQNamespace("urn:example:weather", "forecast", func() interface{} { return new(forecast) })
+	defer func() {
+		iqPayloads.Lock()
+		delete(iqPayloads.m, xml.Name{Space: "urn:example:weather", Local: "forecast"})
+		iqPayloads.Unlock()
+	}()
+
+	query := `<forecast xmlns='urn:example:weather' city='Verona'><sky>clear</sky></forecast>`
+	conn := tScript(`<iq xmlns='jabber:client' type='result' id='w1' from='weather.example.com'>` + query + `</iq>` +
+		`<iq xmlns='jabber:client' type='set' id='w2' from='weather.example.com'><alert xmlns='urn:example:weather' level='2'/></iq>`)
+	c := &Client{conn: conn, jid: "romeo@example.net/orchard"}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	iq, _ := v.(IQ)
+	if f, ok := iq.Payload.(*forecast); !ok || f.City != "Verona" || f.Sky != "clear" || string(iq.Query) != query {
+		t.Errorf("Recv() = %#v; want the decoded forecast", v)
+	}
+
+	// An unregistered element is only kept as XML.
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if iq, _ := v.(IQ); iq.Payload != nil || string(iq.Query) != `<alert xmlns='urn:example:weather' level='2'/>` {
+		t.Errorf("Recv() = %#v; want the raw alert", v)
+	}
+}
+
+func TestRawStanza(t *testing.T) {
+	conn := tScript(`<sent xmlns='urn:example:receipts' count='2'><id>m1</id><id>m2</id></sent>` +
+		`<message xmlns='jabber:client' type='chat' from='juliet@example.com/balcony'><body>hi</body></message>`)
+	c := &Client{conn: conn}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	raw, ok := v.(RawStanza)
+	if !ok || raw.Name != (xml.Name{Space: "urn:example:receipts", Local: "sent"}) || raw.InnerXML != "<id>m1</id><id>m2</id>" ||
+		len(raw.Attr) != 2 || raw.Attr[1].Value != "2" {
+		t.Errorf("Recv() = %#v; want the unknown element", v)
+	}
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if chat, ok := v.(Chat); !ok || chat.Text != "hi" {
+		t.Errorf("Recv() = %#v; want the message after the unknown element", v)
+	}
+}
+
+func TestMessageOtherElemAttrs(t *testing.T) {
+	conn := tScript(`<message xmlns='jabber:client' type='chat' from='ci@example.com/runner'><body>deployed</body>` +
+		`<event xmlns='urn:example:app' xmlns:x='urn:example:x' kind='deploy' x:env='prod'><status>ok</status></event></message>`)
+	c := &Client{conn: conn}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	chat, _ := v.(Chat)
+	want := []XMLElement{{
+		XMLName: xml.Name{Space: "urn:example:app", Local: "event"},
+		Attrs: []xml.Attr{
+			{Name: xml.Name{Local: "kind"}, Value: "deploy"},
+			{Name: xml.Name{Space: "urn:example:x", Local: "env"}, Value: "prod"},
+		},
+		InnerXML: "<status>ok</status>",
+	}}
+	if !reflect.DeepEqual(chat.OtherElem, want) {
+		t.Errorf("OtherElem = %#v; want %#v", chat.OtherElem, want)
+	}
+	if len(chat.OtherElem) == 1 && chat.OtherElem[0].Attr("env") != "prod" {
+		t.Errorf("Attr(env) = %q; want prod", chat.OtherElem[0].Attr("env"))
+	}
+}
+
+func TestChatJIDHelpers(t *testing.T) {
+	for _, tt := range []struct {
+		chat                       Chat
+		group                      bool
+		room, nick, bare, resource string
+	}{
+		{Chat{Type: "groupchat", Remote: "coven@chat.example.com/third/witch"}, true, "coven@chat.example.com", "third/witch", "coven@chat.example.com", "third/witch"},
+		{Chat{Type: "groupchat", Remote: "coven@chat.example.com"}, true, "coven@chat.example.com", "", "coven@chat.example.com", ""},
+		{Chat{Type: "chat", Remote: "coven@chat.example.com/firstwitch"}, false, "", "", "coven@chat.example.com", "firstwitch"},
+		{Chat{Type: "chat", Remote: "juliet@example.com"}, false, "", "", "juliet@example.com", ""},
+	} {
+		c := tt.chat
+		if c.IsGroupChat() != tt.group || c.RoomJID() != tt.room || c.Nick() != tt.nick || c.BareJID() != tt.bare || c.Resource() != tt.resource {
+			t.Errorf("%+v: got %v %q %q %q %q", c, c.IsGroupChat(), c.RoomJID(), c.Nick(), c.BareJID(), c.Resource())
+		}
+	}
+}
+
+func TestParseJID(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want JID
+	}{
+		{"juliet@example.com", JID{"juliet", "example.com", ""}},
+		{"Juliet@Example.COM./Balcony", JID{"juliet", "example.com", "Balcony"}},
+		{"example.com/a/b@c", JID{"", "example.com", "a/b@c"}},
+		{"room@conference.example.com/third witch", JID{"room", "conference.example.com", "third witch"}},
+	} {
+		got, err := ParseJID(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseJID(%q) = %+v, %v; want %+v", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "@example.com", "juliet@", "juliet@example.com/", "jul iet@example.com", "a@b@example.com", "juliet@exa mple.com", strings.Repeat("a", 1024) + "@example.com"} {
+		if j, err := ParseJID(s); err == nil {
+			t.Errorf("ParseJID(%q) = %+v; want an error", s, j)
+		}
+	}
+
+	j := JID{"juliet", "example.com", "balcony"}
+	if j.String() != "juliet@example.com/balcony" || j.Bare().String() != "juliet@example.com" || !j.Bare().IsBare() ||
+		j.WithResource("chamber").String() != "juliet@example.com/chamber" || (JID{Domain: "example.com"}).String() != "example.com" {
+		t.Errorf("%+v: String %q, Bare %q, WithResource %q", j, j, j.Bare(), j.WithResource("chamber"))
+	}
+}
+
+func TestEscapeLocalpart(t *testing.T) {
+	for _, tt := range []struct{ s, escaped string }{
+		{"space cadet", `space\20cadet`},
+		{`call me "ishmael"`, `call\20me\20\22ishmael\22`},
+		{"at&t guy", `at\26t\20guy`},
+		{"d'artagnan", `d\27artagnan`},
+		{"/.fanboy", `\2f.fanboy`},
+		{"::foo::", `\3a\3afoo\3a\3a`},
+		{"<foo>", `\3cfoo\3e`},
+		{"user@host", `user\40host`},
+		{`c:\net`, `c\3a\net`},
+		{`c:\\net`, `c\3a\\net`},
+		{`c:\cool stuff`, `c\3a\cool\20stuff`},
+		{`c:\5commas`, `c\3a\5c5commas`},
+	} {
+		if got := EscapeLocalpart(tt.s); got != tt.escaped {
+			t.Errorf("EscapeLocalpart(%q) = %q; want %q", tt.s, got, tt.escaped)
+		}
+		if got := UnescapeLocalpart(tt.escaped); got != tt.s {
+			t.Errorf("UnescapeLocalpart(%q) = %q; want %q", tt.escaped, got, tt.s)
+		}
+	}
+	if got := escapeJID(`user name@example.com/a b`); got != `user\20name@example.com/a b` {
+		t.Errorf("escapeJID() = %q", got)
+	}
+	if got := escapeJID(`user\20name@example.com`); got != `user\20name@example.com` {
+		t.Errorf("escapeJID() = %q; want the escaped JID unchanged", got)
+	}
+
+	conn := tScript(scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader +
+		`<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` + scriptBindResult)
+	if err := (&Client{conn: conn}).init(&Options{User: "user name@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true}); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte("\x00user\\20name\x00secret")); !strings.Contains(conn.out.String(), want) {
+		t.Errorf("sent %s; want PLAIN with the escaped localpart", conn.out.String())
+	}
+}
+
+func TestPostAuthFeatures(t *testing.T) {
+	auth := scriptStreamHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>` +
+		`<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>` + scriptStreamHeader
+	o := &Options{User: "user@example.com", Password: "secret", NoTLS: true, InsecureAllowUnencryptedAuth: true}
+
+	err := (&Client{conn: tScript(auth + `<stream:features><sm xmlns='urn:xmpp:sm:3'/><ver xmlns='urn:xmpp:features:rosterver'/></stream:features>`)}).init(o)
+	if err == nil || !strings.Contains(err.Error(), "no resource binding") || !strings.Contains(err.Error(), "[sm ver]") {
+		t.Errorf("init() = %v; want an error naming the features offered", err)
+	}
+
+	// Stanzas the server sends before the bind result are skipped.
+	c := &Client{conn: tScript(auth + `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>` +
+		`<message xmlns='jabber:client' from='example.com'><body>Welcome</body></message>` + scriptBindResult)}
+	if err := c.init(o); err != nil {
+		t.Fatalf("init() = %v", err)
+	}
+	if c.JID() != "user@example.com/bot" {
+		t.Errorf("JID() = %q", c.JID())
+	}
+}
+
+func TestPresencePriority(t *testing.T) {
+	conn := tScript(`<presence xmlns='jabber:client' from='juliet@example.com/balcony'><priority> -5 </priority></presence>` +
+		`<presence xmlns='jabber:client' from='juliet@example.com/chamber'><priority>500</priority></presence>`)
+	c := &Client{conn: conn}
+	c.p = xml.NewDecoder(c.conn)
+	for _, want := range []int{-5, 0} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		if p, ok := v.(Presence); !ok || p.Priority != want {
+			t.Errorf("Recv() = %#v; want priority %d", v, want)
+		}
+	}
+
+	if _, err := c.SendPresence(Presence{Priority: 128}); err == nil {
+		t.Error("SendPresence() accepted priority 128")
+	}
+	if _, err := c.SendPresence(Presence{Priority: -128}); err != nil || !strings.HasSuffix(conn.out.String(), "<presence><priority>-128</priority></presence>") {
+		t.Errorf("SendPresence() = %v, sent %q", err, conn.out.String())
+	}
+
+	Options{Status: "away", StatusMessage: "Back at 5 & <b>", Priority: -1}.sendInitialPresence(c)
+	if !strings.Contains(conn.out.String(), "<show>away</show><status>Back at 5 &amp; &lt;b&gt;</status><priority>-1</priority></presence>") {
+		t.Errorf("initial presence %q lacks the priority or the escaped status", conn.out.String())
+	}
+	if err := (&Client{conn: tScript("")}).init(&Options{Priority: 200}); err == nil {
+		t.Error("init() accepted priority 200")
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	conn := tScript(`<message xmlns='jabber:client' from='juliet@example.com/balcony'><body>offline</body>` +
+		`<delay xmlns='urn:xmpp:delay' from='example.com' stamp='2002-09-10T23:08:25.5+02:00'>Offline Storage</delay></message>` +
+		`<message xmlns='jabber:client' from='juliet@example.com/balcony'><body>legacy</body><x xmlns='jabber:x:delay' stamp='20020910T23:08:25'/></message>` +
+		`<message xmlns='jabber:client' from='juliet@example.com/balcony'><body>live</body></message>`)
+	c := &Client{conn: conn}
+	c.p = xml.NewDecoder(c.conn)
+	for _, want := range []time.Time{
+		time.Date(2002, 9, 10, 21, 8, 25, 5e8, time.UTC),
+		time.Date(2002, 9, 10, 23, 8, 25, 0, time.UTC),
+		{},
+	} {
+		v, err := c.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		chat, _ := v.(Chat)
+		if !chat.Stamp.Equal(want) || chat.Delayed != !want.IsZero() || len(chat.OtherElem) != 0 {
+			t.Errorf("Recv() = %q delayed %v at %v; want %v", chat.Text, chat.Delayed, chat.Stamp, want)
+		}
+	}
+}
+
+func TestMUCHistoryDelay(t *testing.T) {
+	conn := tScript(`<message xmlns='jabber:client' from='coven@chat.example.com/firstwitch' type='groupchat'>` +
+		`<body>Thrice the brinded cat hath mew'd.</body>` +
+		`<delay xmlns='urn:xmpp:delay' from='coven@chat.example.com' stamp='2002-10-13T23:58:37Z'/></message>`)
+	c := &Client{conn: conn}
+	c.p = xml.NewDecoder(c.conn)
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	chat, _ := v.(Chat)
+	if !chat.Delayed || chat.DelayedBy != "coven@chat.example.com" || !chat.Stamp.Equal(time.Date(2002, 10, 13, 23, 58, 37, 0, time.UTC)) || chat.Nick() != "firstwitch" {
+		t.Errorf("Recv() = %#v; want the history message with its delay", v)
+	}
+}
+
+type tLogger struct{ lines []string }
+
+func (l *tLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	conn := tScript(`<iq xmlns='jabber:client' type='error' id='gone1' from='example.com'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>` +
+		`<message xmlns='jabber:client' from='juliet@example.com'><body>hi</body></message>`)
+	var l tLogger
+	c := &Client{conn: conn, logger: &l}
+	c.p = xml.NewDecoder(c.conn)
+	if _, err := c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if len(l.lines) != 1 || !strings.Contains(l.lines[0], `dropping IQ error "gone1" from example.com`) || !strings.Contains(l.lines[0], "item-not-found") {
+		t.Errorf("logged %q", l.lines)
+	}
+}
+
+func TestRecvTimeout(t *testing.T) {
+	conn, server := net.Pipe()
+	defer server.Close()
+	c := &Client{conn: conn}
+	c.p = xml.NewDecoder(conn)
+	c.SetRecvTimeout(100 * time.Millisecond)
+	go server.Write([]byte(`<message xmlns='jabber:client' from='juliet@example.com'><body>hi</body></message>`))
+	if v, err := c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v, %v", v, err)
+	}
+	start := time.Now()
+	_, err := c.Recv()
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !strings.Contains(err.Error(), "nothing received for 100ms") {
+		t.Errorf("Recv() = %v; want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Recv() took %v", d)
+	}
+}
+
+func TestJingleFileTransfer(t *testing.T) {
+	var sent []tStanza
+	c := tServer(t, func(s tStanza) string {
+		sent = append(sent, s)
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+	file := JingleFile{Name: "test.txt", MediaType: "text/plain", Size: 6144,
+		Hashes: []FileHash{{Algo: "sha-1", Value: "w0mcJylzCn+AfvuGdqkty2+KP48="}}}
+	s, err := c.OfferFile(context.Background(), "juliet@example.com/balcony", file,
+		JingleTransport{Namespace: JingleTransportIBB, SID: "ch3d9s71", BlockSize: 4096})
+	if err != nil {
+		t.Fatalf("OfferFile() = %v", err)
+	}
+	if err := c.TerminateJingle(context.Background(), *s, "success"); err != nil {
+		t.Fatalf("TerminateJingle() = %v", err)
+	}
+	if err := c.TerminateJingle(context.Background(), *s, "<x/>"); err == nil {
+		t.Error("TerminateJingle() with an invalid reason succeeded")
+	}
+	if err := c.SendJingleTransport(context.Background(), *s, "transport-'x", JingleTransport{}); err == nil {
+		t.Error("SendJingleTransport() with an invalid action succeeded")
+	}
+	want := []string{
+		"<jingle xmlns='urn:xmpp:jingle:1' action='session-initiate' initiator='user@example.com/bot' sid='" + s.SID + "'>" +
+			"<content creator='initiator' name='file'><description xmlns='urn:xmpp:jingle:apps:file-transfer:5'><file>" +
+			"<media-type>text/plain</media-type><name>test.txt</name><size>6144</size>" +
+			"<hash xmlns='urn:xmpp:hashes:2' algo='sha-1'>w0mcJylzCn+AfvuGdqkty2+KP48=</hash></file></description>" +
+			"<transport xmlns='urn:xmpp:jingle:transports:ibb:1' sid='ch3d9s71' block-size='4096'/></content></jingle>",
+		"<jingle xmlns='urn:xmpp:jingle:1' action='session-terminate' initiator='user@example.com/bot' sid='" + s.SID + "'>" +
+			"<reason><success/></reason></jingle>",
+	}
+	if len(sent) != 2 || sent[0].To != "juliet@example.com/balcony" || sent[0].InnerXML != want[0] || sent[1].InnerXML != want[1] {
+		t.Errorf("sent %#v", sent)
+	}
+
+	conn := tScript(`<iq xmlns='jabber:client' type='set' id='jingle1' from='romeo@example.net/orchard'>` +
+		`<jingle xmlns='urn:xmpp:jingle:1' action='session-initiate' initiator='mallory@example.com/x' sid='851ba2'>` +
+		`<content creator='initiator' name='a-file-offer' senders='initiator'>` +
+		`<description xmlns='urn:xmpp:jingle:apps:file-transfer:5'><file><date>1969-07-21T02:56:15Z</date>` +
+		`<name>test.txt</name><size>6144</size></file></description>` +
+		`<transport xmlns='urn:xmpp:jingle:transports:ibb:1' block-size='4096' sid='ch3d9s71'/></content></jingle></iq>` +
+		`<iq xmlns='jabber:client' type='set' id='jingle2' from='romeo@example.net/orchard'>` +
+		`<jingle xmlns='urn:xmpp:jingle:1' action='session-terminate' sid='851ba2'><reason><cancel/><text>Sorry</text></reason></jingle></iq>`)
+	d := &Client{conn: conn, jid: "juliet@example.com/balcony", p: xml.NewDecoder(conn)}
+	v, err := d.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	session := JingleSession{Peer: "romeo@example.net/orchard", SID: "851ba2", Initiator: "romeo@example.net/orchard",
+		Content: "a-file-offer", Creator: "initiator"}
+	wantOffer := JingleOffer{
+		Session:   session,
+		File:      JingleFile{Name: "test.txt", Size: 6144, Date: time.Date(1969, 7, 21, 2, 56, 15, 0, time.UTC)},
+		Transport: JingleTransport{Namespace: JingleTransportIBB, SID: "ch3d9s71", BlockSize: 4096},
+	}
+	if !reflect.DeepEqual(v, wantOffer) {
+		t.Errorf("Recv() = %#v; want %#v", v, wantOffer)
+	}
+	if v, err = d.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if a, ok := v.(JingleAction); !ok || a.Action != JingleSessionTerminate || a.Reason != "cancel" || a.Session.SID != "851ba2" {
+		t.Errorf("Recv() = %#v", v)
+	}
+	if got := conn.out.String(); got != "<iq type='result' to='romeo@example.net/orchard' id='jingle1'/>"+
+		"<iq type='result' to='romeo@example.net/orchard' id='jingle2'/>" {
+		t.Errorf("replies = %q", got)
+	}
+}
+
+func TestIBB(t *testing.T) {
+	var sent []string
+	c := tServer(t, func(s tStanza) string {
+		sent = append(sent, s.InnerXML)
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+	if _, err := c.OpenIBB("juliet@example.com/balcony", "i781hf64", 0); err == nil {
+		t.Error("OpenIBB() with block size 0 succeeded")
+	}
+	w, err := c.OpenIBB("juliet@example.com/balcony", "i781hf64", 4)
+	if err != nil {
+		t.Fatalf("OpenIBB() = %v", err)
+	}
+	w.(*ibbWriter).seq = 65535
+	if _, err := io.WriteString(w, "abcdefghij"); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	want := []string{
+		"<open xmlns='http://jabber.org/protocol/ibb' block-size='4' sid='i781hf64' stanza='iq'/>",
+		"<data xmlns='http://jabber.org/protocol/ibb' seq='65535' sid='i781hf64'>YWJjZA==</data>",
+		"<data xmlns='http://jabber.org/protocol/ibb' seq='0' sid='i781hf64'>ZWZnaA==</data>",
+		"<data xmlns='http://jabber.org/protocol/ibb' seq='1' sid='i781hf64'>aWo=</data>",
+		"<close xmlns='http://jabber.org/protocol/ibb' sid='i781hf64'/>",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %q; want %q", sent, want)
+	}
+
+	iq := func(id, from, payload string) string {
+		return "<iq xmlns='jabber:client' type='set' id='" + id + "' from='" + from + "'>" + payload + "</iq>"
+	}
+	conn := tScript(iq("o1", "romeo@example.net/orchard", "<open xmlns='http://jabber.org/protocol/ibb' block-size='4' sid='s1'/>") +
+		iq("d1", "romeo@example.net/orchard", "<data xmlns='http://jabber.org/protocol/ibb' seq='0' sid='s1'>YWJjZA==</data>") +
+		iq("x1", "mallory@example.com/x", "<data xmlns='http://jabber.org/protocol/ibb' seq='1' sid='s1'>eHh4</data>") +
+		iq("d2", "romeo@example.net/orchard", "<data xmlns='http://jabber.org/protocol/ibb' seq='1' sid='s1'>ZWY=</data>") +
+		iq("c1", "romeo@example.net/orchard", "<close xmlns='http://jabber.org/protocol/ibb' sid='s1'/>"))
+	d := &Client{conn: conn, jid: "juliet@example.com/balcony", p: xml.NewDecoder(conn)}
+	v, err := d.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	open, ok := v.(IBBOpen)
+	if !ok || open.From != "romeo@example.net/orchard" || open.SID != "s1" || open.BlockSize != 4 {
+		t.Fatalf("Recv() = %#v", v)
+	}
+	r, err := d.AcceptIBB(open)
+	if err != nil {
+		t.Fatalf("AcceptIBB() = %v", err)
+	}
+	if _, err := d.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v; want io.EOF", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "abcdef" {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+	wantOut := "<iq type='result' to='romeo@example.net/orchard' id='o1'/>" +
+		"<iq type='error' to='mallory@example.com/x' id='x1'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>" +
+		"<iq type='result' to='romeo@example.net/orchard' id='c1'/>" +
+		"<iq type='result' to='romeo@example.net/orchard' id='d1'/>" +
+		"<iq type='result' to='romeo@example.net/orchard' id='d2'/>"
+	if got := conn.out.String(); got != wantOut {
+		t.Errorf("replies = %q; want %q", got, wantOut)
+	}
+
+	// Closing the stream answers the blocks not read, which the sender waits for.
+	conn = tScript(iq("o2", "romeo@example.net/orchard", "<open xmlns='http://jabber.org/protocol/ibb' block-size='4' sid='s2'/>") +
+		iq("d3", "romeo@example.net/orchard", "<data xmlns='http://jabber.org/protocol/ibb' seq='0' sid='s2'>YWJjZA==</data>") +
+		iq("d4", "romeo@example.net/orchard", "<data xmlns='http://jabber.org/protocol/ibb' seq='1' sid='s2'>ZWY=</data>"))
+	d = &Client{conn: conn, jid: "juliet@example.com/balcony", p: xml.NewDecoder(conn)}
+	if v, err = d.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if r, err = d.AcceptIBB(v.(IBBOpen)); err != nil {
+		t.Fatalf("AcceptIBB() = %v", err)
+	}
+	if _, err := d.Recv(); err != io.EOF {
+		t.Fatalf("Recv() = %v; want io.EOF", err)
+	}
+	if _, err := r.Read(make([]byte, 2)); err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	conn.out.Reset()
+	r.Close()
+	wantOut = "<iq type='error' to='romeo@example.net/orchard' id='d4'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+	if got := conn.out.String(); got != wantOut {
+		t.Errorf("replies = %q; want %q", got, wantOut)
+	}
+}
+
+// tSOCKS5Proxy runs a SOCKS5 streamhost that accepts connections to any address,
+// sends the address it was asked for to addrs and echoes what it receives.
+func tSOCKS5Proxy(t *testing.T, addrs chan<- string) Streamhost {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := io.ReadFull(r, make([]byte, 3)); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				head := make([]byte, 5)
+				if _, err := io.ReadFull(r, head); err != nil {
+					return
+				}
+				addr := make([]byte, int(head[4])+2)
+				if _, err := io.ReadFull(r, addr); err != nil {
+					return
+				}
+				addrs <- string(addr[:len(addr)-2])
+				conn.Write(append(append([]byte{5, 0, 0, 3, head[4]}, addr[:len(addr)-2]...), 0, 0))
+				io.Copy(conn, r)
+			}()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	return Streamhost{JID: "proxy.example.com", Host: "127.0.0.1", Port: port}
+}
+
+func TestS5B(t *testing.T) {
+	addrs := make(chan string, 2)
+	proxy := tSOCKS5Proxy(t, addrs)
+	hash := func(s string) string {
+		sum := sha1.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	var sent []string
+	c := tServer(t, func(s tStanza) string {
+		sent = append(sent, s.To+" "+s.InnerXML)
+		switch {
+		case strings.Contains(s.InnerXML, "disco#items"):
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/disco#items'>" +
+				"<item jid='upload.example.com'/><item jid='proxy.example.com'/></query></iq>"
+		case strings.Contains(s.InnerXML, "disco#info") && s.To == "proxy.example.com":
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/disco#info'>" +
+				"<identity category='proxy' type='bytestreams'/></query></iq>"
+		case strings.Contains(s.InnerXML, "disco#info"):
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/disco#info'/></iq>"
+		case s.To == "proxy.example.com" && !strings.Contains(s.InnerXML, "activate"):
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/bytestreams'>" +
+				"<streamhost jid='proxy.example.com' host='127.0.0.1' port='" + strconv.Itoa(proxy.Port) + "'/></query></iq>"
+		case s.To == "romeo@example.net/orchard" && strings.Contains(s.InnerXML, "bytestreams"):
+			return "<iq xmlns='jabber:client' type='error' id='" + s.ID + "'><error type='cancel'>" +
+				"<item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>"
+		case s.To == "juliet@example.com/balcony":
+			return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/bytestreams' sid='s1'>" +
+				"<streamhost-used jid='proxy.example.com'/></query></iq>"
+		}
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+	hosts, err := c.RequestStreamhosts()
+	if err != nil || !reflect.DeepEqual(hosts, []Streamhost{proxy}) {
+		t.Fatalf("RequestStreamhosts() = %#v, %v", hosts, err)
+	}
+	conn, err := c.OfferS5B(context.Background(), "juliet@example.com/balcony", "s1", hosts)
+	if err != nil {
+		t.Fatalf("OfferS5B() = %v", err)
+	}
+	defer conn.Close()
+	if addr := <-addrs; addr != hash("s1user@example.com/botjuliet@example.com/balcony") {
+		t.Errorf("connected to %q", addr)
+	}
+	if got := sent[len(sent)-1]; got != "proxy.example.com <query xmlns='http://jabber.org/protocol/bytestreams' sid='s1'>"+
+		"<activate>juliet@example.com/balcony</activate></query>" {
+		t.Errorf("sent %q", got)
+	}
+	if _, err := c.OpenBytestream(context.Background(), "romeo@example.net/orchard", "s3", hosts, 4096); err != nil {
+		t.Fatalf("OpenBytestream() = %v", err)
+	}
+	if got := sent[len(sent)-1]; !strings.HasPrefix(got, "romeo@example.net/orchard <open xmlns='http://jabber.org/protocol/ibb'") {
+		t.Errorf("OpenBytestream() did not fall back to IBB: sent %q", got)
+	}
+
+	script := tScript("<iq xmlns='jabber:client' type='set' id='s5b1' from='romeo@example.net/orchard'>" +
+		"<query xmlns='http://jabber.org/protocol/bytestreams' sid='s2' mode='tcp'>" +
+		"<streamhost jid='dead.example.net' host='127.0.0.1' port='1'/>" +
+		"<streamhost jid='proxy.example.com' host='127.0.0.1' port='" + strconv.Itoa(proxy.Port) + "'/></query></iq>")
+	d := &Client{conn: script, jid: "juliet@example.com/balcony", p: xml.NewDecoder(script)}
+	v, err := d.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	r, ok := v.(S5BRequest)
+	if !ok || r.From != "romeo@example.net/orchard" || r.SID != "s2" || len(r.Streamhosts) != 2 {
+		t.Fatalf("Recv() = %#v", v)
+	}
+	conn, err = d.AcceptS5B(context.Background(), r)
+	if err != nil {
+		t.Fatalf("AcceptS5B() = %v", err)
+	}
+	defer conn.Close()
+	if addr := <-addrs; addr != hash("s2romeo@example.net/orchardjuliet@example.com/balcony") {
+		t.Errorf("connected to %q", addr)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if got := script.out.String(); got != "<iq type='result' to='romeo@example.net/orchard' id='s5b1'>"+
+		"<query xmlns='http://jabber.org/protocol/bytestreams' sid='s2'><streamhost-used jid='proxy.example.com'/></query></iq>" {
+		t.Errorf("reply = %q", got)
+	}
+}
+
+func TestMoodActivity(t *testing.T) {
+	var sent []string
+	c := tServer(t, func(s tStanza) string {
+		sent = append(sent, s.InnerXML)
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'/>"
+	})
+	if err := c.PublishMood("in_love", "Juliet & me"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishMood("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishActivity("relaxing", "reading", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishMood("<x/>", ""); err == nil {
+		t.Error("PublishMood() with an invalid mood succeeded")
+	}
+	want := []string{
+		"<pubsub xmlns='http://jabber.org/protocol/pubsub'><publish node='http://jabber.org/protocol/mood'><item>" +
+			"<mood xmlns='http://jabber.org/protocol/mood'><in_love/><text>Juliet &amp; me</text></mood></item></publish></pubsub>",
+		"<pubsub xmlns='http://jabber.org/protocol/pubsub'><publish node='http://jabber.org/protocol/mood'><item>" +
+			"<mood xmlns='http://jabber.org/protocol/mood'></mood></item></publish></pubsub>",
+		"<pubsub xmlns='http://jabber.org/protocol/pubsub'><publish node='http://jabber.org/protocol/activity'><item>" +
+			"<activity xmlns='http://jabber.org/protocol/activity'><relaxing><reading/></relaxing></activity></item></publish></pubsub>",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %q; want %q", sent, want)
+	}
+
+	event := func(node, item string) string {
+		return "<message xmlns='jabber:client' from='juliet@example.com'><event xmlns='http://jabber.org/protocol/pubsub#event'>" +
+			"<items node='" + node + "'><item id='current'>" + item + "</item></items></event></message>"
+	}
+	var d Client
+	d.conn = tConnect(event(nsMood, "<mood xmlns='http://jabber.org/protocol/mood'><happy/><text>Yay</text></mood>") +
+		event(nsMood, "<mood xmlns='http://jabber.org/protocol/mood'/>") +
+		event(nsActivity, "<activity xmlns='http://jabber.org/protocol/activity'><relaxing><partying/></relaxing><text>Party!</text></activity>") +
+		event(nsActivity, "<activity xmlns='http://jabber.org/protocol/activity'><inactive/></activity>"))
+	d.p = xml.NewDecoder(d.conn)
+	for _, want := range []interface{}{
+		Mood{From: "juliet@example.com", Mood: "happy", Text: "Yay"},
+		Mood{From: "juliet@example.com"},
+		Activity{From: "juliet@example.com", General: "relaxing", Specific: "partying", Text: "Party!"},
+		Activity{From: "juliet@example.com", General: "inactive"},
+	} {
+		v, err := d.Recv()
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("Recv() = %#v; want %#v", v, want)
+		}
+	}
+}
+
+func TestNickname(t *testing.T) {
+	conn := tScript(`<presence xmlns='jabber:client' from='romeo@example.net' type='subscribe'>` +
+		`<nick xmlns='http://jabber.org/protocol/nick'>Romeo</nick></presence>` +
+		`<message xmlns='jabber:client' from='romeo@example.net/orchard' type='chat'><body>hi</body>` +
+		`<nick xmlns='http://jabber.org/protocol/nick'>Romeo &amp; co</nick></message>`)
+	c := &Client{conn: conn, jid: "juliet@example.com/balcony", p: xml.NewDecoder(conn)}
+	if err := c.RequestSubscriptionNick("romeo@example.net", "Juliet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Send(Chat{Remote: "romeo@example.net", Type: "chat", ID: "m1", Text: "hi", Nickname: "Juliet"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "<presence to='romeo@example.net' type='subscribe'><nick xmlns='http://jabber.org/protocol/nick'>Juliet</nick></presence>" +
+		"<message to='romeo@example.net' type='chat' id='m1' xml:lang='en'><body>hi</body>" +
+		"<nick xmlns='http://jabber.org/protocol/nick'>Juliet</nick></message>"
+	if got := conn.out.String(); got != want {
+		t.Errorf("sent %q; want %q", got, want)
+	}
+
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if p, ok := v.(Presence); !ok || p.Nickname != "Romeo" {
+		t.Errorf("Recv() = %#v", v)
+	}
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if chat, ok := v.(Chat); !ok || chat.Nickname != "Romeo & co" || len(chat.OtherElem) != 0 {
+		t.Errorf("Recv() = %#v", v)
+	}
+}
+
+func TestRetraction(t *testing.T) {
+	conn := tScript(`<message xmlns='jabber:client' from='romeo@example.net/orchard' type='chat' id='r1'>` +
+		`<retract xmlns='urn:xmpp:message-retract:0' id='origin-1'/><body>fallback</body></message>` +
+		`<message xmlns='jabber:client' from='room@muc.example.com/romeo' type='groupchat'>` +
+		`<apply-to xmlns='urn:xmpp:fasten:0' id='room-1'><retract xmlns='urn:xmpp:message-retract:0'/></apply-to></message>` +
+		`<message xmlns='jabber:client' from='romeo@example.net/garden' type='chat'>` +
+		`<retract xmlns='urn:xmpp:message-retract:1' id='origin-2'/></message>`)
+	c := &Client{conn: conn, jid: "juliet@example.com/balcony", p: xml.NewDecoder(conn)}
+	if err := c.RetractMessage("romeo@example.net", "origin-0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.out.String(); !strings.HasPrefix(got, "<message to='romeo@example.net' type='chat' id='") ||
+		!strings.Contains(got, "<retract xmlns='urn:xmpp:message-retract:0' id='origin-0'/>") ||
+		!strings.Contains(got, "<store xmlns='urn:xmpp:hints'/>") {
+		t.Errorf("sent %q", got)
+	}
+
+	earlier := Chat{Remote: "romeo@example.net/balcony", OriginID: "origin-1"}
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	r, ok := v.(Retraction)
+	if !ok || r != (Retraction{From: "romeo@example.net/orchard", Type: "chat", ID: "origin-1"}) || !r.Retracts(earlier) {
+		t.Errorf("Recv() = %#v", v)
+	}
+	if r.Retracts(Chat{Remote: "tybalt@example.net/street", OriginID: "origin-1"}) {
+		t.Error("retraction applies to a message of another sender")
+	}
+
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	room := Chat{Remote: "room@muc.example.com/romeo", Type: "groupchat",
+		StanzaIDs: []StanzaID{{ID: "room-1", By: "room@muc.example.com"}}}
+	if r, ok := v.(Retraction); !ok || r.ID != "room-1" || !r.Retracts(room) {
+		t.Errorf("Recv() = %#v", v)
+	}
+	room.Remote = "room@muc.example.com/tybalt"
+	if r, _ := v.(Retraction); r.Retracts(room) {
+		t.Error("retraction applies to a message of another occupant")
+	}
+
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if r, ok := v.(Retraction); !ok || r.ID != "origin-2" {
+		t.Errorf("Recv() = %#v", v)
+	}
+}
+
+func TestOccupantID(t *testing.T) {
+	conn := tScript(`<presence xmlns='jabber:client' from='room@conference.example.com/alice'>` +
+		`<x xmlns='http://jabber.org/protocol/muc#user'><item affiliation='none' role='participant'/></x>` +
+		`<occupant-id xmlns='urn:xmpp:occupant-id:0' id='dd72603d'/></presence>` +
+		`<message xmlns='jabber:client' from='room@conference.example.com/alice2' type='groupchat'><body>hi</body>` +
+		`<occupant-id xmlns='urn:xmpp:occupant-id:0' id='dd72603d'/></message>`)
+	c := &Client{conn: conn, jid: "user@example.com/bot", p: xml.NewDecoder(conn)}
+	if _, err := c.JoinMUCNoHistory("room@conference.example.com", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Recv()
+	if err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if p, ok := v.(Presence); !ok || p.OccupantID != "dd72603d" {
+		t.Errorf("Recv() = %#v", v)
+	}
+	if o := c.MUCOccupants("room@conference.example.com"); len(o) != 1 || o[0].OccupantID != "dd72603d" {
+		t.Errorf("MUCOccupants() = %#v", o)
+	}
+	if v, err = c.Recv(); err != nil {
+		t.Fatalf("Recv() = %v", err)
+	}
+	if chat, ok := v.(Chat); !ok || chat.OccupantID != "dd72603d" || len(chat.OtherElem) != 0 {
+		t.Errorf("Recv() = %#v", v)
+	}
+
+	conn.out.Reset()
+	if _, err := c.Send(Chat{Remote: "room@conference.example.com", Type: "groupchat", ID: "m1", Text: "hi", OccupantID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.out.String(); !strings.Contains(got, "<occupant-id xmlns='urn:xmpp:occupant-id:0' id='abc'/>") {
+		t.Errorf("sent %q", got)
+	}
+
+	s := tServer(t, func(s tStanza) string {
+		return "<iq xmlns='jabber:client' type='result' id='" + s.ID + "'><query xmlns='http://jabber.org/protocol/disco#info'>" +
+			"<identity category='conference' type='text'/><feature var='urn:xmpp:occupant-id:0'/></query></iq>"
+	})
+	if ok, err := s.MUCSupportsOccupantID("room@conference.example.com"); err != nil || !ok {
+		t.Errorf("MUCSupportsOccupantID() = %v, %v; want true", ok, err)
+	}
+}
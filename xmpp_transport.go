@@ -0,0 +1,57 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"net"
+)
+
+// transport carries the XML stream between the client and the server. Reads return the
+// stream of the server as XML, and every write is a complete element. Connections that
+// are not transports carry a plain XML stream, see tcpTransport.
+type transport interface {
+	net.Conn
+	// openStream returns the element opening our stream to domain.
+	openStream(domain string) string
+	// isStreamOpen reports whether se is the element opening the server's stream.
+	isStreamOpen(se xml.StartElement) bool
+	// closeStream returns the element closing our stream.
+	closeStream() string
+	// encrypted reports whether the transport is secured by TLS.
+	encrypted() bool
+}
+
+// tcpTransport is the default transport: an XML stream over TCP, RFC 6120 4, secured by
+// TLS from the outset or promoted to it by STARTTLS.
+type tcpTransport struct {
+	net.Conn
+}
+
+func (tcpTransport) openStream(domain string) string {
+	return fmt.Sprintf("<?xml version='1.0'?>\n"+
+		"<stream:stream to='%s' xmlns='%s'\n"+
+		" xmlns:stream='%s' version='1.0'>\n",
+		xmlEscape(domain), nsClient, nsStream)
+}
+
+func (tcpTransport) isStreamOpen(se xml.StartElement) bool {
+	return se.Name.Space == nsStream && se.Name.Local == "stream"
+}
+
+func (tcpTransport) closeStream() string {
+	return "</stream:stream>"
+}
+
+func (t tcpTransport) encrypted() bool {
+	_, ok := t.Conn.(*tls.Conn)
+	return ok
+}
+
+// transport returns the transport the client is connected with.
+func (c *Client) transport() transport {
+	if t, ok := c.conn.(transport); ok {
+		return t
+	}
+	return tcpTransport{c.conn}
+}
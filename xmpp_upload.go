@@ -0,0 +1,116 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const nsUpload = "urn:xmpp:http:upload:0"
+
+// UploadSlot is a slot for uploading a file over HTTP, xep-0363.
+type UploadSlot struct {
+	Put    string      // URL to PUT the file to
+	Get    string      // URL to share once the file is uploaded, e.g. with SendOOB
+	Header http.Header // headers to send with the PUT request
+
+	Size        int64  // size of the file, as requested
+	ContentType string // MIME type of the file, as requested
+}
+
+type clientUploadSlot struct {
+	XMLName xml.Name `xml:"urn:xmpp:http:upload:0 slot"`
+	Put     struct {
+		URL    string `xml:"url,attr"`
+		Header []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"header"`
+	} `xml:"put"`
+	Get struct {
+		URL string `xml:"url,attr"`
+	} `xml:"get"`
+}
+
+// uploadHeaders are the headers a slot may ask for, xep-0363 5; others are ignored.
+var uploadHeaders = []string{"Authorization", "Cookie", "Expires"}
+
+// RequestUploadSlot asks the upload service for a slot to upload a file of size bytes
+// named filename, xep-0363 4, and waits for it. contentType may be empty. The service
+// can be found with DiscoverUploadService.
+func (c *Client) RequestUploadSlot(service, filename string, size int64, contentType string) (*UploadSlot, error) {
+	req := "<request xmlns='" + nsUpload + "' filename='" + xmlEscape(filename) + "' size='" + strconv.FormatInt(size, 10) + "'"
+	if contentType != "" {
+		req += " content-type='" + xmlEscape(contentType) + "'"
+	}
+	iq, err := c.sendIQ(service, IQTypeGet, req+"/>")
+	if err != nil {
+		return nil, err
+	}
+	var s clientUploadSlot
+	if err = iq.decodeQuery(&s); err != nil {
+		return nil, err
+	}
+	if s.Put.URL == "" || s.Get.URL == "" {
+		return nil, errors.New("xmpp: upload slot lacks the put or get URL")
+	}
+	slot := &UploadSlot{Put: s.Put.URL, Get: s.Get.URL, Header: http.Header{}, Size: size, ContentType: contentType}
+	for _, h := range s.Put.Header {
+		for _, name := range uploadHeaders {
+			if strings.EqualFold(h.Name, name) {
+				slot.Header.Set(name, strings.NewReplacer("\r", "", "\n", "").Replace(h.Value))
+			}
+		}
+	}
+	return slot, nil
+}
+
+// UploadFile uploads the slot.Size bytes read from r to the slot with an HTTP PUT request.
+func (c *Client) UploadFile(slot *UploadSlot, r io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, slot.Put, io.LimitReader(r, slot.Size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = slot.Size
+	for name, values := range slot.Header {
+		req.Header[name] = values
+	}
+	if slot.ContentType != "" {
+		req.Header.Set("Content-Type", slot.ContentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("xmpp: uploading the file: %s", resp.Status)
+	}
+	return nil
+}
+
+// DiscoverUploadService returns the upload service among the items of our server,
+// xep-0363 3, or an empty string if there is none.
+func (c *Client) DiscoverUploadService() (string, error) {
+	items, err := c.DiscoItems(c.serverDomain())
+	if err != nil {
+		return "", err
+	}
+	for _, item := range items {
+		info, err := c.DiscoInfo(item.JID)
+		if err != nil {
+			continue
+		}
+		for _, f := range info.Features {
+			if f == nsUpload {
+				return item.JID, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,25 @@
+package xmpp
+
+import "encoding/xml"
+
+type clientVersion struct {
+	XMLName xml.Name `xml:"jabber:iq:version query"`
+	Name    string   `xml:"name"`
+	Version string   `xml:"version"`
+	OS      string   `xml:"os"`
+}
+
+// SoftwareVersion asks the entity jid which software it runs, xep-0092, and waits for
+// the answer. An empty jid asks our server. If the entity declines to answer, the
+// error is a *StanzaError, usually service-unavailable.
+func (c *Client) SoftwareVersion(jid string) (name, version, os string, err error) {
+	iq, err := c.sendIQ(jid, IQTypeGet, "<query xmlns='"+nsVersion+"'/>")
+	if err != nil {
+		return "", "", "", err
+	}
+	var v clientVersion
+	if err = iq.decodeQuery(&v); err != nil {
+		return "", "", "", err
+	}
+	return v.Name, v.Version, v.OS, nil
+}
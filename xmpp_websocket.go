@@ -0,0 +1,294 @@
+package xmpp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const nsFraming = "urn:ietf:params:xml:ns:xmpp-framing"
+
+// WebSocket opcodes, RFC 6455 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsGUID is appended to the key of the opening handshake, RFC 6455 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// NewClientWebSocket connects to the XMPP over WebSocket endpoint url, RFC 7395, like
+// "wss://example.com/xmpp-websocket", and negotiates the stream like Options.NewClient.
+// Host, NoTLS and StartTLS of opts are ignored: the scheme of url tells whether the
+// connection is secured by TLS, which is configured by opts.TLSConfig.
+func NewClientWebSocket(url string, opts Options) (*Client, error) {
+	conn, err := dialWebSocket(url, &opts)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{conn: conn}
+	if err := client.init(&opts); err != nil {
+		client.Close()
+		return nil, err
+	}
+	opts.sendInitialPresence(client)
+	return client, nil
+}
+
+// wsConn is the transport of XMPP over WebSocket: every element is a text message.
+type wsConn struct {
+	net.Conn // the TCP or TLS connection
+	r        *bufio.Reader
+	msg      []byte     // unread rest of the current message
+	writeMu  sync.Mutex // serializes frames, as Read answers pings
+	tls      bool
+}
+
+// dialWebSocket connects to the WebSocket endpoint rawurl and performs the opening
+// handshake, RFC 6455 4.1, asking for the xmpp subprotocol.
+func dialWebSocket(rawurl string, o *Options) (*wsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		secure = true
+	default:
+		return nil, errors.New("xmpp: unsupported WebSocket URL scheme " + u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	c, err := o.dial(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		tc := o.TLSConfig
+		if tc == nil {
+			tc = DefaultConfig.Clone()
+			tc.ServerName = u.Hostname()
+		}
+		t := tls.Client(c, tc)
+		if err = t.Handshake(); err == nil {
+			err = o.verifyPins(t)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = t
+	}
+
+	var nonce [16]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		c.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":                []string{"websocket"},
+			"Connection":             []string{"Upgrade"},
+			"Sec-Websocket-Key":      []string{key},
+			"Sec-Websocket-Version":  []string{"13"},
+			"Sec-Websocket-Protocol": []string{"xmpp"},
+		},
+	}
+	if err = req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		err = errors.New("xmpp: WebSocket handshake failed: " + resp.Status)
+	case resp.Header.Get("Sec-Websocket-Accept") != wsAccept(key):
+		err = errors.New("xmpp: WebSocket handshake failed: invalid Sec-WebSocket-Accept")
+	case resp.Header.Get("Sec-Websocket-Protocol") != "xmpp":
+		err = errors.New("xmpp: WebSocket server does not speak the xmpp subprotocol")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &wsConn{Conn: c, r: r, tls: secure}, nil
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value expected for key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Read reads the XML of the text messages of the server, answering pings on the way.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.msg) == 0 {
+		op, payload, err := readFrame(c.r)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsText, wsContinuation:
+			c.msg = payload
+		case wsPing:
+			if err = c.writeFrame(wsPong, payload); err != nil {
+				return 0, err
+			}
+		case wsClose:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.msg)
+	c.msg = c.msg[n:]
+	return n, nil
+}
+
+// Write sends p, a complete element, as a text message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeFrame(c.Conn, op, payload, true)
+}
+
+func (*wsConn) openStream(domain string) string {
+	return "<open xmlns='" + nsFraming + "' to='" + xmlEscape(domain) + "' version='1.0'/>"
+}
+
+func (*wsConn) isStreamOpen(se xml.StartElement) bool {
+	return se.Name.Space == nsFraming && se.Name.Local == "open"
+}
+
+func (*wsConn) closeStream() string {
+	return "<close xmlns='" + nsFraming + "'/>"
+}
+
+func (c *wsConn) encrypted() bool {
+	return c.tls
+}
+
+// writeFrame writes payload as a single frame, RFC 6455 5.2. Clients have to mask
+// their frames.
+func writeFrame(w io.Writer, op byte, payload []byte, mask bool) error {
+	header := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	data := payload
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		header[1] |= 0x80
+		header = append(header, key[:]...)
+		data = make([]byte, len(payload))
+		for i, b := range payload {
+			data[i] = b ^ key[i%4]
+		}
+	}
+	frame := append(header, data...)
+	n, err := w.Write(frame)
+	if err == nil && n < len(frame) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// readFrame reads a frame, RFC 6455 5.2, and returns its opcode and its unmasked payload.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	op := header[0] & 0x0f
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<24 {
+		return 0, nil, fmt.Errorf("xmpp: WebSocket frame of %d bytes is too large", n)
+	}
+	var key [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return op, payload, nil
+}